@@ -0,0 +1,81 @@
+// Package apperr holds the errors that services return for expected failures,
+// such as a missing record or a taken username. Each carries a Kind that the
+// web layer maps to an HTTP status and a Code that clients can rely on; any
+// other error is treated as internal and its text is never shown to clients.
+package apperr
+
+import "errors"
+
+type Kind int
+
+const (
+	Internal Kind = iota
+	Invalid
+	Unauthorized
+	Forbidden
+	NotFound
+	Conflict
+	// Locked and TooManyRequests are temporary refusals after repeated
+	// failures.
+	Locked
+	TooManyRequests
+	// UnsupportedMediaType refuses a request body in a format the route
+	// doesn't accept.
+	UnsupportedMediaType
+	// PreconditionFailed refuses a change to a record that changed since the
+	// client read it; PreconditionRequired one that didn't say which version
+	// it read.
+	PreconditionFailed
+	PreconditionRequired
+)
+
+// InternalCode is the code of errors that aren't an *Error.
+const InternalCode = "internal_error"
+
+type Error struct {
+	Kind    Kind
+	Code    string
+	Message string
+	// Err is the underlying cause, kept for errors.Is and logs.
+	Err error
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+func New(kind Kind, code, message string) *Error {
+	return &Error{Kind: kind, Code: code, Message: message}
+}
+
+// Wrap keeps the message of err, which must be safe to show to clients.
+func Wrap(kind Kind, code string, err error) *Error {
+	return &Error{Kind: kind, Code: code, Message: err.Error(), Err: err}
+}
+
+// As returns the first *Error in the chain of err.
+func As(err error) (*Error, bool) {
+	var e *Error
+	ok := errors.As(err, &e)
+	return e, ok
+}
+
+// KindOf returns the Kind of err, Internal unless err wraps an *Error.
+func KindOf(err error) Kind {
+	if e, ok := As(err); ok {
+		return e.Kind
+	}
+	return Internal
+}
+
+// CodeOf returns the Code of err, InternalCode unless err wraps an *Error.
+func CodeOf(err error) string {
+	if e, ok := As(err); ok {
+		return e.Code
+	}
+	return InternalCode
+}
@@ -0,0 +1,29 @@
+package apperr
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestError(t *testing.T) {
+	taken := New(Conflict, "username_taken", "username is taken")
+	wrapped := fmt.Errorf("%w by user 2", taken)
+	assert.True(t, errors.Is(wrapped, taken))
+	assert.Equal(t, Conflict, KindOf(wrapped))
+	assert.Equal(t, "username_taken", CodeOf(wrapped))
+	assert.Equal(t, "username is taken by user 2", wrapped.Error())
+
+	cause := errors.New("strconv: bad digit")
+	invalid := Wrap(Invalid, "invalid_request", cause)
+	assert.True(t, errors.Is(invalid, cause))
+	assert.Equal(t, "strconv: bad digit", invalid.Error())
+
+	raw := errors.New("database is locked")
+	assert.Equal(t, Internal, KindOf(raw))
+	assert.Equal(t, InternalCode, CodeOf(raw))
+	_, ok := As(raw)
+	assert.False(t, ok)
+}
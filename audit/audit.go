@@ -0,0 +1,271 @@
+package audit
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/MicBun/go-100-coverage-docker-crud/apperr"
+	"github.com/MicBun/go-100-coverage-docker-crud/core"
+	"gorm.io/gorm"
+)
+
+const (
+	DefaultLimit = 50
+	MaxLimit     = 200
+)
+
+// Outcomes filter events by their HTTP status.
+const (
+	OutcomeSuccess = "success"
+	OutcomeFailure = "failure"
+)
+
+var (
+	ErrInvalidCursor  = apperr.New(apperr.Invalid, "invalid_cursor", "invalid cursor")
+	ErrInvalidOutcome = apperr.New(apperr.Invalid, "invalid_outcome", "invalid outcome, want success or failure")
+)
+
+// Event is one action to record. Before and After are any values that
+// marshal to JSON objects; only the fields that differ between them are
+// stored, and fields that look like secrets never are.
+type Event struct {
+	ActorID    *uint
+	Action     string
+	TargetType string
+	TargetID   string
+	Before     interface{}
+	After      interface{}
+	Status     int
+	IP         string
+	UserAgent  string
+	RequestID  string
+}
+
+// Filter selects events for List. Zero fields don't filter. Cursor is an
+// opaque value taken from a previous Page.
+type Filter struct {
+	ActorID    *uint
+	Action     string
+	TargetType string
+	TargetID   string
+	RequestID  string
+	Outcome    string
+	Since      *time.Time
+	Until      *time.Time
+	Limit      int
+	Cursor     string
+}
+
+// Page lists events newest first.
+type Page struct {
+	Events     []core.AuditEvent
+	Total      int64
+	NextCursor string
+}
+
+// Log is append-only: events are inserted and listed, never changed. Each
+// event is chained to the one before it by hash.
+type Log struct {
+	db  *gorm.DB
+	now func() time.Time
+	// mu serializes Record within this instance; other instances are kept
+	// off the same chain link by the unique index on prev_hash.
+	mu sync.Mutex
+}
+
+type LogInterface interface {
+	Record(event Event) error
+	List(filter Filter) (Page, error)
+	// Verify walks the chain and the checkpoints and reports the first
+	// broken link.
+	Verify() (Report, error)
+	// Checkpoint signs the newest event, or returns nil when it is already
+	// covered by a checkpoint.
+	Checkpoint() (*core.AuditCheckpoint, error)
+}
+
+func NewLog(db *gorm.DB) LogInterface {
+	return &Log{
+		db:  db,
+		now: time.Now,
+	}
+}
+
+func (l *Log) Record(event Event) error {
+	before, after, err := diff(event.Before, event.After)
+	if err != nil {
+		return err
+	}
+	return l.append(core.AuditEvent{
+		// Databases keep microseconds at most; hashing a finer time would
+		// not survive the round trip.
+		CreatedAt:  l.now().UTC().Truncate(time.Microsecond),
+		ActorID:    event.ActorID,
+		Action:     event.Action,
+		TargetType: event.TargetType,
+		TargetID:   event.TargetID,
+		Status:     event.Status,
+		Before:     before,
+		After:      after,
+		IP:         event.IP,
+		UserAgent:  event.UserAgent,
+		RequestID:  event.RequestID,
+	})
+}
+
+func (f Filter) apply(db *gorm.DB) (*gorm.DB, error) {
+	if f.ActorID != nil {
+		db = db.Where("actor_id = ?", *f.ActorID)
+	}
+	if f.Action != "" {
+		db = db.Where("action = ?", f.Action)
+	}
+	if f.TargetType != "" {
+		db = db.Where("target_type = ?", f.TargetType)
+	}
+	if f.TargetID != "" {
+		db = db.Where("target_id = ?", f.TargetID)
+	}
+	if f.RequestID != "" {
+		db = db.Where("request_id = ?", f.RequestID)
+	}
+	switch f.Outcome {
+	case "":
+	case OutcomeSuccess:
+		db = db.Where("status < 400")
+	case OutcomeFailure:
+		db = db.Where("status >= 400")
+	default:
+		return nil, ErrInvalidOutcome
+	}
+	if f.Since != nil {
+		db = db.Where("created_at >= ?", *f.Since)
+	}
+	if f.Until != nil {
+		db = db.Where("created_at < ?", *f.Until)
+	}
+	return db, nil
+}
+
+func (l *Log) List(filter Filter) (Page, error) {
+	var page Page
+	limit := filter.Limit
+	if limit <= 0 {
+		limit = DefaultLimit
+	}
+	if limit > MaxLimit {
+		limit = MaxLimit
+	}
+
+	query, err := filter.apply(l.db.Model(core.AuditEvent{}))
+	if err != nil {
+		return page, err
+	}
+	if err := query.Count(&page.Total).Error; err != nil {
+		return page, err
+	}
+	query, _ = filter.apply(l.db.Model(core.AuditEvent{}))
+	if filter.Cursor != "" {
+		before, err := decodeCursor(filter.Cursor)
+		if err != nil {
+			return page, err
+		}
+		query = query.Where("id < ?", before)
+	}
+
+	var events []core.AuditEvent
+	if err := query.Order("id DESC").Limit(limit + 1).Find(&events).Error; err != nil {
+		return page, err
+	}
+	if len(events) > limit {
+		events = events[:limit]
+		page.NextCursor = encodeCursor(events[limit-1].ID)
+	}
+	page.Events = events
+	return page, nil
+}
+
+func encodeCursor(id uint) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.FormatUint(uint64(id), 10)))
+}
+
+func decodeCursor(s string) (uint, error) {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return 0, ErrInvalidCursor
+	}
+	id, err := strconv.ParseUint(string(data), 10, 64)
+	if err != nil {
+		return 0, ErrInvalidCursor
+	}
+	return uint(id), nil
+}
+
+// secretMarkers are substrings of field names that are never stored.
+var secretMarkers = []string{"password", "secret", "token", "hash", "private", "code"}
+
+func isSecret(field string) bool {
+	field = strings.ToLower(field)
+	for _, marker := range secretMarkers {
+		if strings.Contains(field, marker) {
+			return true
+		}
+	}
+	return false
+}
+
+// fields flattens v into its top level JSON fields, minus secrets.
+func fields(v interface{}) (map[string]interface{}, error) {
+	if v == nil {
+		return nil, nil
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var m map[string]interface{}
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, err
+	}
+	for field := range m {
+		if isSecret(field) {
+			delete(m, field)
+		}
+	}
+	return m, nil
+}
+
+// diff returns the JSON of the fields of before and after that differ. When
+// only one side is given, all of its fields are kept.
+func diff(before, after interface{}) (string, string, error) {
+	b, err := fields(before)
+	if err != nil {
+		return "", "", err
+	}
+	a, err := fields(after)
+	if err != nil {
+		return "", "", err
+	}
+	if b != nil && a != nil {
+		for field, value := range b {
+			if other, ok := a[field]; ok && reflect.DeepEqual(value, other) {
+				delete(a, field)
+				delete(b, field)
+			}
+		}
+	}
+	return encode(b), encode(a), nil
+}
+
+func encode(m map[string]interface{}) string {
+	if len(m) == 0 {
+		return ""
+	}
+	data, _ := json.Marshal(m)
+	return string(data)
+}
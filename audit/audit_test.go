@@ -0,0 +1,353 @@
+package audit
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/MicBun/go-100-coverage-docker-crud/core"
+	"github.com/MicBun/go-100-coverage-docker-crud/database"
+	"github.com/MicBun/go-100-coverage-docker-crud/util/jwtAuth"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"gorm.io/gorm"
+)
+
+// hideTable makes every statement on table fail, until the returned func is
+// called.
+func hideTable(t *testing.T, db *gorm.DB, table string) func() {
+	t.Helper()
+	assert.NoError(t, db.Exec(fmt.Sprintf("ALTER TABLE %s RENAME TO hidden_%s", table, table)).Error)
+	return func() {
+		assert.NoError(t, db.Exec(fmt.Sprintf("ALTER TABLE hidden_%s RENAME TO %s", table, table)).Error)
+	}
+}
+
+// failFinds makes queries that load into a value of the same type as dest
+// fail, until the returned func is called.
+func failFinds(t *testing.T, db *gorm.DB, dest interface{}) func() {
+	t.Helper()
+	assert.NoError(t, db.Callback().Query().Before("gorm:query").Register("test:fail_finds", func(tx *gorm.DB) {
+		if reflect.TypeOf(tx.Statement.Dest) == reflect.TypeOf(dest) {
+			tx.AddError(errors.New("broken"))
+		}
+	}))
+	return func() { assert.NoError(t, db.Callback().Query().Remove("test:fail_finds")) }
+}
+
+func TestContext(t *testing.T) {
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	assert.Equal(t, Event{}, FromContext(c))
+
+	SetActor(c, 3)
+	SetTarget(c, "user", 7)
+	SetChange(c, map[string]string{"name": "Foo"}, nil)
+	event := FromContext(c)
+	assert.Equal(t, uint(3), *event.ActorID)
+	assert.Equal(t, "user", event.TargetType)
+	assert.Equal(t, "7", event.TargetID)
+	assert.Equal(t, map[string]string{"name": "Foo"}, event.Before)
+	assert.Nil(t, event.After)
+}
+
+func TestDiff(t *testing.T) {
+	type user struct {
+		Name     string `json:"name"`
+		Username string `json:"username"`
+		Password string `json:"password"`
+		Token    string `json:"refresh_token"`
+	}
+	before, after, err := diff(
+		user{Name: "Foo", Username: "foo", Password: "old", Token: "a"},
+		user{Name: "Bar", Username: "foo", Password: "new", Token: "b"},
+	)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"name":"Foo"}`, before)
+	assert.Equal(t, `{"name":"Bar"}`, after)
+
+	before, after, err = diff(nil, map[string]string{"username": "foo", "secret": "x", "code": "123456"})
+	assert.NoError(t, err)
+	assert.Equal(t, "", before)
+	assert.Equal(t, `{"username":"foo"}`, after)
+
+	_, _, err = diff(nil, "not an object")
+	assert.Error(t, err)
+	_, _, err = diff(make(chan int), nil)
+	assert.Error(t, err)
+}
+
+func TestLog(t *testing.T) {
+	database.RunTest(func(db *gorm.DB) {
+		now := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+		l := NewLog(db).(*Log)
+		l.now = func() time.Time { return now }
+
+		admin := uint(1)
+		for i, event := range []Event{
+			{ActorID: &admin, Action: "user.register", TargetType: "user", TargetID: "2", Status: 200, RequestID: "a"},
+			{Action: "auth.login", After: map[string]string{"username": "foo"}, Status: 400, IP: "10.0.0.1"},
+			{ActorID: &admin, Action: "user.update", TargetType: "user", TargetID: "2", Status: 200,
+				Before: map[string]string{"name": "Foo"}, After: map[string]string{"name": "Bar"}},
+		} {
+			now = now.Add(time.Duration(i) * time.Hour)
+			assert.NoError(t, l.Record(event))
+		}
+
+		page, err := l.List(Filter{})
+		assert.NoError(t, err)
+		assert.Equal(t, int64(3), page.Total)
+		assert.Equal(t, "user.update", page.Events[0].Action)
+		assert.Equal(t, `{"name":"Foo"}`, page.Events[0].Before)
+		assert.Equal(t, `{"name":"Bar"}`, page.Events[0].After)
+		assert.Empty(t, page.NextCursor)
+
+		page, err = l.List(Filter{Limit: 2})
+		assert.NoError(t, err)
+		assert.Equal(t, 2, len(page.Events))
+		assert.NotEmpty(t, page.NextCursor)
+		page, err = l.List(Filter{Limit: 2, Cursor: page.NextCursor})
+		assert.NoError(t, err)
+		assert.Equal(t, 1, len(page.Events))
+		assert.Equal(t, "user.register", page.Events[0].Action)
+		assert.Empty(t, page.NextCursor)
+
+		page, err = l.List(Filter{ActorID: &admin, TargetType: "user", TargetID: "2"})
+		assert.NoError(t, err)
+		assert.Equal(t, int64(2), page.Total)
+		page, err = l.List(Filter{Outcome: OutcomeFailure})
+		assert.NoError(t, err)
+		assert.Equal(t, int64(1), page.Total)
+		assert.Equal(t, "10.0.0.1", page.Events[0].IP)
+		page, err = l.List(Filter{Action: "user.register", RequestID: "a", Outcome: OutcomeSuccess})
+		assert.NoError(t, err)
+		assert.Equal(t, int64(1), page.Total)
+		since := time.Date(2023, 1, 1, 1, 0, 0, 0, time.UTC)
+		page, err = l.List(Filter{Since: &since, Until: &now})
+		assert.NoError(t, err)
+		assert.Equal(t, int64(1), page.Total)
+		assert.Equal(t, "auth.login", page.Events[0].Action)
+
+		_, err = l.List(Filter{Outcome: "maybe"})
+		assert.Error(t, err)
+		_, err = l.List(Filter{Cursor: "!"})
+		assert.ErrorIs(t, err, ErrInvalidCursor)
+		_, err = l.List(Filter{Cursor: base64.RawURLEncoding.EncodeToString([]byte("x"))})
+		assert.ErrorIs(t, err, ErrInvalidCursor)
+
+		page, err = l.List(Filter{Limit: MaxLimit + 1})
+		assert.NoError(t, err)
+		assert.Equal(t, 3, len(page.Events))
+	})
+}
+
+func TestLogErrors(t *testing.T) {
+	database.RunTest(func(db *gorm.DB) {
+		l := NewLog(db)
+		assert.Error(t, l.Record(Event{Action: "user.update", After: "not an object"}))
+		assert.NoError(t, l.Record(Event{Action: "user.update", Status: 200}))
+
+		restore := failFinds(t, db, &[]core.AuditEvent{})
+		_, err := l.List(Filter{})
+		assert.Error(t, err)
+		restore()
+
+		restore = hideTable(t, db, "audit_events")
+		_, err = l.List(Filter{})
+		assert.Error(t, err)
+		restore()
+	})
+}
+
+func TestChain(t *testing.T) {
+	database.RunTest(func(db *gorm.DB) {
+		l := NewLog(db).(*Log)
+
+		// Events from before chaining was enabled are skipped.
+		assert.NoError(t, db.Create(&core.AuditEvent{Action: "legacy"}).Error)
+		for _, action := range []string{"a", "b", "c", "d"} {
+			assert.NoError(t, l.Record(Event{Action: action, After: map[string]string{"name": action}, Status: 200}))
+		}
+		var events []core.AuditEvent
+		assert.NoError(t, db.Order("id").Find(&events).Error)
+		assert.Equal(t, genesis, events[1].PrevHash)
+		assert.Equal(t, events[1].Hash, events[2].PrevHash)
+
+		report, err := l.Verify()
+		assert.NoError(t, err)
+		assert.Nil(t, report.Broken)
+		assert.Equal(t, int64(4), report.Events)
+		assert.Equal(t, int64(1), report.Unchained)
+		assert.Equal(t, events[4].Hash, report.Head)
+
+		// A second event can't claim the same link.
+		fork := events[3]
+		fork.ID = 0
+		assert.Error(t, db.Create(&fork).Error)
+
+		// The default secret is public, so it signs no checkpoints.
+		_, err = l.Checkpoint()
+		assert.ErrorIs(t, err, jwtAuth.ErrDefaultSecret)
+		defer jwtAuth.SetKeys(jwtAuth.HMACKey(jwtAuth.DefaultSecret))
+		jwtAuth.SetKeys(jwtAuth.HMACKey("audit secret"))
+
+		checkpoint, err := l.Checkpoint()
+		assert.NoError(t, err)
+		assert.Equal(t, events[4].ID, checkpoint.EventID)
+		checkpoint, err = l.Checkpoint()
+		assert.NoError(t, err)
+		assert.Nil(t, checkpoint)
+
+		// Editing an event breaks it.
+		assert.NoError(t, db.Model(&events[2]).Update("status", 500).Error)
+		report, err = l.Verify()
+		assert.NoError(t, err)
+		assert.Equal(t, events[2].ID, report.Broken.EventID)
+		assert.NoError(t, db.Model(&events[2]).Update("status", 200).Error)
+
+		// Removing one breaks the event after it.
+		assert.NoError(t, db.Delete(&events[3]).Error)
+		report, err = l.Verify()
+		assert.NoError(t, err)
+		assert.Equal(t, events[4].ID, report.Broken.EventID)
+		assert.NoError(t, db.Create(&events[3]).Error)
+
+		// Removing the newest events is caught by the checkpoint.
+		assert.NoError(t, db.Delete(&events[4]).Error)
+		report, err = l.Verify()
+		assert.NoError(t, err)
+		assert.Equal(t, events[4].ID, report.Broken.EventID)
+		assert.Contains(t, report.Broken.Reason, "missing")
+		assert.NoError(t, db.Create(&events[4]).Error)
+
+		// So is a checkpoint that was rewritten without the key.
+		assert.NoError(t, db.Model(&core.AuditCheckpoint{}).Where("id = 1").Update("hash", events[3].Hash).Error)
+		report, err = l.Verify()
+		assert.NoError(t, err)
+		assert.Contains(t, report.Broken.Reason, "signature")
+		assert.NoError(t, db.Model(&core.AuditCheckpoint{}).Where("id = 1").Update("hash", events[4].Hash).Error)
+
+		// Checkpoints stay verifiable after their key stops signing tokens.
+		key, _ := jwtAuth.GenerateKey(jwtAuth.AlgEdDSA)
+		jwtAuth.SetKeys(key)
+		assert.NoError(t, l.Record(Event{Action: "e", Status: 200}))
+		_, err = l.Checkpoint()
+		assert.NoError(t, err)
+		jwtAuth.SetKeys(jwtAuth.HMACKey("audit secret"))
+		report, err = l.Verify()
+		assert.NoError(t, err)
+		assert.Nil(t, report.Broken)
+		assert.Equal(t, 2, report.Checkpoints)
+
+		// A rewritten chain signed with a key that was never stored breaks.
+		forger, _ := jwtAuth.GenerateKey(jwtAuth.AlgEdDSA)
+		jwtAuth.SetKeys(forger)
+		signature, _, err := jwtAuth.SignAuditCheckpoint(events[4].ID, events[4].Hash)
+		assert.NoError(t, err)
+		assert.NoError(t, db.Model(&core.AuditCheckpoint{}).Where("id = 1").Update("signature", signature).Error)
+		jwtAuth.SetKeys(jwtAuth.HMACKey("audit secret"))
+		report, err = l.Verify()
+		assert.NoError(t, err)
+		assert.Contains(t, report.Broken.Reason, "unknown key")
+	})
+}
+
+func TestChainErrors(t *testing.T) {
+	database.RunTest(func(db *gorm.DB) {
+		l := NewLog(db)
+		defer jwtAuth.SetKeys(jwtAuth.HMACKey(jwtAuth.DefaultSecret))
+		jwtAuth.SetKeys(jwtAuth.HMACKey("audit secret"))
+
+		restore := hideTable(t, db, "audit_events")
+		assert.Error(t, l.Record(Event{Action: "a"}))
+		_, err := l.Verify()
+		assert.Error(t, err)
+		_, err = l.Checkpoint()
+		assert.Error(t, err)
+		restore()
+
+		// Another instance appending first moves the head, so the insert is
+		// retried on top of its event, but not forever.
+		rivals := 0
+		race := func(tx *gorm.DB) {
+			if event, ok := tx.Statement.Dest.(*core.AuditEvent); ok && rivals > 0 {
+				rivals--
+				assert.NoError(t, db.Exec("INSERT INTO audit_events (action, prev_hash, hash) VALUES ('rival', ?, ?)",
+					event.PrevHash, fmt.Sprint("rival", rivals)).Error)
+			}
+		}
+		assert.NoError(t, db.Callback().Create().Before("gorm:begin_transaction").Register("test:race", race))
+		rivals = 1
+		assert.NoError(t, l.Record(Event{Action: "a"}))
+		rivals = appendAttempts
+		assert.Error(t, l.Record(Event{Action: "b"}))
+		assert.NoError(t, db.Callback().Create().Remove("test:race"))
+		var events []core.AuditEvent
+		assert.NoError(t, db.Order("id").Find(&events).Error)
+		assert.Equal(t, "rival", events[0].Action)
+		assert.Equal(t, events[0].Hash, events[1].PrevHash)
+		assert.Equal(t, 1+appendAttempts+1, len(events))
+
+		// Failures that aren't a lost race aren't retried.
+		assert.NoError(t, db.Callback().Create().Before("gorm:create").Register("test:fail_creates", func(tx *gorm.DB) {
+			tx.AddError(errors.New("broken"))
+		}))
+		assert.Error(t, l.Record(Event{Action: "c"}))
+		assert.NoError(t, db.Callback().Create().Remove("test:fail_creates"))
+		assert.NoError(t, db.Where("1 = 1").Delete(&core.AuditEvent{}).Error)
+
+		assert.NoError(t, l.Record(Event{Action: "a"}))
+		restore = failFinds(t, db, &core.AuditCheckpoint{})
+		_, err = l.Checkpoint()
+		assert.Error(t, err)
+		restore()
+		checkpoint, err := l.Checkpoint()
+		assert.NoError(t, err)
+
+		restore = failFinds(t, db, &[]core.AuditCheckpoint{})
+		_, err = l.Verify()
+		assert.Error(t, err)
+		restore()
+		restore = failFinds(t, db, &core.AuditEvent{})
+		_, err = l.Verify()
+		assert.Error(t, err)
+		restore()
+
+		// An event that lost its chain fields is no longer the one signed.
+		assert.NoError(t, db.Model(&core.AuditEvent{}).Where("id = ?", checkpoint.EventID).
+			Updates(map[string]interface{}{"prev_hash": "", "hash": ""}).Error)
+		report, err := l.Verify()
+		assert.NoError(t, err)
+		assert.Contains(t, report.Broken.Reason, "hash doesn't match")
+
+		assert.NoError(t, db.Model(checkpoint).Update("signature", "forged").Error)
+		report, err = l.Verify()
+		assert.NoError(t, err)
+		assert.Contains(t, report.Broken.Reason, "invalid signature")
+
+		key, _ := jwtAuth.GenerateKey(jwtAuth.AlgEdDSA)
+		jwtAuth.SetKeys(key)
+		assert.NoError(t, l.Record(Event{Action: "b"}))
+		encodePublicKey = func(jwtAuth.Key) (string, error) { return "", errors.New("broken") }
+		_, err = l.Checkpoint()
+		assert.Error(t, err)
+		encodePublicKey = jwtAuth.EncodePublicKey
+		restore = hideTable(t, db, "audit_keys")
+		_, err = l.Checkpoint()
+		assert.Error(t, err)
+		restore()
+		_, err = l.Checkpoint()
+		assert.NoError(t, err)
+
+		restore = failFinds(t, db, &[]core.AuditKey{})
+		_, err = l.Verify()
+		assert.Error(t, err)
+		restore()
+		assert.NoError(t, db.Model(&core.AuditKey{}).Where("1 = 1").Update("public_key", "garbage").Error)
+		_, err = l.Verify()
+		assert.Error(t, err)
+	})
+}
@@ -0,0 +1,253 @@
+package audit
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/MicBun/go-100-coverage-docker-crud/core"
+	"github.com/MicBun/go-100-coverage-docker-crud/util/jwtAuth"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// genesis is the PrevHash of the first chained event.
+var genesis = strings.Repeat("0", sha256.Size*2)
+
+// appendAttempts bounds how often Record retries when another instance
+// appended to the chain first.
+const appendAttempts = 5
+
+// Break is the first link of the chain that doesn't hold.
+type Break struct {
+	EventID uint
+	Reason  string
+}
+
+// Report is the outcome of Verify. Unchained counts the events recorded
+// before chaining was enabled, which can't be verified.
+type Report struct {
+	Events      int64
+	Unchained   int64
+	Head        string
+	Checkpoints int
+	Broken      *Break
+}
+
+// hashContent is every stored field of an event except its ID, which the
+// database assigns, and the hashes themselves.
+type hashContent struct {
+	CreatedAt  string `json:"created_at"`
+	ActorID    *uint  `json:"actor_id"`
+	Action     string `json:"action"`
+	TargetType string `json:"target_type"`
+	TargetID   string `json:"target_id"`
+	Status     int    `json:"status"`
+	Before     string `json:"before"`
+	After      string `json:"after"`
+	IP         string `json:"ip"`
+	UserAgent  string `json:"user_agent"`
+	RequestID  string `json:"request_id"`
+}
+
+func chainHash(prev string, event core.AuditEvent) string {
+	content, _ := json.Marshal(hashContent{
+		CreatedAt:  event.CreatedAt.UTC().Format(time.RFC3339Nano),
+		ActorID:    event.ActorID,
+		Action:     event.Action,
+		TargetType: event.TargetType,
+		TargetID:   event.TargetID,
+		Status:     event.Status,
+		Before:     event.Before,
+		After:      event.After,
+		IP:         event.IP,
+		UserAgent:  event.UserAgent,
+		RequestID:  event.RequestID,
+	})
+	sum := sha256.Sum256(append([]byte(prev+"\n"), content...))
+	return hex.EncodeToString(sum[:])
+}
+
+// head returns the newest chained event, or a zero event when there is none.
+func (l *Log) head() (core.AuditEvent, error) {
+	var event core.AuditEvent
+	err := l.db.Where("hash <> ''").Order("id DESC").Limit(1).Find(&event).Error
+	return event, err
+}
+
+func (l *Log) append(event core.AuditEvent) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var err error
+	for attempt := 0; attempt < appendAttempts; attempt++ {
+		var head core.AuditEvent
+		if head, err = l.head(); err != nil {
+			return err
+		}
+		event.PrevHash = genesis
+		if head.ID != 0 {
+			event.PrevHash = head.Hash
+		}
+		event.Hash = chainHash(event.PrevHash, event)
+		if err = l.db.Create(&event).Error; err == nil {
+			return nil
+		}
+		// Retry only when the insert lost the race for the head.
+		latest, headErr := l.head()
+		if headErr != nil || latest.ID == head.ID {
+			return err
+		}
+	}
+	return err
+}
+
+var errBroken = errors.New("chain broken")
+
+func (l *Log) Verify() (Report, error) {
+	var report Report
+	prev := ""
+	var batch []core.AuditEvent
+	res := l.db.Order("id").FindInBatches(&batch, 500, func(tx *gorm.DB, _ int) error {
+		for _, event := range batch {
+			if prev == "" {
+				if event.Hash == "" && event.PrevHash == "" {
+					report.Unchained++
+					continue
+				}
+				prev = genesis
+			}
+			switch {
+			case event.PrevHash != prev:
+				report.Broken = &Break{event.ID, "previous hash doesn't match the event before it, which was changed or removed"}
+			case chainHash(event.PrevHash, event) != event.Hash:
+				report.Broken = &Break{event.ID, "content doesn't match its hash"}
+			}
+			if report.Broken != nil {
+				return errBroken
+			}
+			report.Events++
+			prev = event.Hash
+		}
+		return nil
+	})
+	if res.Error != nil && !errors.Is(res.Error, errBroken) {
+		return report, res.Error
+	}
+	if report.Broken != nil {
+		return report, nil
+	}
+	if prev != genesis {
+		report.Head = prev
+	}
+
+	if err := l.loadKeys(); err != nil {
+		return report, err
+	}
+	var checkpoints []core.AuditCheckpoint
+	if err := l.db.Order("id").Find(&checkpoints).Error; err != nil {
+		return report, err
+	}
+	for _, checkpoint := range checkpoints {
+		report.Checkpoints++
+		reason, err := l.checkCheckpoint(checkpoint)
+		if err != nil {
+			return report, err
+		}
+		if reason != "" {
+			report.Broken = &Break{checkpoint.EventID, reason}
+			return report, nil
+		}
+	}
+	return report, nil
+}
+
+// loadKeys accepts the stored public keys of every key that signed a
+// checkpoint, including keys that no longer sign tokens.
+func (l *Log) loadKeys() error {
+	var rows []core.AuditKey
+	if err := l.db.Find(&rows).Error; err != nil {
+		return err
+	}
+	keys := make([]jwtAuth.Key, 0, len(rows))
+	for _, row := range rows {
+		key, err := jwtAuth.DecodePublicKey(row.ID, row.Algorithm, row.PublicKey)
+		if err != nil {
+			return err
+		}
+		keys = append(keys, key)
+	}
+	jwtAuth.AddVerificationKeys(keys...)
+	return nil
+}
+
+// checkCheckpoint returns why checkpoint doesn't hold, or "" when it does.
+func (l *Log) checkCheckpoint(checkpoint core.AuditCheckpoint) (string, error) {
+	eventID, hash, err := jwtAuth.ParseAuditCheckpoint(checkpoint.Signature)
+	switch {
+	case errors.Is(err, jwtAuth.ErrUnknownKey):
+		return fmt.Sprintf("checkpoint %d is signed with an unknown key", checkpoint.ID), nil
+	case err != nil:
+		return fmt.Sprintf("checkpoint %d has an invalid signature: %v", checkpoint.ID, err), nil
+	case eventID != checkpoint.EventID || hash != checkpoint.Hash:
+		return fmt.Sprintf("checkpoint %d doesn't match its signature", checkpoint.ID), nil
+	}
+
+	var event core.AuditEvent
+	res := l.db.Where("id = ?", checkpoint.EventID).Limit(1).Find(&event)
+	if res.Error != nil {
+		return "", res.Error
+	}
+	if res.RowsAffected == 0 {
+		return fmt.Sprintf("event signed by checkpoint %d is missing", checkpoint.ID), nil
+	}
+	if event.Hash != checkpoint.Hash {
+		return fmt.Sprintf("hash doesn't match checkpoint %d", checkpoint.ID), nil
+	}
+	return "", nil
+}
+
+// encodePublicKey encodes the keys kept for checkpoints, replaced in tests.
+var encodePublicKey = jwtAuth.EncodePublicKey
+
+func (l *Log) Checkpoint() (*core.AuditCheckpoint, error) {
+	head, err := l.head()
+	if err != nil || head.ID == 0 {
+		return nil, err
+	}
+	var latest core.AuditCheckpoint
+	if err := l.db.Order("id DESC").Limit(1).Find(&latest).Error; err != nil {
+		return nil, err
+	}
+	if latest.EventID == head.ID {
+		return nil, nil
+	}
+	signature, key, err := jwtAuth.SignAuditCheckpoint(head.ID, head.Hash)
+	if err != nil {
+		return nil, err
+	}
+	checkpoint := &core.AuditCheckpoint{
+		CreatedAt: l.now(),
+		EventID:   head.ID,
+		Hash:      head.Hash,
+		Signature: signature,
+	}
+	return checkpoint, l.db.Transaction(func(tx *gorm.DB) error {
+		// Storing the HMAC secret would let anyone who reads it forge
+		// checkpoints, so those are only verified with API_SECRET.
+		if key.Secret == nil {
+			public, err := encodePublicKey(key)
+			if err != nil {
+				return err
+			}
+			row := core.AuditKey{ID: key.ID, Algorithm: key.Algorithm, PublicKey: public, CreatedAt: l.now()}
+			if err := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&row).Error; err != nil {
+				return err
+			}
+		}
+		return tx.Create(checkpoint).Error
+	})
+}
@@ -0,0 +1,60 @@
+package audit
+
+import (
+	"fmt"
+
+	"github.com/gin-gonic/gin"
+)
+
+const contextKey = "audit"
+
+// details is what a handler knows about the action it ran, kept on the
+// request until the audit middleware records it.
+type details struct {
+	actorID    *uint
+	targetType string
+	targetID   string
+	before     interface{}
+	after      interface{}
+}
+
+func current(c *gin.Context) *details {
+	if value, ok := c.Get(contextKey); ok {
+		return value.(*details)
+	}
+	d := &details{}
+	c.Set(contextKey, d)
+	return d
+}
+
+// SetActor names the user acting when the request carries no access token
+// yet, as on login.
+func SetActor(c *gin.Context, id uint) {
+	current(c).actorID = &id
+}
+
+func SetTarget(c *gin.Context, targetType string, id interface{}) {
+	d := current(c)
+	d.targetType = targetType
+	d.targetID = fmt.Sprint(id)
+}
+
+// SetChange records the state of the target before and after the action;
+// either may be nil.
+func SetChange(c *gin.Context, before, after interface{}) {
+	d := current(c)
+	d.before = before
+	d.after = after
+}
+
+// FromContext returns the event described by the handler of the request.
+func FromContext(c *gin.Context) Event {
+	d := current(c)
+	return Event{
+		ActorID:    d.actorID,
+		TargetType: d.targetType,
+		TargetID:   d.targetID,
+		Before:     d.before,
+		After:      d.after,
+	}
+}
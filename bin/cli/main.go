@@ -0,0 +1,134 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/MicBun/go-100-coverage-docker-crud/audit"
+	"github.com/MicBun/go-100-coverage-docker-crud/database"
+	"github.com/joho/godotenv"
+	"gorm.io/gorm"
+)
+
+const usage = `Usage: cli <command> [arguments]
+
+Commands:
+  migrate up          apply every pending migration
+  migrate down [n]    roll back the last n migrations (default 1)
+  migrate status      list migrations and whether they are applied
+  audit verify        check the audit hash chain and its signed checkpoints
+`
+
+func main() {
+	flag.Usage = func() { fmt.Fprint(os.Stderr, usage) }
+	flag.Parse()
+	args := flag.Args()
+	if len(args) < 2 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	err := godotenv.Load()
+	if err != nil {
+		log.Println("Error loading .env file, using default env")
+	}
+
+	dbConfig, err := database.ConfigFromEnv()
+	if err != nil {
+		log.Fatalf("Invalid database configuration %v", err)
+	}
+	db, err := database.Connect(dbConfig)
+	if err != nil {
+		log.Fatalf("Unable to connect to db %v", err)
+	}
+
+	switch args[0] {
+	case "migrate":
+		err = migrate(db, args[1], args[2:])
+	case "audit":
+		err = auditCommand(db, args[1])
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func migrate(db *gorm.DB, command string, args []string) error {
+	m := database.NewMigrator(db, database.Migrations)
+	switch command {
+	case "up":
+		done, err := m.Up()
+		for _, migration := range done {
+			fmt.Printf("applied %d %s\n", migration.Version, migration.Name)
+		}
+		if err == nil && len(done) == 0 {
+			fmt.Println("database is up to date")
+		}
+		return err
+	case "down":
+		steps := 1
+		if len(args) > 0 {
+			n, err := strconv.Atoi(args[0])
+			if err != nil || n < 1 {
+				return fmt.Errorf("invalid number of steps %q", args[0])
+			}
+			steps = n
+		}
+		done, err := m.Down(steps)
+		for _, migration := range done {
+			fmt.Printf("rolled back %d %s\n", migration.Version, migration.Name)
+		}
+		return err
+	case "status":
+		status, err := m.Status()
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "VERSION\tNAME\tAPPLIED AT")
+		for _, s := range status {
+			appliedAt := "pending"
+			if s.AppliedAt != nil {
+				appliedAt = s.AppliedAt.Format(time.RFC3339)
+			}
+			if s.Unknown {
+				appliedAt += " (unknown to this binary)"
+			}
+			fmt.Fprintf(w, "%d\t%s\t%s\n", s.Version, s.Name, appliedAt)
+		}
+		return w.Flush()
+	default:
+		return fmt.Errorf("unknown migrate command %q", command)
+	}
+}
+
+func auditCommand(db *gorm.DB, command string) error {
+	if command != "verify" {
+		return fmt.Errorf("unknown audit command %q", command)
+	}
+	report, err := audit.NewLog(db).Verify()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("verified %d events", report.Events)
+	if report.Unchained > 0 {
+		fmt.Printf(", skipped %d recorded before chaining", report.Unchained)
+	}
+	fmt.Println()
+	if report.Broken != nil {
+		return fmt.Errorf("audit chain broken at event %d: %s", report.Broken.EventID, report.Broken.Reason)
+	}
+	fmt.Printf("verified %d checkpoints\n", report.Checkpoints)
+	if report.Head != "" {
+		fmt.Printf("head %s\n", report.Head)
+	}
+	return nil
+}
@@ -1,9 +1,11 @@
 package main
 
 import (
+	"context"
 	"github.com/MicBun/go-100-coverage-docker-crud/database"
 	"github.com/MicBun/go-100-coverage-docker-crud/docs"
 	"github.com/MicBun/go-100-coverage-docker-crud/service"
+	"github.com/MicBun/go-100-coverage-docker-crud/util"
 	"github.com/MicBun/go-100-coverage-docker-crud/web"
 	"github.com/joho/godotenv"
 	"log"
@@ -15,12 +17,21 @@ func main() {
 		log.Println("Error loading .env file, using default env")
 	}
 
-	db, err := database.Connect()
+	dbConfig, err := database.ConfigFromEnv()
+	if err != nil {
+		log.Fatalf("Invalid database configuration %v", err)
+	}
+	db, err := database.Connect(dbConfig)
 	if err != nil {
 		log.Fatalf("Unable to connect to db %v", err)
 	}
-	if err := database.Migrate(db); err != nil {
-		log.Fatalf("Unable to migrate db %v", err)
+	if util.GetEnv("AUTO_MIGRATE", "false") == "true" {
+		if err := database.Migrate(db); err != nil {
+			log.Fatalf("Unable to migrate db %v", err)
+		}
+	}
+	if err := database.CheckSchema(db); err != nil {
+		log.Fatalf("Refusing to start: %v", err)
 	}
 
 	description := "This is a sample Go User API server. \n\n" +
@@ -28,6 +39,7 @@ func main() {
 		"Login by POST /login username: admin, password: admin to get Admin Bearer Token. \n\n" +
 		"Login by POST /login username: usera@email.com password: password123 to get User Bearer Token. \n\n" +
 		"Then you can use the Bearer Token to access the other endpoints. \n\n" +
+		"When the Bearer Token expires, POST /refresh with the refresh_token from the login response to get a new one. \n\n" +
 		"Admin can access CRUD endpoints, while User can only access /users/get GET endpoint. \n\n" +
 		"Checkout my Github: https://github.com/MicBun\n\n" +
 		"Checkout my Linkedin: https://www.linkedin.com/in/MicBun\n\n"
@@ -37,6 +49,7 @@ func main() {
 
 	c := service.New(db)
 	service.SeedData(c)
+	service.StartJobs(context.Background(), c)
 	web.RegisterAPIRoutes(c)
 	c.Web.Run()
 }
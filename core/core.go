@@ -1,11 +1,192 @@
 package core
 
-import "gorm.io/gorm"
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+const (
+	RoleAdmin = "admin"
+	RoleUser  = "user"
+)
+
+const (
+	PermUsersRead     = "users:read"
+	PermUsersWrite    = "users:write"
+	PermUsersDelete   = "users:delete"
+	PermRolesRead     = "roles:read"
+	PermRolesWrite    = "roles:write"
+	PermProfileRead   = "profile:read"
+	PermProfileWrite  = "profile:write"
+	PermSessionsRead  = "sessions:read"
+	PermSessionsWrite = "sessions:write"
+	PermMFAWrite      = "mfa:write"
+	PermAuditRead     = "audit:read"
+)
+
+// Account statuses. Users who sign up themselves stay pending until they
+// confirm their address. Only active users can log in or use their tokens.
+const (
+	StatusActive              = "active"
+	StatusPendingVerification = "pending_verification"
+	StatusSuspended           = "suspended"
+	StatusLocked              = "locked"
+	StatusDeactivated         = "deactivated"
+)
 
 type User struct {
 	gorm.Model
-	Username string `gorm:"unique"`
+	// Usernames are unique among live users; soft-deleted users don't hold
+	// on to theirs.
+	Username string `gorm:"uniqueIndex:idx_users_username,where:deleted_at IS NULL"`
 	Password string
 	Name     string
-	Token    string
+	Status   string `gorm:"default:active"`
+	// StatusReason and StatusChangedAt describe the last status transition.
+	StatusReason    string
+	StatusChangedAt *time.Time
+	// Version grows with each change to the user's details or status, so
+	// clients can detect that someone else changed it since they read it.
+	Version uint   `gorm:"not null;default:1"`
+	Roles   []Role `gorm:"many2many:user_roles;"`
+}
+
+type Role struct {
+	ID          uint         `gorm:"primarykey"`
+	Name        string       `gorm:"uniqueIndex"`
+	Permissions []Permission `gorm:"many2many:role_permissions;"`
+}
+
+type Permission struct {
+	ID   uint   `gorm:"primarykey"`
+	Name string `gorm:"uniqueIndex"`
+}
+
+type Session struct {
+	ID         uint `gorm:"primarykey"`
+	CreatedAt  time.Time
+	UserID     uint `gorm:"index"`
+	UserAgent  string
+	IP         string
+	LastSeenAt time.Time
+	ExpiresAt  time.Time
+	RevokedAt  *time.Time
+}
+
+// RefreshToken belongs to the Session started by a login. Tokens are rotated
+// on every refresh, so a session holds one live token and the spent ones.
+type RefreshToken struct {
+	ID        uint `gorm:"primarykey"`
+	CreatedAt time.Time
+	UserID    uint   `gorm:"index"`
+	SessionID uint   `gorm:"index"`
+	TokenHash string `gorm:"uniqueIndex"`
+	ExpiresAt time.Time
+	UsedAt    *time.Time
+	RevokedAt *time.Time
+}
+
+// RevokedToken denies an access token by its jti claim until it expires.
+type RevokedToken struct {
+	JTI       string `gorm:"primarykey"`
+	CreatedAt time.Time
+	ExpiresAt time.Time `gorm:"index"`
+}
+
+// SigningKey is a generated token signing key, identified by its kid. A key
+// is retired once a newer key has taken over signing; it stays published for
+// verification until every token it signed has expired.
+type SigningKey struct {
+	ID         string `gorm:"primarykey"`
+	Algorithm  string
+	PrivateKey string
+	CreatedAt  time.Time `gorm:"index"`
+	RetiredAt  *time.Time
+}
+
+// UserMFA is a user's TOTP enrollment. The second factor is required at login
+// once the enrollment is confirmed. LastStep is the newest time step that was
+// accepted, so a code can't be replayed.
+type UserMFA struct {
+	UserID      uint `gorm:"primarykey;autoIncrement:false"`
+	Secret      string
+	CreatedAt   time.Time
+	ConfirmedAt *time.Time
+	LastStep    int64
+}
+
+// RecoveryCode is a single-use replacement for a TOTP code. Only its SHA-256
+// is stored.
+type RecoveryCode struct {
+	ID        uint `gorm:"primarykey"`
+	CreatedAt time.Time
+	UserID    uint   `gorm:"index"`
+	CodeHash  string `gorm:"uniqueIndex"`
+	UsedAt    *time.Time
+}
+
+// PasswordReset is a single-use token that lets a user choose a new password
+// without knowing the old one. Only its SHA-256 is stored.
+type PasswordReset struct {
+	ID        uint `gorm:"primarykey"`
+	CreatedAt time.Time
+	UserID    uint   `gorm:"index"`
+	TokenHash string `gorm:"uniqueIndex"`
+	ExpiresAt time.Time
+	UsedAt    *time.Time
+}
+
+// EmailVerification is a single-use token that proves a user who signed up
+// owns their username's address. Only its SHA-256 is stored.
+type EmailVerification struct {
+	ID        uint `gorm:"primarykey"`
+	CreatedAt time.Time
+	UserID    uint   `gorm:"index"`
+	TokenHash string `gorm:"uniqueIndex"`
+	ExpiresAt time.Time
+	UsedAt    *time.Time
+}
+
+// AuditEvent records one action taken through the API. Rows are only ever
+// inserted. Before and After hold the JSON of the target's fields that the
+// action changed, without secrets. Hash covers the event's content and
+// PrevHash, the Hash of the event recorded before it, so editing or removing
+// an event breaks the chain.
+type AuditEvent struct {
+	ID         uint      `gorm:"primarykey"`
+	CreatedAt  time.Time `gorm:"index"`
+	ActorID    *uint     `gorm:"index"`
+	Action     string    `gorm:"index"`
+	TargetType string
+	TargetID   string `gorm:"index"`
+	Status     int
+	Before     string
+	After      string
+	IP         string
+	UserAgent  string
+	RequestID  string `gorm:"index"`
+	PrevHash   string
+	Hash       string
+}
+
+// AuditCheckpoint is a signature over the hash of the newest audit event at
+// the time, made with the key that signs access tokens. Rewriting the chain
+// up to a checkpoint would require that key.
+type AuditCheckpoint struct {
+	ID        uint `gorm:"primarykey"`
+	CreatedAt time.Time
+	EventID   uint `gorm:"index"`
+	Hash      string
+	Signature string
+}
+
+// AuditKey is the public half of a key that signed audit checkpoints. Unlike
+// a SigningKey it is never deleted, so checkpoints stay verifiable after the
+// key has been rotated out.
+type AuditKey struct {
+	ID        string `gorm:"primarykey"`
+	Algorithm string
+	PublicKey string
+	CreatedAt time.Time
 }
@@ -0,0 +1,94 @@
+package database
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/MicBun/go-100-coverage-docker-crud/util"
+	"gorm.io/driver/postgres"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+const (
+	DriverSQLite   = "sqlite"
+	DriverPostgres = "postgres"
+)
+
+// Config selects the database backend. DSN is a go-sqlite3 filename or URI
+// for DriverSQLite and a libpq connection string or URL for DriverPostgres.
+type Config struct {
+	Driver            string
+	DSN               string
+	SQLiteWAL         bool
+	SQLiteBusyTimeout time.Duration
+	MaxOpenConns      int
+}
+
+// InMemory is the shared in-memory SQLite database used by tests.
+func InMemory() Config {
+	return Config{
+		Driver: DriverSQLite,
+		DSN:    "file::memory:?cache=shared",
+	}
+}
+
+// ConfigFromEnv reads DB_DRIVER, DB_DSN, DB_MAX_OPEN_CONNS, SQLITE_WAL and
+// SQLITE_BUSY_TIMEOUT_MS. By default users are kept in the data.db SQLite file.
+func ConfigFromEnv() (Config, error) {
+	cfg := Config{
+		Driver: util.GetEnv("DB_DRIVER", DriverSQLite),
+		DSN:    util.GetEnv("DB_DSN", "file:data.db"),
+	}
+	var err error
+	if cfg.MaxOpenConns, err = strconv.Atoi(util.GetEnv("DB_MAX_OPEN_CONNS", "0")); err != nil {
+		return cfg, fmt.Errorf("invalid DB_MAX_OPEN_CONNS: %w", err)
+	}
+	if cfg.SQLiteWAL, err = strconv.ParseBool(util.GetEnv("SQLITE_WAL", "true")); err != nil {
+		return cfg, fmt.Errorf("invalid SQLITE_WAL: %w", err)
+	}
+	busyTimeout, err := strconv.Atoi(util.GetEnv("SQLITE_BUSY_TIMEOUT_MS", "5000"))
+	if err != nil {
+		return cfg, fmt.Errorf("invalid SQLITE_BUSY_TIMEOUT_MS: %w", err)
+	}
+	cfg.SQLiteBusyTimeout = time.Duration(busyTimeout) * time.Millisecond
+	return cfg, nil
+}
+
+func (cfg Config) dialector() (gorm.Dialector, error) {
+	switch cfg.Driver {
+	case DriverSQLite:
+		return sqlite.Open(cfg.sqliteDSN()), nil
+	case DriverPostgres:
+		return postgres.Open(cfg.DSN), nil
+	default:
+		return nil, fmt.Errorf("unsupported database driver %q", cfg.Driver)
+	}
+}
+
+// sqliteDSN appends the journal mode and busy timeout as go-sqlite3 URI
+// parameters. In-memory databases have no journal file so WAL is skipped.
+func (cfg Config) sqliteDSN() string {
+	params := url.Values{}
+	if cfg.SQLiteWAL && !strings.Contains(cfg.DSN, ":memory:") && !strings.Contains(cfg.DSN, "mode=memory") {
+		params.Set("_journal_mode", "WAL")
+	}
+	if cfg.SQLiteBusyTimeout > 0 {
+		params.Set("_busy_timeout", strconv.FormatInt(cfg.SQLiteBusyTimeout.Milliseconds(), 10))
+	}
+	if len(params) == 0 {
+		return cfg.DSN
+	}
+	dsn := cfg.DSN
+	if !strings.HasPrefix(dsn, "file:") {
+		dsn = "file:" + dsn
+	}
+	separator := "?"
+	if strings.Contains(dsn, "?") {
+		separator = "&"
+	}
+	return dsn + separator + params.Encode()
+}
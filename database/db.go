@@ -1,19 +1,36 @@
 package database
 
 import (
-	"github.com/MicBun/go-100-coverage-docker-crud/core"
-
-	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
 )
 
-func Connect() (*gorm.DB, error) {
-	return gorm.Open(sqlite.Open("file::memory:?cache=shared"), &gorm.Config{})
+func Connect(cfg Config) (*gorm.DB, error) {
+	dialector, err := cfg.dialector()
+	if err != nil {
+		return nil, err
+	}
+	db, err := gorm.Open(dialector, &gorm.Config{})
+	if err != nil {
+		return nil, err
+	}
+	if cfg.MaxOpenConns > 0 {
+		sqlDB, err := db.DB()
+		if err != nil {
+			return nil, err
+		}
+		sqlDB.SetMaxOpenConns(cfg.MaxOpenConns)
+	}
+	return db, nil
 }
 
+// Migrate applies every pending migration.
 func Migrate(db *gorm.DB) error {
-	if err := db.AutoMigrate(core.User{}); err != nil {
-		return err
-	}
-	return nil
+	_, err := NewMigrator(db, Migrations).Up()
+	return err
+}
+
+// CheckSchema fails unless every known migration has been applied and the
+// database holds none this binary does not know about.
+func CheckSchema(db *gorm.DB) error {
+	return NewMigrator(db, Migrations).Check()
 }
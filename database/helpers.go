@@ -5,7 +5,7 @@ import "gorm.io/gorm"
 type TestFunc func(*gorm.DB)
 
 func RunTest(testFunc TestFunc) {
-	db, err := Connect()
+	db, err := Connect(InMemory())
 	if err != nil {
 		panic(err)
 	}
@@ -0,0 +1,17 @@
+package database
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gorm.io/gorm"
+)
+
+func TestRunTest(t *testing.T) {
+	ran := false
+	RunTest(func(db *gorm.DB) {
+		ran = true
+		assert.NoError(t, CheckSchema(db))
+	})
+	assert.True(t, ran)
+}
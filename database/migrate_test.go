@@ -0,0 +1,217 @@
+package database
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/MicBun/go-100-coverage-docker-crud/util/jwtAuth"
+
+	"github.com/stretchr/testify/assert"
+	"gorm.io/gorm"
+)
+
+// failStatements lets the number of statements in the returned budget
+// through and makes every later one fail. A negative budget fails nothing.
+func failStatements(t *testing.T, db *gorm.DB) *int {
+	t.Helper()
+	budget := -1
+	fail := func(tx *gorm.DB) {
+		if budget < 0 {
+			return
+		}
+		if budget == 0 {
+			tx.AddError(errors.New("broken"))
+			return
+		}
+		budget--
+	}
+	callbacks := db.Callback()
+	assert.NoError(t, callbacks.Create().Before("*").Register("test:fail_statements", fail))
+	assert.NoError(t, callbacks.Query().Before("*").Register("test:fail_statements", fail))
+	assert.NoError(t, callbacks.Update().Before("*").Register("test:fail_statements", fail))
+	assert.NoError(t, callbacks.Delete().Before("*").Register("test:fail_statements", fail))
+	assert.NoError(t, callbacks.Raw().Before("*").Register("test:fail_statements", fail))
+	return &budget
+}
+
+func TestMigrator(t *testing.T) {
+	db, err := Connect(Config{Driver: DriverSQLite, DSN: filepath.Join(t.TempDir(), "migrate.db")})
+	assert.NoError(t, err)
+
+	type widget struct {
+		ID   uint
+		Name string
+	}
+	migrations := []Migration{
+		SQLMigration(2, "add_widget_name_index",
+			[]string{"CREATE INDEX idx_widgets_name ON widgets (name)"},
+			[]string{"DROP INDEX idx_widgets_name"},
+		),
+		{
+			Version: 1,
+			Name:    "create_widgets",
+			Up:      func(tx *gorm.DB) error { return tx.AutoMigrate(widget{}) },
+			Down:    func(tx *gorm.DB) error { return tx.Migrator().DropTable(widget{}) },
+		},
+	}
+	m := NewMigrator(db, migrations)
+	assert.ErrorIs(t, m.Check(), ErrPendingMigrations)
+
+	done, err := m.Up()
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(done))
+	assert.Equal(t, int64(1), done[0].Version)
+	assert.NoError(t, m.Check())
+	assert.True(t, db.Migrator().HasIndex(widget{}, "idx_widgets_name"))
+
+	done, err = m.Up()
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(done))
+
+	done, err = m.Down(1)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(done))
+	assert.Equal(t, int64(2), done[0].Version)
+	assert.False(t, db.Migrator().HasIndex(widget{}, "idx_widgets_name"))
+	assert.ErrorIs(t, m.Check(), ErrPendingMigrations)
+
+	status, err := m.Status()
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(status))
+	assert.NotNil(t, status[0].AppliedAt)
+	assert.Nil(t, status[1].AppliedAt)
+
+	older := NewMigrator(db, migrations[1:])
+	assert.NoError(t, older.Check())
+	_, err = m.Up()
+	assert.NoError(t, err)
+	assert.ErrorIs(t, older.Check(), ErrSchemaTooNew)
+	status, err = older.Status()
+	assert.NoError(t, err)
+	assert.True(t, status[1].Unknown)
+
+	broken := NewMigrator(db, append(migrations, SQLMigration(3, "broken", []string{"CREATE TABLE widgets (id int)"}, nil)))
+	_, err = broken.Up()
+	assert.Error(t, err)
+	assert.ErrorIs(t, broken.Check(), ErrPendingMigrations)
+
+	irreversible := NewMigrator(db, append(migrations, Migration{Version: 3, Name: "irreversible", Up: func(*gorm.DB) error { return nil }}))
+	_, err = irreversible.Up()
+	assert.NoError(t, err)
+	_, err = irreversible.Down(1)
+	assert.Error(t, err)
+
+	failing := NewMigrator(db, append(migrations, Migration{
+		Version: 3,
+		Name:    "failing",
+		Up:      func(*gorm.DB) error { return nil },
+		Down:    func(*gorm.DB) error { return errors.New("broken") },
+	}))
+	_, err = failing.Down(1)
+	assert.Error(t, err)
+	assert.NoError(t, db.Delete(&schemaMigration{}, 3).Error)
+
+	// Versions that are not applied are skipped on the way down.
+	done, err = m.Down(1)
+	assert.NoError(t, err)
+	done, err = m.Down(1)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), done[0].Version)
+	assert.False(t, db.Migrator().HasTable(widget{}))
+
+	budget := failStatements(t, db)
+	*budget = 0
+	assert.Error(t, m.Check())
+}
+
+func TestMigrations(t *testing.T) {
+	db, err := Connect(Config{Driver: DriverSQLite, DSN: filepath.Join(t.TempDir(), "users.db")})
+	assert.NoError(t, err)
+	assert.ErrorIs(t, CheckSchema(db), ErrPendingMigrations)
+	assert.NoError(t, Migrate(db))
+	assert.NoError(t, CheckSchema(db))
+
+	m := NewMigrator(db, Migrations)
+	done, err := m.Down(len(Migrations))
+	assert.NoError(t, err)
+	assert.Equal(t, len(Migrations), len(done))
+	assert.False(t, db.Migrator().HasTable("users"))
+
+	assert.NoError(t, Migrate(db))
+	assert.NoError(t, CheckSchema(db))
+
+	// Rolling back keeps the indexes of the tables that remain.
+	_, err = m.Down(len(Migrations) - 14)
+	assert.NoError(t, err)
+	assert.True(t, db.Migrator().HasIndex("users", "idx_users_username"))
+	assert.NoError(t, Migrate(db))
+}
+
+// TestMigrationFailures fails every statement of every migration in turn and
+// checks that the migration is rolled back and can be retried.
+func TestMigrationFailures(t *testing.T) {
+	db, err := Connect(Config{Driver: DriverSQLite, DSN: filepath.Join(t.TempDir(), "failures.db")})
+	assert.NoError(t, err)
+
+	budget := failStatements(t, db)
+	for i, migration := range Migrations {
+		m := NewMigrator(db, Migrations[:i+1])
+		for n := 0; ; n++ {
+			*budget = n
+			_, err := m.Up()
+			*budget = -1
+			if err == nil {
+				break
+			}
+			assert.ErrorIs(t, m.Check(), ErrPendingMigrations, "version %d", migration.Version)
+		}
+		for n := 0; ; n++ {
+			*budget = n
+			_, err := m.Down(1)
+			*budget = -1
+			if err == nil {
+				break
+			}
+			assert.NoError(t, m.Check(), "version %d", migration.Version)
+		}
+		_, err := m.Up()
+		assert.NoError(t, err)
+
+		if migration.Version == 8 {
+			// Give the audit keys backfill a key to copy.
+			key, err := jwtAuth.GenerateKey(jwtAuth.AlgEdDSA)
+			assert.NoError(t, err)
+			private, err := jwtAuth.EncodePrivateKey(key)
+			assert.NoError(t, err)
+			assert.NoError(t, db.Create(&v8SigningKey{ID: key.ID, Algorithm: key.Algorithm, PrivateKey: private}).Error)
+		}
+	}
+	assert.NoError(t, CheckSchema(db))
+}
+
+func TestAuditKeysMigration(t *testing.T) {
+	db, err := Connect(Config{Driver: DriverSQLite, DSN: filepath.Join(t.TempDir(), "keys.db")})
+	assert.NoError(t, err)
+	_, err = NewMigrator(db, Migrations[:21]).Up()
+	assert.NoError(t, err)
+
+	key, err := jwtAuth.GenerateKey(jwtAuth.AlgES256)
+	assert.NoError(t, err)
+	private, err := jwtAuth.EncodePrivateKey(key)
+	assert.NoError(t, err)
+	assert.NoError(t, db.Create(&v8SigningKey{ID: key.ID, Algorithm: key.Algorithm, PrivateKey: private}).Error)
+
+	// The keys that may have signed earlier checkpoints are kept.
+	assert.NoError(t, Migrate(db))
+	var stored v22AuditKey
+	assert.NoError(t, db.First(&stored).Error)
+	public, err := jwtAuth.DecodePublicKey(stored.ID, stored.Algorithm, stored.PublicKey)
+	assert.NoError(t, err)
+	assert.Equal(t, key.Private.Public(), public.Public)
+
+	_, err = NewMigrator(db, Migrations).Down(1)
+	assert.NoError(t, err)
+	assert.NoError(t, db.Model(&v8SigningKey{}).Where("1 = 1").Update("private_key", "garbage").Error)
+	assert.Error(t, Migrate(db))
+}
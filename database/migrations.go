@@ -0,0 +1,493 @@
+package database
+
+import (
+	"time"
+
+	"github.com/MicBun/go-100-coverage-docker-crud/core"
+	"github.com/MicBun/go-100-coverage-docker-crud/util/jwtAuth"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Migrations is the ordered schema history. Append new entries with the next
+// version; never edit or reorder one that has been released. Migrations use
+// their own snapshot structs instead of the core models so that later model
+// changes do not alter what an old migration does.
+var Migrations = []Migration{
+	{
+		Version: 1,
+		Name:    "create_users_and_roles",
+		Up: func(tx *gorm.DB) error {
+			return tx.AutoMigrate(v1User{}, v1Role{}, v1Permission{}, v1UserRole{}, v1RolePermission{})
+		},
+		Down: func(tx *gorm.DB) error {
+			return tx.Migrator().DropTable(v1RolePermission{}, v1UserRole{}, v1Permission{}, v1Role{}, v1User{})
+		},
+	},
+	{
+		Version: 2,
+		Name:    "seed_default_roles",
+		Up: func(tx *gorm.DB) error {
+			if err := grantPermissions(tx, core.RoleAdmin,
+				core.PermUsersRead, core.PermUsersWrite, core.PermUsersDelete,
+				core.PermRolesRead, core.PermRolesWrite, core.PermProfileRead,
+			); err != nil {
+				return err
+			}
+			return grantPermissions(tx, core.RoleUser, core.PermProfileRead)
+		},
+		Down: func(tx *gorm.DB) error {
+			if err := dropPermissions(tx,
+				core.PermUsersRead, core.PermUsersWrite, core.PermUsersDelete,
+				core.PermRolesRead, core.PermRolesWrite, core.PermProfileRead,
+			); err != nil {
+				return err
+			}
+			return tx.Where("name IN ?", []string{core.RoleAdmin, core.RoleUser}).Delete(&v1Role{}).Error
+		},
+	},
+	{
+		Version: 3,
+		Name:    "create_refresh_tokens",
+		Up: func(tx *gorm.DB) error {
+			return tx.AutoMigrate(v3RefreshToken{})
+		},
+		Down: func(tx *gorm.DB) error {
+			return tx.Migrator().DropTable(v3RefreshToken{})
+		},
+	},
+	SQLMigration(4, "drop_users_token",
+		[]string{"ALTER TABLE users DROP COLUMN token"},
+		[]string{"ALTER TABLE users ADD COLUMN token text"},
+	),
+	{
+		// Refresh token families become sessions. Outstanding refresh tokens
+		// cannot be mapped to a session and are dropped, so those users log
+		// in again.
+		Version: 5,
+		Name:    "create_sessions",
+		Up: func(tx *gorm.DB) error {
+			if err := tx.Migrator().DropTable(v3RefreshToken{}); err != nil {
+				return err
+			}
+			return tx.AutoMigrate(v5Session{}, v5RefreshToken{})
+		},
+		Down: func(tx *gorm.DB) error {
+			if err := tx.Migrator().DropTable(v5RefreshToken{}, v5Session{}); err != nil {
+				return err
+			}
+			return tx.AutoMigrate(v3RefreshToken{})
+		},
+	},
+	{
+		Version: 6,
+		Name:    "grant_admin_sessions",
+		Up: func(tx *gorm.DB) error {
+			return grantPermissions(tx, core.RoleAdmin, core.PermSessionsRead, core.PermSessionsWrite)
+		},
+		Down: func(tx *gorm.DB) error {
+			return dropPermissions(tx, core.PermSessionsRead, core.PermSessionsWrite)
+		},
+	},
+	{
+		Version: 7,
+		Name:    "create_revoked_tokens",
+		Up: func(tx *gorm.DB) error {
+			return tx.AutoMigrate(v7RevokedToken{})
+		},
+		Down: func(tx *gorm.DB) error {
+			return tx.Migrator().DropTable(v7RevokedToken{})
+		},
+	},
+	{
+		Version: 8,
+		Name:    "create_signing_keys",
+		Up: func(tx *gorm.DB) error {
+			return tx.AutoMigrate(v8SigningKey{})
+		},
+		Down: func(tx *gorm.DB) error {
+			return tx.Migrator().DropTable(v8SigningKey{})
+		},
+	},
+	{
+		Version: 9,
+		Name:    "create_mfa",
+		Up: func(tx *gorm.DB) error {
+			return tx.AutoMigrate(v9UserMFA{}, v9RecoveryCode{})
+		},
+		Down: func(tx *gorm.DB) error {
+			return tx.Migrator().DropTable(v9UserMFA{}, v9RecoveryCode{})
+		},
+	},
+	{
+		Version: 10,
+		Name:    "grant_admin_mfa",
+		Up: func(tx *gorm.DB) error {
+			return grantPermissions(tx, core.RoleAdmin, core.PermMFAWrite)
+		},
+		Down: func(tx *gorm.DB) error {
+			return dropPermissions(tx, core.PermMFAWrite)
+		},
+	},
+	{
+		Version: 11,
+		Name:    "create_password_resets",
+		Up: func(tx *gorm.DB) error {
+			return tx.AutoMigrate(v11PasswordReset{})
+		},
+		Down: func(tx *gorm.DB) error {
+			return tx.Migrator().DropTable(v11PasswordReset{})
+		},
+	},
+	{
+		Version: 12,
+		Name:    "grant_profile_write",
+		Up: func(tx *gorm.DB) error {
+			if err := grantPermissions(tx, core.RoleAdmin, core.PermProfileWrite); err != nil {
+				return err
+			}
+			return grantPermissions(tx, core.RoleUser, core.PermProfileWrite)
+		},
+		Down: func(tx *gorm.DB) error {
+			return dropPermissions(tx, core.PermProfileWrite)
+		},
+	},
+	SQLMigration(13, "add_users_status",
+		[]string{"ALTER TABLE users ADD COLUMN status text NOT NULL DEFAULT 'active'"},
+		[]string{"ALTER TABLE users DROP COLUMN status"},
+	),
+	{
+		Version: 14,
+		Name:    "create_email_verifications",
+		Up: func(tx *gorm.DB) error {
+			return tx.AutoMigrate(v14EmailVerification{})
+		},
+		Down: func(tx *gorm.DB) error {
+			return tx.Migrator().DropTable(v14EmailVerification{})
+		},
+	},
+	{
+		Version: 15,
+		Name:    "add_users_status_reason",
+		Up: func(tx *gorm.DB) error {
+			for _, column := range []string{"StatusReason", "StatusChangedAt"} {
+				if err := tx.Migrator().AddColumn(&v15User{}, column); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+		// The sqlite driver drops a column by copying the table, which loses
+		// its indexes, so the columns are dropped in plain SQL.
+		Down: func(tx *gorm.DB) error {
+			for _, column := range []string{"status_reason", "status_changed_at"} {
+				if err := tx.Exec("ALTER TABLE users DROP COLUMN " + column).Error; err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	},
+	SQLMigration(16, "users_username_unique_when_live",
+		[]string{
+			"DROP INDEX idx_users_username",
+			"CREATE UNIQUE INDEX idx_users_username ON users (username) WHERE deleted_at IS NULL",
+		},
+		[]string{
+			"DROP INDEX idx_users_username",
+			"CREATE UNIQUE INDEX idx_users_username ON users (username)",
+		},
+	),
+	{
+		Version: 17,
+		Name:    "create_audit_events",
+		Up: func(tx *gorm.DB) error {
+			return tx.AutoMigrate(v17AuditEvent{})
+		},
+		Down: func(tx *gorm.DB) error {
+			return tx.Migrator().DropTable(v17AuditEvent{})
+		},
+	},
+	{
+		Version: 18,
+		Name:    "grant_admin_audit",
+		Up: func(tx *gorm.DB) error {
+			return grantPermissions(tx, core.RoleAdmin, core.PermAuditRead)
+		},
+		Down: func(tx *gorm.DB) error {
+			return dropPermissions(tx, core.PermAuditRead)
+		},
+	},
+	// Events recorded before this migration keep empty hashes; the chain
+	// starts with the first event recorded after it.
+	SQLMigration(19, "chain_audit_events",
+		[]string{
+			"ALTER TABLE audit_events ADD COLUMN prev_hash text NOT NULL DEFAULT ''",
+			"ALTER TABLE audit_events ADD COLUMN hash text NOT NULL DEFAULT ''",
+			"CREATE UNIQUE INDEX idx_audit_events_prev_hash ON audit_events (prev_hash) WHERE prev_hash <> ''",
+		},
+		[]string{
+			"DROP INDEX idx_audit_events_prev_hash",
+			"ALTER TABLE audit_events DROP COLUMN hash",
+			"ALTER TABLE audit_events DROP COLUMN prev_hash",
+		},
+	),
+	{
+		Version: 20,
+		Name:    "create_audit_checkpoints",
+		Up: func(tx *gorm.DB) error {
+			return tx.AutoMigrate(v20AuditCheckpoint{})
+		},
+		Down: func(tx *gorm.DB) error {
+			return tx.Migrator().DropTable(v20AuditCheckpoint{})
+		},
+	},
+	SQLMigration(21, "add_users_version",
+		[]string{"ALTER TABLE users ADD COLUMN version integer NOT NULL DEFAULT 1"},
+		[]string{"ALTER TABLE users DROP COLUMN version"},
+	),
+	{
+		Version: 22,
+		Name:    "create_audit_keys",
+		Up: func(tx *gorm.DB) error {
+			if err := tx.AutoMigrate(v22AuditKey{}); err != nil {
+				return err
+			}
+			// Checkpoints so far were signed with one of the stored keys.
+			var rows []v8SigningKey
+			if err := tx.Find(&rows).Error; err != nil {
+				return err
+			}
+			for _, row := range rows {
+				key, err := jwtAuth.DecodePrivateKey(row.ID, row.Algorithm, row.PrivateKey)
+				if err != nil {
+					return err
+				}
+				public, err := jwtAuth.EncodePublicKey(key)
+				if err != nil {
+					return err
+				}
+				err = tx.Create(&v22AuditKey{ID: row.ID, Algorithm: row.Algorithm, PublicKey: public, CreatedAt: row.CreatedAt}).Error
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+		Down: func(tx *gorm.DB) error {
+			return tx.Migrator().DropTable(v22AuditKey{})
+		},
+	},
+}
+
+type v1User struct {
+	gorm.Model
+	Username string `gorm:"uniqueIndex"`
+	Password string
+	Name     string
+	Token    string
+}
+
+func (v1User) TableName() string { return "users" }
+
+type v1Role struct {
+	ID   uint   `gorm:"primarykey"`
+	Name string `gorm:"uniqueIndex"`
+}
+
+func (v1Role) TableName() string { return "roles" }
+
+type v1Permission struct {
+	ID   uint   `gorm:"primarykey"`
+	Name string `gorm:"uniqueIndex"`
+}
+
+func (v1Permission) TableName() string { return "permissions" }
+
+type v1UserRole struct {
+	UserID uint `gorm:"primaryKey"`
+	RoleID uint `gorm:"primaryKey"`
+}
+
+func (v1UserRole) TableName() string { return "user_roles" }
+
+type v1RolePermission struct {
+	RoleID       uint `gorm:"primaryKey"`
+	PermissionID uint `gorm:"primaryKey"`
+}
+
+func (v1RolePermission) TableName() string { return "role_permissions" }
+
+type v3RefreshToken struct {
+	ID        uint `gorm:"primarykey"`
+	CreatedAt time.Time
+	UserID    uint   `gorm:"index"`
+	FamilyID  string `gorm:"index"`
+	TokenHash string `gorm:"uniqueIndex"`
+	ExpiresAt time.Time
+	UsedAt    *time.Time
+	RevokedAt *time.Time
+}
+
+func (v3RefreshToken) TableName() string { return "refresh_tokens" }
+
+type v5Session struct {
+	ID         uint `gorm:"primarykey"`
+	CreatedAt  time.Time
+	UserID     uint `gorm:"index"`
+	UserAgent  string
+	IP         string
+	LastSeenAt time.Time
+	ExpiresAt  time.Time
+	RevokedAt  *time.Time
+}
+
+func (v5Session) TableName() string { return "sessions" }
+
+type v5RefreshToken struct {
+	ID        uint `gorm:"primarykey"`
+	CreatedAt time.Time
+	UserID    uint   `gorm:"index"`
+	SessionID uint   `gorm:"index"`
+	TokenHash string `gorm:"uniqueIndex"`
+	ExpiresAt time.Time
+	UsedAt    *time.Time
+	RevokedAt *time.Time
+}
+
+func (v5RefreshToken) TableName() string { return "refresh_tokens" }
+
+type v7RevokedToken struct {
+	JTI       string `gorm:"primarykey"`
+	CreatedAt time.Time
+	ExpiresAt time.Time `gorm:"index"`
+}
+
+func (v7RevokedToken) TableName() string { return "revoked_tokens" }
+
+type v8SigningKey struct {
+	ID         string `gorm:"primarykey"`
+	Algorithm  string
+	PrivateKey string
+	CreatedAt  time.Time `gorm:"index"`
+	RetiredAt  *time.Time
+}
+
+func (v8SigningKey) TableName() string { return "signing_keys" }
+
+type v9UserMFA struct {
+	UserID      uint `gorm:"primarykey;autoIncrement:false"`
+	Secret      string
+	CreatedAt   time.Time
+	ConfirmedAt *time.Time
+	LastStep    int64
+}
+
+func (v9UserMFA) TableName() string { return "user_mfas" }
+
+type v9RecoveryCode struct {
+	ID        uint `gorm:"primarykey"`
+	CreatedAt time.Time
+	UserID    uint   `gorm:"index"`
+	CodeHash  string `gorm:"uniqueIndex"`
+	UsedAt    *time.Time
+}
+
+func (v9RecoveryCode) TableName() string { return "recovery_codes" }
+
+type v11PasswordReset struct {
+	ID        uint `gorm:"primarykey"`
+	CreatedAt time.Time
+	UserID    uint   `gorm:"index"`
+	TokenHash string `gorm:"uniqueIndex"`
+	ExpiresAt time.Time
+	UsedAt    *time.Time
+}
+
+func (v11PasswordReset) TableName() string { return "password_resets" }
+
+type v14EmailVerification struct {
+	ID        uint `gorm:"primarykey"`
+	CreatedAt time.Time
+	UserID    uint   `gorm:"index"`
+	TokenHash string `gorm:"uniqueIndex"`
+	ExpiresAt time.Time
+	UsedAt    *time.Time
+}
+
+func (v14EmailVerification) TableName() string { return "email_verifications" }
+
+// v15User only lists the columns added by migration 15.
+type v15User struct {
+	StatusReason    string `gorm:"not null;default:''"`
+	StatusChangedAt *time.Time
+}
+
+func (v15User) TableName() string { return "users" }
+
+type v17AuditEvent struct {
+	ID         uint      `gorm:"primarykey"`
+	CreatedAt  time.Time `gorm:"index"`
+	ActorID    *uint     `gorm:"index"`
+	Action     string    `gorm:"index"`
+	TargetType string
+	TargetID   string `gorm:"index"`
+	Status     int
+	Before     string
+	After      string
+	IP         string
+	UserAgent  string
+	RequestID  string `gorm:"index"`
+}
+
+func (v17AuditEvent) TableName() string { return "audit_events" }
+
+type v20AuditCheckpoint struct {
+	ID        uint `gorm:"primarykey"`
+	CreatedAt time.Time
+	EventID   uint `gorm:"index"`
+	Hash      string
+	Signature string
+}
+
+func (v20AuditCheckpoint) TableName() string { return "audit_checkpoints" }
+
+type v22AuditKey struct {
+	ID        string `gorm:"primarykey"`
+	Algorithm string
+	PublicKey string
+	CreatedAt time.Time
+}
+
+func (v22AuditKey) TableName() string { return "audit_keys" }
+
+// grantPermissions creates the role and permissions if needed and attaches
+// the permissions to the role. Data migrations use it to extend defaults.
+func grantPermissions(tx *gorm.DB, roleName string, permissionNames ...string) error {
+	role := v1Role{Name: roleName}
+	if err := tx.Where(v1Role{Name: roleName}).FirstOrCreate(&role).Error; err != nil {
+		return err
+	}
+	for _, name := range permissionNames {
+		permission := v1Permission{Name: name}
+		if err := tx.Where(v1Permission{Name: name}).FirstOrCreate(&permission).Error; err != nil {
+			return err
+		}
+		err := tx.Clauses(clause.OnConflict{DoNothing: true}).
+			Create(&v1RolePermission{RoleID: role.ID, PermissionID: permission.ID}).Error
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// dropPermissions removes permissions and detaches them from every role.
+func dropPermissions(tx *gorm.DB, permissionNames ...string) error {
+	ids := tx.Model(&v1Permission{}).Select("id").Where("name IN ?", permissionNames)
+	if err := tx.Where("permission_id IN (?)", ids).Delete(&v1RolePermission{}).Error; err != nil {
+		return err
+	}
+	return tx.Where("name IN ?", permissionNames).Delete(&v1Permission{}).Error
+}
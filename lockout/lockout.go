@@ -0,0 +1,238 @@
+package lockout
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/MicBun/go-100-coverage-docker-crud/apperr"
+	"github.com/MicBun/go-100-coverage-docker-crud/util"
+)
+
+var (
+	ErrAccountLocked   = apperr.New(apperr.Locked, "account_locked", "account is temporarily locked after too many failed logins")
+	ErrTooManyAttempts = apperr.New(apperr.TooManyRequests, "too_many_attempts", "too many failed logins, slow down")
+)
+
+// RetryError rejects a login attempt until RetryAfter has passed. It wraps
+// ErrAccountLocked or ErrTooManyAttempts.
+type RetryError struct {
+	Err        error
+	RetryAfter time.Duration
+}
+
+func (e *RetryError) Error() string {
+	return fmt.Sprintf("%v, retry in %s", e.Err, e.RetryAfter.Round(time.Second))
+}
+
+func (e *RetryError) Unwrap() error {
+	return e.Err
+}
+
+// Policy configures when failed logins slow down and lock out. Failures are
+// forgotten after Window without another failure.
+type Policy struct {
+	// MaxAccountFailures locks the account for LockDuration, for the client
+	// IP that failed.
+	MaxAccountFailures int
+	// MaxUsernameFailures locks the account for LockDuration from every IP,
+	// so rotating addresses doesn't give a fresh budget. It should be well
+	// above MaxAccountFailures, since anyone can use it to lock the owner out.
+	MaxUsernameFailures int
+	// MaxIPFailures blocks the client IP for LockDuration, across accounts.
+	MaxIPFailures int
+	Window        time.Duration
+	LockDuration  time.Duration
+	// From the second consecutive failure of an account on, its next attempt
+	// has to wait BaseDelay, doubling with every further failure up to
+	// MaxDelay. IPs are only limited by MaxIPFailures, since many users may
+	// share one.
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+}
+
+func (p Policy) delay(failures int) time.Duration {
+	if failures < 2 || p.BaseDelay <= 0 {
+		return 0
+	}
+	d := p.BaseDelay
+	for i := 2; i < failures && d < p.MaxDelay; i++ {
+		d *= 2
+	}
+	if d > p.MaxDelay {
+		d = p.MaxDelay
+	}
+	return d
+}
+
+type record struct {
+	failures    int
+	last        time.Time
+	lockedUntil time.Time
+}
+
+// Lockout tracks failed logins in memory. Each instance keeps its own
+// counters, so with several instances the limits apply per instance.
+//
+// Account failures are counted per username and client IP, so guessing from
+// one address can't lock the owner out from another, and usernames that
+// don't exist behave like ones that do. A higher limit per username across
+// IPs caps guessing from many addresses, and the IP limit caps how many
+// accounts one address can try.
+type Lockout struct {
+	policy Policy
+	now    func() time.Time
+
+	mu        sync.Mutex
+	accounts  map[string]*record
+	usernames map[string]*record
+	ips       map[string]*record
+}
+
+type LockoutInterface interface {
+	// Check returns a *RetryError when the attempt must be rejected without
+	// looking at the password.
+	Check(username, ip string) error
+	Fail(username, ip string)
+	// Succeed clears the failures of the account from ip. Failures of the IP
+	// and of the username across IPs are kept, so logging in doesn't reset a
+	// guessing run.
+	Succeed(username, ip string)
+	// Unlock clears the failures of the account from every IP.
+	Unlock(username string)
+	// Prune forgets records that no longer affect any attempt.
+	Prune()
+}
+
+func NewLockout(policy Policy) LockoutInterface {
+	return &Lockout{
+		policy:    policy,
+		now:       time.Now,
+		accounts:  map[string]*record{},
+		usernames: map[string]*record{},
+		ips:       map[string]*record{},
+	}
+}
+
+// accountKey separates usernames and IPs with a byte neither contains.
+func accountKey(username, ip string) string {
+	return username + "\x00" + ip
+}
+
+// current returns the record for key, forgetting failures that fell out of
+// the window.
+func (l *Lockout) current(records map[string]*record, key string, now time.Time) *record {
+	r, ok := records[key]
+	if !ok {
+		r = &record{}
+		records[key] = r
+	}
+	if r.failures > 0 && now.Sub(r.last) > l.policy.Window {
+		r.failures = 0
+	}
+	return r
+}
+
+func (l *Lockout) Check(username, ip string) error {
+	now := l.now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	account := l.current(l.accounts, accountKey(username, ip), now)
+	if now.Before(account.lockedUntil) {
+		return &RetryError{Err: ErrAccountLocked, RetryAfter: account.lockedUntil.Sub(now)}
+	}
+	if user := l.current(l.usernames, username, now); now.Before(user.lockedUntil) {
+		return &RetryError{Err: ErrAccountLocked, RetryAfter: user.lockedUntil.Sub(now)}
+	}
+	client := l.current(l.ips, ip, now)
+	if now.Before(client.lockedUntil) {
+		return &RetryError{Err: ErrTooManyAttempts, RetryAfter: client.lockedUntil.Sub(now)}
+	}
+	if next := account.last.Add(l.policy.delay(account.failures)); now.Before(next) {
+		return &RetryError{Err: ErrTooManyAttempts, RetryAfter: next.Sub(now)}
+	}
+	return nil
+}
+
+func (l *Lockout) Fail(username, ip string) {
+	now := l.now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for _, fail := range []struct {
+		r   *record
+		max int
+	}{
+		{l.current(l.accounts, accountKey(username, ip), now), l.policy.MaxAccountFailures},
+		{l.current(l.usernames, username, now), l.policy.MaxUsernameFailures},
+		{l.current(l.ips, ip, now), l.policy.MaxIPFailures},
+	} {
+		fail.r.failures++
+		fail.r.last = now
+		if fail.max > 0 && fail.r.failures >= fail.max {
+			fail.r.failures = 0
+			fail.r.lockedUntil = now.Add(l.policy.LockDuration)
+		}
+	}
+}
+
+func (l *Lockout) Succeed(username, ip string) {
+	key := accountKey(username, ip)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if r, ok := l.accounts[key]; ok && !l.now().Before(r.lockedUntil) {
+		delete(l.accounts, key)
+	}
+}
+
+func (l *Lockout) Unlock(username string) {
+	prefix := accountKey(username, "")
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.usernames, username)
+	for key := range l.accounts {
+		if strings.HasPrefix(key, prefix) {
+			delete(l.accounts, key)
+		}
+	}
+}
+
+func (l *Lockout) Prune() {
+	now := l.now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, records := range []map[string]*record{l.accounts, l.usernames, l.ips} {
+		for key, r := range records {
+			if now.Sub(r.last) > l.policy.Window && !now.Before(r.lockedUntil) {
+				delete(records, key)
+			}
+		}
+	}
+}
+
+// PolicyFromEnv reads the policy from LOCKOUT_* and LOGIN_DELAY_* variables.
+func PolicyFromEnv() (Policy, error) {
+	var p Policy
+	for _, setting := range []struct {
+		name, fallback string
+		set            func(int)
+	}{
+		{"LOCKOUT_ACCOUNT_FAILURES", "5", func(v int) { p.MaxAccountFailures = v }},
+		{"LOCKOUT_USERNAME_FAILURES", "50", func(v int) { p.MaxUsernameFailures = v }},
+		{"LOCKOUT_IP_FAILURES", "20", func(v int) { p.MaxIPFailures = v }},
+		{"LOCKOUT_WINDOW_MINUTES", "15", func(v int) { p.Window = time.Duration(v) * time.Minute }},
+		{"LOCKOUT_MINUTES", "15", func(v int) { p.LockDuration = time.Duration(v) * time.Minute }},
+		{"LOGIN_DELAY_BASE_MS", "1000", func(v int) { p.BaseDelay = time.Duration(v) * time.Millisecond }},
+		{"LOGIN_DELAY_MAX_MS", "30000", func(v int) { p.MaxDelay = time.Duration(v) * time.Millisecond }},
+	} {
+		value, err := strconv.Atoi(util.GetEnv(setting.name, setting.fallback))
+		if err != nil {
+			return p, fmt.Errorf("invalid %s: %w", setting.name, err)
+		}
+		setting.set(value)
+	}
+	return p, nil
+}
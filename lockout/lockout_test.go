@@ -0,0 +1,178 @@
+package lockout
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var testPolicy = Policy{
+	MaxAccountFailures:  4,
+	MaxUsernameFailures: 8,
+	MaxIPFailures:       6,
+	Window:              10 * time.Minute,
+	LockDuration:        15 * time.Minute,
+	BaseDelay:           time.Second,
+	MaxDelay:            3 * time.Second,
+}
+
+func newTestLockout(now *time.Time) *Lockout {
+	l := NewLockout(testPolicy).(*Lockout)
+	l.now = func() time.Time { return *now }
+	return l
+}
+
+func retryAfter(t *testing.T, err error, target error) time.Duration {
+	t.Helper()
+	var retry *RetryError
+	if !assert.True(t, errors.As(err, &retry)) {
+		return 0
+	}
+	assert.ErrorIs(t, err, target)
+	return retry.RetryAfter
+}
+
+func TestProgressiveDelayAndLock(t *testing.T) {
+	now := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	l := newTestLockout(&now)
+
+	assert.NoError(t, l.Check("foo", "1.1.1.1"))
+	l.Fail("foo", "1.1.1.1")
+	assert.NoError(t, l.Check("foo", "1.1.1.1"))
+
+	l.Fail("foo", "1.1.1.1")
+	assert.Equal(t, time.Second, retryAfter(t, l.Check("foo", "1.1.1.1"), ErrTooManyAttempts))
+	// The delay stays with the account and IP that failed.
+	assert.NoError(t, l.Check("foo", "2.2.2.2"))
+	assert.NoError(t, l.Check("bar", "1.1.1.1"))
+
+	now = now.Add(time.Second)
+	assert.NoError(t, l.Check("foo", "1.1.1.1"))
+	l.Fail("foo", "1.1.1.1")
+	assert.Equal(t, 2*time.Second, retryAfter(t, l.Check("foo", "1.1.1.1"), ErrTooManyAttempts))
+
+	now = now.Add(2 * time.Second)
+	l.Fail("foo", "1.1.1.1")
+	assert.Equal(t, 15*time.Minute, retryAfter(t, l.Check("foo", "1.1.1.1"), ErrAccountLocked))
+	// A correct password doesn't help while locked, but the owner can still
+	// log in from elsewhere.
+	l.Succeed("foo", "1.1.1.1")
+	assert.ErrorIs(t, l.Check("foo", "1.1.1.1"), ErrAccountLocked)
+	assert.NoError(t, l.Check("foo", "2.2.2.2"))
+
+	now = now.Add(15 * time.Minute)
+	assert.NoError(t, l.Check("foo", "1.1.1.1"))
+	l.Fail("foo", "1.1.1.1")
+	assert.NoError(t, l.Check("foo", "1.1.1.1"))
+}
+
+func TestWindowSuccessAndUnlock(t *testing.T) {
+	now := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	l := newTestLockout(&now)
+
+	l.Fail("foo", "1.1.1.1")
+	l.Fail("foo", "1.1.1.1")
+	now = now.Add(11 * time.Minute)
+	assert.NoError(t, l.Check("foo", "1.1.1.1"))
+	l.Fail("foo", "1.1.1.1")
+	assert.NoError(t, l.Check("foo", "1.1.1.1"))
+
+	l.Succeed("foo", "1.1.1.1")
+	l.Fail("foo", "1.1.1.1")
+	assert.NoError(t, l.Check("foo", "1.1.1.1"))
+
+	for i := 0; i < 3; i++ {
+		now = now.Add(time.Minute)
+		l.Fail("foo", "1.1.1.1")
+		l.Fail("foo", "3.3.3.3")
+	}
+	l.Fail("foo", "3.3.3.3")
+	assert.ErrorIs(t, l.Check("foo", "1.1.1.1"), ErrAccountLocked)
+	assert.ErrorIs(t, l.Check("foo", "3.3.3.3"), ErrAccountLocked)
+	// Usernames that don't exist are counted the same way.
+	l.Fail("foobar", "4.4.4.4")
+	l.Fail("foobar", "4.4.4.4")
+	assert.ErrorIs(t, l.Check("foobar", "4.4.4.4"), ErrTooManyAttempts)
+	// Unlocking clears the account from every IP, and only that account.
+	l.Unlock("foo")
+	assert.NoError(t, l.Check("foo", "1.1.1.1"))
+	assert.NoError(t, l.Check("foo", "3.3.3.3"))
+	assert.Error(t, l.Check("foobar", "4.4.4.4"))
+}
+
+func TestIPLimit(t *testing.T) {
+	now := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	l := newTestLockout(&now)
+
+	// Spraying one password across accounts trips the IP limit.
+	for _, username := range []string{"a", "b", "c", "d", "e"} {
+		assert.NoError(t, l.Check(username, "1.1.1.1"))
+		l.Fail(username, "1.1.1.1")
+	}
+	l.Succeed("a", "1.1.1.1")
+	l.Fail("f", "1.1.1.1")
+	assert.Equal(t, 15*time.Minute, retryAfter(t, l.Check("g", "1.1.1.1"), ErrTooManyAttempts))
+	assert.NoError(t, l.Check("g", "2.2.2.2"))
+
+	// Unlocking an account doesn't lift the IP block.
+	l.Unlock("g")
+	assert.Error(t, l.Check("g", "1.1.1.1"))
+
+	now = now.Add(16 * time.Minute)
+	l.Prune()
+	assert.Empty(t, l.accounts)
+	assert.Empty(t, l.ips)
+	assert.NoError(t, l.Check("g", "1.1.1.1"))
+}
+
+func TestUsernameLimit(t *testing.T) {
+	now := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	l := newTestLockout(&now)
+
+	// Rotating addresses doesn't give the account a fresh budget.
+	for i := 0; i < 7; i++ {
+		ip := fmt.Sprintf("10.0.0.%d", i)
+		assert.NoError(t, l.Check("foo", ip))
+		l.Fail("foo", ip)
+		l.Succeed("foo", ip)
+	}
+	assert.NoError(t, l.Check("foo", "10.0.1.0"))
+	l.Fail("foo", "10.0.1.0")
+	assert.Equal(t, 15*time.Minute, retryAfter(t, l.Check("foo", "10.0.2.0"), ErrAccountLocked))
+	assert.NoError(t, l.Check("bar", "10.0.2.0"))
+
+	l.Unlock("foo")
+	assert.NoError(t, l.Check("foo", "10.0.2.0"))
+
+	l.Fail("foo", "10.0.2.0")
+	now = now.Add(11 * time.Minute)
+	l.Prune()
+	assert.Empty(t, l.usernames)
+}
+
+func TestPolicyFromEnv(t *testing.T) {
+	policy, err := PolicyFromEnv()
+	assert.NoError(t, err)
+	assert.Equal(t, 5, policy.MaxAccountFailures)
+	assert.Equal(t, 50, policy.MaxUsernameFailures)
+	assert.Equal(t, 15*time.Minute, policy.LockDuration)
+	assert.Equal(t, 30*time.Second, policy.MaxDelay)
+
+	t.Setenv("LOCKOUT_MINUTES", "soon")
+	_, err = PolicyFromEnv()
+	assert.Error(t, err)
+}
+
+func TestDelay(t *testing.T) {
+	p := Policy{BaseDelay: 2 * time.Second, MaxDelay: 3 * time.Second}
+	assert.Equal(t, time.Duration(0), p.delay(1))
+	assert.Equal(t, 2*time.Second, p.delay(2))
+	assert.Equal(t, 3*time.Second, p.delay(3))
+	assert.Equal(t, 3*time.Second, p.delay(10))
+
+	err := &RetryError{Err: ErrTooManyAttempts, RetryAfter: 1500 * time.Millisecond}
+	assert.Equal(t, "too many failed logins, slow down, retry in 2s", err.Error())
+}
@@ -0,0 +1,278 @@
+package mfa
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/MicBun/go-100-coverage-docker-crud/apperr"
+	"github.com/MicBun/go-100-coverage-docker-crud/core"
+	"gorm.io/gorm"
+)
+
+const (
+	period            = 30 * time.Second
+	digits            = 6
+	skew              = 1
+	recoveryCodeCount = 10
+)
+
+var (
+	ErrInvalidCode    = apperr.New(apperr.Invalid, "invalid_mfa_code", "invalid two-factor code")
+	ErrAlreadyEnabled = apperr.New(apperr.Conflict, "mfa_already_enabled", "two-factor authentication is already enabled")
+	ErrNotEnrolled    = apperr.New(apperr.Conflict, "mfa_not_enrolled", "two-factor authentication is not enrolled")
+)
+
+// Enrollment is what an authenticator app needs to start generating codes.
+// URI is the otpauth:// provisioning URI, which is also the QR code payload.
+type Enrollment struct {
+	Secret string `json:"secret"`
+	URI    string `json:"uri"`
+}
+
+// MFA manages TOTP (RFC 6238, SHA-1, 6 digits, 30 second steps) second
+// factors and their recovery codes.
+type MFA struct {
+	db     *gorm.DB
+	issuer string
+	now    func() time.Time
+}
+
+type MFAInterface interface {
+	// Enroll starts or restarts an unconfirmed enrollment.
+	Enroll(userID uint, account string) (Enrollment, error)
+	// Confirm enables the second factor once the user proves their app works
+	// and returns a fresh set of recovery codes.
+	Confirm(userID uint, code string) ([]string, error)
+	Enabled(userID uint) (bool, error)
+	// Verify accepts a TOTP code or an unused recovery code.
+	Verify(userID uint, code string) error
+	Reset(userID uint) error
+}
+
+func NewMFA(db *gorm.DB, issuer string) MFAInterface {
+	return &MFA{
+		db:     db,
+		issuer: issuer,
+		now:    time.Now,
+	}
+}
+
+var encoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// random is the source of secrets and recovery codes, replaced in tests.
+var random = rand.Reader
+
+func randomString(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := io.ReadFull(random, b); err != nil {
+		return "", err
+	}
+	return encoding.EncodeToString(b), nil
+}
+
+// code computes the HOTP value (RFC 4226) of secret at counter step.
+func code(secret []byte, step int64) string {
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, uint64(step))
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg)
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	mod := uint32(1)
+	for i := 0; i < digits; i++ {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", digits, value%mod)
+}
+
+// GenerateCode returns the code an authenticator app shows for secret at
+// the given time.
+func GenerateCode(secret string, at time.Time) (string, error) {
+	key, err := encoding.DecodeString(secret)
+	if err != nil {
+		return "", err
+	}
+	return code(key, at.Unix()/int64(period/time.Second)), nil
+}
+
+// matchStep returns the time step within the allowed skew that code belongs
+// to, or false when it matches none.
+func (m *MFA) matchStep(secret, given string) (int64, bool) {
+	key, err := encoding.DecodeString(secret)
+	if err != nil {
+		return 0, false
+	}
+	current := m.now().Unix() / int64(period/time.Second)
+	for step := current - skew; step <= current+skew; step++ {
+		if subtle.ConstantTimeCompare([]byte(code(key, step)), []byte(given)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+func normalizeRecoveryCode(code string) string {
+	return strings.ToUpper(strings.ReplaceAll(strings.TrimSpace(code), "-", ""))
+}
+
+func hashRecoveryCode(code string) string {
+	sum := sha256.Sum256([]byte(normalizeRecoveryCode(code)))
+	return hex.EncodeToString(sum[:])
+}
+
+func (m *MFA) load(userID uint) (core.UserMFA, error) {
+	var enrollment core.UserMFA
+	err := m.db.Model(core.UserMFA{}).Where("user_id = ?", userID).First(&enrollment).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return enrollment, ErrNotEnrolled
+	}
+	return enrollment, err
+}
+
+func (m *MFA) Enroll(userID uint, account string) (Enrollment, error) {
+	existing, err := m.load(userID)
+	if err == nil && existing.ConfirmedAt != nil {
+		return Enrollment{}, ErrAlreadyEnabled
+	}
+	if err != nil && !errors.Is(err, ErrNotEnrolled) {
+		return Enrollment{}, err
+	}
+
+	secret, err := randomString(20)
+	if err != nil {
+		return Enrollment{}, err
+	}
+	err = m.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("user_id = ?", userID).Delete(&core.UserMFA{}).Error; err != nil {
+			return err
+		}
+		return tx.Create(&core.UserMFA{UserID: userID, Secret: secret, CreatedAt: m.now()}).Error
+	})
+	if err != nil {
+		return Enrollment{}, err
+	}
+
+	label := url.PathEscape(m.issuer + ":" + account)
+	query := url.Values{}
+	query.Set("secret", secret)
+	query.Set("issuer", m.issuer)
+	query.Set("algorithm", "SHA1")
+	query.Set("digits", fmt.Sprint(digits))
+	query.Set("period", fmt.Sprint(int(period/time.Second)))
+	return Enrollment{
+		Secret: secret,
+		URI:    "otpauth://totp/" + label + "?" + query.Encode(),
+	}, nil
+}
+
+func (m *MFA) Confirm(userID uint, given string) ([]string, error) {
+	enrollment, err := m.load(userID)
+	if err != nil {
+		return nil, err
+	}
+	if enrollment.ConfirmedAt != nil {
+		return nil, ErrAlreadyEnabled
+	}
+	step, ok := m.matchStep(enrollment.Secret, given)
+	if !ok {
+		return nil, ErrInvalidCode
+	}
+
+	codes := make([]string, 0, recoveryCodeCount)
+	rows := make([]core.RecoveryCode, 0, recoveryCodeCount)
+	for i := 0; i < recoveryCodeCount; i++ {
+		plain, err := randomString(7)
+		if err != nil {
+			return nil, err
+		}
+		plain = plain[:5] + "-" + plain[5:10]
+		codes = append(codes, plain)
+		rows = append(rows, core.RecoveryCode{UserID: userID, CodeHash: hashRecoveryCode(plain)})
+	}
+
+	now := m.now()
+	err = m.db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(core.UserMFA{}).Where("user_id = ?", userID).
+			Updates(map[string]interface{}{"confirmed_at": now, "last_step": step}).Error
+		if err != nil {
+			return err
+		}
+		if err := tx.Where("user_id = ?", userID).Delete(&core.RecoveryCode{}).Error; err != nil {
+			return err
+		}
+		return tx.Create(&rows).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+func (m *MFA) Enabled(userID uint) (bool, error) {
+	enrollment, err := m.load(userID)
+	if errors.Is(err, ErrNotEnrolled) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return enrollment.ConfirmedAt != nil, nil
+}
+
+func (m *MFA) Verify(userID uint, given string) error {
+	enrollment, err := m.load(userID)
+	if err != nil {
+		return err
+	}
+	if enrollment.ConfirmedAt == nil {
+		return ErrNotEnrolled
+	}
+
+	if step, ok := m.matchStep(enrollment.Secret, given); ok {
+		// Accepting a step moves LastStep forward only if nobody else has
+		// used it, which makes every code single use.
+		res := m.db.Model(core.UserMFA{}).
+			Where("user_id = ? AND last_step < ?", userID, step).
+			Update("last_step", step)
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return ErrInvalidCode
+		}
+		return nil
+	}
+
+	res := m.db.Model(core.RecoveryCode{}).
+		Where("user_id = ? AND code_hash = ? AND used_at IS NULL", userID, hashRecoveryCode(given)).
+		Update("used_at", m.now())
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return ErrInvalidCode
+	}
+	return nil
+}
+
+func (m *MFA) Reset(userID uint) error {
+	return m.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("user_id = ?", userID).Delete(&core.RecoveryCode{}).Error; err != nil {
+			return err
+		}
+		return tx.Where("user_id = ?", userID).Delete(&core.UserMFA{}).Error
+	})
+}
@@ -0,0 +1,201 @@
+package mfa
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/MicBun/go-100-coverage-docker-crud/core"
+	"github.com/MicBun/go-100-coverage-docker-crud/database"
+	"github.com/stretchr/testify/assert"
+	"gorm.io/gorm"
+)
+
+// failWrites makes event ("INSERT", "UPDATE" or "DELETE") statements on table
+// fail for rows where when holds, until the returned func is called.
+func failWrites(t *testing.T, db *gorm.DB, table, event, when string) func() {
+	t.Helper()
+	name := strings.ToLower("fail_" + table + "_" + event)
+	assert.NoError(t, db.Exec(fmt.Sprintf(
+		"CREATE TRIGGER %s BEFORE %s ON %s WHEN %s BEGIN SELECT RAISE(ABORT, 'broken'); END",
+		name, event, table, when)).Error)
+	return func() { assert.NoError(t, db.Exec("DROP TRIGGER "+name).Error) }
+}
+
+// hideTable makes every statement on table fail, until the returned func is
+// called.
+func hideTable(t *testing.T, db *gorm.DB, table string) func() {
+	t.Helper()
+	assert.NoError(t, db.Exec(fmt.Sprintf("ALTER TABLE %s RENAME TO hidden_%s", table, table)).Error)
+	return func() {
+		assert.NoError(t, db.Exec(fmt.Sprintf("ALTER TABLE hidden_%s RENAME TO %s", table, table)).Error)
+	}
+}
+
+// failFinds makes queries that load into a value of the same type as dest
+// fail, until the returned func is called.
+func failFinds(t *testing.T, db *gorm.DB, dest interface{}) func() {
+	t.Helper()
+	assert.NoError(t, db.Callback().Query().Before("gorm:query").Register("test:fail_finds", func(tx *gorm.DB) {
+		if reflect.TypeOf(tx.Statement.Dest) == reflect.TypeOf(dest) {
+			tx.AddError(errors.New("broken"))
+		}
+	}))
+	return func() { assert.NoError(t, db.Callback().Query().Remove("test:fail_finds")) }
+}
+
+type failingReader struct{}
+
+func (failingReader) Read([]byte) (int, error) { return 0, errors.New("no entropy") }
+
+func TestCodeMatchesRFC6238(t *testing.T) {
+	secret := encoding.EncodeToString([]byte("12345678901234567890"))
+	for unix, want := range map[int64]string{
+		59:         "287082",
+		1111111109: "081804",
+		1234567890: "005924",
+		2000000000: "279037",
+	} {
+		got, err := GenerateCode(secret, time.Unix(unix, 0))
+		assert.NoError(t, err)
+		assert.Equal(t, want, got)
+	}
+	_, err := GenerateCode("not base32!", time.Unix(59, 0))
+	assert.Error(t, err)
+}
+
+func TestEnrollAndVerify(t *testing.T) {
+	database.RunTest(func(db *gorm.DB) {
+		now := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+		m := NewMFA(db, "Acme").(*MFA)
+		m.now = func() time.Time { return now }
+
+		enabled, err := m.Enabled(1)
+		assert.NoError(t, err)
+		assert.False(t, enabled)
+		assert.ErrorIs(t, m.Verify(1, "000000"), ErrNotEnrolled)
+
+		enrollment, err := m.Enroll(1, "foo@bar.com")
+		assert.NoError(t, err)
+		uri, err := url.Parse(enrollment.URI)
+		assert.NoError(t, err)
+		assert.Equal(t, "otpauth", uri.Scheme)
+		assert.Equal(t, "totp", uri.Host)
+		assert.Equal(t, "/Acme:foo@bar.com", uri.Path)
+		assert.Equal(t, enrollment.Secret, uri.Query().Get("secret"))
+		assert.Equal(t, "Acme", uri.Query().Get("issuer"))
+
+		// Unconfirmed enrollments don't count and can be restarted.
+		enabled, _ = m.Enabled(1)
+		assert.False(t, enabled)
+		enrollment, err = m.Enroll(1, "foo@bar.com")
+		assert.NoError(t, err)
+
+		_, err = m.Confirm(1, "000000")
+		assert.ErrorIs(t, err, ErrInvalidCode)
+		code, _ := GenerateCode(enrollment.Secret, now)
+		recovery, err := m.Confirm(1, code)
+		assert.NoError(t, err)
+		assert.Equal(t, recoveryCodeCount, len(recovery))
+		enabled, _ = m.Enabled(1)
+		assert.True(t, enabled)
+		_, err = m.Enroll(1, "foo@bar.com")
+		assert.ErrorIs(t, err, ErrAlreadyEnabled)
+
+		var stored core.RecoveryCode
+		assert.NoError(t, db.Where("user_id = ?", 1).First(&stored).Error)
+		assert.NotContains(t, recovery, stored.CodeHash)
+
+		// The confirming code was spent, the next step and one step of clock
+		// drift are accepted once each.
+		assert.ErrorIs(t, m.Verify(1, code), ErrInvalidCode)
+		now = now.Add(30 * time.Second)
+		code, _ = GenerateCode(enrollment.Secret, now)
+		assert.NoError(t, m.Verify(1, code))
+		assert.ErrorIs(t, m.Verify(1, code), ErrInvalidCode)
+		ahead, _ := GenerateCode(enrollment.Secret, now.Add(30*time.Second))
+		assert.NoError(t, m.Verify(1, ahead))
+		stale, _ := GenerateCode(enrollment.Secret, now.Add(-2*time.Minute))
+		assert.ErrorIs(t, m.Verify(1, stale), ErrInvalidCode)
+
+		assert.NoError(t, m.Verify(1, strings.ToLower(recovery[0])))
+		assert.ErrorIs(t, m.Verify(1, recovery[0]), ErrInvalidCode)
+		assert.NoError(t, m.Verify(1, strings.ReplaceAll(recovery[1], "-", "")))
+
+		assert.NoError(t, m.Reset(1))
+		enabled, _ = m.Enabled(1)
+		assert.False(t, enabled)
+		assert.ErrorIs(t, m.Verify(1, recovery[2]), ErrNotEnrolled)
+	})
+}
+
+func TestMFAErrors(t *testing.T) {
+	database.RunTest(func(db *gorm.DB) {
+		now := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+		m := NewMFA(db, "Acme").(*MFA)
+		m.now = func() time.Time { return now }
+
+		restore := failFinds(t, db, &core.UserMFA{})
+		_, err := m.Enroll(1, "foo@bar.com")
+		assert.Error(t, err)
+		_, err = m.Confirm(1, "000000")
+		assert.Error(t, err)
+		_, err = m.Enabled(1)
+		assert.Error(t, err)
+		assert.Error(t, m.Verify(1, "000000"))
+		restore()
+
+		random = failingReader{}
+		_, err = m.Enroll(1, "foo@bar.com")
+		random = rand.Reader
+		assert.Error(t, err)
+
+		enrollment, err := m.Enroll(1, "foo@bar.com")
+		assert.NoError(t, err)
+		assert.ErrorIs(t, m.Verify(1, "000000"), ErrNotEnrolled)
+		restore = failWrites(t, db, "user_mfas", "DELETE", "1")
+		_, err = m.Enroll(1, "foo@bar.com")
+		assert.Error(t, err)
+		restore()
+
+		code, _ := GenerateCode(enrollment.Secret, now)
+		random = failingReader{}
+		_, err = m.Confirm(1, code)
+		random = rand.Reader
+		assert.Error(t, err)
+		restore = failWrites(t, db, "user_mfas", "UPDATE", "1")
+		_, err = m.Confirm(1, code)
+		assert.Error(t, err)
+		restore()
+		restore = hideTable(t, db, "recovery_codes")
+		_, err = m.Confirm(1, code)
+		assert.Error(t, err)
+		restore()
+
+		// Failed confirmations leave the enrollment unconfirmed.
+		recovery, err := m.Confirm(1, code)
+		assert.NoError(t, err)
+		_, err = m.Confirm(1, code)
+		assert.ErrorIs(t, err, ErrAlreadyEnabled)
+
+		now = now.Add(30 * time.Second)
+		code, _ = GenerateCode(enrollment.Secret, now)
+		restore = failWrites(t, db, "user_mfas", "UPDATE", "1")
+		assert.Error(t, m.Verify(1, code))
+		restore()
+		restore = hideTable(t, db, "recovery_codes")
+		assert.Error(t, m.Verify(1, recovery[0]))
+		assert.Error(t, m.Reset(1))
+		restore()
+
+		// A secret that no longer decodes matches no code.
+		assert.NoError(t, db.Model(core.UserMFA{}).Where("user_id = ?", 1).Update("secret", "not base32!").Error)
+		assert.ErrorIs(t, m.Verify(1, code), ErrInvalidCode)
+		assert.NoError(t, m.Verify(1, recovery[0]))
+	})
+}
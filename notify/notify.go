@@ -0,0 +1,130 @@
+package notify
+
+import (
+	"fmt"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/MicBun/go-100-coverage-docker-crud/util"
+)
+
+// Message is a plain text notification for one recipient.
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Notifier delivers messages to users.
+type Notifier interface {
+	Send(msg Message) error
+}
+
+// encode renders msg as an RFC 5322 email.
+func encode(from string, msg Message, date time.Time) ([]byte, error) {
+	for _, header := range []string{from, msg.To, msg.Subject} {
+		if strings.ContainsAny(header, "\r\n") {
+			return nil, fmt.Errorf("invalid header value %q", header)
+		}
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "From: %s\r\n", from)
+	fmt.Fprintf(&b, "To: %s\r\n", msg.To)
+	fmt.Fprintf(&b, "Subject: %s\r\n", msg.Subject)
+	fmt.Fprintf(&b, "Date: %s\r\n", date.Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=UTF-8\r\n\r\n")
+	b.WriteString(strings.ReplaceAll(msg.Body, "\n", "\r\n"))
+	return []byte(b.String()), nil
+}
+
+type SMTP struct {
+	Addr     string
+	From     string
+	Username string
+	Password string
+}
+
+func (s SMTP) Send(msg Message) error {
+	body, err := encode(s.From, msg, time.Now())
+	if err != nil {
+		return err
+	}
+	var auth smtp.Auth
+	if s.Username != "" {
+		host := s.Addr
+		if i := strings.LastIndex(host, ":"); i >= 0 {
+			host = host[:i]
+		}
+		auth = smtp.PlainAuth("", s.Username, s.Password, host)
+	}
+	return smtp.SendMail(s.Addr, auth, s.From, []string{msg.To}, body)
+}
+
+// Outbox keeps every message instead of delivering it, for tests and local
+// runs. With a directory set it also writes each message there as an .eml
+// file.
+type Outbox struct {
+	dir string
+	now func() time.Time
+
+	mu       sync.Mutex
+	messages []Message
+}
+
+func NewOutbox(dir string) *Outbox {
+	return &Outbox{dir: dir, now: time.Now}
+}
+
+func (o *Outbox) Send(msg Message) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.dir != "" {
+		now := o.now()
+		body, err := encode("outbox@localhost", msg, now)
+		if err != nil {
+			return err
+		}
+		if err := os.MkdirAll(o.dir, 0o755); err != nil {
+			return err
+		}
+		name := fmt.Sprintf("%s-%04d.eml", now.UTC().Format("20060102T150405"), len(o.messages))
+		if err := os.WriteFile(filepath.Join(o.dir, name), body, 0o600); err != nil {
+			return err
+		}
+	}
+	o.messages = append(o.messages, msg)
+	return nil
+}
+
+// Messages returns the messages sent so far, oldest first.
+func (o *Outbox) Messages() []Message {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return append([]Message(nil), o.messages...)
+}
+
+// FromEnv builds the notifier selected by NOTIFIER ("outbox" or "smtp").
+func FromEnv() (Notifier, error) {
+	switch kind := util.GetEnv("NOTIFIER", "outbox"); kind {
+	case "outbox":
+		return NewOutbox(util.GetEnv("OUTBOX_DIR", "")), nil
+	case "smtp":
+		s := SMTP{
+			Addr:     util.GetEnv("SMTP_ADDR", ""),
+			From:     util.GetEnv("SMTP_FROM", ""),
+			Username: util.GetEnv("SMTP_USERNAME", ""),
+			Password: util.GetEnv("SMTP_PASSWORD", ""),
+		}
+		if s.Addr == "" || s.From == "" {
+			return nil, fmt.Errorf("SMTP_ADDR and SMTP_FROM are required")
+		}
+		return s, nil
+	default:
+		return nil, fmt.Errorf("unknown notifier %q", kind)
+	}
+}
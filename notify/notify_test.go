@@ -0,0 +1,151 @@
+package notify
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEncode(t *testing.T) {
+	date := time.Date(2023, 1, 2, 3, 4, 5, 0, time.UTC)
+	body, err := encode("noreply@example.com", Message{To: "foo@bar.com", Subject: "Hi", Body: "line 1\nline 2"}, date)
+	assert.NoError(t, err)
+	assert.Equal(t, "From: noreply@example.com\r\n"+
+		"To: foo@bar.com\r\n"+
+		"Subject: Hi\r\n"+
+		"Date: Mon, 02 Jan 2023 03:04:05 +0000\r\n"+
+		"MIME-Version: 1.0\r\n"+
+		"Content-Type: text/plain; charset=UTF-8\r\n\r\n"+
+		"line 1\r\nline 2", string(body))
+
+	_, err = encode("noreply@example.com", Message{To: "foo@bar.com\r\nBcc: evil@example.com"}, date)
+	assert.Error(t, err)
+}
+
+func TestOutbox(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "outbox")
+	outbox := NewOutbox(dir)
+	assert.NoError(t, outbox.Send(Message{To: "foo@bar.com", Subject: "One", Body: "1"}))
+	assert.NoError(t, outbox.Send(Message{To: "foo@bar.com", Subject: "Two", Body: "2"}))
+	assert.Error(t, outbox.Send(Message{To: "foo@bar.com", Subject: "Three\n"}))
+
+	messages := outbox.Messages()
+	assert.Equal(t, 2, len(messages))
+	assert.Equal(t, "One", messages[0].Subject)
+
+	files, err := os.ReadDir(dir)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(files))
+	content, err := os.ReadFile(filepath.Join(dir, files[1].Name()))
+	assert.NoError(t, err)
+	assert.True(t, strings.Contains(string(content), "Subject: Two\r\n"))
+
+	// Messages that can't be written aren't kept.
+	now := time.Date(2023, 1, 2, 3, 4, 5, 0, time.UTC)
+	outbox.now = func() time.Time { return now }
+	assert.NoError(t, os.Mkdir(filepath.Join(dir, "20230102T030405-0002.eml"), 0o755))
+	assert.Error(t, outbox.Send(Message{To: "foo@bar.com", Subject: "Three"}))
+	blocked := NewOutbox(filepath.Join(dir, files[0].Name(), "outbox"))
+	assert.Error(t, blocked.Send(Message{To: "foo@bar.com", Subject: "Four"}))
+	assert.Equal(t, 2, len(outbox.Messages()))
+	assert.Empty(t, blocked.Messages())
+}
+
+// smtpServer accepts one SMTP session on a local port and returns what the
+// client sent after DATA. Replies for a command can be overridden in reject.
+func smtpServer(t *testing.T, reject map[string]string) (string, <-chan string) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	received := make(chan string, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		reply := func(line string) { fmt.Fprintf(conn, "%s\r\n", line) }
+		reply("220 localhost ESMTP")
+		var data strings.Builder
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			command := strings.ToUpper(strings.Fields(line + " x")[0])
+			if answer, ok := reject[command]; ok {
+				reply(answer)
+				continue
+			}
+			switch command {
+			case "EHLO":
+				reply("250-localhost")
+				reply("250 AUTH PLAIN")
+			case "AUTH":
+				reply("235 accepted")
+			case "DATA":
+				reply("354 go ahead")
+				for {
+					line, err := r.ReadString('\n')
+					if err != nil || line == ".\r\n" {
+						break
+					}
+					data.WriteString(line)
+				}
+				received <- data.String()
+				reply("250 queued")
+			case "QUIT":
+				reply("221 bye")
+				return
+			default:
+				reply("250 ok")
+			}
+		}
+	}()
+	return listener.Addr().String(), received
+}
+
+func TestSMTP(t *testing.T) {
+	addr, received := smtpServer(t, nil)
+	s := SMTP{Addr: addr, From: "noreply@example.com", Username: "user", Password: "secret"}
+	assert.NoError(t, s.Send(Message{To: "foo@bar.com", Subject: "Hi", Body: "hello"}))
+	body := <-received
+	assert.Contains(t, body, "To: foo@bar.com\r\n")
+	assert.Contains(t, body, "hello")
+
+	addr, _ = smtpServer(t, map[string]string{"RCPT": "550 no such user"})
+	s = SMTP{Addr: addr, From: "noreply@example.com"}
+	assert.Error(t, s.Send(Message{To: "nobody@bar.com", Subject: "Hi"}))
+
+	assert.Error(t, s.Send(Message{To: "foo@bar.com", Subject: "Hi\r\nBcc: evil@example.com"}))
+}
+
+func TestFromEnv(t *testing.T) {
+	notifier, err := FromEnv()
+	assert.NoError(t, err)
+	assert.IsType(t, &Outbox{}, notifier)
+
+	t.Setenv("NOTIFIER", "smtp")
+	_, err = FromEnv()
+	assert.Error(t, err)
+	t.Setenv("SMTP_ADDR", "localhost:25")
+	t.Setenv("SMTP_FROM", "noreply@example.com")
+	notifier, err = FromEnv()
+	assert.NoError(t, err)
+	assert.Equal(t, SMTP{Addr: "localhost:25", From: "noreply@example.com"}, notifier)
+
+	t.Setenv("NOTIFIER", "pigeon")
+	_, err = FromEnv()
+	assert.Error(t, err)
+}
@@ -0,0 +1,185 @@
+package ratelimit
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/MicBun/go-100-coverage-docker-crud/util"
+)
+
+// Limit is a token bucket that holds up to Requests tokens and refills all of
+// them over Per. A zero Limit disables limiting.
+type Limit struct {
+	Requests int
+	Per      time.Duration
+}
+
+func (l Limit) Enabled() bool {
+	return l.Requests > 0 && l.Per > 0
+}
+
+func (l Limit) rate() float64 {
+	return float64(l.Requests) / l.Per.Seconds()
+}
+
+// ParseLimit reads limits written as "<requests>/<duration>", such as
+// "120/1m". "off" disables the limit.
+func ParseLimit(value string) (Limit, error) {
+	if value == "off" {
+		return Limit{}, nil
+	}
+	requests, per, ok := strings.Cut(value, "/")
+	if !ok {
+		return Limit{}, fmt.Errorf("invalid rate limit %q, want <requests>/<duration>", value)
+	}
+	n, err := strconv.Atoi(requests)
+	if err != nil || n < 0 {
+		return Limit{}, fmt.Errorf("invalid rate limit %q: bad request count", value)
+	}
+	d, err := time.ParseDuration(per)
+	if err != nil || d <= 0 {
+		return Limit{}, fmt.Errorf("invalid rate limit %q: bad duration", value)
+	}
+	return Limit{Requests: n, Per: d}, nil
+}
+
+// Result describes the bucket after a request took from it.
+type Result struct {
+	Allowed   bool
+	Limit     int
+	Remaining int
+	// Reset is how long until the bucket is full again.
+	Reset time.Duration
+	// RetryAfter is how long until the next request is allowed, zero when
+	// this one was.
+	RetryAfter time.Duration
+}
+
+// Store keeps the buckets. Implementations backed by a shared database or
+// cache make limits hold across instances.
+type Store interface {
+	Take(key string, limit Limit) (Result, error)
+}
+
+type bucket struct {
+	tokens  float64
+	updated time.Time
+	limit   Limit
+}
+
+func (b *bucket) refill(now time.Time) {
+	b.tokens = math.Min(float64(b.limit.Requests), b.tokens+now.Sub(b.updated).Seconds()*b.limit.rate())
+	b.updated = now
+}
+
+// Memory is a Store local to one process. Buckets that have refilled
+// completely are dropped every pruneEvery.
+type Memory struct {
+	now        func() time.Time
+	pruneEvery time.Duration
+
+	mu         sync.Mutex
+	buckets    map[string]*bucket
+	lastPruned time.Time
+}
+
+func NewMemory() *Memory {
+	return &Memory{
+		now:        time.Now,
+		pruneEvery: time.Minute,
+		buckets:    map[string]*bucket{},
+	}
+}
+
+func seconds(tokens, rate float64) time.Duration {
+	return time.Duration(tokens / rate * float64(time.Second))
+}
+
+func (m *Memory) Take(key string, limit Limit) (Result, error) {
+	now := m.now()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if now.Sub(m.lastPruned) >= m.pruneEvery {
+		m.prune(now)
+	}
+
+	b, ok := m.buckets[key]
+	if !ok || b.limit != limit {
+		b = &bucket{tokens: float64(limit.Requests), updated: now, limit: limit}
+		m.buckets[key] = b
+	}
+	b.refill(now)
+
+	result := Result{Limit: limit.Requests}
+	if b.tokens >= 1 {
+		b.tokens--
+		result.Allowed = true
+	} else {
+		result.RetryAfter = seconds(1-b.tokens, limit.rate())
+	}
+	result.Remaining = int(b.tokens)
+	result.Reset = seconds(float64(limit.Requests)-b.tokens, limit.rate())
+	return result, nil
+}
+
+func (m *Memory) prune(now time.Time) {
+	for key, b := range m.buckets {
+		b.refill(now)
+		if b.tokens >= float64(b.limit.Requests) {
+			delete(m.buckets, key)
+		}
+	}
+	m.lastPruned = now
+}
+
+// LimitsFromEnv reads the limit of each route group from RATE_LIMIT_<GROUP>,
+// falling back to the given defaults.
+func LimitsFromEnv(defaults map[string]string) (map[string]Limit, error) {
+	limits := map[string]Limit{}
+	for group, fallback := range defaults {
+		name := "RATE_LIMIT_" + strings.ToUpper(group)
+		limit, err := ParseLimit(util.GetEnv(name, fallback))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		limits[group] = limit
+	}
+	return limits, nil
+}
+
+// APIKeys is the set of API keys that get a bucket of their own, kept as
+// SHA-256 digests so bucket names don't reveal the keys.
+type APIKeys map[string]bool
+
+func digest(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+func NewAPIKeys(keys ...string) APIKeys {
+	set := APIKeys{}
+	for _, key := range keys {
+		if key = strings.TrimSpace(key); key != "" {
+			set[digest(key)] = true
+		}
+	}
+	return set
+}
+
+// APIKeysFromEnv reads the comma-separated keys in RATE_LIMIT_API_KEYS.
+func APIKeysFromEnv() APIKeys {
+	return NewAPIKeys(strings.Split(util.GetEnv("RATE_LIMIT_API_KEYS", ""), ",")...)
+}
+
+// Lookup returns the digest naming key when it is a configured key.
+func (k APIKeys) Lookup(key string) (string, bool) {
+	d := digest(key)
+	return d, key != "" && k[d]
+}
@@ -0,0 +1,94 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseLimit(t *testing.T) {
+	limit, err := ParseLimit("120/1m")
+	assert.NoError(t, err)
+	assert.Equal(t, Limit{Requests: 120, Per: time.Minute}, limit)
+	assert.True(t, limit.Enabled())
+
+	limit, err = ParseLimit("off")
+	assert.NoError(t, err)
+	assert.False(t, limit.Enabled())
+
+	for _, value := range []string{"120", "x/1m", "-1/1m", "10/soon", "10/0s"} {
+		_, err := ParseLimit(value)
+		assert.Error(t, err, value)
+	}
+}
+
+func TestMemoryTokenBucket(t *testing.T) {
+	now := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	m := NewMemory()
+	m.now = func() time.Time { return now }
+	limit := Limit{Requests: 3, Per: 30 * time.Second}
+
+	for remaining := 2; remaining >= 0; remaining-- {
+		result, err := m.Take("a", limit)
+		assert.NoError(t, err)
+		assert.True(t, result.Allowed)
+		assert.Equal(t, 3, result.Limit)
+		assert.Equal(t, remaining, result.Remaining)
+	}
+	result, _ := m.Take("a", limit)
+	assert.False(t, result.Allowed)
+	assert.Equal(t, 10*time.Second, result.RetryAfter)
+	assert.Equal(t, 30*time.Second, result.Reset)
+
+	// Other keys have their own bucket.
+	result, _ = m.Take("b", limit)
+	assert.True(t, result.Allowed)
+
+	// Tokens come back one every 10 seconds.
+	now = now.Add(15 * time.Second)
+	result, _ = m.Take("a", limit)
+	assert.True(t, result.Allowed)
+	assert.Equal(t, 0, result.Remaining)
+	assert.Equal(t, 25*time.Second, result.Reset)
+	result, _ = m.Take("a", limit)
+	assert.False(t, result.Allowed)
+	assert.Equal(t, 5*time.Second, result.RetryAfter)
+
+	// Full buckets are forgotten.
+	now = now.Add(time.Minute)
+	m.Take("c", limit)
+	assert.Equal(t, 1, len(m.buckets))
+}
+
+func TestLimitsFromEnv(t *testing.T) {
+	t.Setenv("RATE_LIMIT_AUTH", "5/1s")
+	limits, err := LimitsFromEnv(map[string]string{"auth": "20/1m", "user": "off"})
+	assert.NoError(t, err)
+	assert.Equal(t, Limit{Requests: 5, Per: time.Second}, limits["auth"])
+	assert.False(t, limits["user"].Enabled())
+
+	t.Setenv("RATE_LIMIT_USER", "lots")
+	_, err = LimitsFromEnv(map[string]string{"user": "off"})
+	assert.Error(t, err)
+}
+
+func TestAPIKeys(t *testing.T) {
+	t.Setenv("RATE_LIMIT_API_KEYS", "partner, ,other")
+	keys := APIKeysFromEnv()
+	assert.Len(t, keys, 2)
+
+	digest, ok := keys.Lookup("partner")
+	assert.True(t, ok)
+	assert.Len(t, digest, 64)
+	assert.NotContains(t, digest, "partner")
+	_, ok = keys.Lookup("other")
+	assert.True(t, ok)
+	_, ok = keys.Lookup("made-up")
+	assert.False(t, ok)
+	_, ok = keys.Lookup("")
+	assert.False(t, ok)
+
+	_, ok = NewAPIKeys().Lookup("partner")
+	assert.False(t, ok)
+}
@@ -0,0 +1,196 @@
+package role
+
+import (
+	"errors"
+	"fmt"
+	"github.com/MicBun/go-100-coverage-docker-crud/apperr"
+	"github.com/MicBun/go-100-coverage-docker-crud/core"
+
+	"gorm.io/gorm"
+)
+
+var (
+	ErrRoleExists = apperr.New(apperr.Conflict, "role_exists", "role already exists")
+	ErrLastAdmin  = apperr.New(apperr.Conflict, "last_admin", "cannot revoke the last admin")
+	// ErrRoleNotFound and ErrUserNotFound wrap gorm.ErrRecordNotFound.
+	ErrRoleNotFound = &apperr.Error{Kind: apperr.NotFound, Code: "role_not_found", Message: "role not found", Err: gorm.ErrRecordNotFound}
+	ErrUserNotFound = &apperr.Error{Kind: apperr.NotFound, Code: "user_not_found", Message: "user not found", Err: gorm.ErrRecordNotFound}
+)
+
+type RBAC struct {
+	db *gorm.DB
+}
+
+type RBACInterface interface {
+	CreateRole(name string, permissions []string) (core.Role, error)
+	UpdateRole(name string, permissions []string) (core.Role, error)
+	GetRole(name string) (core.Role, error)
+	ListRoles() ([]core.Role, error)
+	AssignRole(userID uint, name string) error
+	RevokeRole(userID uint, name string) error
+	UserRoles(userID uint) ([]string, error)
+	HasPermission(roles []string, permission string) (bool, error)
+}
+
+func AdminRBAC(db *gorm.DB) RBACInterface {
+	return &RBAC{
+		db: db,
+	}
+}
+
+func (r *RBAC) findPermissions(names []string) ([]core.Permission, error) {
+	var permissions []core.Permission
+	if len(names) == 0 {
+		return permissions, nil
+	}
+	err := r.db.Model(core.Permission{}).Where("name IN ?", names).Find(&permissions).Error
+	if err != nil {
+		return permissions, err
+	}
+	if len(permissions) != len(unique(names)) {
+		return permissions, apperr.New(apperr.Invalid, "unknown_permission", fmt.Sprintf("unknown permission in %v", names))
+	}
+	return permissions, nil
+}
+
+func (r *RBAC) CreateRole(name string, permissions []string) (core.Role, error) {
+	role := core.Role{Name: name}
+	found, err := r.findPermissions(permissions)
+	if err != nil {
+		return role, err
+	}
+	role.Permissions = found
+	var taken int64
+	if err := r.db.Model(core.Role{}).Where("name = ?", name).Count(&taken).Error; err != nil {
+		return role, err
+	}
+	if taken > 0 {
+		return role, ErrRoleExists
+	}
+	err = r.db.Create(&role).Error
+	return role, err
+}
+
+func (r *RBAC) UpdateRole(name string, permissions []string) (core.Role, error) {
+	role, err := r.GetRole(name)
+	if err != nil {
+		return role, err
+	}
+	found, err := r.findPermissions(permissions)
+	if err != nil {
+		return role, err
+	}
+	if err := r.db.Model(&role).Association("Permissions").Replace(found); err != nil {
+		return role, err
+	}
+	role.Permissions = found
+	return role, nil
+}
+
+func (r *RBAC) GetRole(name string) (core.Role, error) {
+	var role core.Role
+	err := r.db.Model(core.Role{}).Preload("Permissions").Where("name = ?", name).First(&role).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return role, ErrRoleNotFound
+	}
+	return role, err
+}
+
+func (r *RBAC) ListRoles() ([]core.Role, error) {
+	var roles []core.Role
+	err := r.db.Model(core.Role{}).Preload("Permissions").Order("id").Find(&roles).Error
+	return roles, err
+}
+
+func (r *RBAC) AssignRole(userID uint, name string) error {
+	role, err := r.GetRole(name)
+	if err != nil {
+		return err
+	}
+	var user core.User
+	if err := r.db.Model(core.User{}).Where("id = ?", userID).First(&user).Error; err != nil {
+		return userError(err)
+	}
+	return r.db.Model(&user).Association("Roles").Append(&role)
+}
+
+func (r *RBAC) RevokeRole(userID uint, name string) error {
+	role, err := r.GetRole(name)
+	if err != nil {
+		return err
+	}
+	var user core.User
+	if err := r.db.Model(core.User{}).Preload("Roles").Where("id = ?", userID).First(&user).Error; err != nil {
+		return userError(err)
+	}
+	if name == core.RoleAdmin {
+		var admins int64
+		err := r.db.Table("user_roles").
+			Joins("JOIN users ON users.id = user_roles.user_id AND users.deleted_at IS NULL").
+			Where("user_roles.role_id = ?", role.ID).
+			Count(&admins).Error
+		if err != nil {
+			return err
+		}
+		if admins <= 1 && hasRole(user, name) {
+			return ErrLastAdmin
+		}
+	}
+	return r.db.Model(&user).Association("Roles").Delete(&role)
+}
+
+func userError(err error) error {
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return ErrUserNotFound
+	}
+	return err
+}
+
+func (r *RBAC) UserRoles(userID uint) ([]string, error) {
+	var user core.User
+	err := r.db.Model(core.User{}).Preload("Roles", func(db *gorm.DB) *gorm.DB {
+		return db.Order("roles.id")
+	}).Where("id = ?", userID).First(&user).Error
+	if err != nil {
+		return nil, userError(err)
+	}
+	roles := make([]string, 0, len(user.Roles))
+	for _, role := range user.Roles {
+		roles = append(roles, role.Name)
+	}
+	return roles, nil
+}
+
+func (r *RBAC) HasPermission(roles []string, permission string) (bool, error) {
+	if len(roles) == 0 {
+		return false, nil
+	}
+	var count int64
+	err := r.db.Table("role_permissions").
+		Joins("JOIN roles ON roles.id = role_permissions.role_id").
+		Joins("JOIN permissions ON permissions.id = role_permissions.permission_id").
+		Where("roles.name IN ? AND permissions.name = ?", roles, permission).
+		Count(&count).Error
+	return count > 0, err
+}
+
+func hasRole(user core.User, name string) bool {
+	for _, role := range user.Roles {
+		if role.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func unique(names []string) []string {
+	seen := map[string]bool{}
+	var out []string
+	for _, name := range names {
+		if !seen[name] {
+			seen[name] = true
+			out = append(out, name)
+		}
+	}
+	return out
+}
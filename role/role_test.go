@@ -0,0 +1,157 @@
+package role
+
+import (
+	"errors"
+	"fmt"
+	"github.com/MicBun/go-100-coverage-docker-crud/core"
+	"github.com/MicBun/go-100-coverage-docker-crud/database"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gorm.io/gorm"
+)
+
+// failWrites makes event ("INSERT", "UPDATE" or "DELETE") statements on table
+// fail for rows where when holds, until the returned func is called.
+func failWrites(t *testing.T, db *gorm.DB, table, event, when string) func() {
+	t.Helper()
+	name := strings.ToLower("fail_" + table + "_" + event)
+	assert.NoError(t, db.Exec(fmt.Sprintf(
+		"CREATE TRIGGER %s BEFORE %s ON %s WHEN %s BEGIN SELECT RAISE(ABORT, 'broken'); END",
+		name, event, table, when)).Error)
+	return func() { assert.NoError(t, db.Exec("DROP TRIGGER "+name).Error) }
+}
+
+// hideTable makes every statement on table fail, until the returned func is
+// called.
+func hideTable(t *testing.T, db *gorm.DB, table string) func() {
+	t.Helper()
+	assert.NoError(t, db.Exec(fmt.Sprintf("ALTER TABLE %s RENAME TO hidden_%s", table, table)).Error)
+	return func() {
+		assert.NoError(t, db.Exec(fmt.Sprintf("ALTER TABLE hidden_%s RENAME TO %s", table, table)).Error)
+	}
+}
+
+// failFinds makes queries that load into a value of the same type as dest
+// fail, until the returned func is called.
+func failFinds(t *testing.T, db *gorm.DB, dest interface{}) func() {
+	t.Helper()
+	assert.NoError(t, db.Callback().Query().Before("gorm:query").Register("test:fail_finds", func(tx *gorm.DB) {
+		if reflect.TypeOf(tx.Statement.Dest) == reflect.TypeOf(dest) {
+			tx.AddError(errors.New("broken"))
+		}
+	}))
+	return func() { assert.NoError(t, db.Callback().Query().Remove("test:fail_finds")) }
+}
+
+func TestRBAC(t *testing.T) {
+	database.RunTest(func(db *gorm.DB) {
+		r := AdminRBAC(db)
+
+		ok, err := r.HasPermission([]string{core.RoleAdmin}, core.PermUsersDelete)
+		assert.NoError(t, err)
+		assert.True(t, ok)
+
+		ok, err = r.HasPermission([]string{core.RoleUser}, core.PermUsersDelete)
+		assert.NoError(t, err)
+		assert.False(t, ok)
+
+		ok, err = r.HasPermission(nil, core.PermProfileRead)
+		assert.NoError(t, err)
+		assert.False(t, ok)
+
+		_, err = r.CreateRole("auditor", []string{core.PermUsersRead, "users:fly"})
+		assert.Error(t, err)
+
+		auditor, err := r.CreateRole("auditor", []string{core.PermUsersRead, core.PermUsersRead})
+		assert.NoError(t, err)
+		assert.Equal(t, 1, len(auditor.Permissions))
+
+		_, err = r.CreateRole("auditor", nil)
+		assert.ErrorIs(t, err, ErrRoleExists)
+
+		ok, err = r.HasPermission([]string{core.RoleUser, "auditor"}, core.PermUsersRead)
+		assert.NoError(t, err)
+		assert.True(t, ok)
+
+		auditor, err = r.UpdateRole("auditor", []string{core.PermRolesRead})
+		assert.NoError(t, err)
+		ok, err = r.HasPermission([]string{"auditor"}, core.PermUsersRead)
+		assert.NoError(t, err)
+		assert.False(t, ok)
+
+		_, err = r.UpdateRole("auditor", []string{"users:fly"})
+		assert.Error(t, err)
+
+		roles, err := r.ListRoles()
+		assert.NoError(t, err)
+		assert.Equal(t, 3, len(roles))
+
+		admin := core.User{Username: "admin"}
+		assert.NoError(t, db.Create(&admin).Error)
+
+		assert.ErrorIs(t, r.AssignRole(admin.ID, "support"), ErrRoleNotFound)
+		assert.ErrorIs(t, r.AssignRole(admin.ID+1, core.RoleAdmin), ErrUserNotFound)
+		assert.NoError(t, r.AssignRole(admin.ID, core.RoleAdmin))
+		assert.NoError(t, r.AssignRole(admin.ID, core.RoleAdmin))
+
+		names, err := r.UserRoles(admin.ID)
+		assert.NoError(t, err)
+		assert.Equal(t, []string{core.RoleAdmin}, names)
+
+		_, err = r.UserRoles(admin.ID + 1)
+		assert.Error(t, err)
+
+		assert.ErrorIs(t, r.RevokeRole(admin.ID, core.RoleAdmin), ErrLastAdmin)
+
+		other := core.User{Username: "other"}
+		assert.NoError(t, db.Create(&other).Error)
+		assert.NoError(t, r.AssignRole(other.ID, core.RoleAdmin))
+		assert.NoError(t, r.RevokeRole(admin.ID, core.RoleAdmin))
+		assert.Error(t, r.RevokeRole(admin.ID+5, core.RoleAdmin))
+		assert.Error(t, r.RevokeRole(admin.ID, "support"))
+
+		names, err = r.UserRoles(admin.ID)
+		assert.NoError(t, err)
+		assert.Equal(t, 0, len(names))
+
+		// Revoking a role the user doesn't have is a no-op, even for the
+		// last admin role.
+		assert.NoError(t, r.RevokeRole(admin.ID, core.RoleAdmin))
+	})
+}
+
+func TestRBACErrors(t *testing.T) {
+	database.RunTest(func(db *gorm.DB) {
+		r := AdminRBAC(db)
+		admin := core.User{Username: "admin"}
+		assert.NoError(t, db.Create(&admin).Error)
+		assert.NoError(t, r.AssignRole(admin.ID, core.RoleAdmin))
+		_, err := r.UpdateRole("auditor", nil)
+		assert.ErrorIs(t, err, ErrRoleNotFound)
+
+		restore := hideTable(t, db, "permissions")
+		_, err = r.CreateRole("auditor", []string{core.PermUsersRead})
+		assert.Error(t, err)
+		restore()
+
+		restore = failFinds(t, db, new(int64))
+		_, err = r.CreateRole("auditor", nil)
+		assert.Error(t, err)
+		assert.Error(t, r.RevokeRole(admin.ID, core.RoleAdmin))
+		restore()
+
+		restore = failWrites(t, db, "role_permissions", "INSERT", "1")
+		_, err = r.UpdateRole(core.RoleUser, []string{core.PermUsersRead})
+		assert.Error(t, err)
+		restore()
+
+		restore = hideTable(t, db, "users")
+		err = r.AssignRole(admin.ID, core.RoleUser)
+		assert.Error(t, err)
+		assert.NotErrorIs(t, err, ErrUserNotFound)
+		restore()
+	})
+}
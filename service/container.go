@@ -1,26 +1,165 @@
 package service
 
 import (
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/MicBun/go-100-coverage-docker-crud/audit"
+	"github.com/MicBun/go-100-coverage-docker-crud/lockout"
+	"github.com/MicBun/go-100-coverage-docker-crud/mfa"
+	"github.com/MicBun/go-100-coverage-docker-crud/notify"
+	"github.com/MicBun/go-100-coverage-docker-crud/ratelimit"
+	"github.com/MicBun/go-100-coverage-docker-crud/role"
+	"github.com/MicBun/go-100-coverage-docker-crud/session"
+	"github.com/MicBun/go-100-coverage-docker-crud/token"
 	"github.com/MicBun/go-100-coverage-docker-crud/user"
+	"github.com/MicBun/go-100-coverage-docker-crud/util"
+	"github.com/MicBun/go-100-coverage-docker-crud/util/jwtAuth"
+	"github.com/MicBun/go-100-coverage-docker-crud/util/password"
 
 	"github.com/gin-gonic/gin"
 	"gorm.io/gorm"
 )
 
 type Container struct {
-	Web   *gin.Engine
-	DB    *gorm.DB
-	Admin user.AuthInterface
+	Web           *gin.Engine
+	DB            *gorm.DB
+	Admin         user.AuthInterface
+	RBAC          role.RBACInterface
+	Refresh       token.RefreshInterface
+	Sessions      session.SessionsInterface
+	Revocations   token.RevocationsInterface
+	MFA           mfa.MFAInterface
+	Notifier      notify.Notifier
+	PasswordReset user.PasswordResetInterface
+	// Signup is nil unless open signup is enabled.
+	Signup      user.SignupInterface
+	Lockout     lockout.LockoutInterface
+	RateLimiter ratelimit.Store
+	Audit       audit.LogInterface
+	// RateLimits holds the limit of each route group, by group name.
+	RateLimits map[string]ratelimit.Limit
+	// APIKeys are the API keys counted in rate limits on their own.
+	APIKeys ratelimit.APIKeys
+	// Keys is nil when tokens are signed with the legacy HS256 secret.
+	Keys token.SigningKeysInterface
+	// StrictStatus answers every client with the status of the error kind,
+	// not only those that opt in.
+	StrictStatus bool
+	// RequireIfMatch refuses changes to a user that don't send the ETag of
+	// the version they read in If-Match.
+	RequireIfMatch bool
+	// AuditReads records requests that only read data in the audit log too.
+	AuditReads bool
 }
 
 func New(mainDB *gorm.DB) *Container {
 	ginEngine := gin.Default()
 
-	admin := user.AdminAuth(mainDB)
+	hasher, err := password.FromEnv()
+	if err != nil {
+		log.Fatalf("Unable to configure password hasher %v", err)
+	}
+	admin := user.AdminAuth(mainDB, hasher)
+
+	refreshLifespan, err := strconv.Atoi(util.GetEnv("REFRESH_TOKEN_HOUR_LIFESPAN", "720"))
+	if err != nil {
+		log.Fatalf("Invalid REFRESH_TOKEN_HOUR_LIFESPAN %v", err)
+	}
+
+	revocationCache, err := strconv.Atoi(util.GetEnv("REVOCATION_CACHE_SECONDS", "30"))
+	if err != nil {
+		log.Fatalf("Invalid REVOCATION_CACHE_SECONDS %v", err)
+	}
+
+	notifier, err := notify.FromEnv()
+	if err != nil {
+		log.Fatalf("Unable to configure notifier %v", err)
+	}
+	resetLifespan, err := strconv.Atoi(util.GetEnv("RESET_TOKEN_MINUTE_LIFESPAN", "30"))
+	if err != nil {
+		log.Fatalf("Invalid RESET_TOKEN_MINUTE_LIFESPAN %v", err)
+	}
+
+	lockoutPolicy, err := lockout.PolicyFromEnv()
+	if err != nil {
+		log.Fatalf("Invalid lockout policy %v", err)
+	}
+
+	rateLimits, err := ratelimit.LimitsFromEnv(map[string]string{
+		"auth":  "20/1m",
+		"user":  "120/1m",
+		"role":  "60/1m",
+		"admin": "60/1m",
+	})
+	if err != nil {
+		log.Fatalf("Invalid rate limit %v", err)
+	}
+
+	passwordReset := user.NewPasswordReset(mainDB, hasher, notifier,
+		time.Duration(resetLifespan)*time.Minute, util.GetEnv("PASSWORD_RESET_URL", ""))
+
+	var signup user.SignupInterface
+	if util.GetEnv("SIGNUP_ENABLED", "false") == "true" {
+		verifyLifespan, err := strconv.Atoi(util.GetEnv("VERIFY_TOKEN_HOUR_LIFESPAN", "24"))
+		if err != nil {
+			log.Fatalf("Invalid VERIFY_TOKEN_HOUR_LIFESPAN %v", err)
+		}
+		signup = user.NewSignup(mainDB, hasher, notifier,
+			time.Duration(verifyLifespan)*time.Hour, util.GetEnv("SIGNUP_VERIFY_URL", ""))
+	}
+
+	var keys token.SigningKeysInterface
+	if algorithm := util.GetEnv("JWT_ALGORITHM", jwtAuth.AlgHS256); algorithm != jwtAuth.AlgHS256 {
+		rotateHours, err := strconv.Atoi(util.GetEnv("JWT_KEY_ROTATION_HOURS", "720"))
+		if err != nil {
+			log.Fatalf("Invalid JWT_KEY_ROTATION_HOURS %v", err)
+		}
+		publishMinutes, err := strconv.Atoi(util.GetEnv("JWT_KEY_PUBLISH_MINUTES", "60"))
+		if err != nil {
+			log.Fatalf("Invalid JWT_KEY_PUBLISH_MINUTES %v", err)
+		}
+		tokenLifespan, err := jwtAuth.TokenLifespan()
+		if err != nil {
+			log.Fatalf("Invalid TOKEN_MINUTE_LIFESPAN or TOKEN_HOUR_LIFESPAN %v", err)
+		}
+		keys = token.NewSigningKeys(mainDB, algorithm,
+			time.Duration(rotateHours)*time.Hour,
+			time.Duration(publishMinutes)*time.Minute,
+			tokenLifespan,
+		)
+	}
+
+	var strictStatus bool
+	switch mode := util.GetEnv("HTTP_STATUS_MODE", "legacy"); mode {
+	case "legacy":
+	case "strict":
+		strictStatus = true
+	default:
+		log.Fatalf("Invalid HTTP_STATUS_MODE %q", mode)
+	}
 
 	return &Container{
-		Web:   ginEngine,
-		DB:    mainDB,
-		Admin: admin,
+		Web:            ginEngine,
+		DB:             mainDB,
+		Admin:          admin,
+		RBAC:           role.AdminRBAC(mainDB),
+		Refresh:        token.NewRefresh(mainDB, time.Duration(refreshLifespan)*time.Hour),
+		Sessions:       session.NewSessions(mainDB, time.Duration(refreshLifespan)*time.Hour),
+		Revocations:    token.NewRevocations(mainDB, time.Duration(revocationCache)*time.Second),
+		Keys:           keys,
+		MFA:            mfa.NewMFA(mainDB, util.GetEnv("MFA_ISSUER", "Go User API")),
+		Notifier:       notifier,
+		PasswordReset:  passwordReset,
+		Signup:         signup,
+		Lockout:        lockout.NewLockout(lockoutPolicy),
+		RateLimiter:    ratelimit.NewMemory(),
+		Audit:          audit.NewLog(mainDB),
+		RateLimits:     rateLimits,
+		APIKeys:        ratelimit.APIKeysFromEnv(),
+		StrictStatus:   strictStatus,
+		RequireIfMatch: util.GetEnv("IF_MATCH_REQUIRED", "false") == "true",
+		AuditReads:     util.GetEnv("AUDIT_READS", "true") == "true",
 	}
 }
@@ -0,0 +1,65 @@
+package service
+
+import (
+	"context"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/MicBun/go-100-coverage-docker-crud/util"
+)
+
+// StartJobs runs the container's periodic maintenance in the background
+// until ctx is done. Work that must be in place before serving requests runs
+// once synchronously first.
+func StartJobs(ctx context.Context, c *Container) {
+	pruneMinutes, err := strconv.Atoi(util.GetEnv("REVOCATION_PRUNE_MINUTES", "60"))
+	if err != nil {
+		log.Fatalf("Invalid REVOCATION_PRUNE_MINUTES %v", err)
+	}
+	go every(ctx, time.Duration(pruneMinutes)*time.Minute, func() {
+		if _, err := c.Revocations.Prune(); err != nil {
+			log.Printf("Unable to prune revoked tokens %v", err)
+		}
+	})
+	go every(ctx, time.Minute, c.Lockout.Prune)
+
+	checkpointMinutes, err := strconv.Atoi(util.GetEnv("AUDIT_CHECKPOINT_MINUTES", "60"))
+	if err != nil {
+		log.Fatalf("Invalid AUDIT_CHECKPOINT_MINUTES %v", err)
+	}
+	go every(ctx, time.Duration(checkpointMinutes)*time.Minute, func() {
+		if _, err := c.Audit.Checkpoint(); err != nil {
+			log.Printf("Unable to sign audit checkpoint %v", err)
+		}
+	})
+
+	if c.Keys != nil {
+		syncMinutes, err := strconv.Atoi(util.GetEnv("JWT_KEY_SYNC_MINUTES", "5"))
+		if err != nil {
+			log.Fatalf("Invalid JWT_KEY_SYNC_MINUTES %v", err)
+		}
+		if err := c.Keys.Sync(); err != nil {
+			log.Fatalf("Unable to load signing keys %v", err)
+		}
+		go every(ctx, time.Duration(syncMinutes)*time.Minute, func() {
+			if err := c.Keys.Sync(); err != nil {
+				log.Printf("Unable to sync signing keys %v", err)
+			}
+		})
+	}
+}
+
+// every calls job on every tick of interval until ctx is done.
+func every(ctx context.Context, interval time.Duration, job func()) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			job()
+		}
+	}
+}
@@ -1,11 +1,27 @@
 package service
 
 import (
+	"github.com/MicBun/go-100-coverage-docker-crud/core"
 	"log"
 )
 
+// SeedData creates the demo accounts on an empty database. It does nothing
+// once any user, including a soft-deleted one, exists.
 func SeedData(c *Container) {
-	_, err := c.Admin.RegisterUser("admin", "admin", "Admin")
+	var count int64
+	if err := c.DB.Unscoped().Model(core.User{}).Count(&count).Error; err != nil {
+		log.Fatalf("Unable to seed data %v", err)
+		return
+	}
+	if count > 0 {
+		return
+	}
+	admin, err := c.Admin.RegisterUser("admin", "admin", "Admin")
+	if err != nil {
+		log.Fatalf("Unable to seed data %v", err)
+		return
+	}
+	err = c.RBAC.AssignRole(admin.ID, core.RoleAdmin)
 	if err != nil {
 		log.Fatalf("Unable to seed data %v", err)
 		return
@@ -0,0 +1,127 @@
+package session
+
+import (
+	"errors"
+	"time"
+
+	"github.com/MicBun/go-100-coverage-docker-crud/apperr"
+	"github.com/MicBun/go-100-coverage-docker-crud/core"
+	"gorm.io/gorm"
+)
+
+var (
+	ErrSessionInactive = apperr.New(apperr.Unauthorized, "session_inactive", "session has been revoked or has expired")
+	// ErrSessionNotFound wraps gorm.ErrRecordNotFound.
+	ErrSessionNotFound = &apperr.Error{Kind: apperr.NotFound, Code: "session_not_found", Message: "session not found", Err: gorm.ErrRecordNotFound}
+)
+
+// lastSeenResolution limits how often a busy session writes its last seen time.
+const lastSeenResolution = time.Minute
+
+type Sessions struct {
+	db       *gorm.DB
+	lifespan time.Duration
+	now      func() time.Time
+}
+
+type SessionsInterface interface {
+	Start(userID uint, userAgent, ip string) (core.Session, error)
+	List(userID uint) ([]core.Session, error)
+	Revoke(userID, id uint) error
+	RevokeAll(userID uint) error
+	// RevokeOthers logs out every session of the user except keepID.
+	RevokeOthers(userID, keepID uint) error
+	Validate(id uint) (string, error)
+}
+
+// NewSessions keeps sessions alive for lifespan after their last refresh.
+func NewSessions(db *gorm.DB, lifespan time.Duration) SessionsInterface {
+	return &Sessions{
+		db:       db,
+		lifespan: lifespan,
+		now:      time.Now,
+	}
+}
+
+func (s *Sessions) Start(userID uint, userAgent, ip string) (core.Session, error) {
+	now := s.now()
+	session := core.Session{
+		UserID:     userID,
+		UserAgent:  userAgent,
+		IP:         ip,
+		LastSeenAt: now,
+		ExpiresAt:  now.Add(s.lifespan),
+	}
+	err := s.db.Create(&session).Error
+	return session, err
+}
+
+func (s *Sessions) active(db *gorm.DB) *gorm.DB {
+	return db.Where("revoked_at IS NULL AND expires_at > ?", s.now())
+}
+
+// List returns the user's active sessions, most recently used first.
+func (s *Sessions) List(userID uint) ([]core.Session, error) {
+	var sessions []core.Session
+	err := s.active(s.db.Model(core.Session{})).
+		Where("user_id = ?", userID).
+		Order("last_seen_at DESC").Order("id DESC").
+		Find(&sessions).Error
+	return sessions, err
+}
+
+// Revoke ends one of the user's sessions. Sessions of other users are
+// reported as not found.
+func (s *Sessions) Revoke(userID, id uint) error {
+	res := s.db.Model(core.Session{}).
+		Where("id = ? AND user_id = ? AND revoked_at IS NULL", id, userID).
+		Update("revoked_at", s.now())
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return ErrSessionNotFound
+	}
+	return nil
+}
+
+func (s *Sessions) RevokeAll(userID uint) error {
+	return s.db.Model(core.Session{}).
+		Where("user_id = ? AND revoked_at IS NULL", userID).
+		Update("revoked_at", s.now()).Error
+}
+
+func (s *Sessions) RevokeOthers(userID, keepID uint) error {
+	return s.db.Model(core.Session{}).
+		Where("user_id = ? AND id <> ? AND revoked_at IS NULL", userID, keepID).
+		Update("revoked_at", s.now()).Error
+}
+
+// Validate fails with ErrSessionInactive unless the session is live, and
+// records that it was just used. It returns the status of the session's user,
+// read in the same query, so callers can turn away users who are no longer
+// active without another lookup.
+func (s *Sessions) Validate(id uint) (string, error) {
+	var session struct {
+		core.Session
+		Status string
+	}
+	err := s.active(s.db.Model(core.Session{})).
+		Select("sessions.*, users.status").
+		Joins("JOIN users ON users.id = sessions.user_id").
+		Where("sessions.id = ?", id).
+		Take(&session).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return "", ErrSessionInactive
+	}
+	if err != nil {
+		return "", err
+	}
+	now := s.now()
+	if now.Sub(session.LastSeenAt) >= lastSeenResolution {
+		if err := s.db.Model(&session.Session).Update("last_seen_at", now).Error; err != nil {
+			return "", err
+		}
+	}
+	return session.Status, nil
+}
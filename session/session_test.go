@@ -0,0 +1,113 @@
+package session
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/MicBun/go-100-coverage-docker-crud/core"
+	"github.com/MicBun/go-100-coverage-docker-crud/database"
+	"github.com/stretchr/testify/assert"
+	"gorm.io/gorm"
+)
+
+// failWrites makes event ("INSERT", "UPDATE" or "DELETE") statements on table
+// fail for rows where when holds, until the returned func is called.
+func failWrites(t *testing.T, db *gorm.DB, table, event, when string) func() {
+	t.Helper()
+	name := strings.ToLower("fail_" + table + "_" + event)
+	assert.NoError(t, db.Exec(fmt.Sprintf(
+		"CREATE TRIGGER %s BEFORE %s ON %s WHEN %s BEGIN SELECT RAISE(ABORT, 'broken'); END",
+		name, event, table, when)).Error)
+	return func() { assert.NoError(t, db.Exec("DROP TRIGGER "+name).Error) }
+}
+
+func TestSessions(t *testing.T) {
+	database.RunTest(func(db *gorm.DB) {
+		now := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+		s := &Sessions{db: db, lifespan: time.Hour, now: func() time.Time { return now }}
+		for _, username := range []string{"foo@bar.com", "bar@foo.com"} {
+			assert.NoError(t, db.Create(&core.User{Username: username}).Error)
+		}
+
+		validate := func(id uint) error {
+			_, err := s.Validate(id)
+			return err
+		}
+
+		laptop, err := s.Start(1, "laptop", "10.0.0.1")
+		assert.NoError(t, err)
+		phone, err := s.Start(1, "phone", "10.0.0.2")
+		assert.NoError(t, err)
+		other, err := s.Start(2, "desktop", "10.0.0.3")
+		assert.NoError(t, err)
+
+		now = now.Add(2 * time.Minute)
+		status, err := s.Validate(laptop.ID)
+		assert.NoError(t, err)
+		assert.Equal(t, core.StatusActive, status)
+
+		sessions, err := s.List(1)
+		assert.NoError(t, err)
+		assert.Equal(t, 2, len(sessions))
+		assert.Equal(t, "laptop", sessions[0].UserAgent)
+		assert.True(t, sessions[0].LastSeenAt.Equal(now))
+		assert.Equal(t, "phone", sessions[1].UserAgent)
+
+		assert.ErrorIs(t, s.Revoke(1, other.ID), gorm.ErrRecordNotFound)
+		assert.NoError(t, s.Revoke(1, phone.ID))
+		assert.ErrorIs(t, s.Revoke(1, phone.ID), gorm.ErrRecordNotFound)
+		assert.ErrorIs(t, validate(phone.ID), ErrSessionInactive)
+		assert.NoError(t, validate(laptop.ID))
+
+		sessions, err = s.List(1)
+		assert.NoError(t, err)
+		assert.Equal(t, 1, len(sessions))
+
+		tablet, err := s.Start(1, "tablet", "10.0.0.3")
+		assert.NoError(t, err)
+		assert.NoError(t, s.RevokeOthers(1, tablet.ID))
+		assert.ErrorIs(t, validate(laptop.ID), ErrSessionInactive)
+		assert.NoError(t, validate(tablet.ID))
+		assert.NoError(t, validate(other.ID))
+
+		assert.NoError(t, s.RevokeAll(1))
+		assert.ErrorIs(t, validate(tablet.ID), ErrSessionInactive)
+		assert.NoError(t, validate(other.ID))
+		assert.NoError(t, db.Model(core.User{}).Where("id = ?", 2).Update("status", core.StatusSuspended).Error)
+		status, err = s.Validate(other.ID)
+		assert.NoError(t, err)
+		assert.Equal(t, core.StatusSuspended, status)
+
+		now = now.Add(2 * time.Hour)
+		assert.ErrorIs(t, validate(other.ID), ErrSessionInactive)
+		sessions, err = s.List(2)
+		assert.NoError(t, err)
+		assert.Equal(t, 0, len(sessions))
+	})
+}
+
+func TestSessionErrors(t *testing.T) {
+	database.RunTest(func(db *gorm.DB) {
+		s := NewSessions(db, time.Hour).(*Sessions)
+		user := core.User{Username: "foo@bar.com"}
+		assert.NoError(t, db.Create(&user).Error)
+		session, err := s.Start(user.ID, "laptop", "10.0.0.1")
+		assert.NoError(t, err)
+
+		restore := failWrites(t, db, "sessions", "UPDATE", "1")
+		assert.Error(t, s.Revoke(user.ID, session.ID))
+		s.now = func() time.Time { return session.LastSeenAt.Add(lastSeenResolution) }
+		_, err = s.Validate(session.ID)
+		assert.Error(t, err)
+		assert.NotErrorIs(t, err, ErrSessionInactive)
+		restore()
+
+		assert.NoError(t, db.Exec("ALTER TABLE users RENAME TO hidden_users").Error)
+		_, err = s.Validate(session.ID)
+		assert.Error(t, err)
+		assert.NotErrorIs(t, err, ErrSessionInactive)
+		assert.NoError(t, db.Exec("ALTER TABLE hidden_users RENAME TO users").Error)
+	})
+}
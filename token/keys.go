@@ -0,0 +1,122 @@
+package token
+
+import (
+	"time"
+
+	"github.com/MicBun/go-100-coverage-docker-crud/core"
+	"github.com/MicBun/go-100-coverage-docker-crud/util/jwtAuth"
+	"gorm.io/gorm"
+)
+
+// SigningKeys rotates the asymmetric keys that sign access tokens. Keys live
+// in the database so every instance signs with the same key and publishes
+// the same JWKS.
+//
+// A new key is published for publishFor before it starts signing, which
+// gives other instances and JWKS consumers time to pick it up. The key it
+// replaces is retired and stays published for verifyFor, the lifespan of
+// the tokens it signed, before it is deleted. Audit checkpoints keep their own
+// copy of the public half, so deleting a key doesn't affect them.
+type SigningKeys struct {
+	db          *gorm.DB
+	algorithm   string
+	rotateEvery time.Duration
+	publishFor  time.Duration
+	verifyFor   time.Duration
+	now         func() time.Time
+}
+
+type SigningKeysInterface interface {
+	// Sync rotates keys when due and installs the current key set into
+	// jwtAuth.
+	Sync() error
+}
+
+func NewSigningKeys(db *gorm.DB, algorithm string, rotateEvery, publishFor, verifyFor time.Duration) SigningKeysInterface {
+	return &SigningKeys{
+		db:          db,
+		algorithm:   algorithm,
+		rotateEvery: rotateEvery,
+		publishFor:  publishFor,
+		verifyFor:   verifyFor,
+		now:         time.Now,
+	}
+}
+
+// generateKey creates new signing keys, replaced in tests.
+var generateKey = jwtAuth.GenerateKey
+
+func (k *SigningKeys) create() (core.SigningKey, error) {
+	key, err := generateKey(k.algorithm)
+	if err != nil {
+		return core.SigningKey{}, err
+	}
+	encoded, err := jwtAuth.EncodePrivateKey(key)
+	if err != nil {
+		return core.SigningKey{}, err
+	}
+	row := core.SigningKey{ID: key.ID, Algorithm: key.Algorithm, PrivateKey: encoded, CreatedAt: k.now()}
+	return row, k.db.Create(&row).Error
+}
+
+func (k *SigningKeys) Sync() error {
+	now := k.now()
+	if err := k.db.Where("retired_at <= ?", now.Add(-k.verifyFor)).Delete(&core.SigningKey{}).Error; err != nil {
+		return err
+	}
+	var rows []core.SigningKey
+	if err := k.db.Order("created_at").Find(&rows).Error; err != nil {
+		return err
+	}
+
+	if n := len(rows); n == 0 || rows[n-1].Algorithm != k.algorithm || !rows[n-1].CreatedAt.After(now.Add(-k.rotateEvery)) {
+		row, err := k.create()
+		if err != nil {
+			return err
+		}
+		rows = append(rows, row)
+	}
+
+	// Sign with the newest key that has been published long enough, or with
+	// the oldest active key while no key has.
+	signing := -1
+	for i := len(rows) - 1; i >= 0; i-- {
+		if !rows[i].CreatedAt.After(now.Add(-k.publishFor)) {
+			signing = i
+			break
+		}
+	}
+	if signing < 0 {
+		for i, row := range rows {
+			if row.RetiredAt == nil {
+				signing = i
+				break
+			}
+		}
+	}
+
+	var ids []string
+	for i := 0; i < signing; i++ {
+		if rows[i].RetiredAt == nil {
+			rows[i].RetiredAt = &now
+			ids = append(ids, rows[i].ID)
+		}
+	}
+	if len(ids) > 0 {
+		err := k.db.Model(core.SigningKey{}).Where("id IN ? AND retired_at IS NULL", ids).Update("retired_at", now).Error
+		if err != nil {
+			return err
+		}
+	}
+
+	keys := make([]jwtAuth.Key, 0, len(rows))
+	for _, row := range rows {
+		key, err := jwtAuth.DecodePrivateKey(row.ID, row.Algorithm, row.PrivateKey)
+		if err != nil {
+			return err
+		}
+		keys = append(keys, key)
+	}
+	jwtAuth.SetKeys(keys[signing], keys...)
+	return nil
+}
@@ -0,0 +1,168 @@
+package token
+
+import (
+	"testing"
+	"time"
+
+	"github.com/MicBun/go-100-coverage-docker-crud/core"
+	"github.com/MicBun/go-100-coverage-docker-crud/database"
+	"github.com/MicBun/go-100-coverage-docker-crud/util/jwtAuth"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/stretchr/testify/assert"
+	"gorm.io/gorm"
+)
+
+func TestSigningKeyRotation(t *testing.T) {
+	defer jwtAuth.SetKeys(jwtAuth.HMACKey("rahasiasekali"))
+	database.RunTest(func(db *gorm.DB) {
+		now := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+		k := NewSigningKeys(db, jwtAuth.AlgES256, 24*time.Hour, time.Hour, 15*time.Minute).(*SigningKeys)
+		k.now = func() time.Time { return now }
+		kids := func() []string {
+			var ids []string
+			for _, key := range jwtAuth.JWKS().Keys {
+				ids = append(ids, key.KeyID)
+			}
+			return ids
+		}
+		kidOf := func(token string) string {
+			parsed, _, err := new(jwt.Parser).ParseUnverified(token, jwt.MapClaims{})
+			assert.NoError(t, err)
+			return parsed.Header["kid"].(string)
+		}
+
+		legacy, err := jwtAuth.GenerateToken(1, []string{core.RoleUser}, 0)
+		assert.NoError(t, err)
+
+		// The first key signs right away.
+		assert.NoError(t, k.Sync())
+		first, err := jwtAuth.GenerateToken(1, []string{core.RoleUser}, 0)
+		assert.NoError(t, err)
+		firstKid := kidOf(first)
+		assert.Equal(t, []string{firstKid}, kids())
+		_, err = jwtAuth.ParseToken(first)
+		assert.NoError(t, err)
+		_, err = jwtAuth.ParseToken(legacy)
+		assert.Error(t, err)
+
+		// A rotated key is published before it takes over signing.
+		now = now.Add(25 * time.Hour)
+		assert.NoError(t, k.Sync())
+		assert.Equal(t, 2, len(kids()))
+		token, _ := jwtAuth.GenerateToken(1, nil, 0)
+		assert.Equal(t, firstKid, kidOf(token))
+
+		now = now.Add(time.Hour)
+		assert.NoError(t, k.Sync())
+		token, _ = jwtAuth.GenerateToken(1, nil, 0)
+		secondKid := kidOf(token)
+		assert.NotEqual(t, firstKid, secondKid)
+		_, err = jwtAuth.ParseToken(first)
+		assert.NoError(t, err)
+		var retired core.SigningKey
+		assert.NoError(t, db.First(&retired, "id = ?", firstKid).Error)
+		assert.NotNil(t, retired.RetiredAt)
+
+		// Once its tokens have expired the retired key is gone.
+		now = now.Add(15 * time.Minute)
+		assert.NoError(t, k.Sync())
+		assert.Equal(t, []string{secondKid}, kids())
+		_, err = jwtAuth.ParseToken(first)
+		assert.Error(t, err)
+
+		// Another instance picks up the same keys.
+		other := NewSigningKeys(db, jwtAuth.AlgES256, 24*time.Hour, time.Hour, 15*time.Minute).(*SigningKeys)
+		other.now = k.now
+		jwtAuth.SetKeys(jwtAuth.HMACKey("rahasiasekali"))
+		assert.NoError(t, other.Sync())
+		assert.Equal(t, []string{secondKid}, kids())
+
+		// Switching algorithms rotates immediately.
+		k.algorithm = jwtAuth.AlgEdDSA
+		assert.NoError(t, k.Sync())
+		set := jwtAuth.JWKS()
+		assert.Equal(t, 2, len(set.Keys))
+	})
+}
+
+func TestSigningKeyErrors(t *testing.T) {
+	defer jwtAuth.SetKeys(jwtAuth.HMACKey("rahasiasekali"))
+	database.RunTest(func(db *gorm.DB) {
+		now := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+		k := NewSigningKeys(db, "none", 24*time.Hour, time.Hour, 15*time.Minute).(*SigningKeys)
+		k.now = func() time.Time { return now }
+		assert.Error(t, k.Sync())
+
+		k.algorithm = jwtAuth.AlgES256
+		generateKey = func(algorithm string) (jwtAuth.Key, error) {
+			return jwtAuth.Key{ID: "empty", Algorithm: algorithm}, nil
+		}
+		assert.Error(t, k.Sync())
+		generateKey = jwtAuth.GenerateKey
+
+		restore := hideTable(t, db, "signing_keys")
+		assert.Error(t, k.Sync())
+		restore()
+		restore = failFinds(t, db, &[]core.SigningKey{})
+		assert.Error(t, k.Sync())
+		restore()
+
+		assert.NoError(t, k.Sync())
+		now = now.Add(25 * time.Hour)
+		assert.NoError(t, k.Sync())
+		now = now.Add(time.Hour)
+		restore = failWrites(t, db, "signing_keys", "UPDATE", "1")
+		assert.Error(t, k.Sync())
+		restore()
+
+		assert.NoError(t, db.Model(core.SigningKey{}).Where("1 = 1").Update("private_key", "garbage").Error)
+		assert.Error(t, k.Sync())
+	})
+}
+
+func TestSigningAlgorithms(t *testing.T) {
+	defer jwtAuth.SetKeys(jwtAuth.HMACKey("rahasiasekali"))
+	for _, tc := range []struct {
+		algorithm string
+		keyType   string
+		curve     string
+	}{
+		{jwtAuth.AlgRS256, "RSA", ""},
+		{jwtAuth.AlgES256, "EC", "P-256"},
+		{jwtAuth.AlgEdDSA, "OKP", "Ed25519"},
+	} {
+		key, err := jwtAuth.GenerateKey(tc.algorithm)
+		assert.NoError(t, err)
+		encoded, err := jwtAuth.EncodePrivateKey(key)
+		assert.NoError(t, err)
+		decoded, err := jwtAuth.DecodePrivateKey(key.ID, tc.algorithm, encoded)
+		assert.NoError(t, err)
+
+		jwtAuth.SetKeys(decoded)
+		token, err := jwtAuth.GenerateToken(3, []string{core.RoleAdmin}, 9)
+		assert.NoError(t, err)
+		claims, err := jwtAuth.ParseToken(token)
+		assert.NoError(t, err)
+		assert.Equal(t, float64(3), claims["id"])
+
+		set := jwtAuth.JWKS()
+		assert.Equal(t, 1, len(set.Keys))
+		assert.Equal(t, tc.keyType, set.Keys[0].KeyType)
+		assert.Equal(t, tc.curve, set.Keys[0].Curve)
+		assert.Equal(t, tc.algorithm, set.Keys[0].Algorithm)
+		assert.Equal(t, key.ID, set.Keys[0].KeyID)
+	}
+
+	// An HMAC token naming a published key must not verify with it.
+	key, _ := jwtAuth.GenerateKey(jwtAuth.AlgRS256)
+	jwtAuth.SetKeys(key)
+	forged := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"id": 1})
+	forged.Header["kid"] = key.ID
+	signed, err := forged.SignedString([]byte("rahasiasekali"))
+	assert.NoError(t, err)
+	_, err = jwtAuth.ParseToken(signed)
+	assert.Error(t, err)
+
+	_, err = jwtAuth.GenerateKey("none")
+	assert.Error(t, err)
+}
@@ -0,0 +1,140 @@
+package token
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"io"
+	"time"
+
+	"github.com/MicBun/go-100-coverage-docker-crud/apperr"
+	"github.com/MicBun/go-100-coverage-docker-crud/core"
+	"gorm.io/gorm"
+)
+
+var (
+	ErrInvalidRefreshToken = apperr.New(apperr.Unauthorized, "invalid_refresh_token", "invalid refresh token")
+	ErrRefreshTokenReused  = apperr.New(apperr.Unauthorized, "refresh_token_reused", "refresh token reused, the session has been revoked")
+)
+
+type Refresh struct {
+	db       *gorm.DB
+	lifespan time.Duration
+	now      func() time.Time
+}
+
+// RefreshInterface issues opaque refresh tokens for a session. Only their
+// SHA-256 is stored. Rotating a token spends it, and presenting a spent
+// token revokes the session it belongs to.
+type RefreshInterface interface {
+	Issue(userID, sessionID uint) (string, error)
+	Rotate(plain string) (core.RefreshToken, string, error)
+}
+
+func NewRefresh(db *gorm.DB, lifespan time.Duration) RefreshInterface {
+	return &Refresh{
+		db:       db,
+		lifespan: lifespan,
+		now:      time.Now,
+	}
+}
+
+// random is the source of refresh tokens, replaced in tests.
+var random = rand.Reader
+
+func randomToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := io.ReadFull(random, b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func hashToken(plain string) string {
+	sum := sha256.Sum256([]byte(plain))
+	return hex.EncodeToString(sum[:])
+}
+
+func (r *Refresh) create(tx *gorm.DB, userID, sessionID uint) (string, error) {
+	plain, err := randomToken()
+	if err != nil {
+		return "", err
+	}
+	err = tx.Create(&core.RefreshToken{
+		UserID:    userID,
+		SessionID: sessionID,
+		TokenHash: hashToken(plain),
+		ExpiresAt: r.now().Add(r.lifespan),
+	}).Error
+	return plain, err
+}
+
+func (r *Refresh) Issue(userID, sessionID uint) (string, error) {
+	return r.create(r.db, userID, sessionID)
+}
+
+// Rotate spends the token and returns it together with its replacement. The
+// session is extended by the refresh lifespan.
+func (r *Refresh) Rotate(plain string) (core.RefreshToken, string, error) {
+	var current core.RefreshToken
+	var next string
+	reused := false
+	err := r.db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(core.RefreshToken{}).Where("token_hash = ?", hashToken(plain)).First(&current).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrInvalidRefreshToken
+		}
+		if err != nil {
+			return err
+		}
+		now := r.now()
+		var session core.Session
+		err = tx.Model(core.Session{}).
+			Where("id = ? AND revoked_at IS NULL AND expires_at > ?", current.SessionID, now).
+			First(&session).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrInvalidRefreshToken
+		}
+		if err != nil {
+			return err
+		}
+		if current.RevokedAt != nil {
+			return ErrInvalidRefreshToken
+		}
+		// Spend the token with a conditional update so that two concurrent
+		// refreshes with the same token cannot both succeed.
+		res := tx.Model(core.RefreshToken{}).
+			Where("id = ? AND used_at IS NULL", current.ID).
+			Update("used_at", now)
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			reused = true
+			if err := tx.Model(&session).Update("revoked_at", now).Error; err != nil {
+				return err
+			}
+			return tx.Model(core.RefreshToken{}).
+				Where("session_id = ? AND revoked_at IS NULL", session.ID).
+				Update("revoked_at", now).Error
+		}
+		if !current.ExpiresAt.After(now) {
+			return ErrInvalidRefreshToken
+		}
+		err = tx.Model(&session).Updates(core.Session{LastSeenAt: now, ExpiresAt: now.Add(r.lifespan)}).Error
+		if err != nil {
+			return err
+		}
+		next, err = r.create(tx, current.UserID, current.SessionID)
+		return err
+	})
+	if err != nil {
+		return core.RefreshToken{}, "", err
+	}
+	if reused {
+		return core.RefreshToken{}, "", ErrRefreshTokenReused
+	}
+	return current, next, nil
+}
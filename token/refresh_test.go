@@ -0,0 +1,169 @@
+package token
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/MicBun/go-100-coverage-docker-crud/core"
+	"github.com/MicBun/go-100-coverage-docker-crud/database"
+	"github.com/stretchr/testify/assert"
+	"gorm.io/gorm"
+)
+
+// failWrites makes event ("INSERT", "UPDATE" or "DELETE") statements on table
+// fail for rows where when holds, until the returned func is called.
+func failWrites(t *testing.T, db *gorm.DB, table, event, when string) func() {
+	t.Helper()
+	name := strings.ToLower("fail_" + table + "_" + event)
+	assert.NoError(t, db.Exec(fmt.Sprintf(
+		"CREATE TRIGGER %s BEFORE %s ON %s WHEN %s BEGIN SELECT RAISE(ABORT, 'broken'); END",
+		name, event, table, when)).Error)
+	return func() { assert.NoError(t, db.Exec("DROP TRIGGER "+name).Error) }
+}
+
+// hideTable makes every statement on table fail, until the returned func is
+// called.
+func hideTable(t *testing.T, db *gorm.DB, table string) func() {
+	t.Helper()
+	assert.NoError(t, db.Exec(fmt.Sprintf("ALTER TABLE %s RENAME TO hidden_%s", table, table)).Error)
+	return func() {
+		assert.NoError(t, db.Exec(fmt.Sprintf("ALTER TABLE hidden_%s RENAME TO %s", table, table)).Error)
+	}
+}
+
+// failFinds makes queries that load into a value of the same type as dest
+// fail, until the returned func is called.
+func failFinds(t *testing.T, db *gorm.DB, dest interface{}) func() {
+	t.Helper()
+	assert.NoError(t, db.Callback().Query().Before("gorm:query").Register("test:fail_finds", func(tx *gorm.DB) {
+		if reflect.TypeOf(tx.Statement.Dest) == reflect.TypeOf(dest) {
+			tx.AddError(errors.New("broken"))
+		}
+	}))
+	return func() { assert.NoError(t, db.Callback().Query().Remove("test:fail_finds")) }
+}
+
+type failingReader struct{}
+
+func (failingReader) Read([]byte) (int, error) { return 0, errors.New("no entropy") }
+
+func TestRefreshRotation(t *testing.T) {
+	database.RunTest(func(db *gorm.DB) {
+		now := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+		r := &Refresh{db: db, lifespan: time.Hour, now: func() time.Time { return now }}
+		start := func() core.Session {
+			s := core.Session{UserID: 7, LastSeenAt: now, ExpiresAt: now.Add(time.Hour)}
+			assert.NoError(t, db.Create(&s).Error)
+			return s
+		}
+
+		session := start()
+		first, err := r.Issue(7, session.ID)
+		assert.NoError(t, err)
+
+		var stored core.RefreshToken
+		assert.NoError(t, db.First(&stored).Error)
+		assert.NotEqual(t, first, stored.TokenHash)
+		assert.Equal(t, hashToken(first), stored.TokenHash)
+
+		now = now.Add(30 * time.Minute)
+		spent, second, err := r.Rotate(first)
+		assert.NoError(t, err)
+		assert.Equal(t, uint(7), spent.UserID)
+		assert.Equal(t, session.ID, spent.SessionID)
+		assert.NotEqual(t, first, second)
+		assert.NoError(t, db.First(&session, session.ID).Error)
+		assert.True(t, session.ExpiresAt.Equal(now.Add(time.Hour)))
+
+		_, _, err = r.Rotate("unknown")
+		assert.ErrorIs(t, err, ErrInvalidRefreshToken)
+
+		otherSession := start()
+		other, err := r.Issue(7, otherSession.ID)
+		assert.NoError(t, err)
+
+		// Replaying the spent token revokes its session but not other logins.
+		_, _, err = r.Rotate(first)
+		assert.ErrorIs(t, err, ErrRefreshTokenReused)
+		_, _, err = r.Rotate(second)
+		assert.ErrorIs(t, err, ErrInvalidRefreshToken)
+		assert.NoError(t, db.First(&session, session.ID).Error)
+		assert.NotNil(t, session.RevokedAt)
+
+		_, third, err := r.Rotate(other)
+		assert.NoError(t, err)
+
+		now = now.Add(2 * time.Hour)
+		_, _, err = r.Rotate(third)
+		assert.ErrorIs(t, err, ErrInvalidRefreshToken)
+
+		// A live session does not keep an expired token alive.
+		longSession := core.Session{UserID: 7, ExpiresAt: now.Add(24 * time.Hour)}
+		assert.NoError(t, db.Create(&longSession).Error)
+		fourth, err := r.Issue(7, longSession.ID)
+		assert.NoError(t, err)
+		now = now.Add(2 * time.Hour)
+		_, _, err = r.Rotate(fourth)
+		assert.ErrorIs(t, err, ErrInvalidRefreshToken)
+	})
+}
+
+func TestRefreshErrors(t *testing.T) {
+	database.RunTest(func(db *gorm.DB) {
+		r := NewRefresh(db, time.Hour)
+		session := core.Session{UserID: 7, LastSeenAt: time.Now(), ExpiresAt: time.Now().Add(time.Hour)}
+		assert.NoError(t, db.Create(&session).Error)
+		issue := func() string {
+			plain, err := r.Issue(7, session.ID)
+			assert.NoError(t, err)
+			return plain
+		}
+
+		random = failingReader{}
+		_, err := r.Issue(7, session.ID)
+		random = rand.Reader
+		assert.Error(t, err)
+
+		plain := issue()
+		for _, dest := range []interface{}{&core.RefreshToken{}, &core.Session{}} {
+			restore := failFinds(t, db, dest)
+			_, _, err = r.Rotate(plain)
+			assert.Error(t, err)
+			assert.NotErrorIs(t, err, ErrInvalidRefreshToken)
+			restore()
+		}
+
+		restore := failWrites(t, db, "refresh_tokens", "UPDATE", "NEW.used_at IS NOT NULL")
+		_, _, err = r.Rotate(plain)
+		assert.Error(t, err)
+		restore()
+		restore = failWrites(t, db, "sessions", "UPDATE", "1")
+		_, _, err = r.Rotate(plain)
+		assert.Error(t, err)
+		restore()
+		restore = failWrites(t, db, "refresh_tokens", "INSERT", "1")
+		_, _, err = r.Rotate(plain)
+		assert.Error(t, err)
+		restore()
+
+		// A failed rotation leaves the token unspent.
+		_, next, err := r.Rotate(plain)
+		assert.NoError(t, err)
+		restore = failWrites(t, db, "sessions", "UPDATE", "NEW.revoked_at IS NOT NULL")
+		_, _, err = r.Rotate(plain)
+		assert.Error(t, err)
+		assert.NotErrorIs(t, err, ErrRefreshTokenReused)
+		restore()
+
+		// Tokens revoked along with an earlier session don't rotate.
+		assert.NoError(t, db.Model(core.RefreshToken{}).Where("token_hash = ?", hashToken(next)).
+			Update("revoked_at", time.Now()).Error)
+		_, _, err = r.Rotate(next)
+		assert.ErrorIs(t, err, ErrInvalidRefreshToken)
+	})
+}
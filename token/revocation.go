@@ -0,0 +1,96 @@
+package token
+
+import (
+	"sync"
+	"time"
+
+	"github.com/MicBun/go-100-coverage-docker-crud/core"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+type cacheEntry struct {
+	revoked bool
+	until   time.Time
+}
+
+// Revocations is the deny list of access tokens by jti. Lookups are cached in
+// process: revocations until the token expires, and the absence of one for
+// cacheTTL, which bounds how long another instance's revocation goes unseen.
+type Revocations struct {
+	db       *gorm.DB
+	cacheTTL time.Duration
+	now      func() time.Time
+
+	mu    sync.Mutex
+	cache map[string]cacheEntry
+}
+
+type RevocationsInterface interface {
+	Revoke(jti string, expiresAt time.Time) error
+	IsRevoked(jti string) (bool, error)
+	Prune() (int64, error)
+}
+
+func NewRevocations(db *gorm.DB, cacheTTL time.Duration) RevocationsInterface {
+	return &Revocations{
+		db:       db,
+		cacheTTL: cacheTTL,
+		now:      time.Now,
+		cache:    map[string]cacheEntry{},
+	}
+}
+
+func (r *Revocations) remember(jti string, entry cacheEntry) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.cache[jti] = entry
+}
+
+func (r *Revocations) Revoke(jti string, expiresAt time.Time) error {
+	err := r.db.Clauses(clause.OnConflict{DoNothing: true}).
+		Create(&core.RevokedToken{JTI: jti, ExpiresAt: expiresAt}).Error
+	if err != nil {
+		return err
+	}
+	r.remember(jti, cacheEntry{revoked: true, until: expiresAt})
+	return nil
+}
+
+func (r *Revocations) IsRevoked(jti string) (bool, error) {
+	now := r.now()
+	r.mu.Lock()
+	entry, ok := r.cache[jti]
+	r.mu.Unlock()
+	if ok && now.Before(entry.until) {
+		return entry.revoked, nil
+	}
+
+	var revoked core.RevokedToken
+	res := r.db.Model(core.RevokedToken{}).Where("jti = ?", jti).Limit(1).Find(&revoked)
+	if res.Error != nil {
+		return false, res.Error
+	}
+	if res.RowsAffected == 0 {
+		r.remember(jti, cacheEntry{revoked: false, until: now.Add(r.cacheTTL)})
+		return false, nil
+	}
+	r.remember(jti, cacheEntry{revoked: true, until: revoked.ExpiresAt})
+	return true, nil
+}
+
+// Prune forgets revocations of tokens that have expired anyway, both in the
+// database and in the cache, and returns how many rows were deleted.
+func (r *Revocations) Prune() (int64, error) {
+	now := r.now()
+	r.mu.Lock()
+	for jti, entry := range r.cache {
+		if !now.Before(entry.until) {
+			delete(r.cache, jti)
+		}
+	}
+	r.mu.Unlock()
+
+	res := r.db.Where("expires_at <= ?", now).Delete(&core.RevokedToken{})
+	return res.RowsAffected, res.Error
+}
@@ -0,0 +1,70 @@
+package token
+
+import (
+	"testing"
+	"time"
+
+	"github.com/MicBun/go-100-coverage-docker-crud/core"
+	"github.com/MicBun/go-100-coverage-docker-crud/database"
+	"github.com/stretchr/testify/assert"
+	"gorm.io/gorm"
+)
+
+func TestRevocations(t *testing.T) {
+	database.RunTest(func(db *gorm.DB) {
+		now := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+		r := NewRevocations(db, time.Minute).(*Revocations)
+		r.now = func() time.Time { return now }
+
+		revoked, err := r.IsRevoked("a")
+		assert.NoError(t, err)
+		assert.False(t, revoked)
+
+		assert.NoError(t, r.Revoke("a", now.Add(time.Hour)))
+		assert.NoError(t, r.Revoke("a", now.Add(time.Hour)))
+		revoked, err = r.IsRevoked("a")
+		assert.NoError(t, err)
+		assert.True(t, revoked)
+
+		// A revocation written by another instance shows up once the cached
+		// negative answer expires.
+		other := NewRevocations(db, time.Minute)
+		assert.NoError(t, other.Revoke("b", now.Add(2*time.Hour)))
+		assert.NoError(t, db.Create(&core.RevokedToken{JTI: "c", ExpiresAt: now.Add(time.Hour)}).Error)
+		revoked, _ = r.IsRevoked("c")
+		assert.True(t, revoked)
+		revoked, _ = r.IsRevoked("d")
+		assert.False(t, revoked)
+		assert.NoError(t, db.Create(&core.RevokedToken{JTI: "d", ExpiresAt: now.Add(time.Hour)}).Error)
+		revoked, _ = r.IsRevoked("d")
+		assert.False(t, revoked)
+		now = now.Add(2 * time.Minute)
+		revoked, _ = r.IsRevoked("d")
+		assert.True(t, revoked)
+
+		now = now.Add(time.Hour)
+		pruned, err := r.Prune()
+		assert.NoError(t, err)
+		assert.Equal(t, int64(3), pruned)
+		revoked, _ = r.IsRevoked("b")
+		assert.True(t, revoked)
+		revoked, _ = r.IsRevoked("a")
+		assert.False(t, revoked)
+	})
+}
+
+func TestRevocationsError(t *testing.T) {
+	database.RunTest(func(db *gorm.DB) {
+		r := NewRevocations(db, time.Minute)
+		restore := hideTable(t, db, "revoked_tokens")
+		assert.Error(t, r.Revoke("a", time.Now().Add(time.Hour)))
+		_, err := r.IsRevoked("a")
+		assert.Error(t, err)
+		restore()
+
+		// Failures aren't cached.
+		revoked, err := r.IsRevoked("a")
+		assert.NoError(t, err)
+		assert.False(t, revoked)
+	})
+}
@@ -0,0 +1,209 @@
+package user
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/MicBun/go-100-coverage-docker-crud/apperr"
+	"github.com/MicBun/go-100-coverage-docker-crud/core"
+	"gorm.io/gorm"
+)
+
+const (
+	DefaultListLimit = 20
+	MaxListLimit     = 100
+)
+
+var ErrInvalidCursor = apperr.New(apperr.Invalid, "invalid_cursor", "invalid cursor")
+
+var sortColumns = map[string]string{
+	"id":         "id",
+	"username":   "username",
+	"name":       "name",
+	"created_at": "created_at",
+}
+
+// ListOptions filters and pages ListUsers. Sort is one of id, username, name
+// or created_at, prefixed with "-" for descending order. Cursor is an opaque
+// value taken from a previous ListResult. Deleted lists soft-deleted users
+// instead of live ones.
+type ListOptions struct {
+	Limit         int
+	Cursor        string
+	Username      string
+	Name          string
+	Status        string
+	Deleted       bool
+	CreatedAfter  *time.Time
+	CreatedBefore *time.Time
+	Sort          string
+}
+
+type ListResult struct {
+	Users      []core.User
+	Total      int64
+	NextCursor string
+	PrevCursor string
+}
+
+type cursor struct {
+	Value    string `json:"v"`
+	ID       uint   `json:"id"`
+	Backward bool   `json:"b,omitempty"`
+}
+
+func encodeCursor(c cursor) string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeCursor(s string) (cursor, error) {
+	var c cursor
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return c, ErrInvalidCursor
+	}
+	if err := json.Unmarshal(data, &c); err != nil {
+		return c, ErrInvalidCursor
+	}
+	return c, nil
+}
+
+func sortValue(user core.User, key string) string {
+	switch key {
+	case "username":
+		return user.Username
+	case "name":
+		return user.Name
+	case "created_at":
+		return user.CreatedAt.UTC().Format(time.RFC3339Nano)
+	}
+	return ""
+}
+
+func cursorArg(key, value string) (interface{}, error) {
+	if key == "created_at" {
+		t, err := time.Parse(time.RFC3339Nano, value)
+		if err != nil {
+			return nil, ErrInvalidCursor
+		}
+		return t, nil
+	}
+	return value, nil
+}
+
+func (o ListOptions) filter(db *gorm.DB) *gorm.DB {
+	if o.Deleted {
+		db = db.Unscoped().Where("deleted_at IS NOT NULL")
+	}
+	if o.Username != "" {
+		db = db.Where("username LIKE ?", "%"+o.Username+"%")
+	}
+	if o.Name != "" {
+		db = db.Where("name LIKE ?", "%"+o.Name+"%")
+	}
+	if o.Status != "" {
+		db = db.Where("status = ?", o.Status)
+	}
+	if o.CreatedAfter != nil {
+		db = db.Where("created_at >= ?", *o.CreatedAfter)
+	}
+	if o.CreatedBefore != nil {
+		db = db.Where("created_at < ?", *o.CreatedBefore)
+	}
+	return db
+}
+
+func (a *Auth) ListUsers(opts ListOptions) (ListResult, error) {
+	var result ListResult
+
+	limit := opts.Limit
+	if limit <= 0 {
+		limit = DefaultListLimit
+	}
+	if limit > MaxListLimit {
+		limit = MaxListLimit
+	}
+
+	key := strings.TrimPrefix(opts.Sort, "-")
+	if key == "" {
+		key = "id"
+	}
+	column, ok := sortColumns[key]
+	if !ok {
+		return result, apperr.New(apperr.Invalid, "invalid_sort", fmt.Sprintf("invalid sort key %q", key))
+	}
+	descending := strings.HasPrefix(opts.Sort, "-")
+
+	var after cursor
+	if opts.Cursor != "" {
+		c, err := decodeCursor(opts.Cursor)
+		if err != nil {
+			return result, err
+		}
+		after = c
+	}
+
+	if err := opts.filter(a.db.Model(core.User{})).Count(&result.Total).Error; err != nil {
+		return result, err
+	}
+
+	// Walking backwards is the same query with every comparison and ordering
+	// flipped; the page is reversed again once loaded.
+	reverse := descending != after.Backward
+	cmp, order := ">", "ASC"
+	if reverse {
+		cmp, order = "<", "DESC"
+	}
+
+	query := opts.filter(a.db.Model(core.User{}))
+	if opts.Cursor != "" {
+		if column == "id" {
+			query = query.Where("id "+cmp+" ?", after.ID)
+		} else {
+			value, err := cursorArg(key, after.Value)
+			if err != nil {
+				return result, err
+			}
+			query = query.Where(
+				fmt.Sprintf("(%s %s ?) OR (%s = ? AND id %s ?)", column, cmp, column, cmp),
+				value, value, after.ID,
+			)
+		}
+	}
+	if column != "id" {
+		query = query.Order(column + " " + order)
+	}
+	query = query.Order("id " + order)
+
+	var users []core.User
+	if err := query.Limit(limit + 1).Find(&users).Error; err != nil {
+		return result, err
+	}
+	hasMore := len(users) > limit
+	if hasMore {
+		users = users[:limit]
+	}
+	if after.Backward {
+		for i, j := 0, len(users)-1; i < j; i, j = i+1, j-1 {
+			users[i], users[j] = users[j], users[i]
+		}
+	}
+
+	result.Users = users
+	if len(users) == 0 {
+		return result, nil
+	}
+
+	first, last := users[0], users[len(users)-1]
+	if (!after.Backward && hasMore) || after.Backward {
+		result.NextCursor = encodeCursor(cursor{Value: sortValue(last, key), ID: last.ID})
+	}
+	if (after.Backward && hasMore) || (!after.Backward && opts.Cursor != "") {
+		result.PrevCursor = encodeCursor(cursor{Value: sortValue(first, key), ID: first.ID, Backward: true})
+	}
+	return result, nil
+}
@@ -0,0 +1,171 @@
+package user
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/MicBun/go-100-coverage-docker-crud/apperr"
+	"github.com/MicBun/go-100-coverage-docker-crud/core"
+	"github.com/MicBun/go-100-coverage-docker-crud/notify"
+	"github.com/MicBun/go-100-coverage-docker-crud/util/password"
+	"gorm.io/gorm"
+)
+
+var ErrInvalidResetToken = apperr.New(apperr.Invalid, "invalid_reset_token", "invalid or expired reset token")
+
+type PasswordReset struct {
+	db       *gorm.DB
+	hasher   password.PasswordHasher
+	notifier notify.Notifier
+	lifespan time.Duration
+	resetURL string
+	now      func() time.Time
+
+	// pending tracks requests still being handled in the background.
+	pending sync.WaitGroup
+}
+
+// PasswordResetInterface lets users who forgot their password set a new one
+// through a token sent to their username, which doubles as email address.
+type PasswordResetInterface interface {
+	// Request sends a reset token in the background. Unknown usernames are
+	// ignored and failures are only logged, so neither the result nor the
+	// time taken tells callers which accounts exist.
+	Request(username string)
+	// Reset spends the token, sets the new password and returns the user.
+	Reset(token, newPassword string) (core.User, error)
+}
+
+// NewPasswordReset builds the reset flow. When resetURL is set, messages link
+// to it with the token in the token query parameter.
+func NewPasswordReset(db *gorm.DB, hasher password.PasswordHasher, notifier notify.Notifier, lifespan time.Duration, resetURL string) PasswordResetInterface {
+	return &PasswordReset{
+		db:       db,
+		hasher:   hasher,
+		notifier: notifier,
+		lifespan: lifespan,
+		resetURL: resetURL,
+		now:      time.Now,
+	}
+}
+
+// random is the source of tokens, replaced in tests.
+var random = rand.Reader
+
+// newToken returns a random token to send to the user along with the hash to
+// store in its place.
+func newToken() (string, string, error) {
+	b := make([]byte, 32)
+	if _, err := io.ReadFull(random, b); err != nil {
+		return "", "", err
+	}
+	plain := base64.RawURLEncoding.EncodeToString(b)
+	return plain, hashToken(plain), nil
+}
+
+func hashToken(plain string) string {
+	sum := sha256.Sum256([]byte(plain))
+	return hex.EncodeToString(sum[:])
+}
+
+func (p *PasswordReset) Request(username string) {
+	p.pending.Add(1)
+	go func() {
+		defer p.pending.Done()
+		if err := p.send(username); err != nil {
+			log.Printf("Unable to send a password reset token %v", err)
+		}
+	}()
+}
+
+// send stores and sends a reset token when username exists.
+func (p *PasswordReset) send(username string) error {
+	var user core.User
+	res := p.db.Model(core.User{}).Where("username = ?", username).Limit(1).Find(&user)
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return nil
+	}
+
+	plain, hashed, err := newToken()
+	if err != nil {
+		return err
+	}
+	expiresAt := p.now().Add(p.lifespan)
+	err = p.db.Create(&core.PasswordReset{
+		UserID:    user.ID,
+		TokenHash: hashed,
+		ExpiresAt: expiresAt,
+	}).Error
+	if err != nil {
+		return err
+	}
+
+	body := fmt.Sprintf("Hi %s,\n\nSomeone asked to reset the password of your account. "+
+		"If it was you, use this reset token before %s:\n\n%s\n",
+		user.Name, expiresAt.UTC().Format(time.RFC1123), plain)
+	if p.resetURL != "" {
+		body += fmt.Sprintf("\nor open %s?token=%s\n", p.resetURL, url.QueryEscape(plain))
+	}
+	body += "\nIf it wasn't you, ignore this message and your password stays the same.\n"
+	return p.notifier.Send(notify.Message{To: user.Username, Subject: "Reset your password", Body: body})
+}
+
+func (p *PasswordReset) Reset(token, newPassword string) (core.User, error) {
+	var user core.User
+	err := p.db.Transaction(func(tx *gorm.DB) error {
+		var reset core.PasswordReset
+		err := tx.Model(core.PasswordReset{}).Where("token_hash = ?", hashToken(token)).First(&reset).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrInvalidResetToken
+		}
+		if err != nil {
+			return err
+		}
+		now := p.now()
+		if !now.Before(reset.ExpiresAt) {
+			return ErrInvalidResetToken
+		}
+
+		// Spending the token only succeeds once, even for concurrent requests.
+		// Every other token of the user is spent along with it.
+		res := tx.Model(core.PasswordReset{}).
+			Where("id = ? AND used_at IS NULL", reset.ID).
+			Update("used_at", now)
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return ErrInvalidResetToken
+		}
+		err = tx.Model(core.PasswordReset{}).
+			Where("user_id = ? AND used_at IS NULL", reset.UserID).
+			Update("used_at", now).Error
+		if err != nil {
+			return err
+		}
+
+		if err := tx.Model(core.User{}).Where("id = ?", reset.UserID).First(&user).Error; err != nil {
+			return ErrInvalidResetToken
+		}
+		// Hashing is slow, so it only happens for a token that was just spent.
+		// A failure rolls the spending back.
+		hashed, err := p.hasher.Hash(newPassword)
+		if err != nil {
+			return err
+		}
+		return tx.Model(&user).Update("password", hashed).Error
+	})
+	return user, err
+}
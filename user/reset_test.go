@@ -0,0 +1,160 @@
+package user
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/MicBun/go-100-coverage-docker-crud/core"
+	"github.com/MicBun/go-100-coverage-docker-crud/database"
+	"github.com/MicBun/go-100-coverage-docker-crud/notify"
+	"github.com/MicBun/go-100-coverage-docker-crud/util/password"
+	"github.com/stretchr/testify/assert"
+	"gorm.io/gorm"
+)
+
+var resetTokenPattern = regexp.MustCompile(`token=([A-Za-z0-9_%-]+)`)
+
+func TestPasswordReset(t *testing.T) {
+	database.RunTest(func(db *gorm.DB) {
+		a := AdminAuth(db, testHasher)
+		_, err := a.RegisterUser("foo@bar.com", "securePassword", "Foo Bar")
+		assert.NoError(t, err)
+
+		now := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+		outbox := notify.NewOutbox("")
+		p := NewPasswordReset(db, testHasher, outbox, time.Hour, "https://example.com/reset").(*PasswordReset)
+		p.now = func() time.Time { return now }
+		request := func() string {
+			p.Request("foo@bar.com")
+			p.pending.Wait()
+			messages := outbox.Messages()
+			message := messages[len(messages)-1]
+			assert.Equal(t, "foo@bar.com", message.To)
+			match := resetTokenPattern.FindStringSubmatch(message.Body)
+			assert.NotNil(t, match)
+			token, _ := url.QueryUnescape(match[1])
+			assert.Contains(t, message.Body, token)
+			return token
+		}
+
+		p.Request("nobody@bar.com")
+		p.pending.Wait()
+		assert.Empty(t, outbox.Messages())
+
+		first := request()
+		var stored core.PasswordReset
+		assert.NoError(t, db.First(&stored).Error)
+		assert.Equal(t, hashToken(first), stored.TokenHash)
+
+		second := request()
+		_, err = p.Reset("unknown", "newPassword")
+		assert.ErrorIs(t, err, ErrInvalidResetToken)
+
+		u, err := p.Reset(second, "newPassword")
+		assert.NoError(t, err)
+		assert.Equal(t, "foo@bar.com", u.Username)
+		_, err = a.AuthenticateUser("foo@bar.com", "newPassword")
+		assert.NoError(t, err)
+
+		// Tokens are single use, and using one spends the others.
+		_, err = p.Reset(second, "otherPassword")
+		assert.ErrorIs(t, err, ErrInvalidResetToken)
+		_, err = p.Reset(first, "otherPassword")
+		assert.ErrorIs(t, err, ErrInvalidResetToken)
+
+		expired := request()
+		now = now.Add(time.Hour)
+		_, err = p.Reset(expired, "otherPassword")
+		assert.ErrorIs(t, err, ErrInvalidResetToken)
+		_, err = a.AuthenticateUser("foo@bar.com", "newPassword")
+		assert.NoError(t, err)
+
+		// The new password is only hashed for a valid token, and a failed
+		// hash leaves the token unspent.
+		hasher := &failingHasher{PasswordHasher: testHasher}
+		p.hasher = hasher
+		_, err = p.Reset("unknown", "otherPassword")
+		assert.ErrorIs(t, err, ErrInvalidResetToken)
+		assert.Equal(t, 0, hasher.calls)
+		valid := request()
+		_, err = p.Reset(valid, "otherPassword")
+		assert.ErrorIs(t, err, errHashFailed)
+		assert.Equal(t, 1, hasher.calls)
+		p.hasher = testHasher
+		_, err = p.Reset(valid, "otherPassword")
+		assert.NoError(t, err)
+	})
+}
+
+var errHashFailed = errors.New("hash failed")
+
+type failingHasher struct {
+	password.PasswordHasher
+	calls int
+}
+
+func (h *failingHasher) Hash(string) (string, error) {
+	h.calls++
+	return "", errHashFailed
+}
+
+func TestPasswordResetErrors(t *testing.T) {
+	database.RunTest(func(db *gorm.DB) {
+		a := AdminAuth(db, testHasher)
+		u, err := a.RegisterUser("foo@bar.com", "securePassword", "Foo Bar")
+		assert.NoError(t, err)
+		outbox := notify.NewOutbox("")
+		p := NewPasswordReset(db, testHasher, outbox, time.Hour, "").(*PasswordReset)
+		request := func() string {
+			assert.NoError(t, p.send("foo@bar.com"))
+			messages := outbox.Messages()
+			return strings.Split(messages[len(messages)-1].Body, "\n")[4]
+		}
+
+		random = failingReader{}
+		assert.Error(t, p.send("foo@bar.com"))
+		random = rand.Reader
+
+		restore := hideTable(t, db, "users")
+		assert.Error(t, p.send("foo@bar.com"))
+		restore()
+		restore = failWrites(t, db, "password_resets", "INSERT", "1")
+		assert.Error(t, p.send("foo@bar.com"))
+		restore()
+
+		// Requests only log why a token wasn't sent.
+		failing := NewPasswordReset(db, testHasher, failingNotifier{}, time.Hour, "").(*PasswordReset)
+		assert.Error(t, failing.send("foo@bar.com"))
+		failing.Request("foo@bar.com")
+		failing.pending.Wait()
+
+		token := request()
+		restore = hideTable(t, db, "password_resets")
+		_, err = p.Reset(token, "newPassword")
+		assert.Error(t, err)
+		assert.NotErrorIs(t, err, ErrInvalidResetToken)
+		restore()
+
+		// Spending the token, and the other tokens of the user, can fail.
+		restore = failWrites(t, db, "password_resets", "UPDATE", "1")
+		_, err = p.Reset(token, "newPassword")
+		assert.Error(t, err)
+		restore()
+		other := request()
+		restore = failWrites(t, db, "password_resets", "UPDATE", fmt.Sprintf("OLD.token_hash = '%s'", hashToken(other)))
+		_, err = p.Reset(token, "newPassword")
+		assert.Error(t, err)
+		restore()
+
+		// A token of a user deleted since is no good.
+		assert.NoError(t, a.DeleteUser(u.ID))
+		_, err = p.Reset(token, "newPassword")
+		assert.ErrorIs(t, err, ErrInvalidResetToken)
+	})
+}
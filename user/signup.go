@@ -0,0 +1,196 @@
+package user
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/MicBun/go-100-coverage-docker-crud/apperr"
+	"github.com/MicBun/go-100-coverage-docker-crud/core"
+	"github.com/MicBun/go-100-coverage-docker-crud/notify"
+	"github.com/MicBun/go-100-coverage-docker-crud/util/password"
+	"gorm.io/gorm"
+)
+
+var (
+	ErrInvalidVerificationToken = apperr.New(apperr.Invalid, "invalid_verification_token", "invalid or expired verification token")
+	// ErrVerificationNotSent wraps why Register couldn't send the verification
+	// message.
+	ErrVerificationNotSent = errors.New("verification not sent")
+)
+
+type Signup struct {
+	db        *gorm.DB
+	hasher    password.PasswordHasher
+	notifier  notify.Notifier
+	lifespan  time.Duration
+	verifyURL string
+	now       func() time.Time
+}
+
+// SignupInterface lets anyone create an account. Accounts stay pending, and
+// can't log in, until the link sent to their username is followed.
+type SignupInterface interface {
+	Register(username, password, name string) (core.User, error)
+	// Resend sends a new verification token to a pending account. Other
+	// usernames are ignored so callers can't tell which accounts exist.
+	Resend(username string) error
+	// Verify spends the token and activates the account.
+	Verify(token string) (core.User, error)
+}
+
+// NewSignup builds the signup flow. When verifyURL is set, messages link to it
+// with the token in the token query parameter.
+func NewSignup(db *gorm.DB, hasher password.PasswordHasher, notifier notify.Notifier, lifespan time.Duration, verifyURL string) SignupInterface {
+	return &Signup{
+		db:        db,
+		hasher:    hasher,
+		notifier:  notifier,
+		lifespan:  lifespan,
+		verifyURL: verifyURL,
+		now:       time.Now,
+	}
+}
+
+func (s *Signup) Register(username, password, name string) (core.User, error) {
+	hashed, err := s.hasher.Hash(password)
+	if err != nil {
+		return core.User{}, err
+	}
+	user := core.User{
+		Username: username,
+		Password: hashed,
+		Name:     name,
+		Status:   core.StatusPendingVerification,
+	}
+	var message notify.Message
+	err = s.db.Transaction(func(tx *gorm.DB) error {
+		if err := createUser(tx, &user); err != nil {
+			return err
+		}
+		message, err = s.newVerification(tx, user)
+		return err
+	})
+	if err != nil {
+		return user, err
+	}
+
+	// The message only goes out once the account is committed. An address
+	// that can't be reached doesn't leave an account behind that nobody can
+	// verify.
+	if err := s.notifier.Send(message); err != nil {
+		if cleanup := s.remove(user); cleanup != nil {
+			return user, fmt.Errorf("%w: %v (removing the account: %v)", ErrVerificationNotSent, err, cleanup)
+		}
+		return user, fmt.Errorf("%w: %v", ErrVerificationNotSent, err)
+	}
+	return user, nil
+}
+
+// remove deletes a pending account whose verification couldn't be sent.
+func (s *Signup) remove(user core.User) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&user).Association("Roles").Clear(); err != nil {
+			return err
+		}
+		if err := tx.Where("user_id = ?", user.ID).Delete(&core.EmailVerification{}).Error; err != nil {
+			return err
+		}
+		return tx.Unscoped().Delete(&user).Error
+	})
+}
+
+func (s *Signup) Resend(username string) error {
+	var user core.User
+	res := s.db.Model(core.User{}).
+		Where("username = ? AND status = ?", username, core.StatusPendingVerification).
+		Limit(1).Find(&user)
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return nil
+	}
+	message, err := s.newVerification(s.db, user)
+	if err != nil {
+		return err
+	}
+	return s.notifier.Send(message)
+}
+
+// newVerification stores a new verification token for user and returns the
+// message that carries it.
+func (s *Signup) newVerification(tx *gorm.DB, user core.User) (notify.Message, error) {
+	var message notify.Message
+	plain, hashed, err := newToken()
+	if err != nil {
+		return message, err
+	}
+	expiresAt := s.now().Add(s.lifespan)
+	err = tx.Create(&core.EmailVerification{
+		UserID:    user.ID,
+		TokenHash: hashed,
+		ExpiresAt: expiresAt,
+	}).Error
+	if err != nil {
+		return message, err
+	}
+
+	body := fmt.Sprintf("Hi %s,\n\nConfirm your address to activate your account. "+
+		"Use this verification token before %s:\n\n%s\n",
+		user.Name, expiresAt.UTC().Format(time.RFC1123), plain)
+	if s.verifyURL != "" {
+		body += fmt.Sprintf("\nor open %s?token=%s\n", s.verifyURL, url.QueryEscape(plain))
+	}
+	body += "\nIf you didn't sign up, ignore this message.\n"
+	return notify.Message{To: user.Username, Subject: "Verify your email address", Body: body}, nil
+}
+
+func (s *Signup) Verify(token string) (core.User, error) {
+	var user core.User
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		var verification core.EmailVerification
+		err := tx.Model(core.EmailVerification{}).Where("token_hash = ?", hashToken(token)).First(&verification).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrInvalidVerificationToken
+		}
+		if err != nil {
+			return err
+		}
+		now := s.now()
+		if !now.Before(verification.ExpiresAt) {
+			return ErrInvalidVerificationToken
+		}
+
+		// Spending the token only succeeds once, even for concurrent requests.
+		// Every other token of the user is spent along with it.
+		res := tx.Model(core.EmailVerification{}).
+			Where("id = ? AND used_at IS NULL", verification.ID).
+			Update("used_at", now)
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return ErrInvalidVerificationToken
+		}
+		err = tx.Model(core.EmailVerification{}).
+			Where("user_id = ? AND used_at IS NULL", verification.UserID).
+			Update("used_at", now).Error
+		if err != nil {
+			return err
+		}
+
+		if err := tx.Model(core.User{}).Where("id = ?", verification.UserID).First(&user).Error; err != nil {
+			return ErrInvalidVerificationToken
+		}
+		if user.Status != core.StatusPendingVerification {
+			return ErrInvalidVerificationToken
+		}
+		user.Status = core.StatusActive
+		user.Version++
+		return tx.Model(&user).
+			Updates(map[string]interface{}{"status": core.StatusActive, "version": gorm.Expr("version + 1")}).Error
+	})
+	return user, err
+}
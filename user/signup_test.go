@@ -0,0 +1,171 @@
+package user
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/MicBun/go-100-coverage-docker-crud/core"
+	"github.com/MicBun/go-100-coverage-docker-crud/database"
+	"github.com/MicBun/go-100-coverage-docker-crud/notify"
+	"github.com/stretchr/testify/assert"
+	"gorm.io/gorm"
+)
+
+type failingNotifier struct{}
+
+func (failingNotifier) Send(notify.Message) error {
+	return errors.New("unreachable")
+}
+
+func TestSignup(t *testing.T) {
+	database.RunTest(func(db *gorm.DB) {
+		a := AdminAuth(db, testHasher)
+		now := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+		outbox := notify.NewOutbox("")
+		s := NewSignup(db, testHasher, outbox, time.Hour, "https://example.com/verify").(*Signup)
+		s.now = func() time.Time { return now }
+		lastToken := func() string {
+			messages := outbox.Messages()
+			message := messages[len(messages)-1]
+			assert.Equal(t, "foo@bar.com", message.To)
+			match := resetTokenPattern.FindStringSubmatch(message.Body)
+			assert.NotNil(t, match)
+			token, _ := url.QueryUnescape(match[1])
+			return token
+		}
+
+		u, err := s.Register("foo@bar.com", "securePassword", "Foo Bar")
+		assert.NoError(t, err)
+		assert.Equal(t, core.StatusPendingVerification, u.Status)
+		first := lastToken()
+		var stored core.EmailVerification
+		assert.NoError(t, db.First(&stored).Error)
+		assert.Equal(t, hashToken(first), stored.TokenHash)
+
+		_, err = s.Register("foo@bar.com", "otherPassword", "Foo Bar")
+		assert.Error(t, err)
+		_, err = a.AuthenticateUser("foo@bar.com", "securePassword")
+		assert.ErrorIs(t, err, ErrNotVerified)
+		_, err = a.AuthenticateUser("foo@bar.com", "wrongPassword")
+		assert.NotErrorIs(t, err, ErrNotVerified)
+
+		assert.NoError(t, s.Resend("nobody@bar.com"))
+		assert.Equal(t, 1, len(outbox.Messages()))
+		assert.NoError(t, s.Resend("foo@bar.com"))
+		second := lastToken()
+
+		now = now.Add(time.Hour)
+		_, err = s.Verify(first)
+		assert.ErrorIs(t, err, ErrInvalidVerificationToken)
+		now = now.Add(-time.Minute)
+		_, err = s.Verify("unknown")
+		assert.ErrorIs(t, err, ErrInvalidVerificationToken)
+		u, err = s.Verify(second)
+		assert.NoError(t, err)
+		assert.Equal(t, core.StatusActive, u.Status)
+		_, err = a.AuthenticateUser("foo@bar.com", "securePassword")
+		assert.NoError(t, err)
+
+		// Tokens are single use, and verified accounts get no new ones.
+		_, err = s.Verify(second)
+		assert.ErrorIs(t, err, ErrInvalidVerificationToken)
+		_, err = s.Verify(first)
+		assert.ErrorIs(t, err, ErrInvalidVerificationToken)
+		assert.NoError(t, s.Resend("foo@bar.com"))
+		assert.Equal(t, 2, len(outbox.Messages()))
+
+		// An account is only kept if its verification could be sent.
+		s.notifier = failingNotifier{}
+		_, err = s.Register("bar@bar.com", "securePassword", "Bar Foo")
+		assert.ErrorIs(t, err, ErrVerificationNotSent)
+		var count int64
+		assert.NoError(t, db.Unscoped().Model(core.User{}).Where("username = ?", "bar@bar.com").Count(&count).Error)
+		assert.Equal(t, int64(0), count)
+		assert.NoError(t, db.Model(core.EmailVerification{}).Where("user_id <> ?", u.ID).Count(&count).Error)
+		assert.Equal(t, int64(0), count)
+		assert.NoError(t, db.Table("user_roles").Where("user_id <> ?", u.ID).Count(&count).Error)
+		assert.Equal(t, int64(0), count)
+		s.notifier = outbox
+		_, err = s.Register("bar@bar.com", "securePassword", "Bar Foo")
+		assert.NoError(t, err)
+	})
+}
+
+func TestSignupErrors(t *testing.T) {
+	database.RunTest(func(db *gorm.DB) {
+		outbox := notify.NewOutbox("")
+		s := NewSignup(db, testHasher, outbox, time.Hour, "").(*Signup)
+		lastToken := func() string {
+			messages := outbox.Messages()
+			return strings.Split(messages[len(messages)-1].Body, "\n")[4]
+		}
+
+		s.hasher = &failingHasher{PasswordHasher: testHasher}
+		_, err := s.Register("foo@bar.com", "securePassword", "Foo Bar")
+		assert.ErrorIs(t, err, errHashFailed)
+		s.hasher = testHasher
+
+		restore := failWrites(t, db, "email_verifications", "INSERT", "1")
+		_, err = s.Register("foo@bar.com", "securePassword", "Foo Bar")
+		assert.Error(t, err)
+		restore()
+
+		// An account that can't be removed again is reported along with the
+		// failed message.
+		s.notifier = failingNotifier{}
+		for _, table := range []string{"user_roles", "email_verifications", "users"} {
+			restore = failWrites(t, db, table, "DELETE", "1")
+			_, err = s.Register("foo@bar.com", "securePassword", "Foo Bar")
+			assert.ErrorIs(t, err, ErrVerificationNotSent)
+			assert.Contains(t, err.Error(), "removing the account")
+			restore()
+			assert.NoError(t, db.Unscoped().Where("username = ?", "foo@bar.com").Delete(&core.User{}).Error)
+		}
+		s.notifier = outbox
+
+		u, err := s.Register("foo@bar.com", "securePassword", "Foo Bar")
+		assert.NoError(t, err)
+		first := lastToken()
+
+		random = failingReader{}
+		assert.Error(t, s.Resend("foo@bar.com"))
+		random = rand.Reader
+		restore = hideTable(t, db, "users")
+		assert.Error(t, s.Resend("foo@bar.com"))
+		restore()
+
+		restore = hideTable(t, db, "email_verifications")
+		_, err = s.Verify(first)
+		assert.Error(t, err)
+		assert.NotErrorIs(t, err, ErrInvalidVerificationToken)
+		restore()
+
+		// Spending the token, and the other tokens of the user, can fail.
+		restore = failWrites(t, db, "email_verifications", "UPDATE", "1")
+		_, err = s.Verify(first)
+		assert.Error(t, err)
+		restore()
+		assert.NoError(t, s.Resend("foo@bar.com"))
+		second := lastToken()
+		restore = failWrites(t, db, "email_verifications", "UPDATE", fmt.Sprintf("OLD.token_hash = '%s'", hashToken(second)))
+		_, err = s.Verify(first)
+		assert.Error(t, err)
+		restore()
+
+		// Only pending accounts that still exist are verified.
+		assert.NoError(t, db.Model(&core.User{}).Where("id = ?", u.ID).Update("status", core.StatusActive).Error)
+		_, err = s.Verify(first)
+		assert.ErrorIs(t, err, ErrInvalidVerificationToken)
+		assert.NoError(t, db.Model(&core.User{}).Where("id = ?", u.ID).Update("status", core.StatusPendingVerification).Error)
+		assert.NoError(t, s.Resend("foo@bar.com"))
+		third := lastToken()
+		assert.NoError(t, db.Delete(&core.User{}, u.ID).Error)
+		_, err = s.Verify(third)
+		assert.ErrorIs(t, err, ErrInvalidVerificationToken)
+	})
+}
@@ -0,0 +1,95 @@
+package user
+
+import (
+	"fmt"
+
+	"github.com/MicBun/go-100-coverage-docker-crud/apperr"
+	"github.com/MicBun/go-100-coverage-docker-crud/core"
+
+	"gorm.io/gorm"
+)
+
+var (
+	ErrSuspended         = apperr.New(apperr.Forbidden, "account_suspended", "account is suspended")
+	ErrLocked            = apperr.New(apperr.Forbidden, "account_locked_by_admin", "account is locked by an administrator")
+	ErrDeactivated       = apperr.New(apperr.Forbidden, "account_deactivated", "account is deactivated")
+	ErrInvalidTransition = apperr.New(apperr.Conflict, "invalid_transition", "invalid status transition")
+)
+
+// StatusError returns the error that keeps a user with the given status from
+// logging in, or nil for active users.
+func StatusError(status string) error {
+	switch status {
+	case core.StatusActive:
+		return nil
+	case core.StatusPendingVerification:
+		return ErrNotVerified
+	case core.StatusSuspended:
+		return ErrSuspended
+	case core.StatusLocked:
+		return ErrLocked
+	case core.StatusDeactivated:
+		return ErrDeactivated
+	}
+	return apperr.New(apperr.Forbidden, "account_inactive", fmt.Sprintf("account status %q does not allow access", status))
+}
+
+func (a *Auth) Suspend(id uint, reason string) (core.User, error) {
+	return a.transition(id, core.StatusSuspended, reason, core.StatusActive, core.StatusLocked)
+}
+
+func (a *Auth) Lock(id uint, reason string) (core.User, error) {
+	return a.transition(id, core.StatusLocked, reason, core.StatusActive)
+}
+
+// Unlock reverses Lock only.
+func (a *Auth) Unlock(id uint, reason string) (core.User, error) {
+	return a.transition(id, core.StatusActive, reason, core.StatusLocked)
+}
+
+// Reactivate also activates accounts still pending verification, for users
+// whose address was confirmed another way.
+func (a *Auth) Reactivate(id uint, reason string) (core.User, error) {
+	return a.transition(id, core.StatusActive, reason,
+		core.StatusSuspended, core.StatusLocked, core.StatusDeactivated, core.StatusPendingVerification)
+}
+
+func (a *Auth) Deactivate(id uint, reason string) (core.User, error) {
+	return a.transition(id, core.StatusDeactivated, reason,
+		core.StatusActive, core.StatusSuspended, core.StatusLocked, core.StatusPendingVerification)
+}
+
+// transition moves the user to status if it currently has one of from. The
+// check and the update are one statement, so concurrent transitions can't
+// both succeed from the same status.
+func (a *Auth) transition(id uint, status, reason string, from ...string) (core.User, error) {
+	now := a.now()
+	res := a.db.Model(core.User{}).
+		Where("id = ? AND status IN ?", id, from).
+		Updates(map[string]interface{}{
+			"status": status, "status_reason": reason, "status_changed_at": now, "version": gorm.Expr("version + 1"),
+		})
+	if res.Error != nil {
+		return core.User{}, res.Error
+	}
+	user, err := a.GetUser(id)
+	if err != nil {
+		return user, err
+	}
+	if res.RowsAffected == 0 {
+		return user, fmt.Errorf("%w from %s to %s", ErrInvalidTransition, user.Status, status)
+	}
+	return user, nil
+}
+
+func (a *Auth) CheckActive(id uint) error {
+	var user core.User
+	res := a.db.Model(core.User{}).Select("status").Where("id = ?", id).Limit(1).Find(&user)
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return nil
+	}
+	return StatusError(user.Status)
+}
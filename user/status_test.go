@@ -0,0 +1,90 @@
+package user
+
+import (
+	"testing"
+	"time"
+
+	"github.com/MicBun/go-100-coverage-docker-crud/apperr"
+	"github.com/MicBun/go-100-coverage-docker-crud/core"
+	"github.com/MicBun/go-100-coverage-docker-crud/database"
+	"github.com/stretchr/testify/assert"
+	"gorm.io/gorm"
+)
+
+func TestStatusTransitions(t *testing.T) {
+	database.RunTest(func(db *gorm.DB) {
+		a := AdminAuth(db, testHasher).(*Auth)
+		now := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+		a.now = func() time.Time { return now }
+		u, err := a.RegisterUser("foo@bar.com", "securePassword", "Foo Bar")
+		assert.NoError(t, err)
+		assert.NoError(t, a.CheckActive(u.ID))
+		assert.NoError(t, a.CheckActive(u.ID+1))
+
+		_, err = a.Reactivate(u.ID, "already active")
+		assert.ErrorIs(t, err, ErrInvalidTransition)
+
+		suspended, err := a.Suspend(u.ID, "chargeback")
+		assert.NoError(t, err)
+		assert.Equal(t, core.StatusSuspended, suspended.Status)
+		assert.Equal(t, "chargeback", suspended.StatusReason)
+		assert.True(t, suspended.StatusChangedAt.Equal(now))
+		assert.ErrorIs(t, a.CheckActive(u.ID), ErrSuspended)
+		_, err = a.AuthenticateUser("foo@bar.com", "securePassword")
+		assert.ErrorIs(t, err, ErrSuspended)
+		_, err = a.AuthenticateUser("foo@bar.com", "wrongPassword")
+		assert.NotErrorIs(t, err, ErrSuspended)
+		_, err = a.Lock(u.ID, "suspended users can't be locked")
+		assert.ErrorIs(t, err, ErrInvalidTransition)
+
+		now = now.Add(time.Hour)
+		reactivated, err := a.Reactivate(u.ID, "resolved")
+		assert.NoError(t, err)
+		assert.Equal(t, core.StatusActive, reactivated.Status)
+		assert.True(t, reactivated.StatusChangedAt.Equal(now))
+		_, err = a.AuthenticateUser("foo@bar.com", "securePassword")
+		assert.NoError(t, err)
+
+		_, err = a.Lock(u.ID, "investigation")
+		assert.NoError(t, err)
+		assert.ErrorIs(t, a.CheckActive(u.ID), ErrLocked)
+		unlocked, err := a.Unlock(u.ID, "cleared")
+		assert.NoError(t, err)
+		assert.Equal(t, core.StatusActive, unlocked.Status)
+		_, err = a.Unlock(u.ID, "not locked")
+		assert.ErrorIs(t, err, ErrInvalidTransition)
+		_, err = a.Deactivate(u.ID, "left")
+		assert.NoError(t, err)
+		assert.ErrorIs(t, a.CheckActive(u.ID), ErrDeactivated)
+		_, err = a.Suspend(u.ID, "too late")
+		assert.ErrorIs(t, err, ErrInvalidTransition)
+
+		result, err := a.ListUsers(ListOptions{Status: core.StatusDeactivated})
+		assert.NoError(t, err)
+		assert.Equal(t, int64(1), result.Total)
+		result, err = a.ListUsers(ListOptions{Status: core.StatusActive})
+		assert.NoError(t, err)
+		assert.Empty(t, result.Users)
+		assert.Empty(t, result.NextCursor)
+
+		_, err = a.Suspend(u.ID+1, "unknown")
+		assert.ErrorIs(t, err, gorm.ErrRecordNotFound)
+
+		restore := failWrites(t, db, "users", "UPDATE", "1")
+		_, err = a.Reactivate(u.ID, "back")
+		assert.Error(t, err)
+		assert.NotErrorIs(t, err, ErrInvalidTransition)
+		restore()
+		restore = hideTable(t, db, "users")
+		assert.Error(t, a.CheckActive(u.ID))
+		restore()
+	})
+}
+
+func TestStatusError(t *testing.T) {
+	assert.NoError(t, StatusError(core.StatusActive))
+	assert.ErrorIs(t, StatusError(core.StatusSuspended), ErrSuspended)
+	err := StatusError("archived")
+	assert.Equal(t, "account_inactive", apperr.CodeOf(err))
+	assert.Equal(t, apperr.Forbidden, apperr.KindOf(err))
+}
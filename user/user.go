@@ -1,58 +1,188 @@
 package user
 
 import (
-	"crypto/md5"
+	"errors"
 	"fmt"
+	"sync"
+	"time"
+
+	"github.com/MicBun/go-100-coverage-docker-crud/apperr"
 	"github.com/MicBun/go-100-coverage-docker-crud/core"
+	"github.com/MicBun/go-100-coverage-docker-crud/util/password"
 
 	"gorm.io/gorm"
 )
 
+var (
+	ErrNotVerified   = apperr.New(apperr.Forbidden, "email_not_verified", "email address is not verified yet")
+	ErrNotDeleted    = apperr.New(apperr.Conflict, "user_not_deleted", "user is not deleted")
+	ErrUsernameTaken = apperr.New(apperr.Conflict, "username_taken", "username is taken by another user")
+	// ErrUserNotFound wraps gorm.ErrRecordNotFound.
+	ErrUserNotFound = &apperr.Error{Kind: apperr.NotFound, Code: "user_not_found", Message: "user not found", Err: gorm.ErrRecordNotFound}
+	// ErrInvalidCredentials doesn't tell a wrong password from an unknown
+	// username.
+	ErrInvalidCredentials = apperr.New(apperr.Unauthorized, "invalid_credentials", "invalid username or password")
+	ErrUsernameRequired   = apperr.New(apperr.Invalid, "username_required", "username can't be empty")
+	ErrPasswordRequired   = apperr.New(apperr.Invalid, "password_required", "password can't be empty")
+	ErrVersionMismatch    = apperr.New(apperr.PreconditionFailed, "version_mismatch", "user was changed since it was read")
+)
+
+// Fields of a user that UpdateUserFields can change.
+const (
+	FieldUsername = "username"
+	FieldPassword = "password"
+	FieldName     = "name"
+)
+
+// UserUpdate holds new values for the fields of a user. Only the fields named
+// in the mask passed to UpdateUserFields are applied, so a zero value clears
+// a field rather than leaving it unchanged.
+type UserUpdate struct {
+	Username string
+	Password string
+	Name     string
+	// Version, when set, applies the update only while the user is still at
+	// that version. It fails with ErrVersionMismatch otherwise.
+	Version uint
+}
+
 type Auth struct {
-	db *gorm.DB
+	db     *gorm.DB
+	hasher password.PasswordHasher
+	now    func() time.Time
+
+	dummyOnce sync.Once
+	dummy     string
 }
 
 type AuthInterface interface {
 	RegisterUser(username, password, name string) (core.User, error)
 	AuthenticateUser(username, password string) (core.User, error)
 	GetUser(id uint) (core.User, error)
+	// UpdateUser changes the fields given, leaving empty ones unchanged.
 	UpdateUser(id uint, username, password, name string) (core.User, error)
+	// UpdateUserFields changes the fields named in mask to their value in
+	// update, which may clear them. Username and password can't be cleared.
+	UpdateUserFields(id uint, update UserUpdate, mask []string) (core.User, error)
 	DeleteUser(id uint) error
-	ListUsers() ([]core.User, error)
-	SaveToken(id uint, token string) error
+	// DeleteUserAt deletes the user only while it is at version, failing with
+	// ErrVersionMismatch otherwise. A zero version deletes any.
+	DeleteUserAt(id, version uint) error
+	// Restore brings back a soft-deleted user, unless a live user has taken
+	// the username since.
+	Restore(id uint) (core.User, error)
+	// Purge permanently removes a soft-deleted user and everything that
+	// belongs to it.
+	Purge(id uint) error
+	ListUsers(opts ListOptions) (ListResult, error)
+	// Suspend, Lock, Unlock, Reactivate and Deactivate move a user between
+	// statuses, recording the reason. They fail with ErrInvalidTransition
+	// when the current status doesn't allow the move.
+	Suspend(id uint, reason string) (core.User, error)
+	Lock(id uint, reason string) (core.User, error)
+	Unlock(id uint, reason string) (core.User, error)
+	Reactivate(id uint, reason string) (core.User, error)
+	Deactivate(id uint, reason string) (core.User, error)
+	// CheckActive returns the StatusError of an existing user. Unknown ids
+	// are left to the caller's other checks.
+	CheckActive(id uint) error
 }
 
-func AdminAuth(db *gorm.DB) AuthInterface {
+func AdminAuth(db *gorm.DB, hasher password.PasswordHasher) AuthInterface {
 	return &Auth{
-		db: db,
+		db:     db,
+		hasher: hasher,
+		now:    time.Now,
 	}
 }
 
-func hash(plain string) string {
-	data := []byte(plain)
-	return fmt.Sprintf("%x", md5.Sum(data))
-}
-
 func (a *Auth) RegisterUser(username, password, name string) (core.User, error) {
+	hashed, err := a.hasher.Hash(password)
+	if err != nil {
+		return core.User{}, err
+	}
 	user := core.User{
 		Username: username,
-		Password: hash(password),
+		Password: hashed,
 		Name:     name,
+		Status:   core.StatusActive,
 	}
-	err := a.db.Save(&user).Error
+	err = a.db.Transaction(func(tx *gorm.DB) error {
+		return createUser(tx, &user)
+	})
 	return user, err
 }
 
+// checkUsername fails with ErrUsernameTaken when a live user other than id
+// has username.
+func checkUsername(tx *gorm.DB, username string, id uint) error {
+	var taken int64
+	err := tx.Model(core.User{}).Where("username = ? AND id <> ?", username, id).Count(&taken).Error
+	if err != nil {
+		return err
+	}
+	if taken > 0 {
+		return ErrUsernameTaken
+	}
+	return nil
+}
+
+// createUser saves a new user with the default role.
+func createUser(tx *gorm.DB, user *core.User) error {
+	user.Version = 1
+	if err := checkUsername(tx, user.Username, 0); err != nil {
+		return err
+	}
+	if err := tx.Save(user).Error; err != nil {
+		return err
+	}
+	var role core.Role
+	if err := tx.Model(core.Role{}).Where("name = ?", core.RoleUser).First(&role).Error; err != nil {
+		return fmt.Errorf("unable to retrieve default role %w", err)
+	}
+	return tx.Model(user).Association("Roles").Append(&role)
+}
+
+// dummyHash is a hash made with the current settings that no password is
+// checked against for real.
+func (a *Auth) dummyHash() string {
+	a.dummyOnce.Do(func() {
+		a.dummy, _ = a.hasher.Hash("dummy password")
+	})
+	return a.dummy
+}
+
 func (a *Auth) AuthenticateUser(username, password string) (core.User, error) {
 	var user core.User
 	err := a.db.Model(core.User{}).Where("username = ?", username).First(&user).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		// Verify anyway, so unknown usernames take as long as wrong
+		// passwords.
+		a.hasher.Verify(password, a.dummyHash())
+		return user, ErrInvalidCredentials
+	}
 	if err != nil {
-		return user, fmt.Errorf("unable to retrieve user %w", err)
+		return user, err
+	}
+
+	ok, err := a.hasher.Verify(password, user.Password)
+	if err != nil || !ok {
+		return user, ErrInvalidCredentials
+	}
+	// Checked after the password so the status doesn't reveal which
+	// accounts exist.
+	if err := StatusError(user.Status); err != nil {
+		return user, err
 	}
 
-	h := hash(password)
-	if h != user.Password {
-		return user, fmt.Errorf("password mismatch")
+	// Upgrade legacy or outdated hashes while the plain password is at hand.
+	// A failure here must not block the login, the old hash still verifies.
+	if a.hasher.NeedsRehash(user.Password) {
+		if hashed, err := a.hasher.Hash(password); err == nil {
+			if err := a.db.Model(&user).Update("password", hashed).Error; err == nil {
+				user.Password = hashed
+			}
+		}
 	}
 
 	return user, nil
@@ -61,50 +191,163 @@ func (a *Auth) AuthenticateUser(username, password string) (core.User, error) {
 func (a *Auth) GetUser(id uint) (core.User, error) {
 	var user core.User
 	err := a.db.Model(core.User{}).Where("id = ?", id).First(&user).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return user, ErrUserNotFound
+	}
 	return user, err
 }
 
+// NonEmpty is the mask of the fields of u that aren't empty.
+func (u UserUpdate) NonEmpty() []string {
+	var mask []string
+	if u.Username != "" {
+		mask = append(mask, FieldUsername)
+	}
+	if u.Password != "" {
+		mask = append(mask, FieldPassword)
+	}
+	if u.Name != "" {
+		mask = append(mask, FieldName)
+	}
+	return mask
+}
+
 func (a *Auth) UpdateUser(id uint, username, password, name string) (core.User, error) {
+	update := UserUpdate{Username: username, Password: password, Name: name}
+	return a.UpdateUserFields(id, update, update.NonEmpty())
+}
+
+func (a *Auth) UpdateUserFields(id uint, update UserUpdate, mask []string) (core.User, error) {
 	user, err := a.GetUser(id)
 	if err != nil {
 		return user, err
 	}
+	if update.Version != 0 && update.Version != user.Version {
+		return user, ErrVersionMismatch
+	}
 
-	if username != "" {
-		user.Username = username
+	changes := make(map[string]interface{}, len(mask)+1)
+	for _, field := range mask {
+		switch field {
+		case FieldUsername:
+			if update.Username == "" {
+				return user, ErrUsernameRequired
+			}
+			if update.Username != user.Username {
+				if err := checkUsername(a.db, update.Username, id); err != nil {
+					return user, err
+				}
+			}
+			user.Username = update.Username
+			changes["username"] = user.Username
+		case FieldPassword:
+			if update.Password == "" {
+				return user, ErrPasswordRequired
+			}
+			if user.Password, err = a.hasher.Hash(update.Password); err != nil {
+				return user, err
+			}
+			changes["password"] = user.Password
+		case FieldName:
+			user.Name = update.Name
+			changes["name"] = user.Name
+		default:
+			return user, &apperr.Error{Kind: apperr.Invalid, Code: "unknown_field", Message: fmt.Sprintf("unknown field %q", field)}
+		}
+	}
+	if len(changes) == 0 {
+		return user, nil
 	}
-	if password != "" {
-		user.Password = hash(password)
+
+	// The version is checked and bumped by the update itself, so of two
+	// concurrent updates from the same version only one succeeds.
+	changes["version"] = gorm.Expr("version + 1")
+	query := a.db.Model(&user)
+	if update.Version != 0 {
+		query = query.Where("version = ?", update.Version)
 	}
-	if name != "" {
-		user.Name = name
+	res := query.Updates(changes)
+	if res.Error != nil {
+		return user, res.Error
 	}
-	err = a.db.Updates(&user).Error
-	return user, err
+	if res.RowsAffected == 0 && update.Version != 0 {
+		return user, ErrVersionMismatch
+	}
+	return a.GetUser(id)
 }
 
 func (a *Auth) DeleteUser(id uint) error {
+	return a.DeleteUserAt(id, 0)
+}
+
+func (a *Auth) DeleteUserAt(id, version uint) error {
 	user, err := a.GetUser(id)
 	if err != nil {
 		return err
 	}
-	return a.db.Delete(&user).Error
-}
-
-func (a *Auth) ListUsers() ([]core.User, error) {
-	var users []core.User
-	err := a.db.Model(core.User{}).Find(&users).Error
-	if len(users) == 0 {
-		return users, fmt.Errorf("no users found")
+	if version == 0 {
+		return a.db.Delete(&user).Error
+	}
+	res := a.db.Where("version = ?", version).Delete(&user)
+	if res.Error != nil {
+		return res.Error
 	}
-	return users, err
+	if res.RowsAffected == 0 {
+		return ErrVersionMismatch
+	}
+	return nil
 }
 
-func (a *Auth) SaveToken(id uint, token string) error {
-	user, err := a.GetUser(id)
+func (a *Auth) getDeleted(tx *gorm.DB, id uint) (core.User, error) {
+	var user core.User
+	err := tx.Unscoped().Model(core.User{}).Where("id = ?", id).First(&user).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return user, ErrUserNotFound
+	}
 	if err != nil {
-		return err
+		return user, err
 	}
-	user.Token = token
-	return a.db.Save(&user).Error
+	if !user.DeletedAt.Valid {
+		return user, ErrNotDeleted
+	}
+	return user, nil
+}
+
+func (a *Auth) Restore(id uint) (core.User, error) {
+	var user core.User
+	err := a.db.Transaction(func(tx *gorm.DB) error {
+		var err error
+		if user, err = a.getDeleted(tx, id); err != nil {
+			return err
+		}
+		if err := checkUsername(tx, user.Username, user.ID); err != nil {
+			return err
+		}
+		user.DeletedAt = gorm.DeletedAt{}
+		user.Version++
+		return tx.Unscoped().Model(&user).
+			Updates(map[string]interface{}{"deleted_at": nil, "version": gorm.Expr("version + 1")}).Error
+	})
+	return user, err
+}
+
+func (a *Auth) Purge(id uint) error {
+	return a.db.Transaction(func(tx *gorm.DB) error {
+		user, err := a.getDeleted(tx, id)
+		if err != nil {
+			return err
+		}
+		if err := tx.Model(&user).Association("Roles").Clear(); err != nil {
+			return err
+		}
+		for _, model := range []interface{}{
+			&core.RefreshToken{}, &core.Session{}, &core.RecoveryCode{}, &core.UserMFA{},
+			&core.PasswordReset{}, &core.EmailVerification{},
+		} {
+			if err := tx.Where("user_id = ?", user.ID).Delete(model).Error; err != nil {
+				return err
+			}
+		}
+		return tx.Unscoped().Delete(&user).Error
+	})
 }
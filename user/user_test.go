@@ -1,16 +1,75 @@
 package user
 
 import (
+	"crypto/md5"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/MicBun/go-100-coverage-docker-crud/apperr"
+	"github.com/MicBun/go-100-coverage-docker-crud/core"
 	"github.com/MicBun/go-100-coverage-docker-crud/database"
+	"github.com/MicBun/go-100-coverage-docker-crud/util/password"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"gorm.io/gorm"
 )
 
+var testHasher = password.New(password.Bcrypt{Cost: 4})
+
+// failWrites makes event ("INSERT", "UPDATE" or "DELETE") statements on table
+// fail for rows where when holds, until the returned func is called.
+func failWrites(t *testing.T, db *gorm.DB, table, event, when string) func() {
+	t.Helper()
+	name := strings.ToLower("fail_" + table + "_" + event)
+	assert.NoError(t, db.Exec(fmt.Sprintf(
+		"CREATE TRIGGER %s BEFORE %s ON %s WHEN %s BEGIN SELECT RAISE(ABORT, 'broken'); END",
+		name, event, table, when)).Error)
+	return func() { assert.NoError(t, db.Exec("DROP TRIGGER "+name).Error) }
+}
+
+// hideTable makes every statement on table fail, until the returned func is
+// called.
+func hideTable(t *testing.T, db *gorm.DB, table string) func() {
+	t.Helper()
+	assert.NoError(t, db.Exec(fmt.Sprintf("ALTER TABLE %s RENAME TO hidden_%s", table, table)).Error)
+	return func() {
+		assert.NoError(t, db.Exec(fmt.Sprintf("ALTER TABLE hidden_%s RENAME TO %s", table, table)).Error)
+	}
+}
+
+// failFinds makes queries that load into a value of the same type as dest
+// fail, until the returned func is called.
+func failFinds(t *testing.T, db *gorm.DB, dest interface{}) func() {
+	t.Helper()
+	assert.NoError(t, db.Callback().Query().Before("gorm:query").Register("test:fail_finds", func(tx *gorm.DB) {
+		if reflect.TypeOf(tx.Statement.Dest) == reflect.TypeOf(dest) {
+			tx.AddError(errors.New("broken"))
+		}
+	}))
+	return func() { assert.NoError(t, db.Callback().Query().Remove("test:fail_finds")) }
+}
+
+type failingReader struct{}
+
+func (failingReader) Read([]byte) (int, error) { return 0, errors.New("no entropy") }
+
+type countingHasher struct {
+	password.PasswordHasher
+	verified int
+}
+
+func (h *countingHasher) Verify(plain, encoded string) (bool, error) {
+	h.verified++
+	return h.PasswordHasher.Verify(plain, encoded)
+}
+
 func TestAuthUser(t *testing.T) {
 	database.RunTest(func(db *gorm.DB) {
-		a := AdminAuth(db)
+		a := AdminAuth(db, testHasher)
 		u, err := a.RegisterUser("foo@bar.com", "securePassword", "Foo Bar")
 		assert.NoError(t, err)
 
@@ -18,11 +77,35 @@ func TestAuthUser(t *testing.T) {
 		assert.NotEqual(t, "securePassword", u.Password)
 		assert.Equal(t, "Foo Bar", u.Name)
 
+		var registered core.User
+		assert.NoError(t, db.Preload("Roles").First(&registered, u.ID).Error)
+		assert.Equal(t, 1, len(registered.Roles))
+		assert.Equal(t, core.RoleUser, registered.Roles[0].Name)
+
 		_, err = a.AuthenticateUser("foo@bar.com", "notPassword")
-		assert.Error(t, err)
+		assert.ErrorIs(t, err, ErrInvalidCredentials)
 
+		// Unknown usernames still pay for verifying a password.
+		counting := &countingHasher{PasswordHasher: testHasher}
+		a.(*Auth).hasher = counting
 		_, err = a.AuthenticateUser("bar@bar.com", "notPassword")
-		assert.Error(t, err)
+		assert.ErrorIs(t, err, ErrInvalidCredentials)
+		_, err = a.AuthenticateUser("bar@bar.com", "notPassword")
+		assert.ErrorIs(t, err, ErrInvalidCredentials)
+		assert.Equal(t, 2, counting.verified)
+		assert.True(t, strings.HasPrefix(a.(*Auth).dummy, "$2a$04$"))
+		a.(*Auth).hasher = testHasher
+
+		_, err = a.RegisterUser("foo@bar.com", "securePassword", "Foo Again")
+		assert.ErrorIs(t, err, ErrUsernameTaken)
+		other, err := a.RegisterUser("other@bar.com", "securePassword", "Other")
+		assert.NoError(t, err)
+		_, err = a.UpdateUser(other.ID, "foo@bar.com", "", "")
+		assert.ErrorIs(t, err, ErrUsernameTaken)
+		_, err = a.UpdateUser(u.ID, "foo@bar.com", "", "")
+		assert.NoError(t, err)
+		assert.NoError(t, a.DeleteUser(other.ID))
+		assert.NoError(t, a.Purge(other.ID))
 
 		u2, err := a.AuthenticateUser("foo@bar.com", "securePassword")
 		assert.NoError(t, err)
@@ -34,7 +117,8 @@ func TestAuthUser(t *testing.T) {
 		assert.NoError(t, err)
 
 		_, err = a.GetUser(2)
-		assert.Error(t, err)
+		assert.ErrorIs(t, err, ErrUserNotFound)
+		assert.Equal(t, apperr.NotFound, apperr.KindOf(err))
 
 		_, err = a.UpdateUser(u.ID, "bar@foo.com", "passwordSecure", "Bar Foo")
 		assert.NoError(t, err)
@@ -43,9 +127,10 @@ func TestAuthUser(t *testing.T) {
 		assert.NoError(t, err)
 		assert.Equal(t, "Bar Foo", u3.Name)
 
-		users, err := a.ListUsers()
+		users, err := a.ListUsers(ListOptions{})
 		assert.NoError(t, err)
-		assert.Equal(t, 1, len(users))
+		assert.Equal(t, 1, len(users.Users))
+		assert.Equal(t, int64(1), users.Total)
 
 		err = a.DeleteUser(u.ID)
 		assert.NoError(t, err)
@@ -56,20 +141,15 @@ func TestAuthUser(t *testing.T) {
 		_, err = a.GetUser(u.ID)
 		assert.Error(t, err)
 
-		err = a.SaveToken(u.ID, "token")
-		assert.Error(t, err)
-
 		_, err = a.UpdateUser(u.ID, "", "", "Bar Foo")
 		assert.Error(t, err)
 
-		users, err = a.ListUsers()
-		assert.Error(t, err)
-		assert.Equal(t, 0, len(users))
-
-		u, err = a.RegisterUser("new@user.com", "securePassword", "New User")
+		users, err = a.ListUsers(ListOptions{})
 		assert.NoError(t, err)
+		assert.Equal(t, 0, len(users.Users))
+		assert.Equal(t, int64(0), users.Total)
 
-		err = a.SaveToken(u.ID, "token")
+		_, err = a.RegisterUser("new@user.com", "securePassword", "New User")
 		assert.NoError(t, err)
 
 		//
@@ -80,3 +160,318 @@ func TestAuthUser(t *testing.T) {
 		//assert.Equal(t, u.Username, newUser.Username)
 	})
 }
+
+func TestUpdateUserFields(t *testing.T) {
+	database.RunTest(func(db *gorm.DB) {
+		a := AdminAuth(db, testHasher)
+		u, err := a.RegisterUser("foo@bar.com", "securePassword", "Foo Bar")
+		assert.NoError(t, err)
+
+		updated, err := a.UpdateUserFields(u.ID, UserUpdate{Username: "ignored@bar.com"}, []string{FieldName})
+		assert.NoError(t, err)
+		assert.Equal(t, "foo@bar.com", updated.Username)
+		assert.Equal(t, "", updated.Name)
+		stored, err := a.GetUser(u.ID)
+		assert.NoError(t, err)
+		assert.Equal(t, "", stored.Name)
+		assert.Equal(t, "foo@bar.com", stored.Username)
+		assert.False(t, stored.UpdatedAt.Before(u.UpdatedAt))
+
+		_, err = a.UpdateUserFields(u.ID, UserUpdate{}, []string{FieldUsername})
+		assert.ErrorIs(t, err, ErrUsernameRequired)
+		_, err = a.UpdateUserFields(u.ID, UserUpdate{}, []string{FieldPassword})
+		assert.ErrorIs(t, err, ErrPasswordRequired)
+		_, err = a.UpdateUserFields(u.ID, UserUpdate{}, []string{"status"})
+		assert.Equal(t, "unknown_field", apperr.CodeOf(err))
+		_, err = a.UpdateUserFields(9, UserUpdate{Name: "Nobody"}, []string{FieldName})
+		assert.ErrorIs(t, err, ErrUserNotFound)
+
+		_, err = a.UpdateUserFields(u.ID, UserUpdate{Username: "bar@foo.com", Password: "otherPassword"},
+			[]string{FieldUsername, FieldPassword})
+		assert.NoError(t, err)
+		_, err = a.AuthenticateUser("bar@foo.com", "otherPassword")
+		assert.NoError(t, err)
+
+		// UpdateUser still leaves empty fields unchanged.
+		updated, err = a.UpdateUser(u.ID, "", "", "Bar Foo")
+		assert.NoError(t, err)
+		assert.Equal(t, "bar@foo.com", updated.Username)
+		assert.Equal(t, "Bar Foo", updated.Name)
+	})
+}
+
+func TestUserVersion(t *testing.T) {
+	database.RunTest(func(db *gorm.DB) {
+		a := AdminAuth(db, testHasher)
+		u, err := a.RegisterUser("foo@bar.com", "securePassword", "Foo Bar")
+		assert.NoError(t, err)
+		assert.Equal(t, uint(1), u.Version)
+
+		u, err = a.UpdateUser(u.ID, "", "", "Foo")
+		assert.NoError(t, err)
+		assert.Equal(t, uint(2), u.Version)
+
+		_, err = a.UpdateUserFields(u.ID, UserUpdate{Name: "Stale", Version: 1}, []string{FieldName})
+		assert.ErrorIs(t, err, ErrVersionMismatch)
+		assert.Equal(t, apperr.PreconditionFailed, apperr.KindOf(err))
+		u, err = a.UpdateUserFields(u.ID, UserUpdate{Name: "Fresh", Version: 2}, []string{FieldName})
+		assert.NoError(t, err)
+		assert.Equal(t, uint(3), u.Version)
+		assert.Equal(t, "Fresh", u.Name)
+
+		u, err = a.Suspend(u.ID, "review")
+		assert.NoError(t, err)
+		assert.Equal(t, uint(4), u.Version)
+
+		assert.ErrorIs(t, a.DeleteUserAt(u.ID, 3), ErrVersionMismatch)
+		assert.NoError(t, a.DeleteUserAt(u.ID, 4))
+		u, err = a.Restore(u.ID)
+		assert.NoError(t, err)
+		assert.Equal(t, uint(5), u.Version)
+		stored, err := a.GetUser(u.ID)
+		assert.NoError(t, err)
+		assert.Equal(t, uint(5), stored.Version)
+	})
+}
+
+func TestRestoreAndPurge(t *testing.T) {
+	database.RunTest(func(db *gorm.DB) {
+		a := AdminAuth(db, testHasher)
+		u, err := a.RegisterUser("foo@bar.com", "securePassword", "Foo Bar")
+		assert.NoError(t, err)
+		assert.NoError(t, db.Create(&core.Session{UserID: u.ID}).Error)
+
+		_, err = a.Restore(u.ID)
+		assert.ErrorIs(t, err, ErrNotDeleted)
+		assert.ErrorIs(t, a.Purge(u.ID), ErrNotDeleted)
+		assert.NoError(t, a.DeleteUser(u.ID))
+
+		deleted, err := a.ListUsers(ListOptions{Deleted: true})
+		assert.NoError(t, err)
+		assert.Equal(t, int64(1), deleted.Total)
+		assert.Equal(t, u.ID, deleted.Users[0].ID)
+
+		// The username is free again while the user is deleted.
+		taken, err := a.RegisterUser("foo@bar.com", "securePassword", "Other Foo")
+		assert.NoError(t, err)
+		_, err = a.Restore(u.ID)
+		assert.ErrorIs(t, err, ErrUsernameTaken)
+		assert.NoError(t, a.DeleteUser(taken.ID))
+
+		restored, err := a.Restore(u.ID)
+		assert.NoError(t, err)
+		assert.False(t, restored.DeletedAt.Valid)
+		_, err = a.AuthenticateUser("foo@bar.com", "securePassword")
+		assert.NoError(t, err)
+		_, err = a.RegisterUser("foo@bar.com", "securePassword", "Third Foo")
+		assert.Error(t, err)
+
+		assert.NoError(t, a.DeleteUser(u.ID))
+		assert.NoError(t, a.Purge(u.ID))
+		_, err = a.Restore(u.ID)
+		assert.ErrorIs(t, err, gorm.ErrRecordNotFound)
+		var count int64
+		assert.NoError(t, db.Model(core.Session{}).Where("user_id = ?", u.ID).Count(&count).Error)
+		assert.Equal(t, int64(0), count)
+		assert.NoError(t, db.Table("user_roles").Where("user_id = ?", u.ID).Count(&count).Error)
+		assert.Equal(t, int64(0), count)
+
+		deleted, err = a.ListUsers(ListOptions{Deleted: true})
+		assert.NoError(t, err)
+		assert.Equal(t, int64(1), deleted.Total)
+		assert.Equal(t, taken.ID, deleted.Users[0].ID)
+	})
+}
+
+func TestAuthenticateUserRehashesLegacyPassword(t *testing.T) {
+	database.RunTest(func(db *gorm.DB) {
+		legacy := core.User{
+			Username: "legacy@bar.com",
+			Password: fmt.Sprintf("%x", md5.Sum([]byte("securePassword"))),
+			Name:     "Legacy",
+		}
+		assert.NoError(t, db.Create(&legacy).Error)
+
+		a := AdminAuth(db, testHasher)
+		_, err := a.AuthenticateUser("legacy@bar.com", "wrongPassword")
+		assert.Error(t, err)
+
+		u, err := a.AuthenticateUser("legacy@bar.com", "securePassword")
+		assert.NoError(t, err)
+		assert.True(t, strings.HasPrefix(u.Password, "$2a$04$"))
+
+		var stored core.User
+		assert.NoError(t, db.First(&stored, legacy.ID).Error)
+		assert.Equal(t, u.Password, stored.Password)
+
+		upgraded := AdminAuth(db, password.New(password.Bcrypt{Cost: 5}))
+		u, err = upgraded.AuthenticateUser("legacy@bar.com", "securePassword")
+		assert.NoError(t, err)
+		assert.True(t, strings.HasPrefix(u.Password, "$2a$05$"))
+
+		_, err = a.AuthenticateUser("legacy@bar.com", "securePassword")
+		assert.NoError(t, err)
+	})
+}
+
+func TestListUsersPagination(t *testing.T) {
+	database.RunTest(func(db *gorm.DB) {
+		a := AdminAuth(db, testHasher)
+		base := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+		names := []string{"delta", "alpha", "echo", "charlie", "bravo"}
+		for i, name := range names {
+			u := core.User{Username: name + "@bar.com", Name: strings.ToUpper(name[:1]) + name[1:]}
+			u.CreatedAt = base.Add(time.Duration(i) * time.Hour)
+			assert.NoError(t, db.Create(&u).Error)
+		}
+
+		usernames := func(r ListResult) []string {
+			var out []string
+			for _, u := range r.Users {
+				out = append(out, strings.TrimSuffix(u.Username, "@bar.com"))
+			}
+			return out
+		}
+
+		page, err := a.ListUsers(ListOptions{Limit: 2, Sort: "username"})
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"alpha", "bravo"}, usernames(page))
+		assert.Equal(t, int64(5), page.Total)
+		assert.Empty(t, page.PrevCursor)
+
+		page, err = a.ListUsers(ListOptions{Limit: 2, Sort: "username", Cursor: page.NextCursor})
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"charlie", "delta"}, usernames(page))
+
+		last, err := a.ListUsers(ListOptions{Limit: 2, Sort: "username", Cursor: page.NextCursor})
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"echo"}, usernames(last))
+		assert.Empty(t, last.NextCursor)
+
+		back, err := a.ListUsers(ListOptions{Limit: 2, Sort: "username", Cursor: last.PrevCursor})
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"charlie", "delta"}, usernames(back))
+
+		back, err = a.ListUsers(ListOptions{Limit: 2, Sort: "username", Cursor: back.PrevCursor})
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"alpha", "bravo"}, usernames(back))
+		assert.Empty(t, back.PrevCursor)
+		assert.NotEmpty(t, back.NextCursor)
+
+		page, err = a.ListUsers(ListOptions{Limit: 3, Sort: "-created_at"})
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"bravo", "charlie", "echo"}, usernames(page))
+		page, err = a.ListUsers(ListOptions{Limit: 3, Sort: "-created_at", Cursor: page.NextCursor})
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"alpha", "delta"}, usernames(page))
+
+		after := base.Add(time.Hour)
+		before := base.Add(4 * time.Hour)
+		page, err = a.ListUsers(ListOptions{CreatedAfter: &after, CreatedBefore: &before, Sort: "-id"})
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"charlie", "echo", "alpha"}, usernames(page))
+		assert.Equal(t, int64(3), page.Total)
+
+		page, err = a.ListUsers(ListOptions{Username: "ha", Name: "Alp"})
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"alpha"}, usernames(page))
+
+		_, err = a.ListUsers(ListOptions{Sort: "password"})
+		assert.Error(t, err)
+
+		_, err = a.ListUsers(ListOptions{Cursor: "not a cursor"})
+		assert.Error(t, err)
+		_, err = a.ListUsers(ListOptions{Cursor: base64.RawURLEncoding.EncodeToString([]byte("not json"))})
+		assert.ErrorIs(t, err, ErrInvalidCursor)
+
+		page, err = a.ListUsers(ListOptions{Limit: 2, Sort: "-name"})
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"echo", "delta"}, usernames(page))
+		page, err = a.ListUsers(ListOptions{Limit: 2, Sort: "-name", Cursor: page.NextCursor})
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"charlie", "bravo"}, usernames(page))
+
+		page, err = a.ListUsers(ListOptions{Limit: 4})
+		assert.NoError(t, err)
+		page, err = a.ListUsers(ListOptions{Limit: 4, Cursor: page.NextCursor})
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"bravo"}, usernames(page))
+
+		restore := failFinds(t, db, &[]core.User{})
+		_, err = a.ListUsers(ListOptions{})
+		assert.Error(t, err)
+		restore()
+		restore = hideTable(t, db, "users")
+		_, err = a.ListUsers(ListOptions{})
+		assert.Error(t, err)
+		restore()
+
+		_, err = a.ListUsers(ListOptions{Sort: "created_at", Cursor: encodeCursor(cursor{Value: "yesterday", ID: 1})})
+		assert.Error(t, err)
+
+		page, err = a.ListUsers(ListOptions{Limit: 1000})
+		assert.NoError(t, err)
+		assert.Equal(t, 5, len(page.Users))
+	})
+}
+
+func TestUserErrors(t *testing.T) {
+	database.RunTest(func(db *gorm.DB) {
+		a := AdminAuth(db, testHasher).(*Auth)
+		u, err := a.RegisterUser("foo@bar.com", "securePassword", "Foo Bar")
+		assert.NoError(t, err)
+
+		a.hasher = &failingHasher{PasswordHasher: testHasher}
+		_, err = a.RegisterUser("bar@bar.com", "securePassword", "Bar Foo")
+		assert.ErrorIs(t, err, errHashFailed)
+		_, err = a.UpdateUserFields(u.ID, UserUpdate{Password: "newPassword"}, []string{FieldPassword})
+		assert.ErrorIs(t, err, errHashFailed)
+		a.hasher = testHasher
+
+		restore := hideTable(t, db, "users")
+		_, err = a.RegisterUser("bar@bar.com", "securePassword", "Bar Foo")
+		assert.Error(t, err)
+		_, err = a.AuthenticateUser("foo@bar.com", "securePassword")
+		assert.Error(t, err)
+		assert.NotErrorIs(t, err, ErrInvalidCredentials)
+		_, err = a.Restore(u.ID)
+		assert.Error(t, err)
+		assert.NotErrorIs(t, err, ErrUserNotFound)
+		restore()
+
+		restore = failWrites(t, db, "users", "INSERT", "1")
+		_, err = a.RegisterUser("bar@bar.com", "securePassword", "Bar Foo")
+		assert.Error(t, err)
+		restore()
+		restore = hideTable(t, db, "roles")
+		_, err = a.RegisterUser("bar@bar.com", "securePassword", "Bar Foo")
+		assert.ErrorContains(t, err, "default role")
+		restore()
+
+		// An empty mask changes nothing.
+		unchanged, err := a.UpdateUserFields(u.ID, UserUpdate{Name: "Other"}, nil)
+		assert.NoError(t, err)
+		assert.Equal(t, u.Version, unchanged.Version)
+
+		restore = failWrites(t, db, "users", "UPDATE", "1")
+		_, err = a.UpdateUserFields(u.ID, UserUpdate{Name: "Other"}, []string{FieldName})
+		assert.Error(t, err)
+		assert.Error(t, a.DeleteUserAt(u.ID, u.Version))
+		restore()
+
+		// A change that lands between reading and writing the user wins.
+		assert.NoError(t, db.Exec("CREATE TRIGGER skip_users BEFORE UPDATE ON users BEGIN SELECT RAISE(IGNORE); END").Error)
+		_, err = a.UpdateUserFields(u.ID, UserUpdate{Name: "Other", Version: u.Version}, []string{FieldName})
+		assert.ErrorIs(t, err, ErrVersionMismatch)
+		assert.NoError(t, db.Exec("DROP TRIGGER skip_users").Error)
+
+		assert.NoError(t, a.DeleteUser(u.ID))
+		restore = hideTable(t, db, "user_roles")
+		assert.Error(t, a.Purge(u.ID))
+		restore()
+		restore = hideTable(t, db, "refresh_tokens")
+		assert.Error(t, a.Purge(u.ID))
+		restore()
+		assert.NoError(t, a.Purge(u.ID))
+	})
+}
@@ -1,6 +1,10 @@
 package jwtAuth
 
 import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"github.com/MicBun/go-100-coverage-docker-crud/util"
 	"github.com/gin-gonic/gin"
@@ -10,40 +14,199 @@ import (
 	"time"
 )
 
-var apiSecret = util.GetEnv("API_SECRET", "rahasiasekali")
+// DefaultSecret is the API_SECRET used when none is configured. It is
+// public, so anything signed with it proves nothing.
+const DefaultSecret = "rahasiasekali"
 
-func GenerateToken(id uint) (string, error) {
-	tokenLifespan, err := strconv.Atoi(util.GetEnv("TOKEN_HOUR_LIFESPAN", "1"))
+var apiSecret = util.GetEnv("API_SECRET", DefaultSecret)
+
+var ErrDefaultSecret = errors.New("audit checkpoints can't be signed with the default API_SECRET, set API_SECRET or JWT_ALGORITHM")
+
+const (
+	purposeMFA             = "mfa"
+	purposeAuditCheckpoint = "audit_checkpoint"
+)
+
+// GenerateToken signs an access token for the user. sessionID ties the token
+// to a login session so it stops working once that session is revoked; zero
+// issues a token that is not bound to any session.
+func GenerateToken(id uint, roles []string, sessionID uint) (string, error) {
+	tokenLifespan, err := TokenLifespan()
+	if err != nil {
+		return "", err
+	}
+
+	jti, err := newJTI()
 	if err != nil {
 		return "", err
 	}
 
 	claims := jwt.MapClaims{
-		"id": id,
-		"role": func() string {
-			if id == 1 {
-				return "admin"
-			}
-			return "user"
-		}(),
-		"exp": time.Now().Add(time.Hour * time.Duration(tokenLifespan)).Unix(),
+		"id":    id,
+		"roles": roles,
+		"jti":   jti,
+		"exp":   time.Now().Add(tokenLifespan).Unix(),
+	}
+	if sessionID != 0 {
+		claims["sid"] = sessionID
 	}
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return token.SignedString([]byte(apiSecret))
+	return sign(claims)
 }
 
-func TokenValid(c *gin.Context) error {
-	tokenString := ExtractToken(c)
-	_, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+// TokenLifespan is how long access tokens live: TOKEN_MINUTE_LIFESPAN
+// minutes, or else TOKEN_HOUR_LIFESPAN hours as deployments set it before
+// lifespans were counted in minutes, or else 15 minutes.
+func TokenLifespan() (time.Duration, error) {
+	if util.GetEnv("TOKEN_MINUTE_LIFESPAN", "") == "" {
+		if hours := util.GetEnv("TOKEN_HOUR_LIFESPAN", ""); hours != "" {
+			n, err := strconv.Atoi(hours)
+			return time.Duration(n) * time.Hour, err
 		}
-		return []byte(apiSecret), nil
+	}
+	n, err := strconv.Atoi(util.GetEnv("TOKEN_MINUTE_LIFESPAN", "15"))
+	return time.Duration(n) * time.Minute, err
+}
+
+func newJTI() (string, error) {
+	jti := make([]byte, 16)
+	if _, err := rand.Read(jti); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(jti), nil
+}
+
+func sign(claims jwt.MapClaims) (string, error) {
+	return signWith(signingKey(), claims)
+}
+
+func signWith(key Key, claims jwt.MapClaims) (string, error) {
+	token := jwt.NewWithClaims(key.method(), claims)
+	if key.ID != "" {
+		token.Header["kid"] = key.ID
+	}
+	return token.SignedString(key.signingKey())
+}
+
+// GenerateChallengeToken signs the token that proves the password step of a
+// two-step login. It names the user in its own claim and carries a purpose,
+// so it is never accepted as an access token.
+func GenerateChallengeToken(id uint, lifespan time.Duration) (string, error) {
+	jti, err := newJTI()
+	if err != nil {
+		return "", err
+	}
+	return sign(jwt.MapClaims{
+		"purpose":  purposeMFA,
+		"mfa_user": id,
+		"jti":      jti,
+		"exp":      time.Now().Add(lifespan).Unix(),
 	})
+}
+
+// ParseChallengeToken verifies a challenge token and returns the user it was
+// issued for together with its jti and expiry.
+func ParseChallengeToken(tokenString string) (uint, string, time.Time, error) {
+	claims, err := verify(tokenString)
 	if err != nil {
-		return err
+		return 0, "", time.Time{}, err
+	}
+	if claims["purpose"] != purposeMFA {
+		return 0, "", time.Time{}, fmt.Errorf("not a challenge token")
 	}
-	return nil
+	id, err := uintClaim(claims, "mfa_user")
+	if err != nil {
+		return 0, "", time.Time{}, err
+	}
+	jti, _ := claims["jti"].(string)
+	exp, _ := claims["exp"].(float64)
+	return id, jti, time.Unix(int64(exp), 0), nil
+}
+
+// SignAuditCheckpoint signs the hash of an audit event. The signature never
+// expires and carries a purpose, so it is never accepted as an access token.
+// It returns the key that signed, so its public half can be kept for as long
+// as the checkpoint. It fails with ErrDefaultSecret while tokens are signed
+// with DefaultSecret, since anyone could forge such a checkpoint.
+func SignAuditCheckpoint(eventID uint, hash string) (string, Key, error) {
+	key := signingKey()
+	if key.Algorithm == AlgHS256 && bytes.Equal(key.Secret, []byte(DefaultSecret)) {
+		return "", Key{}, ErrDefaultSecret
+	}
+	signature, err := signWith(key, jwt.MapClaims{
+		"purpose":     purposeAuditCheckpoint,
+		"audit_event": eventID,
+		"hash":        hash,
+		"iat":         time.Now().Unix(),
+	})
+	return signature, key, err
+}
+
+// ParseAuditCheckpoint verifies a checkpoint signature and returns the event
+// and hash it covers. The error wraps ErrUnknownKey when the signing key is
+// not known.
+func ParseAuditCheckpoint(signature string) (uint, string, error) {
+	claims, err := verify(signature)
+	if err != nil {
+		return 0, "", err
+	}
+	if claims["purpose"] != purposeAuditCheckpoint {
+		return 0, "", fmt.Errorf("not an audit checkpoint")
+	}
+	id, err := uintClaim(claims, "audit_event")
+	if err != nil {
+		return 0, "", err
+	}
+	hash, _ := claims["hash"].(string)
+	return id, hash, nil
+}
+
+// ParseToken verifies an access token against the current key set and
+// returns its claims.
+func ParseToken(tokenString string) (jwt.MapClaims, error) {
+	claims, err := verify(tokenString)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := claims["purpose"]; ok {
+		return nil, fmt.Errorf("not an access token")
+	}
+	return claims, nil
+}
+
+func verify(tokenString string) (jwt.MapClaims, error) {
+	token, err := jwt.Parse(tokenString, lookupKey)
+	if err != nil {
+		return nil, err
+	}
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok || !token.Valid {
+		return nil, fmt.Errorf("invalid token")
+	}
+	return claims, nil
+}
+
+// claimsKey holds the outcome of parsing the access token of a request, so
+// the token is verified once however many claims are read from it.
+const claimsKey = "jwtAuth.claims"
+
+type parsed struct {
+	claims jwt.MapClaims
+	err    error
+}
+
+func parse(c *gin.Context) (jwt.MapClaims, error) {
+	if value, ok := c.Get(claimsKey); ok {
+		p := value.(parsed)
+		return p.claims, p.err
+	}
+	claims, err := ParseToken(ExtractToken(c))
+	c.Set(claimsKey, parsed{claims, err})
+	return claims, err
+}
+
+func TokenValid(c *gin.Context) error {
+	_, err := parse(c)
+	return err
 }
 
 func ExtractToken(c *gin.Context) string {
@@ -58,46 +221,66 @@ func ExtractToken(c *gin.Context) string {
 	return ""
 }
 
+func uintClaim(claims jwt.MapClaims, name string) (uint, error) {
+	value, ok := claims[name]
+	if !ok {
+		return 0, nil
+	}
+	id, err := strconv.ParseUint(fmt.Sprintf("%.0f", value), 10, 32)
+	if err != nil {
+		return 0, err
+	}
+	return uint(id), nil
+}
+
 func ExtractTokenID(c *gin.Context) (uint, error) {
-	tokenString := ExtractToken(c)
-	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
-		}
-		return []byte(apiSecret), nil
-	})
+	claims, err := parse(c)
 	if err != nil {
 		return 0, err
 	}
-	claims, ok := token.Claims.(jwt.MapClaims)
-	if ok && token.Valid {
-		uid, err := strconv.ParseUint(fmt.Sprintf("%.0f", claims["id"]), 10, 32)
-		if err != nil {
-			return 0, err
-		}
-		return uint(uid), nil
+	return uintClaim(claims, "id")
+}
+
+// ExtractTokenSessionID returns the session the token belongs to, or zero for
+// tokens that are not bound to a session.
+func ExtractTokenSessionID(c *gin.Context) (uint, error) {
+	claims, err := parse(c)
+	if err != nil {
+		return 0, err
 	}
-	return 0, nil
+	return uintClaim(claims, "sid")
 }
 
-func ExtractTokenRole(c *gin.Context) (string, error) {
-	tokenString := ExtractToken(c)
-	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
-		}
-		return []byte(apiSecret), nil
-	})
+// ExtractTokenJTI returns the unique ID of the token and when it expires.
+func ExtractTokenJTI(c *gin.Context) (string, time.Time, error) {
+	claims, err := parse(c)
 	if err != nil {
-		return "", err
+		return "", time.Time{}, err
 	}
-	claims, ok := token.Claims.(jwt.MapClaims)
-	if ok && token.Valid {
-		role, ok := claims["role"].(string)
+	jti, _ := claims["jti"].(string)
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return "", time.Time{}, fmt.Errorf("exp is not a number")
+	}
+	return jti, time.Unix(int64(exp), 0), nil
+}
+
+func ExtractTokenRoles(c *gin.Context) ([]string, error) {
+	claims, err := parse(c)
+	if err != nil {
+		return nil, err
+	}
+	list, ok := claims["roles"].([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("roles is not a list")
+	}
+	roles := make([]string, 0, len(list))
+	for _, item := range list {
+		role, ok := item.(string)
 		if !ok {
-			return "", fmt.Errorf("role is not string")
+			return nil, fmt.Errorf("role is not string")
 		}
-		return role, nil
+		roles = append(roles, role)
 	}
-	return "", nil
+	return roles, nil
 }
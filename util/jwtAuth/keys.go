@@ -0,0 +1,267 @@
+package jwtAuth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"sync"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+const (
+	AlgHS256 = "HS256"
+	AlgRS256 = "RS256"
+	AlgES256 = "ES256"
+	AlgEdDSA = "EdDSA"
+)
+
+// Key is a token signing key. Asymmetric keys hold their private half in
+// Private, or only their public half in Public when they just verify; HMAC
+// keys hold the shared secret in Secret. Tokens signed with a key carry its
+// ID in the kid header, except the legacy HMAC key whose ID is empty so
+// tokens stay verifiable by older releases.
+type Key struct {
+	ID        string
+	Algorithm string
+	Private   crypto.Signer
+	Public    crypto.PublicKey
+	Secret    []byte
+}
+
+func (k Key) method() jwt.SigningMethod {
+	return jwt.GetSigningMethod(k.Algorithm)
+}
+
+func (k Key) signingKey() interface{} {
+	if k.Secret != nil {
+		return k.Secret
+	}
+	return k.Private
+}
+
+func (k Key) verificationKey() interface{} {
+	if k.Secret != nil {
+		return k.Secret
+	}
+	if k.Private == nil {
+		return k.Public
+	}
+	return k.Private.Public()
+}
+
+// HMACKey is the legacy shared-secret key.
+func HMACKey(secret string) Key {
+	return Key{Algorithm: AlgHS256, Secret: []byte(secret)}
+}
+
+// GenerateKey creates a new asymmetric key with a random kid.
+func GenerateKey(algorithm string) (Key, error) {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return Key{}, err
+	}
+	key := Key{ID: hex.EncodeToString(id), Algorithm: algorithm}
+	var err error
+	switch algorithm {
+	case AlgRS256:
+		key.Private, err = rsa.GenerateKey(rand.Reader, 2048)
+	case AlgES256:
+		key.Private, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case AlgEdDSA:
+		_, key.Private, err = ed25519.GenerateKey(rand.Reader)
+	default:
+		err = fmt.Errorf("unsupported signing algorithm %q", algorithm)
+	}
+	return key, err
+}
+
+// EncodePrivateKey returns the private half of an asymmetric key as a PKCS#8
+// PEM block.
+func EncodePrivateKey(key Key) (string, error) {
+	der, err := x509.MarshalPKCS8PrivateKey(key.Private)
+	if err != nil {
+		return "", err
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})), nil
+}
+
+// DecodePrivateKey is the inverse of EncodePrivateKey.
+func DecodePrivateKey(id, algorithm, encoded string) (Key, error) {
+	block, _ := pem.Decode([]byte(encoded))
+	if block == nil {
+		return Key{}, fmt.Errorf("key %s is not PEM encoded", id)
+	}
+	private, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return Key{}, err
+	}
+	signer, ok := private.(crypto.Signer)
+	if !ok {
+		return Key{}, fmt.Errorf("key %s cannot sign", id)
+	}
+	return Key{ID: id, Algorithm: algorithm, Private: signer}, nil
+}
+
+// EncodePublicKey returns the public half of an asymmetric key as a PKIX PEM
+// block.
+func EncodePublicKey(key Key) (string, error) {
+	der, err := x509.MarshalPKIXPublicKey(key.verificationKey())
+	if err != nil {
+		return "", err
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})), nil
+}
+
+// DecodePublicKey is the inverse of EncodePublicKey. The key it returns can
+// only verify.
+func DecodePublicKey(id, algorithm, encoded string) (Key, error) {
+	block, _ := pem.Decode([]byte(encoded))
+	if block == nil {
+		return Key{}, fmt.Errorf("key %s is not PEM encoded", id)
+	}
+	public, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return Key{}, err
+	}
+	return Key{ID: id, Algorithm: algorithm, Public: public}, nil
+}
+
+// JWK is the public half of a key in JSON Web Key form.
+type JWK struct {
+	KeyType   string `json:"kty"`
+	KeyID     string `json:"kid"`
+	Use       string `json:"use"`
+	Algorithm string `json:"alg"`
+	Curve     string `json:"crv,omitempty"`
+	N         string `json:"n,omitempty"`
+	E         string `json:"e,omitempty"`
+	X         string `json:"x,omitempty"`
+	Y         string `json:"y,omitempty"`
+}
+
+type JWKSet struct {
+	Keys []JWK `json:"keys"`
+}
+
+func encode(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// padded returns n as a big-endian byte slice of exactly size bytes, which
+// is how JWK encodes EC coordinates.
+func padded(n *big.Int, size int) []byte {
+	out := make([]byte, size)
+	return n.FillBytes(out)
+}
+
+func (k Key) jwk() (JWK, bool) {
+	out := JWK{KeyID: k.ID, Use: "sig", Algorithm: k.Algorithm}
+	switch public := k.verificationKey().(type) {
+	case *rsa.PublicKey:
+		out.KeyType = "RSA"
+		out.N = encode(public.N.Bytes())
+		out.E = encode(big.NewInt(int64(public.E)).Bytes())
+	case *ecdsa.PublicKey:
+		size := (public.Curve.Params().BitSize + 7) / 8
+		out.KeyType = "EC"
+		out.Curve = public.Curve.Params().Name
+		out.X = encode(padded(public.X, size))
+		out.Y = encode(padded(public.Y, size))
+	case ed25519.PublicKey:
+		out.KeyType = "OKP"
+		out.Curve = "Ed25519"
+		out.X = encode(public)
+	default:
+		return out, false
+	}
+	return out, true
+}
+
+var ErrUnknownKey = errors.New("unknown signing key")
+
+type keySet struct {
+	mu      sync.RWMutex
+	signing Key
+	byID    map[string]Key
+}
+
+var keys = &keySet{}
+
+func init() {
+	SetKeys(HMACKey(apiSecret))
+}
+
+// SetKeys replaces the key used to sign new tokens and the keys accepted when
+// verifying them. The signing key is always accepted.
+func SetKeys(signing Key, verify ...Key) {
+	byID := map[string]Key{signing.ID: signing}
+	for _, key := range verify {
+		byID[key.ID] = key
+	}
+	keys.mu.Lock()
+	defer keys.mu.Unlock()
+	keys.signing = signing
+	keys.byID = byID
+}
+
+// AddVerificationKeys accepts more keys when verifying, without changing the
+// signing key. Tools that only check signatures use it to load stored keys.
+func AddVerificationKeys(verify ...Key) {
+	keys.mu.Lock()
+	defer keys.mu.Unlock()
+	byID := make(map[string]Key, len(keys.byID)+len(verify))
+	for id, key := range keys.byID {
+		byID[id] = key
+	}
+	for _, key := range verify {
+		byID[key.ID] = key
+	}
+	keys.byID = byID
+}
+
+func signingKey() Key {
+	keys.mu.RLock()
+	defer keys.mu.RUnlock()
+	return keys.signing
+}
+
+func lookupKey(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+	keys.mu.RLock()
+	key, ok := keys.byID[kid]
+	keys.mu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("%w %q", ErrUnknownKey, kid)
+	}
+	// The algorithm comes from the key, never from the token, so a public key
+	// can't be replayed as an HMAC secret.
+	if token.Method.Alg() != key.Algorithm {
+		return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+	}
+	return key.verificationKey(), nil
+}
+
+// JWKS returns the public keys currently accepted for verification. The
+// legacy HMAC secret is never published.
+func JWKS() JWKSet {
+	keys.mu.RLock()
+	defer keys.mu.RUnlock()
+	set := JWKSet{Keys: []JWK{}}
+	for _, key := range keys.byID {
+		if jwk, ok := key.jwk(); ok {
+			set.Keys = append(set.Keys, jwk)
+		}
+	}
+	return set
+}
@@ -0,0 +1,258 @@
+package password
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/MicBun/go-100-coverage-docker-crud/util"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// PasswordHasher hashes passwords into a self-describing encoded string that
+// records the algorithm and its parameters, so stored hashes can be verified
+// and upgraded after the configuration changes.
+type PasswordHasher interface {
+	Hash(plain string) (string, error)
+	Verify(plain, encoded string) (bool, error)
+	NeedsRehash(encoded string) bool
+}
+
+type scheme interface {
+	PasswordHasher
+	owns(encoded string) bool
+}
+
+type Bcrypt struct {
+	Cost int
+}
+
+func (b Bcrypt) Hash(plain string) (string, error) {
+	h, err := bcrypt.GenerateFromPassword([]byte(plain), b.Cost)
+	if err != nil {
+		return "", err
+	}
+	return string(h), nil
+}
+
+func (b Bcrypt) Verify(plain, encoded string) (bool, error) {
+	err := bcrypt.CompareHashAndPassword([]byte(encoded), []byte(plain))
+	if err == bcrypt.ErrMismatchedHashAndPassword {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (b Bcrypt) NeedsRehash(encoded string) bool {
+	cost, err := bcrypt.Cost([]byte(encoded))
+	if err != nil {
+		return true
+	}
+	return cost < b.Cost
+}
+
+func (b Bcrypt) owns(encoded string) bool {
+	return strings.HasPrefix(encoded, "$2a$") || strings.HasPrefix(encoded, "$2b$") || strings.HasPrefix(encoded, "$2y$")
+}
+
+// random is the source of salts, replaced in tests.
+var random = rand.Reader
+
+type Argon2id struct {
+	Memory      uint32
+	Iterations  uint32
+	Parallelism uint8
+	SaltLength  uint32
+	KeyLength   uint32
+}
+
+// Hash encodes the result in the PHC string format:
+// $argon2id$v=19$m=<memory>,t=<iterations>,p=<parallelism>$<salt>$<key>
+func (a Argon2id) Hash(plain string) (string, error) {
+	salt := make([]byte, a.SaltLength)
+	if _, err := io.ReadFull(random, salt); err != nil {
+		return "", err
+	}
+	key := argon2.IDKey([]byte(plain), salt, a.Iterations, a.Memory, a.Parallelism, a.KeyLength)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, a.Memory, a.Iterations, a.Parallelism,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	), nil
+}
+
+func (a Argon2id) Verify(plain, encoded string) (bool, error) {
+	params, salt, key, err := decodeArgon2id(encoded)
+	if err != nil {
+		return false, err
+	}
+	other := argon2.IDKey([]byte(plain), salt, params.Iterations, params.Memory, params.Parallelism, uint32(len(key)))
+	return subtle.ConstantTimeCompare(key, other) == 1, nil
+}
+
+func (a Argon2id) NeedsRehash(encoded string) bool {
+	params, salt, key, err := decodeArgon2id(encoded)
+	if err != nil {
+		return true
+	}
+	return params.Memory < a.Memory ||
+		params.Iterations < a.Iterations ||
+		params.Parallelism < a.Parallelism ||
+		uint32(len(salt)) < a.SaltLength ||
+		uint32(len(key)) < a.KeyLength
+}
+
+func (a Argon2id) owns(encoded string) bool {
+	return strings.HasPrefix(encoded, "$argon2id$")
+}
+
+func decodeArgon2id(encoded string) (Argon2id, []byte, []byte, error) {
+	var params Argon2id
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return params, nil, nil, fmt.Errorf("invalid argon2id hash")
+	}
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil {
+		return params, nil, nil, fmt.Errorf("invalid argon2id version: %w", err)
+	}
+	if version != argon2.Version {
+		return params, nil, nil, fmt.Errorf("unsupported argon2id version %d", version)
+	}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.Memory, &params.Iterations, &params.Parallelism); err != nil {
+		return params, nil, nil, fmt.Errorf("invalid argon2id parameters: %w", err)
+	}
+	// argon2 panics on these rather than failing.
+	if params.Iterations < 1 || params.Parallelism < 1 {
+		return params, nil, nil, fmt.Errorf("invalid argon2id parameters %q", parts[3])
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return params, nil, nil, fmt.Errorf("invalid argon2id salt: %w", err)
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return params, nil, nil, fmt.Errorf("invalid argon2id key: %w", err)
+	}
+	params.SaltLength = uint32(len(salt))
+	params.KeyLength = uint32(len(key))
+	return params, salt, key, nil
+}
+
+// legacyMD5 verifies the unsalted hex MD5 digests written by earlier versions.
+// It never produces new hashes and always asks to be rehashed.
+type legacyMD5 struct{}
+
+func (legacyMD5) Hash(string) (string, error) {
+	return "", fmt.Errorf("md5 hashing is no longer supported")
+}
+
+func (legacyMD5) Verify(plain, encoded string) (bool, error) {
+	sum := md5.Sum([]byte(plain))
+	return subtle.ConstantTimeCompare([]byte(hex.EncodeToString(sum[:])), []byte(encoded)) == 1, nil
+}
+
+func (legacyMD5) NeedsRehash(string) bool {
+	return true
+}
+
+func (legacyMD5) owns(encoded string) bool {
+	if len(encoded) != md5.Size*2 {
+		return false
+	}
+	_, err := hex.DecodeString(encoded)
+	return err == nil
+}
+
+type upgrader struct {
+	preferred scheme
+	schemes   []scheme
+}
+
+// New returns a PasswordHasher that hashes with preferred and verifies hashes
+// produced by any supported algorithm. Hashes that were not produced by the
+// preferred algorithm, or with weaker parameters, report NeedsRehash.
+func New(preferred PasswordHasher) PasswordHasher {
+	p, ok := preferred.(scheme)
+	if !ok {
+		panic(fmt.Sprintf("unsupported password hasher %T", preferred))
+	}
+	return &upgrader{
+		preferred: p,
+		schemes:   []scheme{p, Bcrypt{}, Argon2id{}, legacyMD5{}},
+	}
+}
+
+func (u *upgrader) Hash(plain string) (string, error) {
+	return u.preferred.Hash(plain)
+}
+
+func (u *upgrader) Verify(plain, encoded string) (bool, error) {
+	for _, s := range u.schemes {
+		if s.owns(encoded) {
+			return s.Verify(plain, encoded)
+		}
+	}
+	return false, fmt.Errorf("unknown password hash format")
+}
+
+func (u *upgrader) NeedsRehash(encoded string) bool {
+	if !u.preferred.owns(encoded) {
+		return true
+	}
+	return u.preferred.NeedsRehash(encoded)
+}
+
+// FromEnv builds the upgrading hasher configured by PASSWORD_HASHER
+// ("bcrypt" or "argon2id") and the matching parameter variables.
+func FromEnv() (PasswordHasher, error) {
+	switch algorithm := util.GetEnv("PASSWORD_HASHER", "bcrypt"); algorithm {
+	case "bcrypt":
+		cost, err := strconv.Atoi(util.GetEnv("BCRYPT_COST", strconv.Itoa(bcrypt.DefaultCost)))
+		if err != nil {
+			return nil, err
+		}
+		if cost < bcrypt.MinCost || cost > bcrypt.MaxCost {
+			return nil, fmt.Errorf("bcrypt cost %d out of range", cost)
+		}
+		return New(Bcrypt{Cost: cost}), nil
+	case "argon2id":
+		memory, err := strconv.ParseUint(util.GetEnv("ARGON2_MEMORY_KB", "65536"), 10, 32)
+		if err != nil {
+			return nil, err
+		}
+		iterations, err := strconv.ParseUint(util.GetEnv("ARGON2_ITERATIONS", "3"), 10, 32)
+		if err != nil {
+			return nil, err
+		}
+		parallelism, err := strconv.ParseUint(util.GetEnv("ARGON2_PARALLELISM", "2"), 10, 8)
+		if err != nil {
+			return nil, err
+		}
+		if iterations < 1 || parallelism < 1 {
+			return nil, fmt.Errorf("argon2id iterations and parallelism must be at least 1")
+		}
+		if memory < 8*parallelism {
+			return nil, fmt.Errorf("argon2id memory must be at least 8 KiB per thread, got %d KiB for %d", memory, parallelism)
+		}
+		return New(Argon2id{
+			Memory:      uint32(memory),
+			Iterations:  uint32(iterations),
+			Parallelism: uint8(parallelism),
+			SaltLength:  16,
+			KeyLength:   32,
+		}), nil
+	default:
+		return nil, fmt.Errorf("unknown password hasher %q", algorithm)
+	}
+}
@@ -0,0 +1,159 @@
+package password
+
+import (
+	"crypto/rand"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBcrypt(t *testing.T) {
+	h := New(Bcrypt{Cost: 4})
+	encoded, err := h.Hash("securePassword")
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(encoded, "$2a$04$"))
+
+	ok, err := h.Verify("securePassword", encoded)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+
+	ok, err = h.Verify("notPassword", encoded)
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	assert.False(t, h.NeedsRehash(encoded))
+	assert.True(t, New(Bcrypt{Cost: 5}).NeedsRehash(encoded))
+
+	_, err = Bcrypt{Cost: 40}.Hash("securePassword")
+	assert.Error(t, err)
+	_, err = h.Verify("securePassword", "$2a$04$garbage")
+	assert.Error(t, err)
+	assert.True(t, h.NeedsRehash("$2a$garbage"))
+}
+
+func TestArgon2id(t *testing.T) {
+	params := Argon2id{Memory: 1024, Iterations: 1, Parallelism: 1, SaltLength: 16, KeyLength: 32}
+	h := New(params)
+	encoded, err := h.Hash("securePassword")
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(encoded, "$argon2id$v=19$m=1024,t=1,p=1$"))
+
+	ok, err := h.Verify("securePassword", encoded)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+
+	ok, err = h.Verify("notPassword", encoded)
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	assert.False(t, h.NeedsRehash(encoded))
+	params.Iterations = 2
+	assert.True(t, New(params).NeedsRehash(encoded))
+
+	for _, invalid := range []string{
+		"$argon2id$v=19$garbage",
+		"$argon2id$v=x$m=1024,t=1,p=1$c2FsdA$a2V5",
+		"$argon2id$v=16$m=1024,t=1,p=1$c2FsdA$a2V5",
+		"$argon2id$v=19$m=x$c2FsdA$a2V5",
+		"$argon2id$v=19$m=1024,t=1,p=1$!$a2V5",
+		"$argon2id$v=19$m=1024,t=1,p=1$c2FsdA$!",
+		"$argon2id$v=19$m=1024,t=0,p=1$c2FsdA$a2V5",
+		"$argon2id$v=19$m=1024,t=1,p=0$c2FsdA$a2V5",
+	} {
+		_, err = h.Verify("securePassword", invalid)
+		assert.Error(t, err, invalid)
+		assert.True(t, h.NeedsRehash(invalid), invalid)
+	}
+
+	random = failingReader{}
+	defer func() { random = rand.Reader }()
+	_, err = h.Hash("securePassword")
+	assert.Error(t, err)
+}
+
+type failingReader struct{}
+
+func (failingReader) Read([]byte) (int, error) { return 0, errors.New("no entropy") }
+
+func TestUpgrader(t *testing.T) {
+	h := New(Argon2id{Memory: 1024, Iterations: 1, Parallelism: 1, SaltLength: 16, KeyLength: 32})
+
+	ok, err := h.Verify("securePassword", "2d5a4ad6a9c8e3a2dd1b4ea5bcd1e4f6")
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	// md5("admin")
+	ok, err = h.Verify("admin", "21232f297a57a5a743894a0e4a801fc3")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.True(t, h.NeedsRehash("21232f297a57a5a743894a0e4a801fc3"))
+
+	bcryptHash, err := New(Bcrypt{Cost: 4}).Hash("securePassword")
+	assert.NoError(t, err)
+	ok, err = h.Verify("securePassword", bcryptHash)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.True(t, h.NeedsRehash(bcryptHash))
+
+	_, err = h.Verify("securePassword", "plaintext")
+	assert.Error(t, err)
+
+	// MD5 hashes are only ever verified.
+	_, err = legacyMD5{}.Hash("admin")
+	assert.Error(t, err)
+	assert.True(t, legacyMD5{}.NeedsRehash("21232f297a57a5a743894a0e4a801fc3"))
+
+	assert.Panics(t, func() { New(plainHasher{}) })
+}
+
+// plainHasher is a PasswordHasher New doesn't know how to upgrade from.
+type plainHasher struct{}
+
+func (plainHasher) Hash(plain string) (string, error)          { return plain, nil }
+func (plainHasher) Verify(plain, encoded string) (bool, error) { return plain == encoded, nil }
+func (plainHasher) NeedsRehash(string) bool                    { return false }
+
+func TestFromEnv(t *testing.T) {
+	t.Setenv("PASSWORD_HASHER", "argon2id")
+	h, err := FromEnv()
+	assert.NoError(t, err)
+	encoded, err := h.Hash("securePassword")
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(encoded, "$argon2id$"))
+
+	for _, name := range []string{"ARGON2_MEMORY_KB", "ARGON2_ITERATIONS", "ARGON2_PARALLELISM"} {
+		t.Setenv(name, "lots")
+		_, err = FromEnv()
+		assert.Error(t, err, name)
+		t.Setenv(name, "1")
+	}
+	t.Setenv("ARGON2_MEMORY_KB", "8")
+	_, err = FromEnv()
+	assert.NoError(t, err)
+	for _, tc := range [][2]string{{"ARGON2_ITERATIONS", "0"}, {"ARGON2_PARALLELISM", "0"}, {"ARGON2_MEMORY_KB", "7"}} {
+		t.Setenv(tc[0], tc[1])
+		_, err = FromEnv()
+		assert.Error(t, err, tc[0])
+		t.Setenv(tc[0], "8")
+	}
+
+	t.Setenv("PASSWORD_HASHER", "bcrypt")
+	t.Setenv("BCRYPT_COST", "4")
+	h, err = FromEnv()
+	assert.NoError(t, err)
+	encoded, err = h.Hash("securePassword")
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(encoded, "$2a$04$"))
+	t.Setenv("BCRYPT_COST", "40")
+	_, err = FromEnv()
+	assert.Error(t, err)
+	t.Setenv("BCRYPT_COST", "lots")
+	_, err = FromEnv()
+	assert.Error(t, err)
+
+	t.Setenv("PASSWORD_HASHER", "md5")
+	_, err = FromEnv()
+	assert.Error(t, err)
+}
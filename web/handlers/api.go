@@ -1,10 +1,14 @@
 package handlers
 
 import (
+	"github.com/MicBun/go-100-coverage-docker-crud/audit"
+	"github.com/MicBun/go-100-coverage-docker-crud/core"
 	"github.com/MicBun/go-100-coverage-docker-crud/service"
+	"github.com/MicBun/go-100-coverage-docker-crud/user"
 	"github.com/MicBun/go-100-coverage-docker-crud/util/jwtAuth"
-	"net/http"
+	"github.com/MicBun/go-100-coverage-docker-crud/web/middleware"
 	"strconv"
+	"time"
 
 	"github.com/gin-gonic/gin"
 )
@@ -16,13 +20,50 @@ type apiHandler struct {
 type ApiHandlerInterface interface {
 	Hello(c *gin.Context)
 	RegisterUser(c *gin.Context)
+	CreateUser(c *gin.Context)
+	ReplaceUser(c *gin.Context)
+	PatchUser(c *gin.Context)
 	UpdateUser(c *gin.Context)
 	DeleteUser(c *gin.Context)
 	GetUserByID(c *gin.Context)
 	GetUserByToken(c *gin.Context)
 	ListUsers(c *gin.Context)
+	ListDeletedUsers(c *gin.Context)
+	RestoreUser(c *gin.Context)
+	PurgeUser(c *gin.Context)
 	Login(c *gin.Context)
 	RefreshToken(c *gin.Context)
+	RefreshAccessToken(c *gin.Context)
+	Logout(c *gin.Context)
+	JWKS(c *gin.Context)
+	LoginMFA(c *gin.Context)
+	EnrollMFA(c *gin.Context)
+	ConfirmMFA(c *gin.Context)
+	ResetUserMFA(c *gin.Context)
+	ForgotPassword(c *gin.Context)
+	ResetPassword(c *gin.Context)
+	Signup(c *gin.Context)
+	VerifySignup(c *gin.Context)
+	ResendVerification(c *gin.Context)
+	UnlockUser(c *gin.Context)
+	SuspendUser(c *gin.Context)
+	LockUser(c *gin.Context)
+	ReactivateUser(c *gin.Context)
+	DeactivateUser(c *gin.Context)
+	ListAuditEvents(c *gin.Context)
+	UpdateMe(c *gin.Context)
+	ChangePassword(c *gin.Context)
+	ListRoles(c *gin.Context)
+	CreateRole(c *gin.Context)
+	UpdateRole(c *gin.Context)
+	GetUserRoles(c *gin.Context)
+	AssignRole(c *gin.Context)
+	RevokeRole(c *gin.Context)
+	ListSessions(c *gin.Context)
+	RevokeSession(c *gin.Context)
+	ListUserSessions(c *gin.Context)
+	RevokeUserSessions(c *gin.Context)
+	RevokeUserSession(c *gin.Context)
 }
 
 func NewApiHandler(container *service.Container) ApiHandlerInterface {
@@ -62,23 +103,29 @@ type RegisterUserRequest struct {
 // @Failure 401 {object} map[string]interface{}
 // @Router /user/register [post]
 func (h *apiHandler) RegisterUser(c *gin.Context) {
-	role, _ := jwtAuth.ExtractTokenRole(c)
-	if role != "admin" {
-		c.JSON(http.StatusUnauthorized, gin.H{"message": "You are not authorized to perform this action"})
+	if _, ok := h.registerUser(c); !ok {
 		return
 	}
+	c.JSON(200, gin.H{"message": "User registered"})
+	return
+}
+
+// registerUser creates the user described by the request body. It reports
+// false once it has failed the request.
+func (h *apiHandler) registerUser(c *gin.Context) (core.User, bool) {
 	var req RegisterUserRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(400, gin.H{"message": err.Error()})
-		return
+		middleware.Fail(c, 400, invalidRequest(err))
+		return core.User{}, false
 	}
-	_, err := h.container.Admin.RegisterUser(req.Username, req.Password, req.Name)
+	registered, err := h.container.Admin.RegisterUser(req.Username, req.Password, req.Name)
 	if err != nil {
-		c.JSON(400, gin.H{"message": err.Error()})
-		return
+		middleware.Fail(c, 400, err)
+		return core.User{}, false
 	}
-	c.JSON(200, gin.H{"message": "User registered"})
-	return
+	audit.SetTarget(c, "user", registered.ID)
+	audit.SetChange(c, nil, newUserResponse(c, registered))
+	return registered, true
 }
 
 type UpdateUserRequest struct {
@@ -95,31 +142,61 @@ type UpdateUserRequest struct {
 // @Produce  json
 // @Param id path int true "User ID"
 // @Param user body UpdateUserRequest true "User"
+// @Param If-Match header string false "ETag of the User as read, required when IF_MATCH_REQUIRED is set"
 // @Param Authorization header string true "Authorization. How to input in swagger : 'Bearer <insert_your_token_here>'"
 // @Security BearerToken
-// @Success 200 {object} map[string]interface{}
+// @Success 200 {object} object{message=string,user=UserResponse}
+// @Header 200 {string} ETag "Version of the User"
 // @Failure 400 {object} map[string]interface{}
 // @Failure 401 {object} map[string]interface{}
+// @Failure 412 {object} map[string]interface{} "code version_mismatch"
+// @Failure 428 {object} map[string]interface{} "code if_match_required"
+// @Failure 500 {object} map[string]interface{} "The password was changed but the sessions could not be logged out"
 // @Router /user/update/{id} [put]
 func (h *apiHandler) UpdateUser(c *gin.Context) {
-	role, _ := jwtAuth.ExtractTokenRole(c)
-	if role != "admin" {
-		c.JSON(http.StatusUnauthorized, gin.H{"message": "You are not authorized to perform this action"})
+	var req UpdateUserRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		middleware.Fail(c, 400, invalidRequest(err))
 		return
 	}
 	id, _ := strconv.Atoi(c.Param("id"))
-	var req UpdateUserRequest
-	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(400, gin.H{"message": err.Error()})
+	update := user.UserUpdate{Username: req.Username, Password: req.Password, Name: req.Name}
+	h.updateUser(c, uint(id), update, update.NonEmpty())
+}
+
+// updateUser changes the fields in mask of update on user id.
+func (h *apiHandler) updateUser(c *gin.Context, id uint, update user.UserUpdate, mask []string) {
+	audit.SetTarget(c, "user", id)
+	before, err := h.container.Admin.GetUser(id)
+	if err != nil {
+		middleware.Fail(c, 400, err)
+		return
+	}
+	version, ok := h.ifMatch(c, before)
+	if !ok {
 		return
 	}
-	updatedUser, err := h.container.Admin.UpdateUser(uint(id), req.Username, req.Password, req.Name)
+	update.Version = version
+	h.saveUser(c, before, update, mask)
+}
+
+// saveUser applies the fields in mask of update to before. A new password
+// logs the user out everywhere.
+func (h *apiHandler) saveUser(c *gin.Context, before core.User, update user.UserUpdate, mask []string) {
+	updatedUser, err := h.container.Admin.UpdateUserFields(before.ID, update, mask)
 	if err != nil {
-		c.JSON(400, gin.H{"message": err.Error()})
+		middleware.Fail(c, 400, err)
 		return
 	}
-	c.JSON(200, gin.H{"message": "User updated", "user": updatedUser})
-	return
+	audit.SetChange(c, newUserResponse(c, before), newUserResponse(c, updatedUser))
+	if contains(mask, user.FieldPassword) {
+		if err := h.container.Sessions.RevokeAll(updatedUser.ID); err != nil {
+			middleware.Fail(c, 500, err)
+			return
+		}
+	}
+	c.Header("ETag", userETag(updatedUser))
+	c.JSON(200, gin.H{"message": "User updated", "user": newUserResponse(c, updatedUser)})
 }
 
 // DeleteUser godoc
@@ -129,22 +206,36 @@ func (h *apiHandler) UpdateUser(c *gin.Context) {
 // @Accept  json
 // @Produce  json
 // @Param id path int true "User ID"
+// @Param If-Match header string false "ETag of the User as read, required when IF_MATCH_REQUIRED is set"
 // @Param Authorization header string true "Authorization. How to input in swagger : 'Bearer <insert_your_token_here>'"
 // @Security BearerToken
 // @Success 200 {object} map[string]interface{}
 // @Failure 400 {object} map[string]interface{}
 // @Failure 401 {object} map[string]interface{}
+// @Failure 412 {object} map[string]interface{} "code version_mismatch"
+// @Failure 428 {object} map[string]interface{} "code if_match_required"
+// @Failure 500 {object} map[string]interface{} "The User was deleted but the sessions could not be logged out"
 // @Router /user/delete/{id} [delete]
+// @Router /v1/users/{id} [delete]
 func (h *apiHandler) DeleteUser(c *gin.Context) {
-	role, _ := jwtAuth.ExtractTokenRole(c)
-	if role != "admin" {
-		c.JSON(http.StatusUnauthorized, gin.H{"message": "You are not authorized to perform this action"})
-		return
-	}
 	id, _ := strconv.Atoi(c.Param("id"))
-	err := h.container.Admin.DeleteUser(uint(id))
+	audit.SetTarget(c, "user", id)
+	before, err := h.container.Admin.GetUser(uint(id))
 	if err != nil {
-		c.JSON(400, gin.H{"message": err.Error()})
+		middleware.Fail(c, 400, err)
+		return
+	}
+	version, ok := h.ifMatch(c, before)
+	if !ok {
+		return
+	}
+	if err := h.container.Admin.DeleteUserAt(uint(id), version); err != nil {
+		middleware.Fail(c, 400, err)
+		return
+	}
+	audit.SetChange(c, newUserResponse(c, before), nil)
+	if err := h.container.Sessions.RevokeAll(uint(id)); err != nil {
+		middleware.Fail(c, 500, err)
 		return
 	}
 	c.JSON(200, gin.H{"message": "User deleted"})
@@ -158,25 +249,28 @@ func (h *apiHandler) DeleteUser(c *gin.Context) {
 // @Accept  json
 // @Produce  json
 // @Param id path int true "User ID"
+// @Param If-None-Match header string false "ETag of the copy the client has"
 // @Param Authorization header string true "Authorization. How to input in swagger : 'Bearer <insert_your_token_here>'"
 // @Security BearerToken
-// @Success 200 {object} map[string]interface{}
+// @Success 200 {object} object{message=string,user=UserResponse}
+// @Header 200 {string} ETag "Version of the User"
 // @Failure 400 {object} map[string]interface{}
 // @Failure 401 {object} map[string]interface{}
+// @Success 304 "The client's copy is current"
 // @Router /user/get/{id} [get]
+// @Router /v1/users/{id} [get]
 func (h *apiHandler) GetUserByID(c *gin.Context) {
-	role, _ := jwtAuth.ExtractTokenRole(c)
-	if role != "admin" {
-		c.JSON(http.StatusUnauthorized, gin.H{"message": "You are not authorized to perform this action"})
-		return
-	}
 	id, _ := strconv.Atoi(c.Param("id"))
+	audit.SetTarget(c, "user", id)
 	user, err := h.container.Admin.GetUser(uint(id))
 	if err != nil {
-		c.JSON(400, gin.H{"message": err.Error()})
+		middleware.Fail(c, 400, err)
+		return
+	}
+	if notModified(c, user) {
 		return
 	}
-	c.JSON(200, gin.H{"message": "User retrieved", "user": user})
+	c.JSON(200, gin.H{"message": "User retrieved", "user": newUserResponse(c, user)})
 	return
 }
 
@@ -188,58 +282,101 @@ func (h *apiHandler) GetUserByID(c *gin.Context) {
 // @Produce  json
 // @Param Authorization header string true "Authorization. How to input in swagger : 'Bearer <insert_your_token_here>'"
 // @Security BearerToken
-// @Success 200 {object} map[string]interface{}
+// @Success 200 {object} object{message=string,user=UserResponse}
+// @Header 200 {string} ETag "Version of the User"
 // @Failure 400 {object} map[string]interface{}
 // @Failure 401 {object} map[string]interface{}
 // @Router /user/get [get]
+// @Router /v1/users/me [get]
 func (h *apiHandler) GetUserByToken(c *gin.Context) {
-	role, _ := jwtAuth.ExtractTokenRole(c)
-	if role != "user" {
-		c.JSON(http.StatusUnauthorized, gin.H{"message": "You are not authorized to perform this action"})
-		return
-	}
 	id, _ := jwtAuth.ExtractTokenID(c)
+	audit.SetTarget(c, "user", id)
 	user, _ := h.container.Admin.GetUser(id)
-	c.JSON(200, gin.H{"message": "User retrieved", "user": user})
+	if notModified(c, user) {
+		return
+	}
+	c.JSON(200, gin.H{"message": "User retrieved", "user": newUserResponse(c, user)})
 	return
 }
 
+type ListUsersRequest struct {
+	Limit         int        `form:"limit" binding:"omitempty,min=1"`
+	Cursor        string     `form:"cursor"`
+	Username      string     `form:"username"`
+	Name          string     `form:"name"`
+	Status        string     `form:"status"`
+	CreatedAfter  *time.Time `form:"created_after" time_format:"2006-01-02T15:04:05Z07:00"`
+	CreatedBefore *time.Time `form:"created_before" time_format:"2006-01-02T15:04:05Z07:00"`
+	Sort          string     `form:"sort"`
+}
+
 // ListUsers godoc
 // @Summary List Users
-// @Description List Users
+// @Description List Users a page at a time. Follow the next and prev links to move between pages.
 // @Tags User
 // @Accept  json
 // @Produce  json
+// @Param limit query int false "Page size, at most 100" default(20)
+// @Param cursor query string false "Cursor from a previous next or prev link"
+// @Param username query string false "Filter by username substring"
+// @Param name query string false "Filter by name substring"
+// @Param status query string false "Filter by status"
+// @Param created_after query string false "Only users created at or after this RFC 3339 time"
+// @Param created_before query string false "Only users created before this RFC 3339 time"
+// @Param sort query string false "id, username, name or created_at, prefix with - for descending" default(id)
 // @Param Authorization header string true "Authorization. How to input in swagger : 'Bearer <insert_your_token_here>'"
 // @Security BearerToken
-// @Success 200 {object} map[string]interface{}
+// @Success 200 {object} object{message=string,users=[]UserResponse,total=int,next=string,prev=string}
 // @Failure 400 {object} map[string]interface{}
 // @Failure 401 {object} map[string]interface{}
 // @Router /user/list [get]
+// @Router /v1/users [get]
 func (h *apiHandler) ListUsers(c *gin.Context) {
-	role, _ := jwtAuth.ExtractTokenRole(c)
-	if role != "admin" {
-		c.JSON(http.StatusUnauthorized, gin.H{"message": "You are not authorized to perform this action"})
+	h.listUsers(c, false)
+}
+
+func (h *apiHandler) listUsers(c *gin.Context, deleted bool) {
+	var req ListUsersRequest
+	if err := c.ShouldBindQuery(&req); err != nil {
+		middleware.Fail(c, 400, invalidRequest(err))
 		return
 	}
-	users, err := h.container.Admin.ListUsers()
+	result, err := h.container.Admin.ListUsers(user.ListOptions{
+		Limit:         req.Limit,
+		Cursor:        req.Cursor,
+		Username:      req.Username,
+		Name:          req.Name,
+		Status:        req.Status,
+		Deleted:       deleted,
+		CreatedAfter:  req.CreatedAfter,
+		CreatedBefore: req.CreatedBefore,
+		Sort:          req.Sort,
+	})
 	if err != nil {
-		c.JSON(400, gin.H{"message": err.Error()})
+		middleware.Fail(c, 400, err)
 		return
 	}
-	var userList []map[string]interface{}
-	for _, user := range users {
-		userList = append(userList, map[string]interface{}{
-			"id":       user.ID,
-			"username": user.Username,
-			"name":     user.Name,
-			"link":     "/user/get/" + strconv.Itoa(int(user.ID)),
-		})
-	}
-	c.JSON(200, gin.H{"message": "Users retrieved", "users": userList})
+	c.JSON(200, gin.H{
+		"message": "Users retrieved",
+		"users":   newUserListResponse(c, result.Users),
+		"total":   result.Total,
+		"next":    pageLink(c, result.NextCursor),
+		"prev":    pageLink(c, result.PrevCursor),
+	})
 	return
 }
 
+// pageLink returns the current request URL pointing at cursor, or nil when
+// there is no such page.
+func pageLink(c *gin.Context, cursor string) interface{} {
+	if cursor == "" {
+		return nil
+	}
+	query := c.Request.URL.Query()
+	query.Set("cursor", cursor)
+	return c.Request.URL.Path + "?" + query.Encode()
+}
+
 type LoginRequest struct {
 	Username string `json:"username" binding:"required"`
 	Password string `json:"password" binding:"required"`
@@ -247,51 +384,190 @@ type LoginRequest struct {
 
 // Login godoc
 // @Summary Login
-// @Description Login
+// @Description Login with username and password. Users with two-factor authentication get mfa_required and a challenge_token instead of tokens; finish at /login/mfa
 // @Tags User
 // @Accept  json
 // @Produce  json
 // @Param user body LoginRequest true "User"
-// @Success 200 {object} map[string]interface{}
+// @Success 200 {object} object{message=string,user=UserResponse,token=string,refresh_token=string}
 // @Failure 400 {object} map[string]interface{}
+// @Failure 403 {object} map[string]interface{} "code email_not_verified, account_suspended, account_locked_by_admin or account_deactivated"
+// @Failure 423 {object} map[string]interface{} "code account_locked, see Retry-After"
+// @Failure 429 {object} map[string]interface{} "code too_many_attempts, see Retry-After"
 // @Router /login [post]
 func (h *apiHandler) Login(c *gin.Context) {
 	var req LoginRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(400, gin.H{"message": err.Error()})
+		middleware.Fail(c, 400, invalidRequest(err))
+		return
+	}
+	audit.SetChange(c, nil, gin.H{"username": req.Username})
+	ip := c.ClientIP()
+	if err := h.container.Lockout.Check(req.Username, ip); err != nil {
+		rejectLogin(c, err)
 		return
 	}
 	user, err := h.container.Admin.AuthenticateUser(req.Username, req.Password)
+	if user.ID != 0 {
+		audit.SetTarget(c, "user", user.ID)
+	}
+	if rejectInactive(c, err) {
+		return
+	}
 	if err != nil {
-		c.JSON(400, gin.H{"message": err.Error()})
+		h.container.Lockout.Fail(req.Username, ip)
+		middleware.Fail(c, 400, err)
+		return
+	}
+	challenged, err := h.loginChallenge(c, user.ID)
+	if err != nil {
+		middleware.Fail(c, 500, err)
+		return
+	}
+	if challenged {
 		return
 	}
-	token, _ := jwtAuth.GenerateToken(user.ID)
-	h.container.Admin.SaveToken(user.ID, token)
-	c.JSON(200, gin.H{"message": "User logged in", "user": user, "token": token})
+	audit.SetActor(c, user.ID)
+	h.container.Lockout.Succeed(user.Username, ip)
+	token, refreshToken, err := h.issueTokens(c, user.ID)
+	if err != nil {
+		middleware.Fail(c, 500, err)
+		return
+	}
+	c.JSON(200, gin.H{"message": "User logged in", "user": newUserResponse(c, user), "token": token, "refresh_token": refreshToken})
 	return
 }
 
+// issueTokens starts a new session with a fresh access and refresh token pair.
+func (h *apiHandler) issueTokens(c *gin.Context, userID uint) (string, string, error) {
+	roles, err := h.container.RBAC.UserRoles(userID)
+	if err != nil {
+		return "", "", err
+	}
+	session, err := h.container.Sessions.Start(userID, c.Request.UserAgent(), c.ClientIP())
+	if err != nil {
+		return "", "", err
+	}
+	token, err := jwtAuth.GenerateToken(userID, roles, session.ID)
+	if err != nil {
+		return "", "", err
+	}
+	refreshToken, err := h.container.Refresh.Issue(userID, session.ID)
+	if err != nil {
+		return "", "", err
+	}
+	return token, refreshToken, nil
+}
+
+type RefreshTokenRequest struct {
+	RefreshToken string `json:"refresh_token" binding:"required"`
+}
+
 // RefreshToken godoc
 // @Summary Refresh Token
-// @Description Refresh Token
+// @Description Exchange a refresh token for a new access token and refresh token.
+// @Description Each refresh token can be used once; replaying a used one revokes the session.
+// @Tags User
+// @Accept  json
+// @Produce  json
+// @Param token body RefreshTokenRequest true "Refresh token"
+// @Success 200 {object} map[string]interface{}
+// @Failure 400 {object} map[string]interface{}
+// @Failure 401 {object} map[string]interface{}
+// @Router /refresh [post]
+func (h *apiHandler) RefreshToken(c *gin.Context) {
+	var req RefreshTokenRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		middleware.Fail(c, 400, invalidRequest(err))
+		return
+	}
+	spent, refreshToken, err := h.container.Refresh.Rotate(req.RefreshToken)
+	if spent.UserID != 0 {
+		audit.SetActor(c, spent.UserID)
+		audit.SetTarget(c, "session", spent.SessionID)
+	}
+	if err != nil {
+		middleware.Fail(c, 401, err)
+		return
+	}
+	roles, err := h.container.RBAC.UserRoles(spent.UserID)
+	if err != nil {
+		middleware.Fail(c, 401, err)
+		return
+	}
+	token, err := jwtAuth.GenerateToken(spent.UserID, roles, spent.SessionID)
+	if err != nil {
+		middleware.Fail(c, 500, err)
+		return
+	}
+	c.JSON(200, gin.H{"message": "Token refreshed", "token": token, "refresh_token": refreshToken})
+}
+
+// RefreshAccessToken godoc
+// @Summary Refresh Token (deprecated)
+// @Description Exchange the presented access token for a new one in the same session. The presented token stops working.
+// @Description Deprecated: use POST /refresh with a refresh token.
 // @Tags User
 // @Accept  json
 // @Produce  json
 // @Param Authorization header string true "Authorization. How to input in swagger : 'Bearer <insert_your_token_here>'"
 // @Security BearerToken
-// @Success 200 {object} map[string]interface{}
+// @Success 200 {object} object{message=string,token=string}
 // @Failure 400 {object} map[string]interface{}
 // @Failure 401 {object} map[string]interface{}
 // @Router /user/refresh [get]
-func (h *apiHandler) RefreshToken(c *gin.Context) {
+func (h *apiHandler) RefreshAccessToken(c *gin.Context) {
 	userID, _ := jwtAuth.ExtractTokenID(c)
-	user, _ := h.container.Admin.GetUser(userID)
-	if user.Token != jwtAuth.ExtractToken(c) {
-		c.JSON(400, gin.H{"message": "Previous token is not valid"})
+	sessionID, _ := jwtAuth.ExtractTokenSessionID(c)
+	jti, expiresAt, _ := jwtAuth.ExtractTokenJTI(c)
+	if sessionID != 0 {
+		audit.SetTarget(c, "session", sessionID)
+	}
+	roles, err := h.container.RBAC.UserRoles(userID)
+	if err != nil {
+		middleware.Fail(c, 401, err)
+		return
+	}
+	token, err := jwtAuth.GenerateToken(userID, roles, sessionID)
+	if err != nil {
+		middleware.Fail(c, 500, err)
+		return
+	}
+	if err := h.container.Revocations.Revoke(jti, expiresAt); err != nil {
+		middleware.Fail(c, 400, err)
 		return
 	}
-	token, _ := jwtAuth.GenerateToken(user.ID)
-	h.container.Admin.SaveToken(user.ID, token)
 	c.JSON(200, gin.H{"message": "Token refreshed", "token": token})
 }
+
+// Logout godoc
+// @Summary Logout
+// @Description Revoke the presented access token and end its session, including its refresh token
+// @Tags User
+// @Accept  json
+// @Produce  json
+// @Param Authorization header string true "Authorization. How to input in swagger : 'Bearer <insert_your_token_here>'"
+// @Security BearerToken
+// @Success 200 {object} map[string]interface{}
+// @Failure 400 {object} map[string]interface{}
+// @Failure 401 {object} map[string]interface{}
+// @Router /logout [post]
+func (h *apiHandler) Logout(c *gin.Context) {
+	jti, expiresAt, _ := jwtAuth.ExtractTokenJTI(c)
+	if jti != "" {
+		if err := h.container.Revocations.Revoke(jti, expiresAt); err != nil {
+			middleware.Fail(c, 400, err)
+			return
+		}
+	}
+	userID, _ := jwtAuth.ExtractTokenID(c)
+	sessionID, _ := jwtAuth.ExtractTokenSessionID(c)
+	if sessionID != 0 {
+		audit.SetTarget(c, "session", sessionID)
+		if err := h.container.Sessions.Revoke(userID, sessionID); err != nil {
+			middleware.Fail(c, 400, err)
+			return
+		}
+	}
+	c.JSON(200, gin.H{"message": "User logged out"})
+}
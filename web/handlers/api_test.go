@@ -3,32 +3,65 @@ package handlers_test
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"github.com/MicBun/go-100-coverage-docker-crud/audit"
 	"github.com/MicBun/go-100-coverage-docker-crud/core"
+	"github.com/MicBun/go-100-coverage-docker-crud/mfa"
+	"github.com/MicBun/go-100-coverage-docker-crud/notify"
+	"github.com/MicBun/go-100-coverage-docker-crud/role"
 	"github.com/MicBun/go-100-coverage-docker-crud/service"
+	"github.com/MicBun/go-100-coverage-docker-crud/session"
+	"github.com/MicBun/go-100-coverage-docker-crud/token"
+	"github.com/MicBun/go-100-coverage-docker-crud/user"
+	"github.com/MicBun/go-100-coverage-docker-crud/util"
 	"github.com/MicBun/go-100-coverage-docker-crud/util/jwtAuth"
 	"github.com/MicBun/go-100-coverage-docker-crud/web"
+	"github.com/MicBun/go-100-coverage-docker-crud/web/handlers"
+	"github.com/MicBun/go-100-coverage-docker-crud/web/middleware"
+	"io"
 	"net/http"
+	"net/http/httptest"
 	"strconv"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/gin-gonic/gin"
 	"github.com/stretchr/testify/assert"
 )
 
 var adminHeader = map[string]string{
 	"Authorization": "Bearer " + func() string {
-		token, _ := jwtAuth.GenerateToken(1)
+		token, _ := jwtAuth.GenerateToken(1, []string{core.RoleAdmin}, 0)
 		return token
 	}(),
 }
 
 var userHeader = map[string]string{
 	"Authorization": "Bearer " + func() string {
-		token, _ := jwtAuth.GenerateToken(2)
+		token, _ := jwtAuth.GenerateToken(2, []string{core.RoleUser}, 0)
 		return token
 	}(),
 }
 
+var noRoleHeader = map[string]string{
+	"Authorization": "Bearer " + func() string {
+		token, _ := jwtAuth.GenerateToken(3, nil, 0)
+		return token
+	}(),
+}
+
+// problemCode returns the code of a problem details response.
+func problemCode(t *testing.T, w *httptest.ResponseRecorder) string {
+	assert.Equal(t, middleware.ProblemContentType, w.Header().Get("Content-Type"))
+	var problem struct {
+		Code string
+	}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &problem))
+	return problem.Code
+}
+
 func TestHelloEndpoint(t *testing.T) {
 	web.RunTest(func(c *service.Container) {
 		w, err := web.MakeRequest(c.Web, http.MethodGet, "/hello", nil)
@@ -68,7 +101,7 @@ func TestRegisterEndpoint(t *testing.T) {
 
 		w, err = web.MakeRequest(c.Web, http.MethodPost, "/user/register", bytes.NewReader(jsonBody), adminHeader)
 		assert.Equal(t, http.StatusBadRequest, w.Code)
-		assert.Equal(t, `{"message":"UNIQUE constraint failed: users.username"}`, w.Body.String())
+		assert.Equal(t, "username_taken", problemCode(t, w))
 
 		w, err = web.MakeRequest(c.Web, http.MethodPost, "/user/register", nil, adminHeader)
 		assert.Equal(t, http.StatusBadRequest, w.Code)
@@ -105,7 +138,7 @@ func TestUpdateEndpoint(t *testing.T) {
 
 		w, err = web.MakeRequest(c.Web, http.MethodPut, "/user/update/2", bytes.NewReader(jsonBody), adminHeader)
 		assert.Equal(t, http.StatusBadRequest, w.Code)
-		assert.Equal(t, `{"message":"record not found"}`, w.Body.String())
+		assert.Equal(t, "user_not_found", problemCode(t, w))
 	})
 }
 
@@ -131,7 +164,58 @@ func TestDeleteEndpoint(t *testing.T) {
 
 		w, err = web.MakeRequest(c.Web, http.MethodDelete, "/user/delete/1", nil, adminHeader)
 		assert.Equal(t, http.StatusBadRequest, w.Code)
-		assert.Equal(t, `{"message":"record not found"}`, w.Body.String())
+		assert.Equal(t, "user_not_found", problemCode(t, w))
+	})
+}
+
+func TestRestoreAndPurgeEndpoints(t *testing.T) {
+	web.RunTest(func(c *service.Container) {
+		jsonBody, _ := json.Marshal(core.User{Username: "foo@bar.com", Password: "securePassword", Name: "Foo Bar"})
+		register := func() int {
+			w, err := web.MakeRequest(c.Web, http.MethodPost, "/user/register", bytes.NewReader(jsonBody), adminHeader)
+			assert.NoError(t, err)
+			return w.Code
+		}
+		assert.Equal(t, http.StatusOK, register())
+		assert.Equal(t, http.StatusBadRequest, register())
+
+		w, err := web.MakeRequest(c.Web, http.MethodGet, "/user/deleted", nil, userHeader)
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+		w, err = web.MakeRequest(c.Web, http.MethodPost, "/user/restore/1", nil, adminHeader)
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		w, err = web.MakeRequest(c.Web, http.MethodDelete, "/user/purge/1", nil, adminHeader)
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+
+		w, err = web.MakeRequest(c.Web, http.MethodDelete, "/user/delete/1", nil, adminHeader)
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusOK, w.Code)
+		w, err = web.MakeRequest(c.Web, http.MethodGet, "/user/deleted", nil, adminHeader)
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Contains(t, w.Body.String(), `"total":1`)
+		assert.Contains(t, w.Body.String(), `"deleted_at"`)
+
+		// The username can be registered again, which blocks restoring.
+		assert.Equal(t, http.StatusOK, register())
+		w, err = web.MakeRequest(c.Web, http.MethodPost, "/user/restore/1", nil, adminHeader)
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		assert.Contains(t, w.Body.String(), `"code":"username_taken"`)
+		w, err = web.MakeRequest(c.Web, http.MethodDelete, "/user/delete/2", nil, adminHeader)
+		assert.Equal(t, http.StatusOK, w.Code)
+		w, err = web.MakeRequest(c.Web, http.MethodPost, "/user/restore/1", nil, adminHeader)
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.NotContains(t, w.Body.String(), `"deleted_at"`)
+		w, err = web.MakeRequest(c.Web, http.MethodGet, "/user/get/1", nil, adminHeader)
+		assert.Equal(t, http.StatusOK, w.Code)
+
+		w, err = web.MakeRequest(c.Web, http.MethodDelete, "/user/purge/2", nil, userHeader)
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+		w, err = web.MakeRequest(c.Web, http.MethodDelete, "/user/purge/2", nil, adminHeader)
+		assert.Equal(t, http.StatusOK, w.Code)
+		w, err = web.MakeRequest(c.Web, http.MethodPost, "/user/restore/2", nil, adminHeader)
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		w, err = web.MakeRequest(c.Web, http.MethodGet, "/user/deleted", nil, adminHeader)
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Contains(t, w.Body.String(), `"users":[]`)
 	})
 }
 
@@ -169,7 +253,7 @@ func TestGetUserByIDEndpoint(t *testing.T) {
 
 func TestGetUserByTokenEndpoint(t *testing.T) {
 	web.RunTest(func(c *service.Container) {
-		w, err := web.MakeRequest(c.Web, http.MethodGet, "/user/get", nil, adminHeader)
+		w, err := web.MakeRequest(c.Web, http.MethodGet, "/user/get", nil, noRoleHeader)
 		assert.Equal(t, http.StatusUnauthorized, w.Code)
 
 		user := core.User{
@@ -208,9 +292,13 @@ func TestGetUsersEndpoint(t *testing.T) {
 		w, err := web.MakeRequest(c.Web, http.MethodGet, "/user/list", nil, userHeader)
 		assert.Equal(t, http.StatusUnauthorized, w.Code)
 
-		w, err = web.MakeRequest(c.Web, http.MethodGet, "/user/list", nil, adminHeader)
-		assert.Equal(t, http.StatusBadRequest, w.Code)
-		assert.Equal(t, `{"message":"no users found"}`, w.Body.String())
+		// An empty page is not an error, in either status mode.
+		for _, header := range []map[string]string{adminHeader, {"Authorization": adminHeader["Authorization"], middleware.StatusModeHeader: middleware.StatusModeStrict}} {
+			w, err = web.MakeRequest(c.Web, http.MethodGet, "/user/list?status=deactivated", nil, header)
+			assert.NoError(t, err)
+			assert.Equal(t, http.StatusOK, w.Code)
+			assert.JSONEq(t, `{"message":"Users retrieved","users":[],"total":0,"next":null,"prev":null}`, w.Body.String())
+		}
 
 		var users []core.User
 		for i := 0; i < 10; i++ {
@@ -239,6 +327,51 @@ func TestGetUsersEndpoint(t *testing.T) {
 		assert.NoError(t, err)
 		assert.Equal(t, "Users retrieved", resp.Message)
 		assert.Equal(t, len(users), len(resp.Users))
+
+		var page struct {
+			Users []struct {
+				Username string
+				Link     string
+			}
+			Total int
+			Next  *string
+			Prev  *string
+		}
+		w, err = web.MakeRequest(c.Web, http.MethodGet, "/user/list?limit=4&sort=-username", nil, adminHeader)
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusOK, w.Code)
+		err = json.Unmarshal(w.Body.Bytes(), &page)
+		assert.NoError(t, err)
+		assert.Equal(t, 4, len(page.Users))
+		assert.Equal(t, 10, page.Total)
+		assert.Equal(t, "foo9@bar.com", page.Users[0].Username)
+		assert.Nil(t, page.Prev)
+		assert.NotNil(t, page.Next)
+
+		w, err = web.MakeRequest(c.Web, http.MethodGet, *page.Next, nil, adminHeader)
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusOK, w.Code)
+		page.Next, page.Prev = nil, nil
+		err = json.Unmarshal(w.Body.Bytes(), &page)
+		assert.NoError(t, err)
+		assert.Equal(t, "foo5@bar.com", page.Users[0].Username)
+		assert.NotNil(t, page.Prev)
+
+		w, err = web.MakeRequest(c.Web, http.MethodGet, "/user/list?username=foo3", nil, adminHeader)
+		assert.Equal(t, http.StatusOK, w.Code)
+		err = json.Unmarshal(w.Body.Bytes(), &page)
+		assert.NoError(t, err)
+		assert.Equal(t, 1, page.Total)
+		assert.Equal(t, "/user/get/4", page.Users[0].Link)
+
+		w, err = web.MakeRequest(c.Web, http.MethodGet, "/user/list?limit=-1", nil, adminHeader)
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+
+		w, err = web.MakeRequest(c.Web, http.MethodGet, "/user/list?sort=password", nil, adminHeader)
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+
+		w, err = web.MakeRequest(c.Web, http.MethodGet, "/user/list?created_after=yesterday", nil, adminHeader)
+		assert.Equal(t, http.StatusBadRequest, w.Code)
 	})
 }
 
@@ -252,7 +385,7 @@ func TestLoginEndpoint(t *testing.T) {
 		jsonBody, _ := json.Marshal(user)
 		w, err := web.MakeRequest(c.Web, http.MethodPost, "/user/register", bytes.NewReader(jsonBody), map[string]string{
 			"Authorization": "Bearer " + func() string {
-				token, _ := jwtAuth.GenerateToken(1)
+				token, _ := jwtAuth.GenerateToken(1, []string{core.RoleAdmin}, 0)
 				return token
 			}(),
 		})
@@ -273,6 +406,22 @@ func TestLoginEndpoint(t *testing.T) {
 		w, err = web.MakeRequest(c.Web, http.MethodPost, "/login", nil)
 		assert.Equal(t, http.StatusBadRequest, w.Code)
 
+		// Logins that can't start a session fail without tokens.
+		rbac, sessions, refresh := c.RBAC, c.Sessions, c.Refresh
+		for _, fail := range []func(){
+			func() { c.RBAC = failingRoles{rbac} },
+			func() { c.Sessions = failingSessions{sessions} },
+			func() { t.Setenv("TOKEN_MINUTE_LIFESPAN", "soon") },
+			func() { c.Refresh = failingRefresh{refresh} },
+		} {
+			fail()
+			w, err = web.MakeRequest(c.Web, http.MethodPost, "/login", bytes.NewReader(jsonBody))
+			assert.Equal(t, http.StatusInternalServerError, w.Code)
+			assert.NotContains(t, w.Body.String(), "token")
+			c.RBAC, c.Sessions, c.Refresh = rbac, sessions, refresh
+			t.Setenv("TOKEN_MINUTE_LIFESPAN", "15")
+		}
+
 		req.Password = "wrongPassword"
 		jsonBody, _ = json.Marshal(req)
 		w, err = web.MakeRequest(c.Web, http.MethodPost, "/login", bytes.NewReader(jsonBody))
@@ -288,14 +437,189 @@ func TestRefreshTokenEndpoint(t *testing.T) {
 			Name:     "Foo Bar",
 		}
 		jsonBody, _ := json.Marshal(user)
-		w, err := web.MakeRequest(c.Web, http.MethodPost, "/user/register", bytes.NewReader(jsonBody), map[string]string{
+		w, err := web.MakeRequest(c.Web, http.MethodPost, "/user/register", bytes.NewReader(jsonBody), adminHeader)
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusOK, w.Code)
+
+		var req struct {
+			Username string
+			Password string
+		}
+		req.Username = user.Username
+		req.Password = user.Password
+		jsonBody, _ = json.Marshal(req)
+		w, err = web.MakeRequest(c.Web, http.MethodPost, "/login", bytes.NewReader(jsonBody))
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusOK, w.Code)
+
+		var resp struct {
+			Message      string
+			Token        string
+			RefreshToken string `json:"refresh_token"`
+		}
+		err = json.Unmarshal(w.Body.Bytes(), &resp)
+		assert.NoError(t, err)
+		assert.NotEmpty(t, resp.Token)
+		assert.NotEmpty(t, resp.RefreshToken)
+		firstRefresh := resp.RefreshToken
+
+		// A second login must not invalidate the first one.
+		w, err = web.MakeRequest(c.Web, http.MethodPost, "/login", bytes.NewReader(jsonBody))
+		assert.Equal(t, http.StatusOK, w.Code)
+		err = json.Unmarshal(w.Body.Bytes(), &resp)
+		assert.NoError(t, err)
+		otherRefresh := resp.RefreshToken
+
+		jsonBody, _ = json.Marshal(map[string]string{"refresh_token": firstRefresh})
+		w, err = web.MakeRequest(c.Web, http.MethodPost, "/refresh", bytes.NewReader(jsonBody))
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusOK, w.Code)
+		err = json.Unmarshal(w.Body.Bytes(), &resp)
+		assert.NoError(t, err)
+		assert.Equal(t, "Token refreshed", resp.Message)
+		assert.NotEqual(t, firstRefresh, resp.RefreshToken)
+		rotatedRefresh := resp.RefreshToken
+
+		w, err = web.MakeRequest(c.Web, http.MethodGet, "/user/get", nil, map[string]string{"Authorization": "Bearer " + resp.Token})
+		assert.Equal(t, http.StatusOK, w.Code)
+
+		w, err = web.MakeRequest(c.Web, http.MethodPost, "/refresh", bytes.NewReader(jsonBody))
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+		assert.Contains(t, w.Body.String(), "reused")
+
+		jsonBody, _ = json.Marshal(map[string]string{"refresh_token": rotatedRefresh})
+		w, err = web.MakeRequest(c.Web, http.MethodPost, "/refresh", bytes.NewReader(jsonBody))
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+		jsonBody, _ = json.Marshal(map[string]string{"refresh_token": otherRefresh})
+		w, err = web.MakeRequest(c.Web, http.MethodPost, "/refresh", bytes.NewReader(jsonBody))
+		assert.Equal(t, http.StatusOK, w.Code)
+		err = json.Unmarshal(w.Body.Bytes(), &resp)
+		assert.NoError(t, err)
+
+		w, err = web.MakeRequest(c.Web, http.MethodPost, "/refresh", nil)
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+
+		rbac := c.RBAC
+		c.RBAC = failingRoles{rbac}
+		jsonBody, _ = json.Marshal(map[string]string{"refresh_token": resp.RefreshToken})
+		w, err = web.MakeRequest(c.Web, http.MethodPost, "/refresh", bytes.NewReader(jsonBody))
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+		c.RBAC = rbac
+		w, err = web.MakeRequest(c.Web, http.MethodPost, "/refresh", bytes.NewReader(jsonBody))
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+		assert.Contains(t, w.Body.String(), "reused")
+
+		jsonBody, _ = json.Marshal(req)
+		w, err = web.MakeRequest(c.Web, http.MethodPost, "/login", bytes.NewReader(jsonBody))
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		t.Setenv("TOKEN_MINUTE_LIFESPAN", "soon")
+		jsonBody, _ = json.Marshal(map[string]string{"refresh_token": resp.RefreshToken})
+		w, err = web.MakeRequest(c.Web, http.MethodPost, "/refresh", bytes.NewReader(jsonBody))
+		assert.Equal(t, http.StatusInternalServerError, w.Code)
+		t.Setenv("TOKEN_MINUTE_LIFESPAN", "15")
+
+		jsonBody, _ = json.Marshal(req)
+		w, err = web.MakeRequest(c.Web, http.MethodPost, "/login", bytes.NewReader(jsonBody))
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+
+		w, err = web.MakeRequest(c.Web, http.MethodDelete, "/user/delete/1", nil, adminHeader)
+		assert.Equal(t, http.StatusOK, w.Code)
+		jsonBody, _ = json.Marshal(map[string]string{"refresh_token": resp.RefreshToken})
+		w, err = web.MakeRequest(c.Web, http.MethodPost, "/refresh", bytes.NewReader(jsonBody))
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+	})
+}
+
+func TestRoleEndpoints(t *testing.T) {
+	web.RunTest(func(c *service.Container) {
+		w, err := web.MakeRequest(c.Web, http.MethodGet, "/role/list", nil, userHeader)
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+		w, err = web.MakeRequest(c.Web, http.MethodGet, "/role/list", nil, adminHeader)
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusOK, w.Code)
+		var listResp struct {
+			Message string
+			Roles   []struct {
+				Name        string
+				Permissions []string
+			}
+		}
+		err = json.Unmarshal(w.Body.Bytes(), &listResp)
+		assert.NoError(t, err)
+		assert.Equal(t, 2, len(listResp.Roles))
+		rbac := c.RBAC
+		c.RBAC = failingRoles{rbac}
+		w, err = web.MakeRequest(c.Web, http.MethodGet, "/role/list", nil, adminHeader)
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		c.RBAC = rbac
+
+		supportHeader := map[string]string{
 			"Authorization": "Bearer " + func() string {
-				token, _ := jwtAuth.GenerateToken(1)
+				token, _ := jwtAuth.GenerateToken(2, []string{"support"}, 0)
 				return token
 			}(),
-		})
+		}
+		w, err = web.MakeRequest(c.Web, http.MethodGet, "/user/list", nil, supportHeader)
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+		jsonBody, _ := json.Marshal(map[string]interface{}{"name": "support", "permissions": []string{"unknown:perm"}})
+		w, err = web.MakeRequest(c.Web, http.MethodPost, "/role/create", bytes.NewReader(jsonBody), adminHeader)
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+
+		w, err = web.MakeRequest(c.Web, http.MethodPost, "/role/create", nil, adminHeader)
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+
+		jsonBody, _ = json.Marshal(map[string]interface{}{"name": "support", "permissions": []string{core.PermProfileRead}})
+		w, err = web.MakeRequest(c.Web, http.MethodPost, "/role/create", bytes.NewReader(jsonBody), adminHeader)
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusOK, w.Code)
+
+		jsonBody, _ = json.Marshal(map[string]interface{}{"permissions": []string{core.PermUsersRead}})
+		w, err = web.MakeRequest(c.Web, http.MethodPut, "/role/update/support", bytes.NewReader(jsonBody), adminHeader)
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusOK, w.Code)
+
+		w, err = web.MakeRequest(c.Web, http.MethodPut, "/role/update/support", nil, adminHeader)
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+
+		w, err = web.MakeRequest(c.Web, http.MethodPut, "/role/update/auditor", bytes.NewReader(jsonBody), adminHeader)
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+
+		w, err = web.MakeRequest(c.Web, http.MethodGet, "/user/list", nil, supportHeader)
+		assert.Equal(t, http.StatusOK, w.Code)
+
+		user := core.User{
+			Username: "foo@bar.com",
+			Password: "securePassword",
+			Name:     "Foo Bar",
+		}
+		jsonBody, _ = json.Marshal(user)
+		w, err = web.MakeRequest(c.Web, http.MethodPost, "/user/register", bytes.NewReader(jsonBody), adminHeader)
+		assert.Equal(t, http.StatusOK, w.Code)
+
+		jsonBody, _ = json.Marshal(map[string]string{"role": "support"})
+		w, err = web.MakeRequest(c.Web, http.MethodPost, "/admin/user/1/roles", bytes.NewReader(jsonBody), userHeader)
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+		w, err = web.MakeRequest(c.Web, http.MethodPost, "/admin/user/1/roles", nil, adminHeader)
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+
+		w, err = web.MakeRequest(c.Web, http.MethodPost, "/admin/user/1/roles", bytes.NewReader(jsonBody), adminHeader)
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusOK, w.Code)
+
+		w, err = web.MakeRequest(c.Web, http.MethodPost, "/admin/user/2/roles", bytes.NewReader(jsonBody), adminHeader)
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+
+		w, err = web.MakeRequest(c.Web, http.MethodGet, "/admin/user/1/roles", nil, adminHeader)
 		assert.NoError(t, err)
 		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, `{"message":"Roles retrieved","roles":["user","support"]}`, w.Body.String())
+
+		w, err = web.MakeRequest(c.Web, http.MethodGet, "/admin/user/2/roles", nil, adminHeader)
+		assert.Equal(t, http.StatusBadRequest, w.Code)
 
 		var req struct {
 			Username string
@@ -304,27 +628,1590 @@ func TestRefreshTokenEndpoint(t *testing.T) {
 		req.Username = user.Username
 		req.Password = user.Password
 		jsonBody, _ = json.Marshal(req)
-		w, err = web.MakeRequest(c.Web, http.MethodPost, "/login", bytes.NewReader(jsonBody))
+		login := func() map[string]string {
+			w, err := web.MakeRequest(c.Web, http.MethodPost, "/login", bytes.NewReader(jsonBody))
+			assert.NoError(t, err)
+			assert.Equal(t, http.StatusOK, w.Code)
+			var loginResp struct {
+				Token string
+			}
+			assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &loginResp))
+			return map[string]string{"Authorization": "Bearer " + loginResp.Token}
+		}
+		loginHeader := login()
+		w, err = web.MakeRequest(c.Web, http.MethodGet, "/user/list", nil, loginHeader)
+		assert.Equal(t, http.StatusOK, w.Code)
+
+		// Revoking a role logs the user out, so tokens that still list it
+		// stop working.
+		w, err = web.MakeRequest(c.Web, http.MethodDelete, "/admin/user/1/roles/support", nil, adminHeader)
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusOK, w.Code)
+		w, err = web.MakeRequest(c.Web, http.MethodGet, "/user/list", nil, loginHeader)
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+		w, err = web.MakeRequest(c.Web, http.MethodDelete, "/admin/user/1/roles/auditor", nil, adminHeader)
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		sessions := c.Sessions
+		c.Sessions = failingSessions{sessions}
+		w, err = web.MakeRequest(c.Web, http.MethodDelete, "/admin/user/1/roles/support", nil, adminHeader)
+		assert.Equal(t, http.StatusInternalServerError, w.Code)
+		c.Sessions = sessions
+
+		loginHeader = login()
+		w, err = web.MakeRequest(c.Web, http.MethodGet, "/user/get", nil, loginHeader)
+		assert.Equal(t, http.StatusOK, w.Code)
+		w, err = web.MakeRequest(c.Web, http.MethodGet, "/user/list", nil, loginHeader)
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+	})
+}
+
+func TestSessionEndpoints(t *testing.T) {
+	web.RunTest(func(c *service.Container) {
+		user := core.User{
+			Username: "foo@bar.com",
+			Password: "securePassword",
+			Name:     "Foo Bar",
+		}
+		jsonBody, _ := json.Marshal(user)
+		w, err := web.MakeRequest(c.Web, http.MethodPost, "/user/register", bytes.NewReader(jsonBody), adminHeader)
 		assert.NoError(t, err)
 		assert.Equal(t, http.StatusOK, w.Code)
 
+		login := func(userAgent string) (map[string]string, string) {
+			jsonBody, _ := json.Marshal(map[string]string{"username": user.Username, "password": user.Password})
+			w, err := web.MakeRequest(c.Web, http.MethodPost, "/login", bytes.NewReader(jsonBody), map[string]string{"User-Agent": userAgent})
+			assert.NoError(t, err)
+			assert.Equal(t, http.StatusOK, w.Code)
+			var resp struct {
+				Token        string
+				RefreshToken string `json:"refresh_token"`
+			}
+			assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+			return map[string]string{"Authorization": "Bearer " + resp.Token}, resp.RefreshToken
+		}
+		laptop, _ := login("laptop")
+		phone, phoneRefresh := login("phone")
+
 		var resp struct {
-			Message string
-			Token   string
+			Sessions []struct {
+				ID        uint
+				UserAgent string `json:"user_agent"`
+				Current   bool
+			}
 		}
-		err = json.Unmarshal(w.Body.Bytes(), &resp)
+		w, err = web.MakeRequest(c.Web, http.MethodGet, "/user/sessions", nil, laptop)
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		assert.Equal(t, 2, len(resp.Sessions))
+		var phoneID uint
+		for _, s := range resp.Sessions {
+			assert.Equal(t, s.UserAgent == "laptop", s.Current)
+			if s.UserAgent == "phone" {
+				phoneID = s.ID
+			}
+		}
+
+		w, err = web.MakeRequest(c.Web, http.MethodDelete, "/user/sessions/999", nil, laptop)
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+
+		w, err = web.MakeRequest(c.Web, http.MethodDelete, "/user/sessions/"+strconv.Itoa(int(phoneID)), nil, laptop)
 		assert.NoError(t, err)
+		assert.Equal(t, http.StatusOK, w.Code)
+
+		w, err = web.MakeRequest(c.Web, http.MethodGet, "/user/get", nil, phone)
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+		jsonBody, _ = json.Marshal(map[string]string{"refresh_token": phoneRefresh})
+		w, err = web.MakeRequest(c.Web, http.MethodPost, "/refresh", bytes.NewReader(jsonBody))
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+		w, err = web.MakeRequest(c.Web, http.MethodGet, "/user/get", nil, laptop)
+		assert.Equal(t, http.StatusOK, w.Code)
+
+		w, err = web.MakeRequest(c.Web, http.MethodGet, "/admin/user/1/sessions", nil, userHeader)
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+		w, err = web.MakeRequest(c.Web, http.MethodGet, "/admin/user/1/sessions", nil, adminHeader)
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		assert.Equal(t, 1, len(resp.Sessions))
+		assert.False(t, resp.Sessions[0].Current)
+
+		w, err = web.MakeRequest(c.Web, http.MethodDelete, "/admin/user/2/sessions/"+strconv.Itoa(int(resp.Sessions[0].ID)), nil, adminHeader)
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+
+		w, err = web.MakeRequest(c.Web, http.MethodDelete, "/admin/user/1/sessions/"+strconv.Itoa(int(resp.Sessions[0].ID)), nil, adminHeader)
+		assert.Equal(t, http.StatusOK, w.Code)
+		w, err = web.MakeRequest(c.Web, http.MethodGet, "/user/get", nil, laptop)
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
 
-		newHeader := map[string]string{
-			"Authorization": "Bearer " + resp.Token,
+		laptop, _ = login("laptop")
+		phone, _ = login("phone")
+		sessions := c.Sessions
+		c.Sessions = failingSessions{sessions}
+		w, err = web.MakeRequest(c.Web, http.MethodGet, "/user/sessions", nil, laptop)
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		w, err = web.MakeRequest(c.Web, http.MethodGet, "/admin/user/1/sessions", nil, adminHeader)
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		w, err = web.MakeRequest(c.Web, http.MethodDelete, "/admin/user/1/sessions", nil, adminHeader)
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		c.Sessions = sessions
+		w, err = web.MakeRequest(c.Web, http.MethodDelete, "/admin/user/1/sessions", nil, adminHeader)
+		assert.Equal(t, http.StatusOK, w.Code)
+		w, err = web.MakeRequest(c.Web, http.MethodGet, "/user/get", nil, laptop)
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+		w, err = web.MakeRequest(c.Web, http.MethodGet, "/user/get", nil, phone)
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+	})
+}
+
+func TestLogoutEndpoint(t *testing.T) {
+	web.RunTest(func(c *service.Container) {
+		user := core.User{
+			Username: "foo@bar.com",
+			Password: "securePassword",
+			Name:     "Foo Bar",
 		}
-		w, err = web.MakeRequest(c.Web, http.MethodGet, "/user/refresh", bytes.NewReader(jsonBody), newHeader)
+		jsonBody, _ := json.Marshal(user)
+		w, err := web.MakeRequest(c.Web, http.MethodPost, "/user/register", bytes.NewReader(jsonBody), adminHeader)
 		assert.NoError(t, err)
-		fmt.Println(w.Body.String())
 		assert.Equal(t, http.StatusOK, w.Code)
 
-		w, err = web.MakeRequest(c.Web, http.MethodGet, "/user/refresh", bytes.NewReader(jsonBody), userHeader)
+		jsonBody, _ = json.Marshal(map[string]string{"username": user.Username, "password": user.Password})
+		w, err = web.MakeRequest(c.Web, http.MethodPost, "/login", bytes.NewReader(jsonBody))
+		assert.NoError(t, err)
+		var resp struct {
+			Token        string
+			RefreshToken string `json:"refresh_token"`
+		}
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		header := map[string]string{"Authorization": "Bearer " + resp.Token}
+
+		w, err = web.MakeRequest(c.Web, http.MethodPost, "/logout", nil)
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+		// Logouts that can't revoke the token or end the session say so.
+		revocations, sessions := c.Revocations, c.Sessions
+		c.Revocations = failingRevocations{revocations}
+		w, err = web.MakeRequest(c.Web, http.MethodPost, "/logout", nil, header)
 		assert.Equal(t, http.StatusBadRequest, w.Code)
+		c.Revocations = revocations
+		c.Sessions = failingSessions{sessions}
+		w, err = web.MakeRequest(c.Web, http.MethodPost, "/logout", nil, header)
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		c.Sessions = sessions
+		// The token is revoked by then, so log in again.
+		jsonBody, _ = json.Marshal(map[string]string{"username": user.Username, "password": user.Password})
+		w, err = web.MakeRequest(c.Web, http.MethodPost, "/login", bytes.NewReader(jsonBody))
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		header = map[string]string{"Authorization": "Bearer " + resp.Token}
 
+		w, err = web.MakeRequest(c.Web, http.MethodPost, "/logout", nil, header)
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Contains(t, w.Body.String(), "User logged out")
+
+		w, err = web.MakeRequest(c.Web, http.MethodGet, "/user/get", nil, header)
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+		jsonBody, _ = json.Marshal(map[string]string{"refresh_token": resp.RefreshToken})
+		w, err = web.MakeRequest(c.Web, http.MethodPost, "/refresh", bytes.NewReader(jsonBody))
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+		// Tokens without a session are revoked by jti alone.
+		w, err = web.MakeRequest(c.Web, http.MethodPost, "/logout", nil, userHeader)
+		assert.Equal(t, http.StatusOK, w.Code)
+		w, err = web.MakeRequest(c.Web, http.MethodGet, "/user/get", nil, userHeader)
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+	})
+}
+
+func TestJWKSEndpoint(t *testing.T) {
+	web.RunTest(func(c *service.Container) {
+		w, err := web.MakeRequest(c.Web, http.MethodGet, "/.well-known/jwks.json", nil)
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.JSONEq(t, `{"keys":[]}`, w.Body.String())
+	})
+}
+
+// assertUserResponse checks that a serialized user carries exactly the public
+// fields and nothing that could leak credentials, and links to where endpoint
+// reads it.
+func assertUserResponse(t *testing.T, endpoint string, user map[string]interface{}) {
+	t.Helper()
+	keys := make([]string, 0, len(user))
+	for key := range user {
+		keys = append(keys, key)
+	}
+	assert.ElementsMatch(t, []string{"id", "username", "name", "status", "created_at", "updated_at", "link"}, keys)
+	link := fmt.Sprintf("/user/get/%v", user["id"])
+	if strings.HasPrefix(endpoint, "/v1/") {
+		link = fmt.Sprintf("/v1/users/%v", user["id"])
+	}
+	assert.Equal(t, link, user["link"], endpoint)
+	for _, key := range []string{"created_at", "updated_at"} {
+		_, err := time.Parse(time.RFC3339, user[key].(string))
+		assert.NoError(t, err)
+	}
+}
+
+func TestUsersResource(t *testing.T) {
+	web.RunTest(func(c *service.Container) {
+		var resp struct {
+			User  handlers.UserResponse
+			Users []handlers.UserResponse
+			Total int
+			Token string
+		}
+		request := func(method, endpoint, body string, header map[string]string, status int) *httptest.ResponseRecorder {
+			w, err := web.MakeRequest(c.Web, method, endpoint, strings.NewReader(body), header)
+			assert.NoError(t, err)
+			assert.Equal(t, status, w.Code, method+" "+endpoint)
+			assert.Empty(t, w.Header().Get("Deprecation"), endpoint)
+			resp.User, resp.Users = handlers.UserResponse{}, nil
+			json.Unmarshal(w.Body.Bytes(), &resp)
+			return w
+		}
+
+		w := request(http.MethodPost, "/v1/users", `{"username":"foo@bar.com","password":"securePassword","name":"Foo Bar"}`, adminHeader, http.StatusCreated)
+		assert.Equal(t, "/v1/users/1", w.Header().Get("Location"))
+		assert.Equal(t, "foo@bar.com", resp.User.Username)
+		w = request(http.MethodPost, "/v1/users", `{"username":"foo@bar.com","password":"securePassword","name":"Foo Bar"}`, adminHeader, http.StatusBadRequest)
+		assert.Equal(t, "username_taken", problemCode(t, w))
+
+		request(http.MethodGet, "/v1/users", "", adminHeader, http.StatusOK)
+		assert.Equal(t, 1, resp.Total)
+		request(http.MethodGet, "/v1/users/1", "", adminHeader, http.StatusOK)
+		assert.Equal(t, "Foo Bar", resp.User.Name)
+		assert.Equal(t, "/v1/users/1", resp.User.Link)
+		// The legacy routes keep the legacy link.
+		w, _ = web.MakeRequest(c.Web, http.MethodGet, "/user/get/1", nil, adminHeader)
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Contains(t, w.Body.String(), `"link":"/user/get/1"`)
+
+		request(http.MethodPost, "/login", `{"username":"foo@bar.com","password":"securePassword"}`, nil, http.StatusOK)
+		request(http.MethodGet, "/v1/users/me", "", map[string]string{"Authorization": "Bearer " + resp.Token}, http.StatusOK)
+		assert.Equal(t, uint(1), resp.User.ID)
+
+		// PATCH changes only the fields given, PUT needs the whole user.
+		request(http.MethodPatch, "/v1/users/1", `{"name":"Foo"}`, adminHeader, http.StatusOK)
+		assert.Equal(t, "foo@bar.com", resp.User.Username)
+		assert.Equal(t, "Foo", resp.User.Name)
+		w = request(http.MethodPut, "/v1/users/1", `{"name":"Bar"}`, adminHeader, http.StatusBadRequest)
+		assert.Equal(t, "invalid_request", problemCode(t, w))
+		w = request(http.MethodPut, "/v1/users/1", `{"username":"bar@foo.com"}`, adminHeader, http.StatusBadRequest)
+		assert.Equal(t, "invalid_request", problemCode(t, w))
+		request(http.MethodPut, "/v1/users/1", `{"username":"bar@foo.com","name":"Bar"}`, adminHeader, http.StatusOK)
+		assert.Equal(t, "bar@foo.com", resp.User.Username)
+		assert.Equal(t, "Bar", resp.User.Name)
+		assert.Equal(t, "/v1/users/1", resp.User.Link)
+		request(http.MethodPut, "/v1/users/1", `{"username":"bar@foo.com","name":""}`, adminHeader, http.StatusOK)
+		assert.Equal(t, "", resp.User.Name)
+		// Leaving the password out keeps it.
+		request(http.MethodPost, "/login", `{"username":"bar@foo.com","password":"securePassword"}`, nil, http.StatusOK)
+		request(http.MethodPut, "/v1/users/1", `{"username":"bar@foo.com","name":"","password":"otherPassword"}`, adminHeader, http.StatusOK)
+		request(http.MethodPost, "/login", `{"username":"bar@foo.com","password":"otherPassword"}`, nil, http.StatusOK)
+		// The update fails loudly when the sessions can't be logged out.
+		sessions := c.Sessions
+		c.Sessions = failingSessions{sessions}
+		request(http.MethodPut, "/v1/users/1", `{"username":"bar@foo.com","name":"","password":"securePassword"}`, adminHeader, http.StatusInternalServerError)
+		c.Sessions = sessions
+
+		w = request(http.MethodGet, "/v1/users", "", userHeader, http.StatusUnauthorized)
+		assert.Equal(t, "permission_denied", problemCode(t, w))
+
+		c.Sessions = failingSessions{sessions}
+		request(http.MethodDelete, "/v1/users/1", "", adminHeader, http.StatusInternalServerError)
+		c.Sessions = sessions
+		w = request(http.MethodGet, "/v1/users/1", "", adminHeader, http.StatusBadRequest)
+		assert.Equal(t, "user_not_found", problemCode(t, w))
+	})
+}
+
+func TestPatchUser(t *testing.T) {
+	web.RunTest(func(c *service.Container) {
+		jsonBody, _ := json.Marshal(core.User{Username: "foo@bar.com", Password: "securePassword", Name: "Foo Bar"})
+		web.MakeRequest(c.Web, http.MethodPost, "/v1/users", bytes.NewReader(jsonBody), adminHeader)
+
+		var resp struct {
+			User  handlers.UserResponse
+			Token string
+		}
+		patch := func(path, contentType, body string, header map[string]string, status int) *httptest.ResponseRecorder {
+			merged := map[string]string{"Content-Type": contentType}
+			for key, val := range header {
+				merged[key] = val
+			}
+			w, err := web.MakeRequest(c.Web, http.MethodPatch, path, strings.NewReader(body), merged)
+			assert.NoError(t, err)
+			assert.Equal(t, status, w.Code, body)
+			resp.User = handlers.UserResponse{}
+			json.Unmarshal(w.Body.Bytes(), &resp)
+			return w
+		}
+
+		// Merge patch: null clears the name, other fields stay.
+		patch("/v1/users/1", handlers.MergePatchContentType, `{"name":null}`, adminHeader, http.StatusOK)
+		assert.Equal(t, "foo@bar.com", resp.User.Username)
+		assert.Equal(t, "", resp.User.Name)
+		patch("/v1/users/1", handlers.MergePatchContentType, `{"name":"Foo","username":"bar@foo.com"}`, adminHeader, http.StatusOK)
+		assert.Equal(t, "bar@foo.com", resp.User.Username)
+		assert.Equal(t, "Foo", resp.User.Name)
+
+		// JSON patch, guarded by a test operation.
+		patch("/v1/users/1", handlers.JSONPatchContentType,
+			`[{"op":"test","path":"/name","value":"Foo"},{"op":"replace","path":"/name","value":"Foo Bar"},{"op":"remove","path":"/name"},{"op":"add","path":"/name","value":"Bar"}]`,
+			adminHeader, http.StatusOK)
+		assert.Equal(t, "Bar", resp.User.Name)
+		patch("/v1/users/1", handlers.JSONPatchContentType, `[{"op":"copy","from":"/username","path":"/name"}]`, adminHeader, http.StatusOK)
+		assert.Equal(t, "bar@foo.com", resp.User.Name)
+		w, _ := web.MakeRequest(c.Web, http.MethodPost, "/login", strings.NewReader(`{"username":"bar@foo.com","password":"securePassword"}`))
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		own := map[string]string{"Authorization": "Bearer " + resp.Token}
+		patch("/v1/users/1", handlers.JSONPatchContentType, `[{"op":"add","path":"/password","value":"otherPassword"}]`, adminHeader, http.StatusOK)
+		// The new password logged out every session.
+		w, _ = web.MakeRequest(c.Web, http.MethodGet, "/user/get", nil, own)
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+		for _, tc := range []struct {
+			contentType, body string
+			code              string
+		}{
+			{handlers.JSONPatchContentType, `[{"op":"test","path":"/name","value":"Nope"},{"op":"remove","path":"/name"}]`, "patch_test_failed"},
+			{handlers.JSONPatchContentType, `[{"op":"replace","path":"/status","value":"suspended"}]`, "read_only_field"},
+			{handlers.JSONPatchContentType, `[{"op":"remove","path":"/username"}]`, "username_required"},
+			{handlers.JSONPatchContentType, `[{"op":"replace","path":"/nickname","value":"foo"}]`, "invalid_patch"},
+			{handlers.JSONPatchContentType, `[{"op":"add","path":"/name/first","value":"foo"}]`, "invalid_patch"},
+			{handlers.JSONPatchContentType, `[{"op":"swap","path":"/name"}]`, "invalid_patch"},
+			{handlers.JSONPatchContentType, `[{"op":"add","path":"/name"}]`, "invalid_patch"},
+			{handlers.JSONPatchContentType, `[{"op":"copy","from":"name","path":"/username"}]`, "invalid_patch"},
+			{handlers.JSONPatchContentType, `[{"op":"copy","from":"/nickname","path":"/name"}]`, "invalid_patch"},
+			{handlers.JSONPatchContentType, `[{"op":"move","from":"/username","path":"/name"}]`, "username_required"},
+			{handlers.JSONPatchContentType, `{"op":"remove","path":"/name"}`, "invalid_request"},
+			{handlers.MergePatchContentType, `{"id":7}`, "read_only_field"},
+			{handlers.MergePatchContentType, `{"name":7}`, "invalid_value"},
+			{handlers.MergePatchContentType, `{"name":{"first":"Foo"}}`, "invalid_value"},
+			{handlers.MergePatchContentType, `{"username":null}`, "username_required"},
+			{handlers.MergePatchContentType, `[]`, "invalid_request"},
+		} {
+			w := patch("/v1/users/1", tc.contentType, tc.body, adminHeader, http.StatusBadRequest)
+			assert.Equal(t, tc.code, problemCode(t, w), tc.body)
+		}
+		w = patch("/v1/users/1", handlers.JSONPatchContentType, `[{"op":"test","path":"/name","value":"Nope"}]`,
+			map[string]string{"Authorization": adminHeader["Authorization"], middleware.StatusModeHeader: middleware.StatusModeStrict},
+			http.StatusConflict)
+		assert.Equal(t, "patch_test_failed", problemCode(t, w))
+		w = patch("/v1/users/1", "text/plain", `name=Foo`, adminHeader, http.StatusUnsupportedMediaType)
+		assert.Equal(t, "unsupported_media_type", problemCode(t, w))
+		assert.Contains(t, w.Header().Get("Accept-Patch"), handlers.MergePatchContentType)
+		w = patch("/v1/users/9", handlers.MergePatchContentType, `{"name":"Nobody"}`, adminHeader, http.StatusBadRequest)
+		assert.Equal(t, "user_not_found", problemCode(t, w))
+
+		// Plain JSON still leaves empty fields unchanged.
+		patch("/v1/users/1", gin.MIMEJSON, `{"name":"","username":"foo@bar.com"}`, adminHeader, http.StatusOK)
+		assert.Equal(t, "foo@bar.com", resp.User.Username)
+		assert.Equal(t, "bar@foo.com", resp.User.Name)
+
+		w, _ = web.MakeRequest(c.Web, http.MethodPost, "/login", strings.NewReader(`{"username":"foo@bar.com","password":"otherPassword"}`))
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		own = map[string]string{"Authorization": "Bearer " + resp.Token}
+
+		// Users patch their own profile, but not their password.
+		patch("/user/me", handlers.MergePatchContentType, `{"name":null}`, own, http.StatusOK)
+		assert.Equal(t, "", resp.User.Name)
+		w = patch("/user/me", handlers.MergePatchContentType, `{"password":"stolenPassword"}`, own, http.StatusBadRequest)
+		assert.Equal(t, "read_only_field", problemCode(t, w))
+		w = patch("/user/me", "text/plain", `name=Me`, own, http.StatusUnsupportedMediaType)
+		assert.Equal(t, "unsupported_media_type", problemCode(t, w))
+		patch("/user/me", handlers.JSONPatchContentType, `[{"op":"add","path":"/name","value":"Me"}]`, own, http.StatusOK)
+		assert.Equal(t, "Me", resp.User.Name)
+	})
+}
+
+func TestUserETags(t *testing.T) {
+	send := func(c *service.Container, method, path, contentType, body string, header map[string]string) *httptest.ResponseRecorder {
+		merged := map[string]string{"Authorization": adminHeader["Authorization"]}
+		if contentType != "" {
+			merged["Content-Type"] = contentType
+		}
+		for key, val := range header {
+			merged[key] = val
+		}
+		w, err := web.MakeRequest(c.Web, method, path, strings.NewReader(body), merged)
+		assert.NoError(t, err)
+		return w
+	}
+
+	web.RunTest(func(c *service.Container) {
+		w := send(c, http.MethodPost, "/v1/users", "", `{"username":"foo@bar.com","password":"securePassword","name":"Foo Bar"}`, nil)
+		assert.Equal(t, http.StatusCreated, w.Code)
+		assert.Equal(t, `"1"`, w.Header().Get("ETag"))
+
+		w = send(c, http.MethodGet, "/user/get/1", "", "", nil)
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, `"1"`, w.Header().Get("ETag"))
+		for _, tag := range []string{`"1"`, `W/"1"`, `"0", "1"`, `*`} {
+			w = send(c, http.MethodGet, "/user/get/1", "", "", map[string]string{"If-None-Match": tag})
+			assert.Equal(t, http.StatusNotModified, w.Code, tag)
+			assert.Empty(t, w.Body.String())
+			assert.Equal(t, `"1"`, w.Header().Get("ETag"))
+		}
+		w = send(c, http.MethodGet, "/v1/users/1", "", "", map[string]string{"If-None-Match": `"0"`})
+		assert.Equal(t, http.StatusOK, w.Code)
+
+		// Two admins read version 1; the second write is refused.
+		w = send(c, http.MethodPut, "/user/update/1", "", `{"name":"First"}`, map[string]string{"If-Match": `"1"`})
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, `"2"`, w.Header().Get("ETag"))
+		w = send(c, http.MethodPut, "/user/update/1", "", `{"name":"Second"}`, map[string]string{"If-Match": `"1"`})
+		assert.Equal(t, http.StatusPreconditionFailed, w.Code)
+		assert.Equal(t, "version_mismatch", problemCode(t, w))
+		w = send(c, http.MethodGet, "/user/get/1", "", "", map[string]string{"If-None-Match": `"1"`})
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Contains(t, w.Body.String(), "First")
+
+		w = send(c, http.MethodPatch, "/v1/users/1", handlers.MergePatchContentType, `{"name":null}`, map[string]string{"If-Match": `"2"`})
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, `"3"`, w.Header().Get("ETag"))
+		// Weak tags never match If-Match.
+		w = send(c, http.MethodPut, "/v1/users/1", "", `{"username":"foo@bar.com","name":"Foo"}`, map[string]string{"If-Match": `W/"3"`})
+		assert.Equal(t, http.StatusPreconditionFailed, w.Code)
+		w = send(c, http.MethodPut, "/v1/users/1", "", `{"username":"foo@bar.com","name":"Foo"}`, map[string]string{"If-Match": `*`})
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, `"4"`, w.Header().Get("ETag"))
+		// Without If-Match writes go through.
+		w = send(c, http.MethodPatch, "/v1/users/1", "", `{"name":"Bar"}`, nil)
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, `"5"`, w.Header().Get("ETag"))
+
+		// The admin token belongs to user 1.
+		w = send(c, http.MethodGet, "/v1/users/me", "", "", map[string]string{"If-None-Match": `"5"`})
+		assert.Equal(t, http.StatusNotModified, w.Code)
+
+		w = send(c, http.MethodDelete, "/v1/users/1", "", "", map[string]string{"If-Match": `"4"`})
+		assert.Equal(t, http.StatusPreconditionFailed, w.Code)
+		// So is a change between reading the User and deleting it.
+		admin := c.Admin
+		c.Admin = racingDelete{admin}
+		w = send(c, http.MethodDelete, "/v1/users/1", "", "", map[string]string{"If-Match": `"5"`})
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		assert.Equal(t, "version_mismatch", problemCode(t, w))
+		c.Admin = admin
+		w = send(c, http.MethodDelete, "/v1/users/1", "", "", map[string]string{"If-Match": `"5"`})
+		assert.Equal(t, http.StatusOK, w.Code)
+	})
+
+	t.Setenv("IF_MATCH_REQUIRED", "true")
+	web.RunTest(func(c *service.Container) {
+		w := send(c, http.MethodPost, "/v1/users", "", `{"username":"foo@bar.com","password":"securePassword","name":"Foo Bar"}`, nil)
+		assert.Equal(t, http.StatusCreated, w.Code)
+
+		for _, tc := range []struct {
+			method, path, contentType, body string
+		}{
+			{http.MethodPut, "/user/update/1", "", `{"name":"Foo"}`},
+			{http.MethodPut, "/v1/users/1", "", `{"username":"foo@bar.com","name":"Foo"}`},
+			{http.MethodPatch, "/v1/users/1", handlers.MergePatchContentType, `{"name":"Foo"}`},
+			{http.MethodDelete, "/user/delete/1", "", ""},
+		} {
+			w = send(c, tc.method, tc.path, tc.contentType, tc.body, nil)
+			assert.Equal(t, http.StatusPreconditionRequired, w.Code, tc.path)
+			assert.Equal(t, "if_match_required", problemCode(t, w), tc.path)
+		}
+		w = send(c, http.MethodPatch, "/v1/users/1", "", `{"name":"Foo"}`, map[string]string{"If-Match": `"1"`})
+		assert.Equal(t, http.StatusOK, w.Code)
+		w = send(c, http.MethodGet, "/v1/users/1", "", "", nil)
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, `"2"`, w.Header().Get("ETag"))
+	})
+}
+
+type racingDelete struct{ user.AuthInterface }
+
+func (racingDelete) DeleteUserAt(uint, uint) error { return user.ErrVersionMismatch }
+
+func TestLegacyUserRoutesDeprecated(t *testing.T) {
+	web.RunTest(func(c *service.Container) {
+		jsonBody, _ := json.Marshal(core.User{Username: "foo@bar.com", Password: "securePassword", Name: "Foo Bar"})
+		for _, tc := range []struct {
+			method, path, successor string
+		}{
+			{http.MethodPost, "/user/register", "/v1/users"},
+			{http.MethodGet, "/user/list", "/v1/users"},
+			{http.MethodGet, "/user/get/1", "/v1/users/1"},
+			{http.MethodGet, "/user/get", "/v1/users/me"},
+			{http.MethodPut, "/user/update/1", "/v1/users/1"},
+			{http.MethodDelete, "/user/delete/1", "/v1/users/1"},
+			// Failed requests are flagged too.
+			{http.MethodGet, "/user/get/9", "/v1/users/9"},
+		} {
+			w, err := web.MakeRequest(c.Web, tc.method, tc.path, bytes.NewReader(jsonBody), adminHeader)
+			assert.NoError(t, err)
+			assert.Equal(t, "@1792281600", w.Header().Get("Deprecation"), tc.path)
+			assert.Equal(t, "Fri, 30 Apr 2027 00:00:00 GMT", w.Header().Get("Sunset"), tc.path)
+			assert.Equal(t, "<"+tc.successor+`>; rel="successor-version"`, w.Header().Get("Link"), tc.path)
+		}
+
+		w, err := web.MakeRequest(c.Web, http.MethodGet, "/user/sessions", nil, adminHeader)
+		assert.NoError(t, err)
+		assert.Empty(t, w.Header().Get("Deprecation"))
+	})
+}
+
+func TestUserResponsesHideSecrets(t *testing.T) {
+	web.RunTest(func(c *service.Container) {
+		jsonBody, _ := json.Marshal(core.User{Username: "foo@bar.com", Password: "securePassword", Name: "Foo Bar"})
+		w, err := web.MakeRequest(c.Web, http.MethodPost, "/user/register", bytes.NewReader(jsonBody), adminHeader)
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusOK, w.Code)
+
+		var resp struct {
+			User  map[string]interface{}
+			Users []map[string]interface{}
+			Token string
+		}
+		check := func(method, endpoint string, body []byte, header map[string]string) {
+			w, err := web.MakeRequest(c.Web, method, endpoint, bytes.NewReader(body), header)
+			assert.NoError(t, err)
+			assert.Equal(t, http.StatusOK, w.Code, endpoint)
+			assert.NotContains(t, w.Body.String(), "$2a$")
+			assert.NotContains(t, strings.ToLower(w.Body.String()), "password")
+			resp.User, resp.Users = nil, nil
+			assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+			if resp.User != nil {
+				assertUserResponse(t, endpoint, resp.User)
+			}
+			for _, user := range resp.Users {
+				assertUserResponse(t, endpoint, user)
+			}
+		}
+
+		jsonBody, _ = json.Marshal(map[string]string{"username": "foo@bar.com", "password": "securePassword"})
+		check(http.MethodPost, "/login", jsonBody, nil)
+		assert.Equal(t, "foo@bar.com", resp.User["username"])
+		header := map[string]string{"Authorization": "Bearer " + resp.Token}
+
+		check(http.MethodGet, "/user/get", nil, header)
+		check(http.MethodGet, "/user/get/1", nil, adminHeader)
+		check(http.MethodGet, "/user/list", nil, adminHeader)
+		assert.Equal(t, 1, len(resp.Users))
+		jsonBody, _ = json.Marshal(map[string]string{"name": "Foo", "password": "otherPassword"})
+		check(http.MethodPut, "/user/update/1", jsonBody, adminHeader)
+		assert.Equal(t, "Foo", resp.User["name"])
+	})
+}
+
+func TestMFAEndpoints(t *testing.T) {
+	web.RunTest(func(c *service.Container) {
+		jsonBody, _ := json.Marshal(core.User{Username: "foo@bar.com", Password: "securePassword", Name: "Foo Bar"})
+		w, err := web.MakeRequest(c.Web, http.MethodPost, "/user/register", bytes.NewReader(jsonBody), adminHeader)
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusOK, w.Code)
+
+		var resp struct {
+			Token          string
+			MFARequired    bool   `json:"mfa_required"`
+			ChallengeToken string `json:"challenge_token"`
+			Secret         string
+			URI            string
+			RecoveryCodes  []string `json:"recovery_codes"`
+		}
+		login := func() {
+			resp.Token, resp.ChallengeToken, resp.MFARequired = "", "", false
+			jsonBody, _ := json.Marshal(map[string]string{"username": "foo@bar.com", "password": "securePassword"})
+			w, err := web.MakeRequest(c.Web, http.MethodPost, "/login", bytes.NewReader(jsonBody))
+			assert.NoError(t, err)
+			assert.Equal(t, http.StatusOK, w.Code)
+			assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		}
+		secondStep := func(challenge, code string) *httptest.ResponseRecorder {
+			jsonBody, _ := json.Marshal(map[string]string{"challenge_token": challenge, "code": code})
+			w, err := web.MakeRequest(c.Web, http.MethodPost, "/login/mfa", bytes.NewReader(jsonBody))
+			assert.NoError(t, err)
+			return w
+		}
+
+		login()
+		assert.False(t, resp.MFARequired)
+		header := map[string]string{"Authorization": "Bearer " + resp.Token}
+
+		w, err = web.MakeRequest(c.Web, http.MethodPost, "/user/mfa/enroll", nil, header)
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		assert.Contains(t, resp.URI, "otpauth://totp/")
+
+		jsonBody, _ = json.Marshal(map[string]string{"code": "000000"})
+		w, err = web.MakeRequest(c.Web, http.MethodPost, "/user/mfa/confirm", bytes.NewReader(jsonBody), header)
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		code, _ := mfa.GenerateCode(resp.Secret, time.Now().Add(-30*time.Second))
+		jsonBody, _ = json.Marshal(map[string]string{"code": code})
+		w, err = web.MakeRequest(c.Web, http.MethodPost, "/user/mfa/confirm", bytes.NewReader(jsonBody), header)
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		assert.Equal(t, 10, len(resp.RecoveryCodes))
+
+		login()
+		assert.True(t, resp.MFARequired)
+		assert.Empty(t, resp.Token)
+		challenge := resp.ChallengeToken
+
+		// The challenge is not an access token.
+		w, err = web.MakeRequest(c.Web, http.MethodGet, "/user/get", nil, map[string]string{"Authorization": "Bearer " + challenge})
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+		w = secondStep(challenge, "000000")
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+		code, _ = mfa.GenerateCode(resp.Secret, time.Now())
+		w = secondStep(challenge, code)
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		assert.NotEmpty(t, resp.Token)
+		w, err = web.MakeRequest(c.Web, http.MethodGet, "/user/get", nil, map[string]string{"Authorization": "Bearer " + resp.Token})
+		assert.Equal(t, http.StatusOK, w.Code)
+
+		// A spent challenge can't be replayed, even with a fresh code.
+		w = secondStep(challenge, resp.RecoveryCodes[0])
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+		login()
+		w = secondStep(resp.ChallengeToken, resp.RecoveryCodes[0])
+		assert.Equal(t, http.StatusOK, w.Code)
+		login()
+		w = secondStep(resp.ChallengeToken, resp.RecoveryCodes[0])
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+		w, err = web.MakeRequest(c.Web, http.MethodDelete, "/admin/user/1/mfa", nil, userHeader)
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+		w, err = web.MakeRequest(c.Web, http.MethodDelete, "/admin/user/99/mfa", nil, adminHeader)
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		w, err = web.MakeRequest(c.Web, http.MethodDelete, "/admin/user/1/mfa", nil, adminHeader)
+		assert.Equal(t, http.StatusOK, w.Code)
+		// The failed codes count against the account like wrong passwords.
+		w, err = web.MakeRequest(c.Web, http.MethodPost, "/admin/user/1/unlock", nil, adminHeader)
+		assert.Equal(t, http.StatusOK, w.Code)
+		login()
+		assert.False(t, resp.MFARequired)
+		assert.NotEmpty(t, resp.Token)
+	})
+}
+
+func TestLoginMFAErrors(t *testing.T) {
+	t.Setenv("RATE_LIMIT_AUTH", "off")
+	web.RunTest(func(c *service.Container) {
+		for _, username := range []string{"admin@bar.com", "foo@bar.com"} {
+			jsonBody, _ := json.Marshal(core.User{Username: username, Password: "securePassword", Name: "Foo Bar"})
+			w, _ := web.MakeRequest(c.Web, http.MethodPost, "/user/register", bytes.NewReader(jsonBody), adminHeader)
+			assert.Equal(t, http.StatusOK, w.Code)
+		}
+		var resp struct {
+			Token          string
+			ChallengeToken string `json:"challenge_token"`
+			Secret         string
+			RecoveryCodes  []string `json:"recovery_codes"`
+		}
+		login := func() *httptest.ResponseRecorder {
+			jsonBody, _ := json.Marshal(map[string]string{"username": "foo@bar.com", "password": "securePassword"})
+			w, _ := web.MakeRequest(c.Web, http.MethodPost, "/login", bytes.NewReader(jsonBody))
+			json.Unmarshal(w.Body.Bytes(), &resp)
+			return w
+		}
+		secondStep := func(challenge, code string) *httptest.ResponseRecorder {
+			jsonBody, _ := json.Marshal(map[string]string{"challenge_token": challenge, "code": code})
+			w, _ := web.MakeRequest(c.Web, http.MethodPost, "/login/mfa", bytes.NewReader(jsonBody))
+			return w
+		}
+		// Each accepted code works once, so the steps that get past the
+		// code use up the recovery codes.
+		var recoveryCodes []string
+		nextCode := func() string {
+			code := recoveryCodes[0]
+			recoveryCodes = recoveryCodes[1:]
+			return code
+		}
+
+		login()
+		header := map[string]string{"Authorization": "Bearer " + resp.Token}
+		admin, mfas, rbac, revocations := c.Admin, c.MFA, c.RBAC, c.Revocations
+		c.Admin = failingUserLookup{admin}
+		w, _ := web.MakeRequest(c.Web, http.MethodPost, "/user/mfa/enroll", nil, header)
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		c.Admin = admin
+		w, _ = web.MakeRequest(c.Web, http.MethodPost, "/user/mfa/enroll", nil, header)
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		w, _ = web.MakeRequest(c.Web, http.MethodPost, "/user/mfa/confirm", nil, header)
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		code, _ := mfa.GenerateCode(resp.Secret, time.Now())
+		jsonBody, _ := json.Marshal(map[string]string{"code": code})
+		w, _ = web.MakeRequest(c.Web, http.MethodPost, "/user/mfa/confirm", bytes.NewReader(jsonBody), header)
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		recoveryCodes = resp.RecoveryCodes
+		w, _ = web.MakeRequest(c.Web, http.MethodPost, "/user/mfa/enroll", nil, header)
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		assert.Contains(t, w.Body.String(), "mfa_already_enabled")
+
+		// The password step fails when the second factor can't be checked.
+		c.MFA = failingMFA{mfas}
+		assert.Equal(t, http.StatusInternalServerError, login().Code)
+		c.MFA = mfas
+		restore := breakSigning()
+		assert.Equal(t, http.StatusInternalServerError, login().Code)
+		restore()
+
+		login()
+		challenge := resp.ChallengeToken
+		w, _ = web.MakeRequest(c.Web, http.MethodPost, "/login/mfa", nil)
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		expired, _ := jwtAuth.GenerateChallengeToken(2, -time.Minute)
+		unknown, _ := jwtAuth.GenerateChallengeToken(99, time.Minute)
+		for _, token := range []string{"nope", expired, unknown} {
+			w = secondStep(token, recoveryCodes[0])
+			assert.Equal(t, http.StatusUnauthorized, w.Code)
+			assert.Contains(t, w.Body.String(), "invalid_challenge")
+		}
+
+		for _, fail := range []func(){
+			func() { c.Admin = failingUserLookup{admin} },
+			func() { c.MFA = failingMFA{mfas} },
+		} {
+			fail()
+			assert.Equal(t, http.StatusInternalServerError, secondStep(challenge, recoveryCodes[0]).Code)
+			c.Admin, c.MFA = admin, mfas
+		}
+		c.Revocations = failingRevocations{revocations}
+		assert.Equal(t, http.StatusInternalServerError, secondStep(challenge, nextCode()).Code)
+		c.Revocations = revocations
+		// Every failure after the code was accepted spends the challenge.
+		for _, fail := range []func(){
+			func() { c.Admin = failingStatusCheck{admin} },
+			func() { c.RBAC = failingRoles{rbac} },
+		} {
+			login()
+			fail()
+			assert.Equal(t, http.StatusInternalServerError, secondStep(resp.ChallengeToken, nextCode()).Code)
+			c.Admin, c.RBAC = admin, rbac
+			assert.Equal(t, http.StatusUnauthorized, secondStep(resp.ChallengeToken, recoveryCodes[0]).Code)
+		}
+
+		// The account is checked again after the second factor.
+		login()
+		w, _ = web.MakeRequest(c.Web, http.MethodPost, "/admin/user/2/suspend", strings.NewReader(`{"reason":"chargeback"}`), adminHeader)
+		assert.Equal(t, http.StatusOK, w.Code)
+		w = secondStep(resp.ChallengeToken, nextCode())
+		assert.Equal(t, http.StatusForbidden, w.Code)
+		assert.Contains(t, w.Body.String(), "account_suspended")
+		assert.NotContains(t, w.Body.String(), "token")
+		w, _ = web.MakeRequest(c.Web, http.MethodPost, "/admin/user/2/reactivate", strings.NewReader(`{"reason":"resolved"}`), adminHeader)
+		assert.Equal(t, http.StatusOK, w.Code)
+
+		// Wrong codes count against the account like wrong passwords.
+		login()
+		assert.Equal(t, http.StatusUnauthorized, secondStep(resp.ChallengeToken, "000000").Code)
+		assert.Equal(t, http.StatusUnauthorized, secondStep(resp.ChallengeToken, "000000").Code)
+		w = secondStep(resp.ChallengeToken, recoveryCodes[0])
+		assert.Equal(t, http.StatusTooManyRequests, w.Code)
+		assert.Contains(t, w.Body.String(), "too_many_attempts")
+
+		c.MFA = failingMFA{mfas}
+		w, _ = web.MakeRequest(c.Web, http.MethodDelete, "/admin/user/2/mfa", nil, adminHeader)
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		c.MFA = mfas
+	})
+}
+
+func TestPasswordResetEndpoints(t *testing.T) {
+	web.RunTest(func(c *service.Container) {
+		jsonBody, _ := json.Marshal(core.User{Username: "foo@bar.com", Password: "securePassword", Name: "Foo Bar"})
+		w, err := web.MakeRequest(c.Web, http.MethodPost, "/user/register", bytes.NewReader(jsonBody), adminHeader)
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusOK, w.Code)
+
+		jsonBody, _ = json.Marshal(map[string]string{"username": "foo@bar.com", "password": "securePassword"})
+		w, err = web.MakeRequest(c.Web, http.MethodPost, "/login", bytes.NewReader(jsonBody))
+		var login struct{ Token string }
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &login))
+
+		outbox := c.Notifier.(*notify.Outbox)
+		w, err = web.MakeRequest(c.Web, http.MethodPost, "/password/forgot", nil)
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		jsonBody, _ = json.Marshal(map[string]string{"username": "nobody@bar.com"})
+		w, err = web.MakeRequest(c.Web, http.MethodPost, "/password/forgot", bytes.NewReader(jsonBody))
+		assert.Equal(t, http.StatusOK, w.Code)
+		unknown := w.Body.String()
+
+		// The token is sent in the background.
+		sent := func(n int) []notify.Message {
+			assert.Eventually(t, func() bool { return len(outbox.Messages()) == n }, time.Second, time.Millisecond)
+			return outbox.Messages()
+		}
+		jsonBody, _ = json.Marshal(map[string]string{"username": "foo@bar.com"})
+		w, err = web.MakeRequest(c.Web, http.MethodPost, "/password/forgot", bytes.NewReader(jsonBody))
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, unknown, w.Body.String())
+		messages := sent(1)
+		lines := strings.Split(messages[0].Body, "\n")
+		token := lines[4]
+
+		jsonBody, _ = json.Marshal(map[string]string{"token": "wrong", "password": "newPassword"})
+		w, err = web.MakeRequest(c.Web, http.MethodPost, "/password/reset", bytes.NewReader(jsonBody))
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		jsonBody, _ = json.Marshal(map[string]string{"token": token, "password": "newPassword"})
+		w, err = web.MakeRequest(c.Web, http.MethodPost, "/password/reset", bytes.NewReader(jsonBody))
+		assert.Equal(t, http.StatusOK, w.Code)
+		w, err = web.MakeRequest(c.Web, http.MethodPost, "/password/reset", bytes.NewReader(jsonBody))
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+
+		// Resetting logs out every session.
+		w, err = web.MakeRequest(c.Web, http.MethodGet, "/user/get", nil, map[string]string{"Authorization": "Bearer " + login.Token})
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+		jsonBody, _ = json.Marshal(map[string]string{"username": "foo@bar.com", "password": "newPassword"})
+		w, err = web.MakeRequest(c.Web, http.MethodPost, "/login", bytes.NewReader(jsonBody))
+		assert.Equal(t, http.StatusOK, w.Code)
+
+		// The reset fails loudly when the sessions can't be logged out.
+		jsonBody, _ = json.Marshal(map[string]string{"username": "foo@bar.com"})
+		web.MakeRequest(c.Web, http.MethodPost, "/password/forgot", bytes.NewReader(jsonBody))
+		messages = sent(2)
+		token = strings.Split(messages[len(messages)-1].Body, "\n")[4]
+		sessions := c.Sessions
+		c.Sessions = failingSessions{sessions}
+		jsonBody, _ = json.Marshal(map[string]string{"token": token, "password": "otherPassword"})
+		w, err = web.MakeRequest(c.Web, http.MethodPost, "/password/reset", bytes.NewReader(jsonBody))
+		assert.Equal(t, http.StatusInternalServerError, w.Code)
+		c.Sessions = sessions
+
+		w, err = web.MakeRequest(c.Web, http.MethodPost, "/password/reset", strings.NewReader(`{}`))
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		reset := c.PasswordReset
+		c.PasswordReset = failingPasswordReset{reset}
+		jsonBody, _ = json.Marshal(map[string]string{"token": token, "password": "otherPassword"})
+		w, err = web.MakeRequest(c.Web, http.MethodPost, "/password/reset", bytes.NewReader(jsonBody))
+		assert.Equal(t, http.StatusInternalServerError, w.Code)
+		c.PasswordReset = reset
+	})
+}
+
+type failingPasswordReset struct{ user.PasswordResetInterface }
+
+func (failingPasswordReset) Reset(string, string) (core.User, error) {
+	return core.User{}, errUnavailable
+}
+
+func TestProfileEndpoints(t *testing.T) {
+	web.RunTest(func(c *service.Container) {
+		jsonBody, _ := json.Marshal(core.User{Username: "foo@bar.com", Password: "securePassword", Name: "Foo Bar"})
+		w, err := web.MakeRequest(c.Web, http.MethodPost, "/user/register", bytes.NewReader(jsonBody), adminHeader)
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusOK, w.Code)
+
+		login := func(password string) string {
+			jsonBody, _ := json.Marshal(map[string]string{"username": "foo@bar.com", "password": password})
+			w, err := web.MakeRequest(c.Web, http.MethodPost, "/login", bytes.NewReader(jsonBody))
+			assert.NoError(t, err)
+			assert.Equal(t, http.StatusOK, w.Code)
+			var body struct{ Token string }
+			assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+			return body.Token
+		}
+		first := map[string]string{"Authorization": "Bearer " + login("securePassword")}
+		second := map[string]string{"Authorization": "Bearer " + login("securePassword")}
+
+		for _, body := range []string{`{"roles":["admin"]}`, `{"password":"x"}`, `{"id":1}`, `not json`} {
+			w, err = web.MakeRequest(c.Web, http.MethodPatch, "/user/me", strings.NewReader(body), first)
+			assert.Equal(t, http.StatusBadRequest, w.Code, body)
+		}
+		w, err = web.MakeRequest(c.Web, http.MethodPatch, "/user/me", strings.NewReader(`{"name":"Bar Foo"}`), first)
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Contains(t, w.Body.String(), `"name":"Bar Foo"`)
+		var updated struct{ User struct{ ID uint } }
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &updated))
+		assert.Contains(t, w.Body.String(), `"username":"foo@bar.com"`)
+		roles, err := c.RBAC.UserRoles(updated.User.ID)
+		assert.NoError(t, err)
+		assert.Equal(t, []string{core.RoleUser}, roles)
+
+		w, err = web.MakeRequest(c.Web, http.MethodPost, "/user/me/password", strings.NewReader(`{}`), first)
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		jsonBody, _ = json.Marshal(map[string]string{"current_password": "wrong", "new_password": "newPassword"})
+		w, err = web.MakeRequest(c.Web, http.MethodPost, "/user/me/password", bytes.NewReader(jsonBody), first)
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		c.Lockout.Unlock("foo@bar.com")
+		jsonBody, _ = json.Marshal(map[string]string{"current_password": "securePassword", "new_password": "newPassword"})
+		w, err = web.MakeRequest(c.Web, http.MethodPost, "/user/me/password", bytes.NewReader(jsonBody), first)
+		assert.Equal(t, http.StatusOK, w.Code)
+
+		// The session that changed the password stays, the others are logged out.
+		w, err = web.MakeRequest(c.Web, http.MethodGet, "/user/get", nil, first)
+		assert.Equal(t, http.StatusOK, w.Code)
+		w, err = web.MakeRequest(c.Web, http.MethodGet, "/user/get", nil, second)
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+		login("newPassword")
+
+		admin := c.Admin
+		jsonBody, _ = json.Marshal(map[string]string{"current_password": "newPassword", "new_password": "otherPassword"})
+		for _, failing := range []user.AuthInterface{failingUserLookup{admin}, failingUpdate{admin}} {
+			c.Admin = failing
+			w, err = web.MakeRequest(c.Web, http.MethodPost, "/user/me/password", bytes.NewReader(jsonBody), first)
+			assert.Equal(t, http.StatusBadRequest, w.Code)
+		}
+		c.Admin = admin
+
+		// The change fails loudly when the other sessions can't be logged out.
+		sessions := c.Sessions
+		c.Sessions = failingSessions{sessions}
+		w, err = web.MakeRequest(c.Web, http.MethodPost, "/user/me/password", bytes.NewReader(jsonBody), first)
+		assert.Equal(t, http.StatusInternalServerError, w.Code)
+		c.Sessions = sessions
+
+		// Wrong current passwords are throttled like logins.
+		jsonBody, _ = json.Marshal(map[string]string{"current_password": "wrong", "new_password": "otherPassword"})
+		for i := 0; i < 2; i++ {
+			w, err = web.MakeRequest(c.Web, http.MethodPost, "/user/me/password", bytes.NewReader(jsonBody), first)
+			assert.Equal(t, http.StatusBadRequest, w.Code)
+		}
+		w, err = web.MakeRequest(c.Web, http.MethodPost, "/user/me/password", bytes.NewReader(jsonBody), first)
+		assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	})
+}
+
+type failingUpdate struct{ user.AuthInterface }
+
+func (failingUpdate) UpdateUser(uint, string, string, string) (core.User, error) {
+	return core.User{}, errUnavailable
+}
+
+func TestSignupEndpoints(t *testing.T) {
+	jsonBody, _ := json.Marshal(map[string]string{"username": "foo@bar.com", "password": "securePassword", "name": "Foo Bar"})
+	web.RunTest(func(c *service.Container) {
+		w, err := web.MakeRequest(c.Web, http.MethodPost, "/signup", bytes.NewReader(jsonBody))
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusNotFound, w.Code)
+	})
+
+	t.Setenv("SIGNUP_ENABLED", "true")
+	web.RunTest(func(c *service.Container) {
+		w, err := web.MakeRequest(c.Web, http.MethodPost, "/signup", strings.NewReader(`{"username":"foo","password":"x","name":"Foo"}`))
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		w, err = web.MakeRequest(c.Web, http.MethodPost, "/signup", bytes.NewReader(jsonBody))
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Contains(t, w.Body.String(), `"status":"pending_verification"`)
+		w, err = web.MakeRequest(c.Web, http.MethodPost, "/signup", bytes.NewReader(jsonBody))
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+
+		login, _ := json.Marshal(map[string]string{"username": "foo@bar.com", "password": "securePassword"})
+		w, err = web.MakeRequest(c.Web, http.MethodPost, "/login", bytes.NewReader(login))
+		assert.Equal(t, http.StatusForbidden, w.Code)
+		assert.Contains(t, w.Body.String(), `"code":"email_not_verified"`)
+
+		outbox := c.Notifier.(*notify.Outbox)
+		w, err = web.MakeRequest(c.Web, http.MethodPost, "/signup/resend", strings.NewReader(`{"username":"foo@bar.com"}`))
+		assert.Equal(t, http.StatusOK, w.Code)
+		messages := outbox.Messages()
+		assert.Equal(t, 2, len(messages))
+		token := strings.Split(messages[1].Body, "\n")[4]
+
+		w, err = web.MakeRequest(c.Web, http.MethodPost, "/signup/verify", strings.NewReader(`{"token":"wrong"}`))
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		verify, _ := json.Marshal(map[string]string{"token": token})
+		w, err = web.MakeRequest(c.Web, http.MethodPost, "/signup/verify", bytes.NewReader(verify))
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Contains(t, w.Body.String(), `"status":"active"`)
+		w, err = web.MakeRequest(c.Web, http.MethodPost, "/signup/verify", bytes.NewReader(verify))
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+
+		w, err = web.MakeRequest(c.Web, http.MethodPost, "/login", bytes.NewReader(login))
+		assert.Equal(t, http.StatusOK, w.Code)
+
+		signup := c.Signup
+		c.Signup = failingSignup{signup}
+		other, _ := json.Marshal(map[string]string{"username": "bar@bar.com", "password": "securePassword", "name": "Bar Foo"})
+		w, err = web.MakeRequest(c.Web, http.MethodPost, "/signup", bytes.NewReader(other))
+		assert.Equal(t, http.StatusInternalServerError, w.Code)
+		assert.Equal(t, "notification_failed", problemCode(t, w))
+		w, err = web.MakeRequest(c.Web, http.MethodPost, "/signup/verify", bytes.NewReader(verify))
+		assert.Equal(t, http.StatusInternalServerError, w.Code)
+		w, err = web.MakeRequest(c.Web, http.MethodPost, "/signup/resend", strings.NewReader(`{"username":"bar@bar.com"}`))
+		assert.Equal(t, http.StatusInternalServerError, w.Code)
+		assert.Equal(t, "notification_failed", problemCode(t, w))
+		c.Signup = signup
+
+		for _, path := range []string{"/signup/verify", "/signup/resend"} {
+			w, err = web.MakeRequest(c.Web, http.MethodPost, path, strings.NewReader(`{}`))
+			assert.Equal(t, http.StatusBadRequest, w.Code, path)
+		}
+	})
+}
+
+type failingSignup struct{ user.SignupInterface }
+
+func (failingSignup) Register(string, string, string) (core.User, error) {
+	return core.User{}, fmt.Errorf("%w: %v", user.ErrVerificationNotSent, errUnavailable)
+}
+func (failingSignup) Verify(string) (core.User, error) { return core.User{}, errUnavailable }
+func (failingSignup) Resend(string) error              { return errUnavailable }
+
+func TestStatusEndpoints(t *testing.T) {
+	web.RunTest(func(c *service.Container) {
+		// The test tokens belong to users 1 and 2, so the user under test is 3.
+		for _, username := range []string{"admin@bar.com", "user@bar.com", "foo@bar.com"} {
+			jsonBody, _ := json.Marshal(core.User{Username: username, Password: "securePassword", Name: "Foo Bar"})
+			w, err := web.MakeRequest(c.Web, http.MethodPost, "/user/register", bytes.NewReader(jsonBody), adminHeader)
+			assert.NoError(t, err)
+			assert.Equal(t, http.StatusOK, w.Code)
+		}
+		login, _ := json.Marshal(map[string]string{"username": "foo@bar.com", "password": "securePassword"})
+		w, err := web.MakeRequest(c.Web, http.MethodPost, "/login", bytes.NewReader(login))
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusOK, w.Code)
+		var body struct{ Token string }
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+		fooHeader := map[string]string{"Authorization": "Bearer " + body.Token}
+
+		w, err = web.MakeRequest(c.Web, http.MethodPost, "/admin/user/3/suspend", strings.NewReader(`{"reason":"chargeback"}`), userHeader)
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+		w, err = web.MakeRequest(c.Web, http.MethodPost, "/admin/user/3/suspend", strings.NewReader(`{}`), adminHeader)
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		w, err = web.MakeRequest(c.Web, http.MethodPost, "/admin/user/1/suspend", strings.NewReader(`{"reason":"self"}`), adminHeader)
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		w, err = web.MakeRequest(c.Web, http.MethodPost, "/admin/user/3/reactivate", strings.NewReader(`{"reason":"noop"}`), adminHeader)
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		assert.Contains(t, w.Body.String(), `"code":"invalid_transition"`)
+
+		w, err = web.MakeRequest(c.Web, http.MethodPost, "/admin/user/3/suspend", strings.NewReader(`{"reason":"chargeback"}`), adminHeader)
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Contains(t, w.Body.String(), `"status":"suspended"`)
+		assert.Contains(t, w.Body.String(), `"status_reason":"chargeback"`)
+		assert.Contains(t, w.Body.String(), `"status_changed_at"`)
+
+		// Existing tokens stop working and new logins are refused.
+		w, err = web.MakeRequest(c.Web, http.MethodGet, "/user/get", nil, fooHeader)
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+		w, err = web.MakeRequest(c.Web, http.MethodPost, "/login", bytes.NewReader(login))
+		assert.Equal(t, http.StatusForbidden, w.Code)
+		assert.Contains(t, w.Body.String(), `"code":"account_suspended"`)
+
+		w, err = web.MakeRequest(c.Web, http.MethodGet, "/user/list?status=suspended", nil, adminHeader)
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Contains(t, w.Body.String(), `"total":1`)
+
+		w, err = web.MakeRequest(c.Web, http.MethodPost, "/admin/user/3/reactivate", strings.NewReader(`{"reason":"resolved"}`), adminHeader)
+		assert.Equal(t, http.StatusOK, w.Code)
+		w, err = web.MakeRequest(c.Web, http.MethodPost, "/login", bytes.NewReader(login))
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+		fooHeader = map[string]string{"Authorization": "Bearer " + body.Token}
+
+		w, err = web.MakeRequest(c.Web, http.MethodPost, "/admin/user/3/lock", strings.NewReader(`{"reason":"investigation"}`), adminHeader)
+		assert.Equal(t, http.StatusOK, w.Code)
+		w, err = web.MakeRequest(c.Web, http.MethodGet, "/user/get", nil, fooHeader)
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+		w, err = web.MakeRequest(c.Web, http.MethodPost, "/login", bytes.NewReader(login))
+		assert.Equal(t, http.StatusForbidden, w.Code)
+		assert.Contains(t, w.Body.String(), `"code":"account_locked_by_admin"`)
+		w, err = web.MakeRequest(c.Web, http.MethodPost, "/admin/user/3/deactivate", strings.NewReader(`{"reason":"left"}`), adminHeader)
+		assert.Equal(t, http.StatusOK, w.Code)
+		w, err = web.MakeRequest(c.Web, http.MethodPost, "/login", bytes.NewReader(login))
+		assert.Equal(t, http.StatusForbidden, w.Code)
+		assert.Contains(t, w.Body.String(), `"code":"account_deactivated"`)
+
+		// The change fails loudly when the sessions can't be logged out.
+		w, err = web.MakeRequest(c.Web, http.MethodPost, "/admin/user/3/reactivate", strings.NewReader(`{"reason":"back"}`), adminHeader)
+		assert.Equal(t, http.StatusOK, w.Code)
+		sessions := c.Sessions
+		c.Sessions = failingSessions{sessions}
+		w, err = web.MakeRequest(c.Web, http.MethodPost, "/admin/user/3/suspend", strings.NewReader(`{"reason":"chargeback"}`), adminHeader)
+		assert.Equal(t, http.StatusInternalServerError, w.Code)
+		c.Sessions = sessions
+	})
+}
+
+func TestAuditEndpoints(t *testing.T) {
+	// Leave reads out so the listings below only hold the changes.
+	t.Setenv("AUDIT_READS", "false")
+	web.RunTest(func(c *service.Container) {
+		jsonBody, _ := json.Marshal(core.User{Username: "foo@bar.com", Password: "securePassword", Name: "Foo Bar"})
+		w, err := web.MakeRequest(c.Web, http.MethodPost, "/user/register", bytes.NewReader(jsonBody),
+			map[string]string{"Authorization": adminHeader["Authorization"], "X-Request-ID": "register-1"})
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "register-1", w.Header().Get("X-Request-ID"))
+
+		jsonBody, _ = json.Marshal(map[string]string{"name": "Bar Foo", "password": "newPassword"})
+		w, err = web.MakeRequest(c.Web, http.MethodPut, "/user/update/1", bytes.NewReader(jsonBody), adminHeader)
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.NotEmpty(t, w.Header().Get("X-Request-ID"))
+		w, err = web.MakeRequest(c.Web, http.MethodDelete, "/user/delete/1", nil, userHeader)
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+		login := func(password string) {
+			jsonBody, _ := json.Marshal(map[string]string{"username": "foo@bar.com", "password": password})
+			web.MakeRequest(c.Web, http.MethodPost, "/login", bytes.NewReader(jsonBody), map[string]string{"User-Agent": "test-agent"})
+		}
+		login("wrong")
+		c.Lockout.Unlock("foo@bar.com")
+		login("newPassword")
+
+		type page struct {
+			Events []map[string]interface{}
+			Total  int
+			Next   *string
+		}
+		list := func(query string, header map[string]string) (int, page) {
+			w, err := web.MakeRequest(c.Web, http.MethodGet, "/audit"+query, nil, header)
+			assert.NoError(t, err)
+			var p page
+			json.Unmarshal(w.Body.Bytes(), &p)
+			return w.Code, p
+		}
+
+		code, _ := list("", userHeader)
+		assert.Equal(t, http.StatusUnauthorized, code)
+		code, _ = list("?outcome=maybe", adminHeader)
+		assert.Equal(t, http.StatusBadRequest, code)
+		code, _ = list("?cursor=!", adminHeader)
+		assert.Equal(t, http.StatusBadRequest, code)
+
+		code, all := list("", adminHeader)
+		assert.Equal(t, http.StatusOK, code)
+		// Newest first.
+		actions := make([]string, 0, len(all.Events))
+		for _, event := range all.Events {
+			actions = append(actions, event["action"].(string))
+		}
+		assert.Equal(t, []string{"auth.login", "auth.login", "user.delete", "user.update", "user.register"}, actions)
+
+		register := all.Events[4]
+		assert.Equal(t, float64(1), register["actor_id"])
+		assert.Equal(t, "user", register["target_type"])
+		assert.Equal(t, "1", register["target_id"])
+		assert.Equal(t, "register-1", register["request_id"])
+		assert.Equal(t, "foo@bar.com", register["after"].(map[string]interface{})["username"])
+
+		update := all.Events[3]
+		assert.Equal(t, "Foo Bar", update["before"].(map[string]interface{})["name"])
+		assert.NotContains(t, update["before"], "username")
+		assert.Equal(t, "Bar Foo", update["after"].(map[string]interface{})["name"])
+		assert.NotContains(t, fmt.Sprint(all.Events), "Password")
+
+		assert.Equal(t, float64(http.StatusUnauthorized), all.Events[2]["status"])
+		assert.Equal(t, float64(2), all.Events[2]["actor_id"])
+
+		success, failure := all.Events[0], all.Events[1]
+		assert.Equal(t, float64(http.StatusOK), success["status"])
+		assert.Equal(t, float64(1), success["actor_id"])
+		assert.Equal(t, "test-agent", success["user_agent"])
+		assert.Equal(t, float64(http.StatusBadRequest), failure["status"])
+		assert.Nil(t, failure["actor_id"])
+		assert.Equal(t, map[string]interface{}{"username": "foo@bar.com"}, failure["after"])
+
+		_, failures := list("?action=auth.login&outcome=failure", adminHeader)
+		assert.Equal(t, 1, failures.Total)
+		// The refused delete.
+		_, byActor := list("?actor_id=2", adminHeader)
+		assert.Equal(t, 1, byActor.Total)
+		_, byRequest := list("?request_id=register-1", adminHeader)
+		assert.Equal(t, 1, byRequest.Total)
+
+		_, first := list("?limit=2&target_type=user", adminHeader)
+		assert.Equal(t, 4, first.Total)
+		assert.Equal(t, 2, len(first.Events))
+		assert.NotNil(t, first.Next)
+		w, err = web.MakeRequest(c.Web, http.MethodGet, *first.Next, nil, adminHeader)
+		var second page
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &second))
+		assert.Equal(t, 2, len(second.Events))
+		assert.Less(t, second.Events[0]["id"], first.Events[1]["id"])
+	})
+}
+
+func TestProblemDetails(t *testing.T) {
+	web.RunTest(func(c *service.Container) {
+		jsonBody, _ := json.Marshal(core.User{Username: "foo@bar.com", Password: "securePassword", Name: "Foo Bar"})
+		web.MakeRequest(c.Web, http.MethodPost, "/user/register", bytes.NewReader(jsonBody), adminHeader)
+		w, err := web.MakeRequest(c.Web, http.MethodPost, "/user/register", bytes.NewReader(jsonBody),
+			map[string]string{"Authorization": adminHeader["Authorization"], "X-Request-ID": "dup-1"})
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		assert.Equal(t, middleware.ProblemContentType, w.Header().Get("Content-Type"))
+		assert.JSONEq(t, `{
+			"type": "about:blank",
+			"title": "Bad Request",
+			"status": 400,
+			"detail": "username is taken by another user",
+			"instance": "/user/register",
+			"code": "username_taken",
+			"message": "username is taken by another user",
+			"request_id": "dup-1"
+		}`, w.Body.String())
+
+		for _, tc := range []struct {
+			method, path, body string
+			header             map[string]string
+			status             int
+			code               string
+		}{
+			{http.MethodPost, "/user/register", `{"username":`, adminHeader, 400, "invalid_request"},
+			{http.MethodGet, "/user/get/9", "", adminHeader, 400, "user_not_found"},
+			{http.MethodGet, "/user/list?sort=age", "", adminHeader, 400, "invalid_sort"},
+			{http.MethodGet, "/user/list", "", nil, 401, "unauthorized"},
+			{http.MethodGet, "/user/list", "", userHeader, 401, "permission_denied"},
+			{http.MethodPost, "/login", `{"username":"foo@bar.com","password":"wrong"}`, nil, 400, "invalid_credentials"},
+			{http.MethodPost, "/login", `{"username":"nobody","password":"wrong"}`, nil, 400, "invalid_credentials"},
+			{http.MethodPost, "/refresh", `{"refresh_token":"nope"}`, nil, 401, "invalid_refresh_token"},
+			{http.MethodPost, "/role/create", `{"name":"admin"}`, adminHeader, 400, "role_exists"},
+			{http.MethodPost, "/role/create", `{"name":"pilot","permissions":["users:fly"]}`, adminHeader, 400, "unknown_permission"},
+			{http.MethodPut, "/role/update/pilot", `{"permissions":[]}`, adminHeader, 400, "role_not_found"},
+			{http.MethodPost, "/admin/user/1/roles", `{"role":"pilot"}`, adminHeader, 400, "role_not_found"},
+			{http.MethodPost, "/user/restore/1", "", adminHeader, 400, "user_not_deleted"},
+		} {
+			var body io.Reader
+			if tc.body != "" {
+				body = strings.NewReader(tc.body)
+			}
+			w, _ := web.MakeRequest(c.Web, tc.method, tc.path, body, tc.header)
+			assert.Equal(t, tc.status, w.Code, tc.path)
+			assert.Equal(t, tc.code, problemCode(t, w), tc.path)
+		}
+
+		// Errors that aren't domain errors keep their text to the logs.
+		c.Web.GET("/test/fail", func(ctx *gin.Context) {
+			middleware.Fail(ctx, http.StatusBadRequest, errors.New("UNIQUE constraint failed: users.username"))
+		})
+		w, _ = web.MakeRequest(c.Web, http.MethodGet, "/test/fail", nil)
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		assert.Equal(t, "internal_error", problemCode(t, w))
+		assert.NotContains(t, w.Body.String(), "UNIQUE")
+	})
+}
+
+func TestStrictStatus(t *testing.T) {
+	strict := func(header map[string]string) map[string]string {
+		out := map[string]string{middleware.StatusModeHeader: middleware.StatusModeStrict}
+		for key, val := range header {
+			out[key] = val
+		}
+		return out
+	}
+	web.RunTest(func(c *service.Container) {
+		jsonBody, _ := json.Marshal(core.User{Username: "foo@bar.com", Password: "securePassword", Name: "Foo Bar"})
+		w, _ := web.MakeRequest(c.Web, http.MethodPost, "/user/register", bytes.NewReader(jsonBody), strict(adminHeader))
+		assert.Equal(t, http.StatusOK, w.Code)
+
+		for _, tc := range []struct {
+			method, path, body string
+			header             map[string]string
+			status             int
+			code               string
+		}{
+			{http.MethodGet, "/user/get/9", "", adminHeader, 404, "user_not_found"},
+			{http.MethodPut, "/user/update/9", `{"name":"Nobody"}`, adminHeader, 404, "user_not_found"},
+			{http.MethodPut, "/role/update/pilot", `{"permissions":[]}`, adminHeader, 404, "role_not_found"},
+			{http.MethodPost, "/user/register", string(jsonBody), adminHeader, 409, "username_taken"},
+			{http.MethodPost, "/role/create", `{"name":"admin"}`, adminHeader, 409, "role_exists"},
+			{http.MethodPost, "/user/restore/1", "", adminHeader, 409, "user_not_deleted"},
+			{http.MethodGet, "/user/list", "", userHeader, 403, "permission_denied"},
+			{http.MethodPost, "/role/create", `{"name":"pilot"}`, userHeader, 403, "permission_denied"},
+			{http.MethodPost, "/user/register", `{"username":`, adminHeader, 422, "invalid_request"},
+			{http.MethodGet, "/user/list?sort=age", "", adminHeader, 422, "invalid_sort"},
+			{http.MethodPost, "/role/create", `{"name":"pilot","permissions":["users:fly"]}`, adminHeader, 422, "unknown_permission"},
+			{http.MethodGet, "/user/list", "", nil, 401, "unauthorized"},
+			{http.MethodPost, "/login", `{"username":"foo@bar.com","password":"wrong"}`, nil, 401, "invalid_credentials"},
+		} {
+			var body io.Reader
+			if tc.body != "" {
+				body = strings.NewReader(tc.body)
+			}
+			w, _ := web.MakeRequest(c.Web, tc.method, tc.path, body, strict(tc.header))
+			assert.Equal(t, tc.status, w.Code, tc.path)
+			assert.Equal(t, tc.code, problemCode(t, w), tc.path)
+			var problem middleware.Problem
+			assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &problem))
+			assert.Equal(t, tc.status, problem.Status, tc.path)
+		}
+
+		// Clients that don't opt in keep the legacy statuses.
+		w, _ = web.MakeRequest(c.Web, http.MethodGet, "/user/get/9", nil, adminHeader)
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		w, _ = web.MakeRequest(c.Web, http.MethodGet, "/user/list", nil, userHeader)
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+		c.Web.GET("/test/fail", func(ctx *gin.Context) {
+			middleware.Fail(ctx, http.StatusBadRequest, errors.New("disk full"))
+		})
+		w, _ = web.MakeRequest(c.Web, http.MethodGet, "/test/fail", nil, strict(nil))
+		assert.Equal(t, http.StatusInternalServerError, w.Code)
+		assert.Equal(t, "internal_error", problemCode(t, w))
+
+		// The audit log records the status the client saw.
+		page, err := c.Audit.List(audit.Filter{Action: "user.view", Limit: 1})
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusBadRequest, page.Events[0].Status)
+		w, _ = web.MakeRequest(c.Web, http.MethodGet, "/user/get/9", nil, strict(adminHeader))
+		page, err = c.Audit.List(audit.Filter{Action: "user.view", Limit: 1})
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusNotFound, page.Events[0].Status)
+	})
+
+	t.Setenv("HTTP_STATUS_MODE", "strict")
+	web.RunTest(func(c *service.Container) {
+		w, _ := web.MakeRequest(c.Web, http.MethodGet, "/user/get/9", nil, adminHeader)
+		assert.Equal(t, http.StatusNotFound, w.Code)
+		assert.Equal(t, "user_not_found", problemCode(t, w))
+	})
+}
+
+func TestLoginLockout(t *testing.T) {
+	login := func(c *service.Container, password string) *httptest.ResponseRecorder {
+		jsonBody, _ := json.Marshal(map[string]string{"username": "foo@bar.com", "password": password})
+		w, err := web.MakeRequest(c.Web, http.MethodPost, "/login", bytes.NewReader(jsonBody))
+		assert.NoError(t, err)
+		return w
+	}
+	register := func(c *service.Container) {
+		jsonBody, _ := json.Marshal(core.User{Username: "foo@bar.com", Password: "securePassword", Name: "Foo Bar"})
+		w, err := web.MakeRequest(c.Web, http.MethodPost, "/user/register", bytes.NewReader(jsonBody), adminHeader)
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusOK, w.Code)
+	}
+
+	web.RunTest(func(c *service.Container) {
+		register(c)
+		assert.Equal(t, http.StatusBadRequest, login(c, "wrongPassword").Code)
+		assert.Equal(t, http.StatusBadRequest, login(c, "wrongPassword").Code)
+		w := login(c, "securePassword")
+		assert.Equal(t, http.StatusTooManyRequests, w.Code)
+		assert.Equal(t, "1", w.Header().Get("Retry-After"))
+		assert.Contains(t, w.Body.String(), `"code":"too_many_attempts"`)
+	})
+
+	t.Setenv("LOGIN_DELAY_BASE_MS", "0")
+	web.RunTest(func(c *service.Container) {
+		register(c)
+		for i := 0; i < 5; i++ {
+			assert.Equal(t, http.StatusBadRequest, login(c, "wrongPassword").Code)
+		}
+		w := login(c, "securePassword")
+		assert.Equal(t, http.StatusLocked, w.Code)
+		assert.Equal(t, "900", w.Header().Get("Retry-After"))
+		assert.Contains(t, w.Body.String(), `"code":"account_locked"`)
+
+		w, _ = web.MakeRequest(c.Web, http.MethodPost, "/admin/user/1/unlock", nil, userHeader)
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+		w, _ = web.MakeRequest(c.Web, http.MethodPost, "/admin/user/99/unlock", nil, adminHeader)
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		w, _ = web.MakeRequest(c.Web, http.MethodPost, "/admin/user/1/unlock", nil, adminHeader)
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, http.StatusOK, login(c, "securePassword").Code)
+	})
+}
+
+// Services whose calls fail, for the error paths of the handlers.
+var errUnavailable = errors.New("unavailable")
+
+// failingUnlock is an Admin whose Unlock fails, as when the status changes
+// at the same time.
+type failingUnlock struct{ user.AuthInterface }
+
+func (failingUnlock) Unlock(uint, string) (core.User, error) {
+	return core.User{}, user.ErrInvalidTransition
+}
+
+type failingRoles struct{ role.RBACInterface }
+
+func (failingRoles) UserRoles(uint) ([]string, error) { return nil, errUnavailable }
+func (failingRoles) ListRoles() ([]core.Role, error)  { return nil, errUnavailable }
+
+type failingRevocations struct{ token.RevocationsInterface }
+
+func (failingRevocations) Revoke(string, time.Time) error { return errUnavailable }
+
+type failingSessions struct{ session.SessionsInterface }
+
+func (failingSessions) Start(uint, string, string) (core.Session, error) {
+	return core.Session{}, errUnavailable
+}
+func (failingSessions) Revoke(uint, uint) error       { return errUnavailable }
+func (failingSessions) RevokeAll(uint) error          { return errUnavailable }
+func (failingSessions) RevokeOthers(uint, uint) error { return errUnavailable }
+func (failingSessions) List(uint) ([]core.Session, error) {
+	return nil, errUnavailable
+}
+
+type failingRefresh struct{ token.RefreshInterface }
+
+func (failingRefresh) Issue(uint, uint) (string, error) { return "", errUnavailable }
+
+type failingUserLookup struct{ user.AuthInterface }
+
+func (failingUserLookup) GetUser(uint) (core.User, error) { return core.User{}, errUnavailable }
+
+type failingStatusCheck struct{ user.AuthInterface }
+
+func (failingStatusCheck) CheckActive(uint) error { return errUnavailable }
+
+type failingMFA struct{ mfa.MFAInterface }
+
+func (failingMFA) Enabled(uint) (bool, error) { return false, errUnavailable }
+func (failingMFA) Verify(uint, string) error  { return errUnavailable }
+func (failingMFA) Reset(uint) error           { return errUnavailable }
+
+// breakSigning makes signing tokens fail until the returned func restores
+// the default key. Tokens signed before stay valid.
+func breakSigning() func() {
+	legacy := jwtAuth.HMACKey(util.GetEnv("API_SECRET", "rahasiasekali"))
+	jwtAuth.SetKeys(jwtAuth.Key{ID: "broken", Algorithm: jwtAuth.AlgRS256, Secret: []byte("x")}, legacy)
+	return func() { jwtAuth.SetKeys(legacy) }
+}
+
+func TestUnlockUser(t *testing.T) {
+	web.RunTest(func(c *service.Container) {
+		for _, username := range []string{"foo@bar.com", "bar@foo.com"} {
+			jsonBody, _ := json.Marshal(core.User{Username: username, Password: "securePassword", Name: "Foo Bar"})
+			w, _ := web.MakeRequest(c.Web, http.MethodPost, "/user/register", bytes.NewReader(jsonBody), adminHeader)
+			assert.Equal(t, http.StatusOK, w.Code)
+		}
+		login := func() *httptest.ResponseRecorder {
+			jsonBody, _ := json.Marshal(map[string]string{"username": "bar@foo.com", "password": "securePassword"})
+			w, _ := web.MakeRequest(c.Web, http.MethodPost, "/login", bytes.NewReader(jsonBody))
+			return w
+		}
+		var resp struct {
+			User handlers.UserResponse `json:"user"`
+		}
+
+		w, _ := web.MakeRequest(c.Web, http.MethodPost, "/admin/user/2/lock", strings.NewReader(`{"reason":"investigation"}`), adminHeader)
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, http.StatusForbidden, login().Code)
+
+		// The status can only be lifted when it still is locked.
+		admin := c.Admin
+		c.Admin = failingUnlock{admin}
+		w, _ = web.MakeRequest(c.Web, http.MethodPost, "/admin/user/2/unlock", nil, adminHeader)
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		c.Admin = admin
+
+		w, _ = web.MakeRequest(c.Web, http.MethodPost, "/admin/user/2/unlock", strings.NewReader(`{"reason":"resolved"}`), adminHeader)
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		assert.Equal(t, core.StatusActive, resp.User.Status)
+		assert.Equal(t, "resolved", resp.User.StatusReason)
+		assert.Equal(t, http.StatusOK, login().Code)
+
+		w, _ = web.MakeRequest(c.Web, http.MethodPost, "/admin/user/2/lock", strings.NewReader(`{"reason":"again"}`), adminHeader)
+		assert.Equal(t, http.StatusOK, w.Code)
+		w, _ = web.MakeRequest(c.Web, http.MethodPost, "/admin/user/2/unlock", nil, adminHeader)
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		assert.Equal(t, "unlocked", resp.User.StatusReason)
+
+		// Active users only have their failed logins cleared.
+		w, _ = web.MakeRequest(c.Web, http.MethodPost, "/admin/user/2/unlock", nil, adminHeader)
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		assert.Equal(t, core.StatusActive, resp.User.Status)
+	})
+}
+
+func TestRateLimits(t *testing.T) {
+	t.Setenv("RATE_LIMIT_AUTH", "2/1m")
+	t.Setenv("RATE_LIMIT_USER", "1/1m")
+	t.Setenv("RATE_LIMIT_API_KEYS", "partner, other")
+	web.RunTest(func(c *service.Container) {
+		jsonBody, _ := json.Marshal(map[string]string{"username": "foo@bar.com", "password": "securePassword"})
+		for i := 0; i < 2; i++ {
+			w, err := web.MakeRequest(c.Web, http.MethodPost, "/login", bytes.NewReader(jsonBody))
+			assert.NoError(t, err)
+			assert.Equal(t, http.StatusBadRequest, w.Code)
+			assert.Equal(t, "2", w.Header().Get("RateLimit-Limit"))
+			assert.Equal(t, strconv.Itoa(1-i), w.Header().Get("RateLimit-Remaining"))
+			assert.Equal(t, "2;w=60", w.Header().Get("RateLimit-Policy"))
+		}
+		w, _ := web.MakeRequest(c.Web, http.MethodPost, "/login", bytes.NewReader(jsonBody))
+		assert.Equal(t, http.StatusTooManyRequests, w.Code)
+		assert.Equal(t, "30", w.Header().Get("Retry-After"))
+		assert.Equal(t, "60", w.Header().Get("RateLimit-Reset"))
+		assert.Contains(t, w.Body.String(), `"code":"rate_limited"`)
+		// Other groups have their own limits.
+		w, _ = web.MakeRequest(c.Web, http.MethodGet, "/hello", nil)
+		assert.Equal(t, http.StatusOK, w.Code)
+
+		// Authenticated groups count per user, or per API key when a configured
+		// one is sent.
+		w, _ = web.MakeRequest(c.Web, http.MethodGet, "/user/get", nil, adminHeader)
+		assert.Equal(t, "0", w.Header().Get("RateLimit-Remaining"))
+		w, _ = web.MakeRequest(c.Web, http.MethodGet, "/user/get", nil, adminHeader)
+		assert.Equal(t, http.StatusTooManyRequests, w.Code)
+		w, _ = web.MakeRequest(c.Web, http.MethodGet, "/user/get", nil, userHeader)
+		assert.NotEqual(t, http.StatusTooManyRequests, w.Code)
+		w, _ = web.MakeRequest(c.Web, http.MethodGet, "/user/get", nil, map[string]string{
+			"Authorization": adminHeader["Authorization"],
+			"X-API-Key":     "partner",
+		})
+		assert.NotEqual(t, http.StatusTooManyRequests, w.Code)
+		// Unknown keys are ignored.
+		w, _ = web.MakeRequest(c.Web, http.MethodGet, "/user/get", nil, map[string]string{
+			"Authorization": adminHeader["Authorization"],
+			"X-API-Key":     "made-up",
+		})
+		assert.Equal(t, http.StatusTooManyRequests, w.Code)
+		w, _ = web.MakeRequest(c.Web, http.MethodGet, "/role/list", nil, adminHeader)
+		assert.Equal(t, http.StatusOK, w.Code)
+	})
+}
+
+func TestLegacyRefresh(t *testing.T) {
+	t.Setenv("TOKEN_HOUR_LIFESPAN", "2")
+	web.RunTest(func(c *service.Container) {
+		jsonBody, _ := json.Marshal(core.User{Username: "foo@bar.com", Password: "securePassword", Name: "Foo Bar"})
+		w, _ := web.MakeRequest(c.Web, http.MethodPost, "/user/register", bytes.NewReader(jsonBody), adminHeader)
+		assert.Equal(t, http.StatusOK, w.Code)
+		jsonBody, _ = json.Marshal(map[string]string{"username": "foo@bar.com", "password": "securePassword"})
+		w, _ = web.MakeRequest(c.Web, http.MethodPost, "/login", bytes.NewReader(jsonBody))
+		assert.Equal(t, http.StatusOK, w.Code)
+		var resp struct {
+			Token string `json:"token"`
+		}
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		// Without TOKEN_MINUTE_LIFESPAN, TOKEN_HOUR_LIFESPAN still applies.
+		claims, err := jwtAuth.ParseToken(resp.Token)
+		assert.NoError(t, err)
+		assert.InDelta(t, time.Now().Add(2*time.Hour).Unix(), claims["exp"], 5)
+		header := map[string]string{"Authorization": "Bearer " + resp.Token}
+
+		rbac, revocations := c.RBAC, c.Revocations
+		c.RBAC = failingRoles{rbac}
+		w, _ = web.MakeRequest(c.Web, http.MethodGet, "/user/refresh", nil, header)
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+		c.RBAC = rbac
+		c.Revocations = failingRevocations{revocations}
+		w, _ = web.MakeRequest(c.Web, http.MethodGet, "/user/refresh", nil, header)
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		c.Revocations = revocations
+		t.Setenv("TOKEN_MINUTE_LIFESPAN", "soon")
+		w, _ = web.MakeRequest(c.Web, http.MethodGet, "/user/refresh", nil, header)
+		assert.Equal(t, http.StatusInternalServerError, w.Code)
+		t.Setenv("TOKEN_MINUTE_LIFESPAN", "15")
+
+		w, _ = web.MakeRequest(c.Web, http.MethodGet, "/user/refresh", nil, header)
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.NotEmpty(t, w.Header().Get("Deprecation"))
+		assert.Equal(t, `</refresh>; rel="successor-version"`, w.Header().Get("Link"))
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		claims, err = jwtAuth.ParseToken(resp.Token)
+		assert.NoError(t, err)
+		assert.InDelta(t, time.Now().Add(15*time.Minute).Unix(), claims["exp"], 5)
+
+		// The presented token is spent, the new one works in the same session.
+		w, _ = web.MakeRequest(c.Web, http.MethodGet, "/user/refresh", nil, header)
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+		w, _ = web.MakeRequest(c.Web, http.MethodGet, "/user/get", nil, map[string]string{"Authorization": "Bearer " + resp.Token})
+		assert.Equal(t, http.StatusOK, w.Code)
 	})
 }
@@ -0,0 +1,121 @@
+package handlers
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/MicBun/go-100-coverage-docker-crud/audit"
+	"github.com/MicBun/go-100-coverage-docker-crud/core"
+	"github.com/MicBun/go-100-coverage-docker-crud/web/middleware"
+	"github.com/gin-gonic/gin"
+)
+
+// AuditEventResponse is one recorded action. Before and after hold only the
+// fields of the target that the action changed.
+type AuditEventResponse struct {
+	ID         uint            `json:"id"`
+	CreatedAt  string          `json:"created_at"`
+	ActorID    *uint           `json:"actor_id"`
+	Action     string          `json:"action"`
+	TargetType string          `json:"target_type,omitempty"`
+	TargetID   string          `json:"target_id,omitempty"`
+	Status     int             `json:"status"`
+	Before     json.RawMessage `json:"before,omitempty" swaggertype:"object"`
+	After      json.RawMessage `json:"after,omitempty" swaggertype:"object"`
+	IP         string          `json:"ip"`
+	UserAgent  string          `json:"user_agent"`
+	RequestID  string          `json:"request_id"`
+}
+
+func rawJSON(s string) json.RawMessage {
+	if s == "" {
+		return nil
+	}
+	return json.RawMessage(s)
+}
+
+func newAuditEventResponse(event core.AuditEvent) AuditEventResponse {
+	return AuditEventResponse{
+		ID:         event.ID,
+		CreatedAt:  isoTime(event.CreatedAt),
+		ActorID:    event.ActorID,
+		Action:     event.Action,
+		TargetType: event.TargetType,
+		TargetID:   event.TargetID,
+		Status:     event.Status,
+		Before:     rawJSON(event.Before),
+		After:      rawJSON(event.After),
+		IP:         event.IP,
+		UserAgent:  event.UserAgent,
+		RequestID:  event.RequestID,
+	}
+}
+
+type ListAuditEventsRequest struct {
+	Limit      int        `form:"limit" binding:"omitempty,min=1"`
+	Cursor     string     `form:"cursor"`
+	ActorID    *uint      `form:"actor_id"`
+	Action     string     `form:"action"`
+	TargetType string     `form:"target_type"`
+	TargetID   string     `form:"target_id"`
+	RequestID  string     `form:"request_id"`
+	Outcome    string     `form:"outcome" binding:"omitempty,oneof=success failure"`
+	Since      *time.Time `form:"since" time_format:"2006-01-02T15:04:05Z07:00"`
+	Until      *time.Time `form:"until" time_format:"2006-01-02T15:04:05Z07:00"`
+}
+
+// ListAuditEvents godoc
+// @Summary List Audit Events
+// @Description List recorded actions newest first, a page at a time. Follow the next link for older events.
+// @Tags Audit
+// @Accept  json
+// @Produce  json
+// @Param limit query int false "Page size, at most 200" default(50)
+// @Param cursor query string false "Cursor from a previous next link"
+// @Param actor_id query int false "Only actions by this User"
+// @Param action query string false "Only this action, such as user.update or auth.login"
+// @Param target_type query string false "Only actions on this kind of target, such as user, role or session"
+// @Param target_id query string false "Only actions on this target"
+// @Param request_id query string false "Only actions of this request"
+// @Param outcome query string false "success or failure"
+// @Param since query string false "Only actions at or after this RFC 3339 time"
+// @Param until query string false "Only actions before this RFC 3339 time"
+// @Param Authorization header string true "Authorization. How to input in swagger : 'Bearer <insert_your_token_here>'"
+// @Security BearerToken
+// @Success 200 {object} object{message=string,events=[]AuditEventResponse,total=int,next=string}
+// @Failure 400 {object} map[string]interface{}
+// @Failure 401 {object} map[string]interface{}
+// @Router /audit [get]
+func (h *apiHandler) ListAuditEvents(c *gin.Context) {
+	var req ListAuditEventsRequest
+	if err := c.ShouldBindQuery(&req); err != nil {
+		middleware.Fail(c, 400, invalidRequest(err))
+		return
+	}
+	page, err := h.container.Audit.List(audit.Filter{
+		ActorID:    req.ActorID,
+		Action:     req.Action,
+		TargetType: req.TargetType,
+		TargetID:   req.TargetID,
+		RequestID:  req.RequestID,
+		Outcome:    req.Outcome,
+		Since:      req.Since,
+		Until:      req.Until,
+		Limit:      req.Limit,
+		Cursor:     req.Cursor,
+	})
+	if err != nil {
+		middleware.Fail(c, 400, err)
+		return
+	}
+	events := make([]AuditEventResponse, 0, len(page.Events))
+	for _, event := range page.Events {
+		events = append(events, newAuditEventResponse(event))
+	}
+	c.JSON(200, gin.H{
+		"message": "Audit events retrieved",
+		"events":  events,
+		"total":   page.Total,
+		"next":    pageLink(c, page.NextCursor),
+	})
+}
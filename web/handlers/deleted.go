@@ -0,0 +1,81 @@
+package handlers
+
+import (
+	"strconv"
+
+	"github.com/MicBun/go-100-coverage-docker-crud/audit"
+	"github.com/MicBun/go-100-coverage-docker-crud/web/middleware"
+	"github.com/gin-gonic/gin"
+)
+
+// ListDeletedUsers godoc
+// @Summary List Deleted Users
+// @Description List soft-deleted Users a page at a time, with the same filters and paging as /user/list
+// @Tags User
+// @Accept  json
+// @Produce  json
+// @Param limit query int false "Page size, at most 100" default(20)
+// @Param cursor query string false "Cursor from a previous next or prev link"
+// @Param username query string false "Filter by username substring"
+// @Param name query string false "Filter by name substring"
+// @Param status query string false "Filter by status"
+// @Param created_after query string false "Only users created at or after this RFC 3339 time"
+// @Param created_before query string false "Only users created before this RFC 3339 time"
+// @Param sort query string false "id, username, name or created_at, prefix with - for descending" default(id)
+// @Param Authorization header string true "Authorization. How to input in swagger : 'Bearer <insert_your_token_here>'"
+// @Security BearerToken
+// @Success 200 {object} object{message=string,users=[]UserResponse,total=int,next=string,prev=string}
+// @Failure 400 {object} map[string]interface{}
+// @Failure 401 {object} map[string]interface{}
+// @Router /user/deleted [get]
+func (h *apiHandler) ListDeletedUsers(c *gin.Context) {
+	h.listUsers(c, true)
+}
+
+// RestoreUser godoc
+// @Summary Restore User
+// @Description Restore a soft-deleted User. Fails with the username_taken code when a live User has the username now
+// @Tags User
+// @Accept  json
+// @Produce  json
+// @Param id path int true "User ID"
+// @Param Authorization header string true "Authorization. How to input in swagger : 'Bearer <insert_your_token_here>'"
+// @Security BearerToken
+// @Success 200 {object} object{message=string,user=UserResponse}
+// @Failure 400 {object} map[string]interface{}
+// @Failure 401 {object} map[string]interface{}
+// @Router /user/restore/{id} [post]
+func (h *apiHandler) RestoreUser(c *gin.Context) {
+	id, _ := strconv.Atoi(c.Param("id"))
+	audit.SetTarget(c, "user", id)
+	restored, err := h.container.Admin.Restore(uint(id))
+	if err != nil {
+		middleware.Fail(c, 400, err)
+		return
+	}
+	audit.SetChange(c, nil, newUserResponse(c, restored))
+	c.JSON(200, gin.H{"message": "User restored", "user": newUserResponse(c, restored)})
+}
+
+// PurgeUser godoc
+// @Summary Purge User
+// @Description Permanently remove a soft-deleted User with its roles, sessions, second factor and pending tokens. This can't be undone
+// @Tags User
+// @Accept  json
+// @Produce  json
+// @Param id path int true "User ID"
+// @Param Authorization header string true "Authorization. How to input in swagger : 'Bearer <insert_your_token_here>'"
+// @Security BearerToken
+// @Success 200 {object} map[string]interface{}
+// @Failure 400 {object} map[string]interface{}
+// @Failure 401 {object} map[string]interface{}
+// @Router /user/purge/{id} [delete]
+func (h *apiHandler) PurgeUser(c *gin.Context) {
+	id, _ := strconv.Atoi(c.Param("id"))
+	audit.SetTarget(c, "user", id)
+	if err := h.container.Admin.Purge(uint(id)); err != nil {
+		middleware.Fail(c, 400, err)
+		return
+	}
+	c.JSON(200, gin.H{"message": "User purged"})
+}
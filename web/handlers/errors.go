@@ -0,0 +1,23 @@
+package handlers
+
+import (
+	"github.com/MicBun/go-100-coverage-docker-crud/apperr"
+)
+
+var (
+	errInvalidChallenge  = apperr.New(apperr.Unauthorized, "invalid_challenge_token", "invalid challenge token")
+	errOwnStatus         = apperr.New(apperr.Forbidden, "own_status_change", "you can't change your own status")
+	errIncorrectPassword = apperr.New(apperr.Invalid, "incorrect_password", "current password is incorrect")
+)
+
+// invalidRequest marks a body or query that couldn't be bound to the
+// request struct.
+func invalidRequest(err error) error {
+	return apperr.Wrap(apperr.Invalid, "invalid_request", err)
+}
+
+// notificationFailed hides why a notification couldn't be sent behind
+// message.
+func notificationFailed(message string, err error) error {
+	return &apperr.Error{Kind: apperr.Internal, Code: "notification_failed", Message: message, Err: err}
+}
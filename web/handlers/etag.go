@@ -0,0 +1,69 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/MicBun/go-100-coverage-docker-crud/apperr"
+	"github.com/MicBun/go-100-coverage-docker-crud/core"
+	"github.com/MicBun/go-100-coverage-docker-crud/user"
+	"github.com/MicBun/go-100-coverage-docker-crud/web/middleware"
+	"github.com/gin-gonic/gin"
+)
+
+var errIfMatchRequired = apperr.New(apperr.PreconditionRequired, "if_match_required",
+	"send the ETag of the user you read in If-Match")
+
+// userETag identifies the version of a user. It's strong: the representation
+// of a user only changes along with its version.
+func userETag(u core.User) string {
+	return `"` + strconv.FormatUint(uint64(u.Version), 10) + `"`
+}
+
+// etagListed reports whether the If-Match or If-None-Match header lists etag.
+// weak ignores the W/ prefix, as If-None-Match does.
+func etagListed(header, etag string, weak bool) bool {
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if weak {
+			tag = strings.TrimPrefix(tag, "W/")
+		}
+		if tag == "*" || tag == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// notModified answers 304 when the If-None-Match header of the request lists
+// the ETag of u, which the client already has.
+func notModified(c *gin.Context, u core.User) bool {
+	c.Header("ETag", userETag(u))
+	header := c.GetHeader("If-None-Match")
+	if header == "" || !etagListed(header, userETag(u), true) {
+		return false
+	}
+	c.Status(http.StatusNotModified)
+	return true
+}
+
+// ifMatch returns the version of current that the If-Match header of the
+// request allows changing, or 0 for any when it has none. It fails the
+// request with 412 when the header doesn't list the ETag of current, and
+// with 428 when it's missing but required.
+func (h *apiHandler) ifMatch(c *gin.Context, current core.User) (uint, bool) {
+	header := c.GetHeader("If-Match")
+	if header == "" {
+		if h.container.RequireIfMatch {
+			middleware.Fail(c, http.StatusPreconditionRequired, errIfMatchRequired)
+			return 0, false
+		}
+		return 0, true
+	}
+	if !etagListed(header, userETag(current), false) {
+		middleware.Fail(c, http.StatusPreconditionFailed, user.ErrVersionMismatch)
+		return 0, false
+	}
+	return current.Version, true
+}
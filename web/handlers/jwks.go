@@ -0,0 +1,18 @@
+package handlers
+
+import (
+	"github.com/MicBun/go-100-coverage-docker-crud/util/jwtAuth"
+	"github.com/gin-gonic/gin"
+)
+
+// JWKS godoc
+// @Summary JSON Web Key Set
+// @Description Public keys that verify access tokens, selected by the kid token header. Empty while tokens are signed with the legacy HS256 secret
+// @Tags Token
+// @Produce  json
+// @Success 200 {object} jwtAuth.JWKSet
+// @Router /.well-known/jwks.json [get]
+func (h *apiHandler) JWKS(c *gin.Context) {
+	c.Header("Cache-Control", "public, max-age=300")
+	c.JSON(200, jwtAuth.JWKS())
+}
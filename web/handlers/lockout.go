@@ -0,0 +1,68 @@
+package handlers
+
+import (
+	"errors"
+	"math"
+	"strconv"
+
+	"github.com/MicBun/go-100-coverage-docker-crud/audit"
+	"github.com/MicBun/go-100-coverage-docker-crud/core"
+	"github.com/MicBun/go-100-coverage-docker-crud/lockout"
+	"github.com/MicBun/go-100-coverage-docker-crud/web/middleware"
+	"github.com/gin-gonic/gin"
+)
+
+// rejectLogin answers a login attempt refused by the lockout. Locked accounts
+// get 423 and the account_locked code so clients can tell them apart from a
+// wrong password; throttled attempts get 429.
+func rejectLogin(c *gin.Context, err error) {
+	var retry *lockout.RetryError
+	if errors.As(err, &retry) {
+		c.Header("Retry-After", strconv.Itoa(int(math.Ceil(retry.RetryAfter.Seconds()))))
+	}
+	if errors.Is(err, lockout.ErrAccountLocked) {
+		middleware.Fail(c, 423, err)
+		return
+	}
+	middleware.Fail(c, 429, err)
+}
+
+// UnlockUser godoc
+// @Summary Unlock User
+// @Description Clear the failed login count and lockout of a User, and make a User locked by an administrator active again
+// @Tags User
+// @Accept  json
+// @Produce  json
+// @Param id path int true "User ID"
+// @Param status body StatusChangeRequest false "Reason, recorded when the User was locked by an administrator"
+// @Param Authorization header string true "Authorization. How to input in swagger : 'Bearer <insert_your_token_here>'"
+// @Security BearerToken
+// @Success 200 {object} object{message=string,user=UserResponse}
+// @Failure 400 {object} map[string]interface{}
+// @Failure 401 {object} map[string]interface{}
+// @Router /admin/user/{id}/unlock [post]
+func (h *apiHandler) UnlockUser(c *gin.Context) {
+	id, _ := strconv.Atoi(c.Param("id"))
+	audit.SetTarget(c, "user", id)
+	user, err := h.container.Admin.GetUser(uint(id))
+	if err != nil {
+		middleware.Fail(c, 400, err)
+		return
+	}
+	h.container.Lockout.Unlock(user.Username)
+	if user.Status == core.StatusLocked {
+		var req StatusChangeRequest
+		c.ShouldBindJSON(&req)
+		if req.Reason == "" {
+			req.Reason = "unlocked"
+		}
+		unlocked, err := h.container.Admin.Unlock(user.ID, req.Reason)
+		if err != nil {
+			middleware.Fail(c, 400, err)
+			return
+		}
+		audit.SetChange(c, newUserResponse(c, user), newUserResponse(c, unlocked))
+		user = unlocked
+	}
+	c.JSON(200, gin.H{"message": "User unlocked", "user": newUserResponse(c, user)})
+}
@@ -0,0 +1,201 @@
+package handlers
+
+import (
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/MicBun/go-100-coverage-docker-crud/apperr"
+	"github.com/MicBun/go-100-coverage-docker-crud/audit"
+	"github.com/MicBun/go-100-coverage-docker-crud/mfa"
+	"github.com/MicBun/go-100-coverage-docker-crud/util/jwtAuth"
+	"github.com/MicBun/go-100-coverage-docker-crud/web/middleware"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// challengeLifespan is how long the second step of a two-step login may take.
+const challengeLifespan = 5 * time.Minute
+
+type LoginMFARequest struct {
+	ChallengeToken string `json:"challenge_token" binding:"required"`
+	Code           string `json:"code" binding:"required"`
+}
+
+// LoginMFA godoc
+// @Summary Login Second Factor
+// @Description Finish a login that answered with mfa_required by sending its challenge_token with a TOTP or recovery code
+// @Tags User
+// @Accept  json
+// @Produce  json
+// @Param login body LoginMFARequest true "Challenge and code"
+// @Success 200 {object} object{message=string,user=UserResponse,token=string,refresh_token=string}
+// @Failure 400 {object} map[string]interface{}
+// @Failure 401 {object} map[string]interface{}
+// @Failure 403 {object} map[string]interface{} "code account_suspended, account_locked_by_admin or account_deactivated"
+// @Failure 423 {object} map[string]interface{} "code account_locked, see Retry-After"
+// @Failure 429 {object} map[string]interface{} "code too_many_attempts, see Retry-After"
+// @Router /login/mfa [post]
+func (h *apiHandler) LoginMFA(c *gin.Context) {
+	var req LoginMFARequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		middleware.Fail(c, 400, invalidRequest(err))
+		return
+	}
+	userID, jti, expiresAt, err := jwtAuth.ParseChallengeToken(req.ChallengeToken)
+	if err != nil {
+		middleware.Fail(c, 401, errInvalidChallenge)
+		return
+	}
+	audit.SetTarget(c, "user", userID)
+	if revoked, err := h.container.Revocations.IsRevoked(jti); err != nil || revoked {
+		middleware.Fail(c, 401, errInvalidChallenge)
+		return
+	}
+	user, err := h.container.Admin.GetUser(userID)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		middleware.Fail(c, 401, errInvalidChallenge)
+		return
+	}
+	if err != nil {
+		middleware.Fail(c, 500, err)
+		return
+	}
+	ip := c.ClientIP()
+	if err := h.container.Lockout.Check(user.Username, ip); err != nil {
+		rejectLogin(c, err)
+		return
+	}
+	if err := h.container.MFA.Verify(userID, req.Code); err != nil {
+		if errors.Is(err, mfa.ErrInvalidCode) || errors.Is(err, mfa.ErrNotEnrolled) {
+			h.container.Lockout.Fail(user.Username, ip)
+			middleware.Fail(c, 401, apperr.Wrap(apperr.Unauthorized, apperr.CodeOf(err), err))
+			return
+		}
+		middleware.Fail(c, 500, err)
+		return
+	}
+	// The challenge is spent, replaying it must not log in again.
+	if err := h.container.Revocations.Revoke(jti, expiresAt); err != nil {
+		middleware.Fail(c, 500, err)
+		return
+	}
+	// The account may have been suspended or locked since the password step.
+	if err := h.container.Admin.CheckActive(user.ID); err != nil {
+		if !rejectInactive(c, err) {
+			middleware.Fail(c, 500, err)
+		}
+		return
+	}
+	audit.SetActor(c, user.ID)
+	h.container.Lockout.Succeed(user.Username, ip)
+	token, refreshToken, err := h.issueTokens(c, user.ID)
+	if err != nil {
+		middleware.Fail(c, 500, err)
+		return
+	}
+	c.JSON(200, gin.H{"message": "User logged in", "user": newUserResponse(c, user), "token": token, "refresh_token": refreshToken})
+}
+
+// EnrollMFA godoc
+// @Summary Enroll Two-Factor Authentication
+// @Description Start TOTP enrollment for the logged in User. Scan the uri as a QR code, then confirm with a code from the app
+// @Tags MFA
+// @Accept  json
+// @Produce  json
+// @Param Authorization header string true "Authorization. How to input in swagger : 'Bearer <insert_your_token_here>'"
+// @Security BearerToken
+// @Success 200 {object} object{message=string,secret=string,uri=string}
+// @Failure 400 {object} map[string]interface{}
+// @Failure 401 {object} map[string]interface{}
+// @Router /user/mfa/enroll [post]
+func (h *apiHandler) EnrollMFA(c *gin.Context) {
+	userID, _ := jwtAuth.ExtractTokenID(c)
+	audit.SetTarget(c, "user", userID)
+	user, err := h.container.Admin.GetUser(userID)
+	if err != nil {
+		middleware.Fail(c, 400, err)
+		return
+	}
+	enrollment, err := h.container.MFA.Enroll(user.ID, user.Username)
+	if err != nil {
+		middleware.Fail(c, 400, err)
+		return
+	}
+	c.JSON(200, gin.H{"message": "Two-factor enrollment started", "secret": enrollment.Secret, "uri": enrollment.URI})
+}
+
+type ConfirmMFARequest struct {
+	Code string `json:"code" binding:"required"`
+}
+
+// ConfirmMFA godoc
+// @Summary Confirm Two-Factor Authentication
+// @Description Enable TOTP with a code from the authenticator app. The response lists single-use recovery codes, which are shown only once
+// @Tags MFA
+// @Accept  json
+// @Produce  json
+// @Param code body ConfirmMFARequest true "TOTP code"
+// @Param Authorization header string true "Authorization. How to input in swagger : 'Bearer <insert_your_token_here>'"
+// @Security BearerToken
+// @Success 200 {object} object{message=string,recovery_codes=[]string}
+// @Failure 400 {object} map[string]interface{}
+// @Failure 401 {object} map[string]interface{}
+// @Router /user/mfa/confirm [post]
+func (h *apiHandler) ConfirmMFA(c *gin.Context) {
+	var req ConfirmMFARequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		middleware.Fail(c, 400, invalidRequest(err))
+		return
+	}
+	userID, _ := jwtAuth.ExtractTokenID(c)
+	audit.SetTarget(c, "user", userID)
+	codes, err := h.container.MFA.Confirm(userID, req.Code)
+	if err != nil {
+		middleware.Fail(c, 400, err)
+		return
+	}
+	c.JSON(200, gin.H{"message": "Two-factor authentication enabled", "recovery_codes": codes})
+}
+
+// ResetUserMFA godoc
+// @Summary Reset Two-Factor Authentication
+// @Description Remove the second factor and recovery codes of a User, who can then log in with the password alone and enroll again
+// @Tags MFA
+// @Accept  json
+// @Produce  json
+// @Param id path int true "User ID"
+// @Param Authorization header string true "Authorization. How to input in swagger : 'Bearer <insert_your_token_here>'"
+// @Security BearerToken
+// @Success 200 {object} map[string]interface{}
+// @Failure 400 {object} map[string]interface{}
+// @Failure 401 {object} map[string]interface{}
+// @Router /admin/user/{id}/mfa [delete]
+func (h *apiHandler) ResetUserMFA(c *gin.Context) {
+	id, _ := strconv.Atoi(c.Param("id"))
+	audit.SetTarget(c, "user", id)
+	if _, err := h.container.Admin.GetUser(uint(id)); err != nil {
+		middleware.Fail(c, 400, err)
+		return
+	}
+	if err := h.container.MFA.Reset(uint(id)); err != nil {
+		middleware.Fail(c, 400, err)
+		return
+	}
+	c.JSON(200, gin.H{"message": "Two-factor authentication reset"})
+}
+
+// loginChallenge answers the password step of a login when the user has a
+// second factor, or returns false when the login can complete right away.
+func (h *apiHandler) loginChallenge(c *gin.Context, userID uint) (bool, error) {
+	enabled, err := h.container.MFA.Enabled(userID)
+	if err != nil || !enabled {
+		return false, err
+	}
+	challenge, err := jwtAuth.GenerateChallengeToken(userID, challengeLifespan)
+	if err != nil {
+		return false, err
+	}
+	c.JSON(200, gin.H{"message": "Two-factor code required", "mfa_required": true, "challenge_token": challenge})
+	return true, nil
+}
@@ -0,0 +1,75 @@
+package handlers
+
+import (
+	"errors"
+
+	"github.com/MicBun/go-100-coverage-docker-crud/audit"
+	"github.com/MicBun/go-100-coverage-docker-crud/user"
+	"github.com/MicBun/go-100-coverage-docker-crud/web/middleware"
+	"github.com/gin-gonic/gin"
+)
+
+type ForgotPasswordRequest struct {
+	Username string `json:"username" binding:"required"`
+}
+
+// ForgotPassword godoc
+// @Summary Forgot Password
+// @Description Send a single-use password reset token to the User in the background. The response is the same whether or not the account exists, and whether or not the token could be sent
+// @Tags Password
+// @Accept  json
+// @Produce  json
+// @Param user body ForgotPasswordRequest true "Username"
+// @Success 200 {object} map[string]interface{}
+// @Failure 400 {object} map[string]interface{}
+// @Router /password/forgot [post]
+func (h *apiHandler) ForgotPassword(c *gin.Context) {
+	var req ForgotPasswordRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		middleware.Fail(c, 400, invalidRequest(err))
+		return
+	}
+	audit.SetChange(c, nil, gin.H{"username": req.Username})
+	h.container.PasswordReset.Request(req.Username)
+	c.JSON(200, gin.H{"message": "If the account exists, a reset token has been sent"})
+}
+
+type ResetPasswordRequest struct {
+	Token    string `json:"token" binding:"required"`
+	Password string `json:"password" binding:"required"`
+}
+
+// ResetPassword godoc
+// @Summary Reset Password
+// @Description Set a new password with a reset token. Every session of the User is logged out
+// @Tags Password
+// @Accept  json
+// @Produce  json
+// @Param reset body ResetPasswordRequest true "Reset token and new password"
+// @Success 200 {object} map[string]interface{}
+// @Failure 400 {object} map[string]interface{}
+// @Failure 500 {object} map[string]interface{} "The password was reset but the sessions could not be logged out"
+// @Router /password/reset [post]
+func (h *apiHandler) ResetPassword(c *gin.Context) {
+	var req ResetPasswordRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		middleware.Fail(c, 400, invalidRequest(err))
+		return
+	}
+	reset, err := h.container.PasswordReset.Reset(req.Token, req.Password)
+	if errors.Is(err, user.ErrInvalidResetToken) {
+		middleware.Fail(c, 400, err)
+		return
+	}
+	if err != nil {
+		middleware.Fail(c, 500, err)
+		return
+	}
+	audit.SetActor(c, reset.ID)
+	audit.SetTarget(c, "user", reset.ID)
+	if err := h.container.Sessions.RevokeAll(reset.ID); err != nil {
+		middleware.Fail(c, 500, err)
+		return
+	}
+	c.JSON(200, gin.H{"message": "Password reset"})
+}
@@ -0,0 +1,244 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/MicBun/go-100-coverage-docker-crud/apperr"
+	"github.com/MicBun/go-100-coverage-docker-crud/audit"
+	"github.com/MicBun/go-100-coverage-docker-crud/user"
+	"github.com/MicBun/go-100-coverage-docker-crud/web/middleware"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	MergePatchContentType = "application/merge-patch+json"
+	JSONPatchContentType  = "application/json-patch+json"
+)
+
+var (
+	errPatchTestFailed   = apperr.New(apperr.Conflict, "patch_test_failed", "a test operation of the patch failed")
+	errUnsupportedFormat = apperr.New(apperr.UnsupportedMediaType, "unsupported_media_type",
+		"send application/json, "+MergePatchContentType+" or "+JSONPatchContentType)
+)
+
+func invalidPatch(format string, args ...interface{}) error {
+	return &apperr.Error{Kind: apperr.Invalid, Code: "invalid_patch", Message: fmt.Sprintf(format, args...)}
+}
+
+// patchFormat returns the patch format of the request body, or "" for plain
+// JSON which routes handle as they always did. Any other format fails the
+// request with 415.
+func patchFormat(c *gin.Context) (string, bool) {
+	switch format := c.ContentType(); format {
+	case "", gin.MIMEJSON:
+		return "", true
+	case MergePatchContentType, JSONPatchContentType:
+		return format, true
+	}
+	c.Header("Accept-Patch", strings.Join([]string{gin.MIMEJSON, MergePatchContentType, JSONPatchContentType}, ", "))
+	middleware.Fail(c, 415, errUnsupportedFormat)
+	return "", false
+}
+
+// patchUser applies the patch in the request body to the representation of
+// user id. Only the writable fields may change; password is writable without
+// being part of the representation.
+func (h *apiHandler) patchUser(c *gin.Context, format string, id uint, writable ...string) {
+	audit.SetTarget(c, "user", id)
+	before, err := h.container.Admin.GetUser(id)
+	if err != nil {
+		middleware.Fail(c, 400, err)
+		return
+	}
+	version, ok := h.ifMatch(c, before)
+	if !ok {
+		return
+	}
+	update, mask, err := userPatch(format, c.Request.Body, newUserResponse(c, before), writable)
+	if err != nil {
+		middleware.Fail(c, 400, err)
+		return
+	}
+	update.Version = version
+	h.saveUser(c, before, update, mask)
+}
+
+// userPatch turns a patch of current into an update of the fields it
+// changes.
+func userPatch(format string, body io.Reader, current UserResponse, writable []string) (user.UserUpdate, []string, error) {
+	var update user.UserUpdate
+	doc := map[string]interface{}{}
+	encoded, _ := json.Marshal(current)
+	json.Unmarshal(encoded, &doc)
+
+	patched, err := applyPatch(format, body, doc)
+	if err != nil {
+		return update, nil, err
+	}
+
+	keys := make([]string, 0, len(doc)+len(patched))
+	for key := range doc {
+		keys = append(keys, key)
+	}
+	for key := range patched {
+		if _, ok := doc[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	var mask []string
+	for _, key := range keys {
+		before, had := doc[key]
+		after, has := patched[key]
+		if had == has && reflect.DeepEqual(before, after) {
+			continue
+		}
+		if !contains(writable, key) {
+			return update, nil, &apperr.Error{Kind: apperr.Invalid, Code: "read_only_field", Message: fmt.Sprintf("%s can't be changed", key)}
+		}
+		// A removed field is cleared.
+		var value string
+		if has && after != nil {
+			s, ok := after.(string)
+			if !ok {
+				return update, nil, &apperr.Error{Kind: apperr.Invalid, Code: "invalid_value", Message: fmt.Sprintf("%s must be a string", key)}
+			}
+			value = s
+		}
+		switch key {
+		case user.FieldUsername:
+			update.Username = value
+		case user.FieldPassword:
+			update.Password = value
+		case user.FieldName:
+			update.Name = value
+		}
+		mask = append(mask, key)
+	}
+	return update, mask, nil
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// applyPatch returns a copy of doc with the merge patch (RFC 7396) or JSON
+// patch (RFC 6902) in body applied. format is one of the two patch formats
+// accepted by patchFormat.
+func applyPatch(format string, body io.Reader, doc map[string]interface{}) (map[string]interface{}, error) {
+	if format == MergePatchContentType {
+		var patch map[string]interface{}
+		if err := json.NewDecoder(body).Decode(&patch); err != nil {
+			return nil, invalidRequest(err)
+		}
+		return mergePatch(doc, patch), nil
+	}
+	var ops []patchOperation
+	if err := json.NewDecoder(body).Decode(&ops); err != nil {
+		return nil, invalidRequest(err)
+	}
+	return jsonPatch(doc, ops)
+}
+
+func mergePatch(target, patch map[string]interface{}) map[string]interface{} {
+	out := make(map[string]interface{}, len(target))
+	for key, value := range target {
+		out[key] = value
+	}
+	for key, value := range patch {
+		if value == nil {
+			delete(out, key)
+			continue
+		}
+		if object, ok := value.(map[string]interface{}); ok {
+			existing, _ := out[key].(map[string]interface{})
+			out[key] = mergePatch(existing, object)
+			continue
+		}
+		out[key] = value
+	}
+	return out
+}
+
+type patchOperation struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path"`
+	From  string          `json:"from"`
+	Value json.RawMessage `json:"value"`
+}
+
+// member returns the member of a flat document that pointer refers to.
+// Resources here have no nested objects, so deeper pointers are refused.
+func member(pointer string) (string, error) {
+	if !strings.HasPrefix(pointer, "/") || strings.Contains(pointer[1:], "/") {
+		return "", invalidPatch("path %q doesn't name a field", pointer)
+	}
+	return strings.NewReplacer("~1", "/", "~0", "~").Replace(pointer[1:]), nil
+}
+
+func jsonPatch(doc map[string]interface{}, ops []patchOperation) (map[string]interface{}, error) {
+	out := make(map[string]interface{}, len(doc))
+	for key, value := range doc {
+		out[key] = value
+	}
+	for i, op := range ops {
+		key, err := member(op.Path)
+		if err != nil {
+			return nil, err
+		}
+		var value interface{}
+		switch op.Op {
+		case "add", "replace", "test":
+			if op.Value == nil {
+				return nil, invalidPatch("operation %d has no value", i)
+			}
+			// The value was already checked to be JSON when the patch was
+			// decoded.
+			json.Unmarshal(op.Value, &value)
+		case "move", "copy":
+			from, err := member(op.From)
+			if err != nil {
+				return nil, err
+			}
+			var ok bool
+			if value, ok = out[from]; !ok {
+				return nil, invalidPatch("operation %d moves or copies missing field %s", i, from)
+			}
+			if op.Op == "move" {
+				delete(out, from)
+			}
+		}
+		current, exists := out[key]
+		switch op.Op {
+		case "add", "move", "copy":
+			out[key] = value
+		case "replace", "remove":
+			if !exists {
+				return nil, invalidPatch("operation %d targets missing field %s", i, key)
+			}
+			if op.Op == "remove" {
+				delete(out, key)
+			} else {
+				out[key] = value
+			}
+		case "test":
+			if !exists || !reflect.DeepEqual(current, value) {
+				return nil, errPatchTestFailed
+			}
+		default:
+			return nil, invalidPatch("operation %d has unknown op %q", i, op.Op)
+		}
+	}
+	return out, nil
+}
@@ -0,0 +1,119 @@
+package handlers
+
+import (
+	"encoding/json"
+
+	"github.com/MicBun/go-100-coverage-docker-crud/audit"
+	"github.com/MicBun/go-100-coverage-docker-crud/user"
+	"github.com/MicBun/go-100-coverage-docker-crud/util/jwtAuth"
+	"github.com/MicBun/go-100-coverage-docker-crud/web/middleware"
+	"github.com/gin-gonic/gin"
+)
+
+type UpdateMeRequest struct {
+	Username string `json:"username"`
+	Name     string `json:"name"`
+}
+
+// UpdateMe godoc
+// @Summary Update Me
+// @Description Update the username or name of the logged in User. Any other field, such as password or roles, is rejected. Also takes a JSON merge patch or JSON patch, which can clear the name
+// @Tags User
+// @Accept  json
+// @Accept  application/merge-patch+json
+// @Accept  application/json-patch+json
+// @Produce  json
+// @Param user body UpdateMeRequest true "Profile"
+// @Param If-Match header string false "ETag of the User as read, required when IF_MATCH_REQUIRED is set"
+// @Param Authorization header string true "Authorization. How to input in swagger : 'Bearer <insert_your_token_here>'"
+// @Security BearerToken
+// @Success 200 {object} object{message=string,user=UserResponse}
+// @Header 200 {string} ETag "Version of the User"
+// @Failure 400 {object} map[string]interface{}
+// @Failure 401 {object} map[string]interface{}
+// @Failure 415 {object} map[string]interface{} "code unsupported_media_type, see Accept-Patch"
+// @Failure 412 {object} map[string]interface{} "code version_mismatch"
+// @Failure 428 {object} map[string]interface{} "code if_match_required"
+// @Router /user/me [patch]
+func (h *apiHandler) UpdateMe(c *gin.Context) {
+	format, ok := patchFormat(c)
+	if !ok {
+		return
+	}
+	if format != "" {
+		id, _ := jwtAuth.ExtractTokenID(c)
+		h.patchUser(c, format, id, user.FieldUsername, user.FieldName)
+		return
+	}
+	var req UpdateMeRequest
+	decoder := json.NewDecoder(c.Request.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&req); err != nil {
+		middleware.Fail(c, 400, invalidRequest(err))
+		return
+	}
+	id, _ := jwtAuth.ExtractTokenID(c)
+	update := user.UserUpdate{Username: req.Username, Name: req.Name}
+	h.updateUser(c, id, update, update.NonEmpty())
+}
+
+type ChangePasswordRequest struct {
+	CurrentPassword string `json:"current_password" binding:"required"`
+	NewPassword     string `json:"new_password" binding:"required"`
+}
+
+// ChangePassword godoc
+// @Summary Change Password
+// @Description Change the password of the logged in User. Every other session of the User is logged out
+// @Tags User
+// @Accept  json
+// @Produce  json
+// @Param password body ChangePasswordRequest true "Current and new password"
+// @Param Authorization header string true "Authorization. How to input in swagger : 'Bearer <insert_your_token_here>'"
+// @Security BearerToken
+// @Success 200 {object} map[string]interface{}
+// @Failure 400 {object} map[string]interface{}
+// @Failure 401 {object} map[string]interface{}
+// @Failure 423 {object} map[string]interface{} "code account_locked, see Retry-After"
+// @Failure 429 {object} map[string]interface{} "code too_many_attempts, see Retry-After"
+// @Failure 500 {object} map[string]interface{} "The password was changed but the other sessions could not be logged out"
+// @Router /user/me/password [post]
+func (h *apiHandler) ChangePassword(c *gin.Context) {
+	var req ChangePasswordRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		middleware.Fail(c, 400, invalidRequest(err))
+		return
+	}
+	id, _ := jwtAuth.ExtractTokenID(c)
+	audit.SetTarget(c, "user", id)
+	current, err := h.container.Admin.GetUser(id)
+	if err != nil {
+		middleware.Fail(c, 400, err)
+		return
+	}
+
+	// The current password is checked like a login, so a stolen access token
+	// can't be used to guess it.
+	ip := c.ClientIP()
+	if err := h.container.Lockout.Check(current.Username, ip); err != nil {
+		rejectLogin(c, err)
+		return
+	}
+	if _, err := h.container.Admin.AuthenticateUser(current.Username, req.CurrentPassword); err != nil {
+		h.container.Lockout.Fail(current.Username, ip)
+		middleware.Fail(c, 400, errIncorrectPassword)
+		return
+	}
+	h.container.Lockout.Succeed(current.Username, ip)
+
+	if _, err := h.container.Admin.UpdateUser(id, "", req.NewPassword, ""); err != nil {
+		middleware.Fail(c, 400, err)
+		return
+	}
+	sessionID, _ := jwtAuth.ExtractTokenSessionID(c)
+	if err := h.container.Sessions.RevokeOthers(id, sessionID); err != nil {
+		middleware.Fail(c, 500, err)
+		return
+	}
+	c.JSON(200, gin.H{"message": "Password changed"})
+}
@@ -0,0 +1,70 @@
+package handlers
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/MicBun/go-100-coverage-docker-crud/core"
+	"github.com/gin-gonic/gin"
+)
+
+// UserResponse is the public representation of a user. Fields are copied one
+// by one so that password hashes, tokens and any column added to core.User
+// later stay out of responses unless they are listed here.
+type UserResponse struct {
+	ID       uint   `json:"id"`
+	Username string `json:"username"`
+	Name     string `json:"name"`
+	Status   string `json:"status"`
+	// StatusReason and StatusChangedAt are only set once the status changed.
+	StatusReason    string `json:"status_reason,omitempty"`
+	StatusChangedAt string `json:"status_changed_at,omitempty"`
+	CreatedAt       string `json:"created_at"`
+	UpdatedAt       string `json:"updated_at"`
+	DeletedAt       string `json:"deleted_at,omitempty"`
+	Link            string `json:"link"`
+}
+
+func isoTime(t time.Time) string {
+	return t.UTC().Format(time.RFC3339)
+}
+
+// userLink is where the user is read. Requests to the legacy routes keep
+// getting the legacy link.
+func userLink(c *gin.Context, id uint) string {
+	if !strings.HasPrefix(c.Request.URL.Path, "/v1/") {
+		return "/user/get/" + strconv.Itoa(int(id))
+	}
+	return "/v1/users/" + strconv.Itoa(int(id))
+}
+
+func newUserResponse(c *gin.Context, user core.User) UserResponse {
+	var statusChangedAt, deletedAt string
+	if user.StatusChangedAt != nil {
+		statusChangedAt = isoTime(*user.StatusChangedAt)
+	}
+	if user.DeletedAt.Valid {
+		deletedAt = isoTime(user.DeletedAt.Time)
+	}
+	return UserResponse{
+		ID:              user.ID,
+		Username:        user.Username,
+		Name:            user.Name,
+		Status:          user.Status,
+		StatusReason:    user.StatusReason,
+		StatusChangedAt: statusChangedAt,
+		CreatedAt:       isoTime(user.CreatedAt),
+		UpdatedAt:       isoTime(user.UpdatedAt),
+		DeletedAt:       deletedAt,
+		Link:            userLink(c, user.ID),
+	}
+}
+
+func newUserListResponse(c *gin.Context, users []core.User) []UserResponse {
+	list := make([]UserResponse, 0, len(users))
+	for _, user := range users {
+		list = append(list, newUserResponse(c, user))
+	}
+	return list
+}
@@ -0,0 +1,212 @@
+package handlers
+
+import (
+	"strconv"
+
+	"github.com/MicBun/go-100-coverage-docker-crud/audit"
+	"github.com/MicBun/go-100-coverage-docker-crud/core"
+	"github.com/MicBun/go-100-coverage-docker-crud/web/middleware"
+	"github.com/gin-gonic/gin"
+)
+
+func roleResponse(role core.Role) map[string]interface{} {
+	permissions := make([]string, 0, len(role.Permissions))
+	for _, permission := range role.Permissions {
+		permissions = append(permissions, permission.Name)
+	}
+	return map[string]interface{}{
+		"name":        role.Name,
+		"permissions": permissions,
+	}
+}
+
+// ListRoles godoc
+// @Summary List Roles
+// @Description List Roles with their permissions
+// @Tags Role
+// @Accept  json
+// @Produce  json
+// @Param Authorization header string true "Authorization. How to input in swagger : 'Bearer <insert_your_token_here>'"
+// @Security BearerToken
+// @Success 200 {object} map[string]interface{}
+// @Failure 400 {object} map[string]interface{}
+// @Failure 401 {object} map[string]interface{}
+// @Router /role/list [get]
+func (h *apiHandler) ListRoles(c *gin.Context) {
+	roles, err := h.container.RBAC.ListRoles()
+	if err != nil {
+		middleware.Fail(c, 400, err)
+		return
+	}
+	var roleList []map[string]interface{}
+	for _, role := range roles {
+		roleList = append(roleList, roleResponse(role))
+	}
+	c.JSON(200, gin.H{"message": "Roles retrieved", "roles": roleList})
+}
+
+type RoleRequest struct {
+	Name        string   `json:"name" binding:"required"`
+	Permissions []string `json:"permissions"`
+}
+
+// CreateRole godoc
+// @Summary Create Role
+// @Description Create Role from existing permissions
+// @Tags Role
+// @Accept  json
+// @Produce  json
+// @Param role body RoleRequest true "Role"
+// @Param Authorization header string true "Authorization. How to input in swagger : 'Bearer <insert_your_token_here>'"
+// @Security BearerToken
+// @Success 200 {object} map[string]interface{}
+// @Failure 400 {object} map[string]interface{}
+// @Failure 401 {object} map[string]interface{}
+// @Router /role/create [post]
+func (h *apiHandler) CreateRole(c *gin.Context) {
+	var req RoleRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		middleware.Fail(c, 400, invalidRequest(err))
+		return
+	}
+	audit.SetTarget(c, "role", req.Name)
+	created, err := h.container.RBAC.CreateRole(req.Name, req.Permissions)
+	if err != nil {
+		middleware.Fail(c, 400, err)
+		return
+	}
+	audit.SetChange(c, nil, roleResponse(created))
+	c.JSON(200, gin.H{"message": "Role created"})
+}
+
+type UpdateRoleRequest struct {
+	Permissions []string `json:"permissions"`
+}
+
+// UpdateRole godoc
+// @Summary Update Role
+// @Description Replace the permissions of a Role. Permissions are checked on every request, so the change applies right away
+// @Tags Role
+// @Accept  json
+// @Produce  json
+// @Param name path string true "Role name"
+// @Param role body UpdateRoleRequest true "Permissions"
+// @Param Authorization header string true "Authorization. How to input in swagger : 'Bearer <insert_your_token_here>'"
+// @Security BearerToken
+// @Success 200 {object} map[string]interface{}
+// @Failure 400 {object} map[string]interface{}
+// @Failure 401 {object} map[string]interface{}
+// @Router /role/update/{name} [put]
+func (h *apiHandler) UpdateRole(c *gin.Context) {
+	var req UpdateRoleRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		middleware.Fail(c, 400, invalidRequest(err))
+		return
+	}
+	audit.SetTarget(c, "role", c.Param("name"))
+	before, _ := h.container.RBAC.GetRole(c.Param("name"))
+	updated, err := h.container.RBAC.UpdateRole(c.Param("name"), req.Permissions)
+	if err != nil {
+		middleware.Fail(c, 400, err)
+		return
+	}
+	audit.SetChange(c, roleResponse(before), roleResponse(updated))
+	c.JSON(200, gin.H{"message": "Role updated"})
+}
+
+// GetUserRoles godoc
+// @Summary Get User Roles
+// @Description Get the roles assigned to a User
+// @Tags Role
+// @Accept  json
+// @Produce  json
+// @Param id path int true "User ID"
+// @Param Authorization header string true "Authorization. How to input in swagger : 'Bearer <insert_your_token_here>'"
+// @Security BearerToken
+// @Success 200 {object} map[string]interface{}
+// @Failure 400 {object} map[string]interface{}
+// @Failure 401 {object} map[string]interface{}
+// @Router /admin/user/{id}/roles [get]
+func (h *apiHandler) GetUserRoles(c *gin.Context) {
+	id, _ := strconv.Atoi(c.Param("id"))
+	audit.SetTarget(c, "user", id)
+	roles, err := h.container.RBAC.UserRoles(uint(id))
+	if err != nil {
+		middleware.Fail(c, 400, err)
+		return
+	}
+	c.JSON(200, gin.H{"message": "Roles retrieved", "roles": roles})
+}
+
+type AssignRoleRequest struct {
+	Role string `json:"role" binding:"required"`
+}
+
+// AssignRole godoc
+// @Summary Assign Role
+// @Description Assign a Role to a User. Takes effect on the User's next token.
+// @Tags Role
+// @Accept  json
+// @Produce  json
+// @Param id path int true "User ID"
+// @Param role body AssignRoleRequest true "Role"
+// @Param Authorization header string true "Authorization. How to input in swagger : 'Bearer <insert_your_token_here>'"
+// @Security BearerToken
+// @Success 200 {object} map[string]interface{}
+// @Failure 400 {object} map[string]interface{}
+// @Failure 401 {object} map[string]interface{}
+// @Router /admin/user/{id}/roles [post]
+func (h *apiHandler) AssignRole(c *gin.Context) {
+	id, _ := strconv.Atoi(c.Param("id"))
+	var req AssignRoleRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		middleware.Fail(c, 400, invalidRequest(err))
+		return
+	}
+	audit.SetTarget(c, "user", id)
+	before, _ := h.container.RBAC.UserRoles(uint(id))
+	if err := h.container.RBAC.AssignRole(uint(id), req.Role); err != nil {
+		middleware.Fail(c, 400, err)
+		return
+	}
+	h.auditUserRoles(c, uint(id), before)
+	c.JSON(200, gin.H{"message": "Role assigned"})
+}
+
+// RevokeRole godoc
+// @Summary Revoke Role
+// @Description Revoke a Role from a User. Every session of the User is logged out, so tokens that still carry the Role stop working right away
+// @Tags Role
+// @Accept  json
+// @Produce  json
+// @Param id path int true "User ID"
+// @Param role path string true "Role name"
+// @Param Authorization header string true "Authorization. How to input in swagger : 'Bearer <insert_your_token_here>'"
+// @Security BearerToken
+// @Success 200 {object} map[string]interface{}
+// @Failure 400 {object} map[string]interface{}
+// @Failure 401 {object} map[string]interface{}
+// @Failure 500 {object} map[string]interface{} "The Role was revoked but the sessions could not be logged out"
+// @Router /admin/user/{id}/roles/{role} [delete]
+func (h *apiHandler) RevokeRole(c *gin.Context) {
+	id, _ := strconv.Atoi(c.Param("id"))
+	audit.SetTarget(c, "user", id)
+	before, _ := h.container.RBAC.UserRoles(uint(id))
+	if err := h.container.RBAC.RevokeRole(uint(id), c.Param("role")); err != nil {
+		middleware.Fail(c, 400, err)
+		return
+	}
+	h.auditUserRoles(c, uint(id), before)
+	// Access tokens carry the roles they were issued with.
+	if err := h.container.Sessions.RevokeAll(uint(id)); err != nil {
+		middleware.Fail(c, 500, err)
+		return
+	}
+	c.JSON(200, gin.H{"message": "Role revoked"})
+}
+
+// auditUserRoles records the roles of the user before and after a change.
+func (h *apiHandler) auditUserRoles(c *gin.Context, userID uint, before []string) {
+	after, _ := h.container.RBAC.UserRoles(userID)
+	audit.SetChange(c, gin.H{"roles": before}, gin.H{"roles": after})
+}
@@ -0,0 +1,148 @@
+package handlers
+
+import (
+	"strconv"
+
+	"github.com/MicBun/go-100-coverage-docker-crud/audit"
+	"github.com/MicBun/go-100-coverage-docker-crud/core"
+	"github.com/MicBun/go-100-coverage-docker-crud/util/jwtAuth"
+	"github.com/MicBun/go-100-coverage-docker-crud/web/middleware"
+	"github.com/gin-gonic/gin"
+)
+
+func sessionList(sessions []core.Session, currentID uint) []map[string]interface{} {
+	list := make([]map[string]interface{}, 0, len(sessions))
+	for _, session := range sessions {
+		list = append(list, map[string]interface{}{
+			"id":           session.ID,
+			"user_agent":   session.UserAgent,
+			"ip":           session.IP,
+			"created_at":   session.CreatedAt,
+			"last_seen_at": session.LastSeenAt,
+			"expires_at":   session.ExpiresAt,
+			"current":      session.ID == currentID,
+		})
+	}
+	return list
+}
+
+// ListSessions godoc
+// @Summary List Sessions
+// @Description List the active sessions of the logged in User
+// @Tags Session
+// @Accept  json
+// @Produce  json
+// @Param Authorization header string true "Authorization. How to input in swagger : 'Bearer <insert_your_token_here>'"
+// @Security BearerToken
+// @Success 200 {object} map[string]interface{}
+// @Failure 400 {object} map[string]interface{}
+// @Failure 401 {object} map[string]interface{}
+// @Router /user/sessions [get]
+func (h *apiHandler) ListSessions(c *gin.Context) {
+	userID, _ := jwtAuth.ExtractTokenID(c)
+	sessionID, _ := jwtAuth.ExtractTokenSessionID(c)
+	audit.SetTarget(c, "user", userID)
+	sessions, err := h.container.Sessions.List(userID)
+	if err != nil {
+		middleware.Fail(c, 400, err)
+		return
+	}
+	c.JSON(200, gin.H{"message": "Sessions retrieved", "sessions": sessionList(sessions, sessionID)})
+}
+
+// RevokeSession godoc
+// @Summary Revoke Session
+// @Description Log out one of the logged in User's sessions
+// @Tags Session
+// @Accept  json
+// @Produce  json
+// @Param id path int true "Session ID"
+// @Param Authorization header string true "Authorization. How to input in swagger : 'Bearer <insert_your_token_here>'"
+// @Security BearerToken
+// @Success 200 {object} map[string]interface{}
+// @Failure 400 {object} map[string]interface{}
+// @Failure 401 {object} map[string]interface{}
+// @Router /user/sessions/{id} [delete]
+func (h *apiHandler) RevokeSession(c *gin.Context) {
+	userID, _ := jwtAuth.ExtractTokenID(c)
+	id, _ := strconv.Atoi(c.Param("id"))
+	audit.SetTarget(c, "session", id)
+	if err := h.container.Sessions.Revoke(userID, uint(id)); err != nil {
+		middleware.Fail(c, 400, err)
+		return
+	}
+	c.JSON(200, gin.H{"message": "Session revoked"})
+}
+
+// ListUserSessions godoc
+// @Summary List User Sessions
+// @Description List the active sessions of any User
+// @Tags Session
+// @Accept  json
+// @Produce  json
+// @Param id path int true "User ID"
+// @Param Authorization header string true "Authorization. How to input in swagger : 'Bearer <insert_your_token_here>'"
+// @Security BearerToken
+// @Success 200 {object} map[string]interface{}
+// @Failure 400 {object} map[string]interface{}
+// @Failure 401 {object} map[string]interface{}
+// @Router /admin/user/{id}/sessions [get]
+func (h *apiHandler) ListUserSessions(c *gin.Context) {
+	id, _ := strconv.Atoi(c.Param("id"))
+	sessionID, _ := jwtAuth.ExtractTokenSessionID(c)
+	audit.SetTarget(c, "user", id)
+	sessions, err := h.container.Sessions.List(uint(id))
+	if err != nil {
+		middleware.Fail(c, 400, err)
+		return
+	}
+	c.JSON(200, gin.H{"message": "Sessions retrieved", "sessions": sessionList(sessions, sessionID)})
+}
+
+// RevokeUserSessions godoc
+// @Summary Revoke User Sessions
+// @Description Log out every session of any User
+// @Tags Session
+// @Accept  json
+// @Produce  json
+// @Param id path int true "User ID"
+// @Param Authorization header string true "Authorization. How to input in swagger : 'Bearer <insert_your_token_here>'"
+// @Security BearerToken
+// @Success 200 {object} map[string]interface{}
+// @Failure 400 {object} map[string]interface{}
+// @Failure 401 {object} map[string]interface{}
+// @Router /admin/user/{id}/sessions [delete]
+func (h *apiHandler) RevokeUserSessions(c *gin.Context) {
+	id, _ := strconv.Atoi(c.Param("id"))
+	audit.SetTarget(c, "user", id)
+	if err := h.container.Sessions.RevokeAll(uint(id)); err != nil {
+		middleware.Fail(c, 400, err)
+		return
+	}
+	c.JSON(200, gin.H{"message": "Sessions revoked"})
+}
+
+// RevokeUserSession godoc
+// @Summary Revoke User Session
+// @Description Log out one session of any User
+// @Tags Session
+// @Accept  json
+// @Produce  json
+// @Param id path int true "User ID"
+// @Param sid path int true "Session ID"
+// @Param Authorization header string true "Authorization. How to input in swagger : 'Bearer <insert_your_token_here>'"
+// @Security BearerToken
+// @Success 200 {object} map[string]interface{}
+// @Failure 400 {object} map[string]interface{}
+// @Failure 401 {object} map[string]interface{}
+// @Router /admin/user/{id}/sessions/{sid} [delete]
+func (h *apiHandler) RevokeUserSession(c *gin.Context) {
+	id, _ := strconv.Atoi(c.Param("id"))
+	sid, _ := strconv.Atoi(c.Param("sid"))
+	audit.SetTarget(c, "session", sid)
+	if err := h.container.Sessions.Revoke(uint(id), uint(sid)); err != nil {
+		middleware.Fail(c, 400, err)
+		return
+	}
+	c.JSON(200, gin.H{"message": "Session revoked"})
+}
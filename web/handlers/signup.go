@@ -0,0 +1,114 @@
+package handlers
+
+import (
+	"errors"
+
+	"github.com/MicBun/go-100-coverage-docker-crud/audit"
+	"github.com/MicBun/go-100-coverage-docker-crud/core"
+	"github.com/MicBun/go-100-coverage-docker-crud/user"
+	"github.com/MicBun/go-100-coverage-docker-crud/web/middleware"
+	"github.com/gin-gonic/gin"
+)
+
+type SignupRequest struct {
+	Username string `json:"username" binding:"required,email"`
+	Password string `json:"password" binding:"required"`
+	Name     string `json:"name" binding:"required"`
+}
+
+// Signup godoc
+// @Summary Sign Up
+// @Description Create an account without an admin. Only available when SIGNUP_ENABLED=true. The account can log in once the verification token sent to the username is confirmed at /signup/verify
+// @Tags Signup
+// @Accept  json
+// @Produce  json
+// @Param user body SignupRequest true "User"
+// @Success 200 {object} object{message=string,user=UserResponse}
+// @Failure 400 {object} map[string]interface{}
+// @Failure 500 {object} map[string]interface{} "code notification_failed, no account is created"
+// @Router /signup [post]
+func (h *apiHandler) Signup(c *gin.Context) {
+	var req SignupRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		middleware.Fail(c, 400, invalidRequest(err))
+		return
+	}
+	created, err := h.container.Signup.Register(req.Username, req.Password, req.Name)
+	if err != nil {
+		audit.SetChange(c, nil, gin.H{"username": req.Username})
+		if errors.Is(err, user.ErrVerificationNotSent) {
+			middleware.Fail(c, 500, notificationFailed("unable to send the verification token", err))
+			return
+		}
+		middleware.Fail(c, 400, err)
+		return
+	}
+	audit.SetActor(c, created.ID)
+	audit.SetTarget(c, "user", created.ID)
+	audit.SetChange(c, nil, newUserResponse(c, created))
+	c.JSON(200, gin.H{"message": "User registered, check your email to verify the account", "user": newUserResponse(c, created)})
+}
+
+type VerifySignupRequest struct {
+	Token string `json:"token" binding:"required"`
+}
+
+// VerifySignup godoc
+// @Summary Verify Sign Up
+// @Description Activate an account with the verification token sent at signup
+// @Tags Signup
+// @Accept  json
+// @Produce  json
+// @Param token body VerifySignupRequest true "Verification token"
+// @Success 200 {object} object{message=string,user=UserResponse}
+// @Failure 400 {object} map[string]interface{}
+// @Router /signup/verify [post]
+func (h *apiHandler) VerifySignup(c *gin.Context) {
+	var req VerifySignupRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		middleware.Fail(c, 400, invalidRequest(err))
+		return
+	}
+	verified, err := h.container.Signup.Verify(req.Token)
+	if errors.Is(err, user.ErrInvalidVerificationToken) {
+		middleware.Fail(c, 400, err)
+		return
+	}
+	if err != nil {
+		middleware.Fail(c, 500, err)
+		return
+	}
+	audit.SetActor(c, verified.ID)
+	audit.SetTarget(c, "user", verified.ID)
+	audit.SetChange(c, gin.H{"status": core.StatusPendingVerification}, gin.H{"status": verified.Status})
+	c.JSON(200, gin.H{"message": "Email verified", "user": newUserResponse(c, verified)})
+}
+
+type ResendVerificationRequest struct {
+	Username string `json:"username" binding:"required"`
+}
+
+// ResendVerification godoc
+// @Summary Resend Verification
+// @Description Send a new verification token to an account that hasn't been verified. The response is the same whether or not such an account exists
+// @Tags Signup
+// @Accept  json
+// @Produce  json
+// @Param user body ResendVerificationRequest true "Username"
+// @Success 200 {object} map[string]interface{}
+// @Failure 400 {object} map[string]interface{}
+// @Failure 500 {object} map[string]interface{}
+// @Router /signup/resend [post]
+func (h *apiHandler) ResendVerification(c *gin.Context) {
+	var req ResendVerificationRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		middleware.Fail(c, 400, invalidRequest(err))
+		return
+	}
+	audit.SetChange(c, nil, gin.H{"username": req.Username})
+	if err := h.container.Signup.Resend(req.Username); err != nil {
+		middleware.Fail(c, 500, notificationFailed("unable to send the verification token", err))
+		return
+	}
+	c.JSON(200, gin.H{"message": "If the account is awaiting verification, a new token has been sent"})
+}
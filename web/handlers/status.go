@@ -0,0 +1,132 @@
+package handlers
+
+import (
+	"strconv"
+
+	"github.com/MicBun/go-100-coverage-docker-crud/apperr"
+	"github.com/MicBun/go-100-coverage-docker-crud/audit"
+	"github.com/MicBun/go-100-coverage-docker-crud/core"
+	"github.com/MicBun/go-100-coverage-docker-crud/util/jwtAuth"
+	"github.com/MicBun/go-100-coverage-docker-crud/web/middleware"
+	"github.com/gin-gonic/gin"
+)
+
+// rejectInactive answers logins of accounts that aren't active with 403 and
+// a code naming the status. The password was right, so the attempt doesn't
+// count towards the lockout.
+func rejectInactive(c *gin.Context, err error) bool {
+	if apperr.KindOf(err) != apperr.Forbidden {
+		return false
+	}
+	middleware.Fail(c, 403, err)
+	return true
+}
+
+type StatusChangeRequest struct {
+	Reason string `json:"reason" binding:"required"`
+}
+
+// changeStatus applies a status transition to the user in the id parameter.
+// Every transition away from active logs out the user's sessions.
+func (h *apiHandler) changeStatus(c *gin.Context, transition func(id uint, reason string) (core.User, error)) {
+	id, _ := strconv.Atoi(c.Param("id"))
+	audit.SetTarget(c, "user", id)
+	var req StatusChangeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		middleware.Fail(c, 400, invalidRequest(err))
+		return
+	}
+	if self, _ := jwtAuth.ExtractTokenID(c); self == uint(id) {
+		middleware.Fail(c, 400, errOwnStatus)
+		return
+	}
+	before, _ := h.container.Admin.GetUser(uint(id))
+	changed, err := transition(uint(id), req.Reason)
+	if err != nil {
+		middleware.Fail(c, 400, err)
+		return
+	}
+	audit.SetChange(c, newUserResponse(c, before), newUserResponse(c, changed))
+	if changed.Status != core.StatusActive {
+		if err := h.container.Sessions.RevokeAll(changed.ID); err != nil {
+			middleware.Fail(c, 500, err)
+			return
+		}
+	}
+	c.JSON(200, gin.H{"message": "User status changed", "user": newUserResponse(c, changed)})
+}
+
+// SuspendUser godoc
+// @Summary Suspend User
+// @Description Suspend an active or locked User. The User can't log in and existing tokens stop working right away
+// @Tags User Status
+// @Accept  json
+// @Produce  json
+// @Param id path int true "User ID"
+// @Param status body StatusChangeRequest true "Reason"
+// @Param Authorization header string true "Authorization. How to input in swagger : 'Bearer <insert_your_token_here>'"
+// @Security BearerToken
+// @Success 200 {object} object{message=string,user=UserResponse}
+// @Failure 400 {object} map[string]interface{} "code invalid_transition when the current status doesn't allow it"
+// @Failure 401 {object} map[string]interface{}
+// @Failure 500 {object} map[string]interface{} "The status was changed but the sessions could not be logged out"
+// @Router /admin/user/{id}/suspend [post]
+func (h *apiHandler) SuspendUser(c *gin.Context) {
+	h.changeStatus(c, h.container.Admin.Suspend)
+}
+
+// LockUser godoc
+// @Summary Lock User
+// @Description Lock an active User, for example while an incident is investigated. The User can't log in and existing tokens stop working right away
+// @Tags User Status
+// @Accept  json
+// @Produce  json
+// @Param id path int true "User ID"
+// @Param status body StatusChangeRequest true "Reason"
+// @Param Authorization header string true "Authorization. How to input in swagger : 'Bearer <insert_your_token_here>'"
+// @Security BearerToken
+// @Success 200 {object} object{message=string,user=UserResponse}
+// @Failure 400 {object} map[string]interface{} "code invalid_transition when the current status doesn't allow it"
+// @Failure 401 {object} map[string]interface{}
+// @Failure 500 {object} map[string]interface{} "The status was changed but the sessions could not be logged out"
+// @Router /admin/user/{id}/lock [post]
+func (h *apiHandler) LockUser(c *gin.Context) {
+	h.changeStatus(c, h.container.Admin.Lock)
+}
+
+// ReactivateUser godoc
+// @Summary Reactivate User
+// @Description Make a suspended, locked, deactivated or unverified User active again
+// @Tags User Status
+// @Accept  json
+// @Produce  json
+// @Param id path int true "User ID"
+// @Param status body StatusChangeRequest true "Reason"
+// @Param Authorization header string true "Authorization. How to input in swagger : 'Bearer <insert_your_token_here>'"
+// @Security BearerToken
+// @Success 200 {object} object{message=string,user=UserResponse}
+// @Failure 400 {object} map[string]interface{} "code invalid_transition when the current status doesn't allow it"
+// @Failure 401 {object} map[string]interface{}
+// @Router /admin/user/{id}/reactivate [post]
+func (h *apiHandler) ReactivateUser(c *gin.Context) {
+	h.changeStatus(c, h.container.Admin.Reactivate)
+}
+
+// DeactivateUser godoc
+// @Summary Deactivate User
+// @Description Deactivate a User without deleting it. The User can't log in and existing tokens stop working right away
+// @Tags User Status
+// @Accept  json
+// @Produce  json
+// @Param id path int true "User ID"
+// @Param status body StatusChangeRequest true "Reason"
+// @Param Authorization header string true "Authorization. How to input in swagger : 'Bearer <insert_your_token_here>'"
+// @Security BearerToken
+// @Success 200 {object} object{message=string,user=UserResponse}
+// @Failure 400 {object} map[string]interface{} "code invalid_transition when the current status doesn't allow it"
+// @Failure 401 {object} map[string]interface{}
+// @Failure 500 {object} map[string]interface{} "The status was changed but the sessions could not be logged out"
+// @Router /admin/user/{id}/deactivate [post]
+func (h *apiHandler) DeactivateUser(c *gin.Context) {
+	h.changeStatus(c, h.container.Admin.Deactivate)
+}
@@ -0,0 +1,110 @@
+package handlers
+
+import (
+	"strconv"
+
+	"github.com/MicBun/go-100-coverage-docker-crud/user"
+	"github.com/MicBun/go-100-coverage-docker-crud/web/middleware"
+	"github.com/gin-gonic/gin"
+)
+
+// CreateUser godoc
+// @Summary Create User
+// @Description Create a User. The Location header links to the new User
+// @Tags User
+// @Accept  json
+// @Produce  json
+// @Param user body RegisterUserRequest true "User"
+// @Param Authorization header string true "Authorization. How to input in swagger : 'Bearer <insert_your_token_here>'"
+// @Security BearerToken
+// @Success 201 {object} object{message=string,user=UserResponse}
+// @Header 201 {string} ETag "Version of the User"
+// @Failure 400 {object} map[string]interface{}
+// @Failure 401 {object} map[string]interface{}
+// @Router /v1/users [post]
+func (h *apiHandler) CreateUser(c *gin.Context) {
+	created, ok := h.registerUser(c)
+	if !ok {
+		return
+	}
+	c.Header("Location", userLink(c, created.ID))
+	c.Header("ETag", userETag(created))
+	c.JSON(201, gin.H{"message": "User created", "user": newUserResponse(c, created)})
+}
+
+// ReplaceUserRequest is the whole user. Name must be given but may be empty.
+// The password is never read back, so leaving it out keeps the current one.
+type ReplaceUserRequest struct {
+	Username string  `json:"username" binding:"required"`
+	Password string  `json:"password"`
+	Name     *string `json:"name" binding:"required"`
+}
+
+// ReplaceUser godoc
+// @Summary Replace User
+// @Description Replace a User with the one given. Username and name are required, an empty name clears it. The password is only changed when given, which logs the User out everywhere
+// @Tags User
+// @Accept  json
+// @Produce  json
+// @Param id path int true "User ID"
+// @Param user body ReplaceUserRequest true "User"
+// @Param If-Match header string false "ETag of the User as read, required when IF_MATCH_REQUIRED is set"
+// @Param Authorization header string true "Authorization. How to input in swagger : 'Bearer <insert_your_token_here>'"
+// @Security BearerToken
+// @Success 200 {object} object{message=string,user=UserResponse}
+// @Header 200 {string} ETag "Version of the User"
+// @Failure 400 {object} map[string]interface{}
+// @Failure 401 {object} map[string]interface{}
+// @Failure 412 {object} map[string]interface{} "code version_mismatch"
+// @Failure 428 {object} map[string]interface{} "code if_match_required"
+// @Failure 500 {object} map[string]interface{} "The password was changed but the sessions could not be logged out"
+// @Router /v1/users/{id} [put]
+func (h *apiHandler) ReplaceUser(c *gin.Context) {
+	var req ReplaceUserRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		middleware.Fail(c, 400, invalidRequest(err))
+		return
+	}
+	id, _ := strconv.Atoi(c.Param("id"))
+	update := user.UserUpdate{Username: req.Username, Password: req.Password, Name: *req.Name}
+	mask := []string{user.FieldUsername, user.FieldName}
+	if req.Password != "" {
+		mask = append(mask, user.FieldPassword)
+	}
+	h.updateUser(c, uint(id), update, mask)
+}
+
+// PatchUser godoc
+// @Summary Patch User
+// @Description Change a User with a JSON merge patch (RFC 7396) or JSON patch (RFC 6902) of its representation. Username, name and password can be changed and name cleared; plain JSON changes only the non-empty fields given
+// @Tags User
+// @Accept  json
+// @Accept  application/merge-patch+json
+// @Accept  application/json-patch+json
+// @Produce  json
+// @Param id path int true "User ID"
+// @Param user body object true "Patch"
+// @Param If-Match header string false "ETag of the User as read, required when IF_MATCH_REQUIRED is set"
+// @Param Authorization header string true "Authorization. How to input in swagger : 'Bearer <insert_your_token_here>'"
+// @Security BearerToken
+// @Success 200 {object} object{message=string,user=UserResponse}
+// @Header 200 {string} ETag "Version of the User"
+// @Failure 400 {object} map[string]interface{}
+// @Failure 401 {object} map[string]interface{}
+// @Failure 415 {object} map[string]interface{} "code unsupported_media_type, see Accept-Patch"
+// @Failure 412 {object} map[string]interface{} "code version_mismatch"
+// @Failure 428 {object} map[string]interface{} "code if_match_required"
+// @Failure 500 {object} map[string]interface{} "The password was changed but the sessions could not be logged out"
+// @Router /v1/users/{id} [patch]
+func (h *apiHandler) PatchUser(c *gin.Context) {
+	format, ok := patchFormat(c)
+	if !ok {
+		return
+	}
+	if format == "" {
+		h.UpdateUser(c)
+		return
+	}
+	id, _ := strconv.Atoi(c.Param("id"))
+	h.patchUser(c, format, uint(id), user.FieldUsername, user.FieldPassword, user.FieldName)
+}
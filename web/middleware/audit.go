@@ -0,0 +1,37 @@
+package middleware
+
+import (
+	"log"
+
+	"github.com/MicBun/go-100-coverage-docker-crud/audit"
+	"github.com/MicBun/go-100-coverage-docker-crud/util/jwtAuth"
+	"github.com/gin-gonic/gin"
+)
+
+// Audit records the request as action once the rest of the chain has run,
+// with whatever target and changes the handler attached. Place it before the
+// permission check so refused attempts are recorded too. A failure to record
+// is logged but doesn't fail the request, which has already been answered.
+func Audit(events audit.LogInterface, action string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Next()
+
+		event := audit.FromContext(c)
+		event.Action = action
+		if event.ActorID == nil {
+			if id, err := jwtAuth.ExtractTokenID(c); err == nil {
+				event.ActorID = &id
+			}
+		}
+		event.Status = c.Writer.Status()
+		if status, _, failed := failure(c); failed {
+			event.Status = status
+		}
+		event.IP = c.ClientIP()
+		event.UserAgent = c.Request.UserAgent()
+		event.RequestID = c.GetString(requestIDKey)
+		if err := events.Record(event); err != nil {
+			log.Printf("unable to record audit event %s: %v", action, err)
+		}
+	}
+}
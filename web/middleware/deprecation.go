@@ -0,0 +1,33 @@
+package middleware
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Deprecated marks a route as deprecated since deprecation and due to be
+// removed at sunset, with the Deprecation (RFC 9745) and Sunset (RFC 8594)
+// headers. successor is the route replacing it, linked as the successor
+// version; its :name segments are filled from the request's path parameters.
+func Deprecated(deprecation, sunset time.Time, successor string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Header("Deprecation", "@"+strconv.FormatInt(deprecation.Unix(), 10))
+		c.Header("Sunset", sunset.UTC().Format(http.TimeFormat))
+		c.Header("Link", "<"+fillParams(c, successor)+`>; rel="successor-version"`)
+		c.Next()
+	}
+}
+
+func fillParams(c *gin.Context, path string) string {
+	segments := strings.Split(path, "/")
+	for i, segment := range segments {
+		if strings.HasPrefix(segment, ":") {
+			segments[i] = c.Param(segment[1:])
+		}
+	}
+	return strings.Join(segments, "/")
+}
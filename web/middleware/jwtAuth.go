@@ -1,15 +1,62 @@
 package middleware
 
 import (
+	"github.com/MicBun/go-100-coverage-docker-crud/apperr"
+	"github.com/MicBun/go-100-coverage-docker-crud/service"
+	"github.com/MicBun/go-100-coverage-docker-crud/user"
 	"github.com/MicBun/go-100-coverage-docker-crud/util/jwtAuth"
 	"github.com/gin-gonic/gin"
 )
 
-func JwtAuthMiddleware() gin.HandlerFunc {
+var errUnauthorized = apperr.New(apperr.Unauthorized, "unauthorized", "missing, invalid or revoked access token")
+
+// JwtAuthMiddleware lets requests with a valid, unrevoked access token of an
+// active user through. The token is parsed once and its claims kept on the
+// request for the extractors in jwtAuth.
+func JwtAuthMiddleware(container *service.Container) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		err := jwtAuth.TokenValid(c)
 		if err != nil {
-			c.AbortWithStatusJSON(401, gin.H{"error": "Unauthorized"})
+			Fail(c, 401, errUnauthorized)
+			return
+		}
+		jti, _, err := jwtAuth.ExtractTokenJTI(c)
+		if err != nil {
+			Fail(c, 401, errUnauthorized)
+			return
+		}
+		if jti != "" {
+			revoked, err := container.Revocations.IsRevoked(jti)
+			if err != nil || revoked {
+				Fail(c, 401, errUnauthorized)
+				return
+			}
+		}
+		sessionID, err := jwtAuth.ExtractTokenSessionID(c)
+		if err != nil {
+			Fail(c, 401, errUnauthorized)
+			return
+		}
+		userID, err := jwtAuth.ExtractTokenID(c)
+		if err != nil {
+			Fail(c, 401, errUnauthorized)
+			return
+		}
+		// The status is read on every request, so suspending a user cuts off
+		// tokens that were issued before. Sessions read it along with the
+		// session itself.
+		if sessionID != 0 {
+			status, err := container.Sessions.Validate(sessionID)
+			if err != nil {
+				Fail(c, 401, errUnauthorized)
+				return
+			}
+			err = user.StatusError(status)
+		} else {
+			err = container.Admin.CheckActive(userID)
+		}
+		if err != nil {
+			Fail(c, 401, err)
 			return
 		}
 		c.Next()
@@ -0,0 +1,26 @@
+package middleware
+
+import (
+	"net/http"
+
+	"github.com/MicBun/go-100-coverage-docker-crud/apperr"
+	"github.com/MicBun/go-100-coverage-docker-crud/role"
+	"github.com/MicBun/go-100-coverage-docker-crud/util/jwtAuth"
+	"github.com/gin-gonic/gin"
+)
+
+var errPermissionDenied = apperr.New(apperr.Forbidden, "permission_denied", "You are not authorized to perform this action")
+
+// RequirePermission only lets the request through when one of the roles in
+// the bearer token grants permission. It must run after JwtAuthMiddleware.
+func RequirePermission(rbac role.RBACInterface, permission string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		roles, _ := jwtAuth.ExtractTokenRoles(c)
+		ok, err := rbac.HasPermission(roles, permission)
+		if err != nil || !ok {
+			Fail(c, http.StatusUnauthorized, errPermissionDenied)
+			return
+		}
+		c.Next()
+	}
+}
@@ -0,0 +1,115 @@
+package middleware
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/MicBun/go-100-coverage-docker-crud/apperr"
+	"github.com/gin-gonic/gin"
+)
+
+const ProblemContentType = "application/problem+json"
+
+// StatusModeHeader lets a client opt in to strict statuses while the server
+// still answers others with the legacy ones.
+const StatusModeHeader = "X-Status-Mode"
+
+const (
+	StatusModeLegacy = "legacy"
+	StatusModeStrict = "strict"
+)
+
+const strictStatusKey = "strictStatus"
+
+// kindStatus is the status of each apperr.Kind in strict mode.
+var kindStatus = map[apperr.Kind]int{
+	apperr.Internal:             http.StatusInternalServerError,
+	apperr.Invalid:              http.StatusUnprocessableEntity,
+	apperr.Unauthorized:         http.StatusUnauthorized,
+	apperr.Forbidden:            http.StatusForbidden,
+	apperr.NotFound:             http.StatusNotFound,
+	apperr.Conflict:             http.StatusConflict,
+	apperr.Locked:               http.StatusLocked,
+	apperr.TooManyRequests:      http.StatusTooManyRequests,
+	apperr.UnsupportedMediaType: http.StatusUnsupportedMediaType,
+	apperr.PreconditionFailed:   http.StatusPreconditionFailed,
+	apperr.PreconditionRequired: http.StatusPreconditionRequired,
+}
+
+// Problem is an RFC 7807 problem details body. Code is stable for clients to
+// branch on. Message repeats Detail for clients written against the older
+// {"message": ...} bodies.
+type Problem struct {
+	Type      string `json:"type"`
+	Title     string `json:"title"`
+	Status    int    `json:"status"`
+	Detail    string `json:"detail"`
+	Instance  string `json:"instance"`
+	Code      string `json:"code"`
+	Message   string `json:"message"`
+	RequestID string `json:"request_id,omitempty"`
+}
+
+// Fail aborts the request with err, which Problems renders once the chain
+// returns. status is the status the route answers with for this failure.
+func Fail(c *gin.Context, status int, err error) {
+	c.Error(err).SetMeta(status)
+	c.Abort()
+}
+
+// failure returns the status and error the request failed with, unless a
+// response has already been written. In strict mode the status comes from the
+// kind of the error rather than the route.
+func failure(c *gin.Context) (int, error, bool) {
+	if c.Writer.Written() || len(c.Errors) == 0 {
+		return 0, nil, false
+	}
+	last := c.Errors.Last()
+	if c.GetBool(strictStatusKey) {
+		return kindStatus[apperr.KindOf(last.Err)], last.Err, true
+	}
+	status, ok := last.Meta.(int)
+	if !ok {
+		status = http.StatusInternalServerError
+	}
+	return status, last.Err, true
+}
+
+// Problems renders the error passed to Fail as a problem details body. Errors
+// that aren't an *apperr.Error are logged and shown only as internal errors,
+// so database and driver messages never reach clients.
+//
+// Failures keep the legacy status of their route, mostly 400 and 401, unless
+// strict is set or the request carries the strict StatusModeHeader; then a
+// missing record is 404, a duplicate 409, a refusal 403 and a validation
+// error 422.
+func Problems(strict bool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if strict || c.GetHeader(StatusModeHeader) == StatusModeStrict {
+			c.Set(strictStatusKey, true)
+		}
+		c.Next()
+		status, err, ok := failure(c)
+		if !ok {
+			return
+		}
+		problem := Problem{
+			Type:      "about:blank",
+			Title:     http.StatusText(status),
+			Status:    status,
+			Instance:  c.Request.URL.Path,
+			RequestID: c.GetString(requestIDKey),
+		}
+		if e, ok := apperr.As(err); ok {
+			problem.Code = e.Code
+			problem.Detail = err.Error()
+		} else {
+			log.Printf("%s %s failed: %v", c.Request.Method, c.Request.URL.Path, err)
+			problem.Code = apperr.InternalCode
+			problem.Detail = "internal error"
+		}
+		problem.Message = problem.Detail
+		c.Header("Content-Type", ProblemContentType)
+		c.JSON(status, problem)
+	}
+}
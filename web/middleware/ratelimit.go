@@ -0,0 +1,77 @@
+package middleware
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/MicBun/go-100-coverage-docker-crud/apperr"
+	"github.com/MicBun/go-100-coverage-docker-crud/ratelimit"
+	"github.com/MicBun/go-100-coverage-docker-crud/util/jwtAuth"
+	"github.com/gin-gonic/gin"
+)
+
+var errRateLimited = apperr.New(apperr.TooManyRequests, "rate_limited", "Rate limit exceeded")
+
+// KeyFunc names the client a request is counted against.
+type KeyFunc func(c *gin.Context) string
+
+func ByIP(c *gin.Context) string {
+	return "ip:" + c.ClientIP()
+}
+
+// ByUser counts requests with a valid bearer token against the user and
+// everything else against the client IP.
+func ByUser(c *gin.Context) string {
+	id, err := jwtAuth.ExtractTokenID(c)
+	if err != nil || id == 0 {
+		return ByIP(c)
+	}
+	return "user:" + strconv.Itoa(int(id))
+}
+
+// ByAPIKey counts requests carrying one of keys in the X-API-Key header
+// against that key. Any other key is ignored, so requests can't escape their
+// limit by making keys up, and counted by ByUser.
+func ByAPIKey(keys ratelimit.APIKeys) KeyFunc {
+	return func(c *gin.Context) string {
+		digest, ok := keys.Lookup(c.GetHeader("X-API-Key"))
+		if !ok {
+			return ByUser(c)
+		}
+		return "key:" + digest
+	}
+}
+
+func ceilSeconds(d time.Duration) string {
+	return strconv.Itoa(int(math.Ceil(d.Seconds())))
+}
+
+// RateLimit takes a token from the client's bucket in group and rejects the
+// request with 429 once it is empty. Responses carry the RateLimit-* headers
+// of the IETF draft, and Retry-After when rejected. If the store fails the
+// request is let through.
+func RateLimit(store ratelimit.Store, group string, limit ratelimit.Limit, key KeyFunc) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !limit.Enabled() {
+			c.Next()
+			return
+		}
+		result, err := store.Take(group+":"+key(c), limit)
+		if err != nil {
+			c.Next()
+			return
+		}
+		c.Header("RateLimit-Policy", strconv.Itoa(limit.Requests)+";w="+ceilSeconds(limit.Per))
+		c.Header("RateLimit-Limit", strconv.Itoa(result.Limit))
+		c.Header("RateLimit-Remaining", strconv.Itoa(result.Remaining))
+		c.Header("RateLimit-Reset", ceilSeconds(result.Reset))
+		if !result.Allowed {
+			c.Header("Retry-After", ceilSeconds(result.RetryAfter))
+			Fail(c, http.StatusTooManyRequests, errRateLimited)
+			return
+		}
+		c.Next()
+	}
+}
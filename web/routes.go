@@ -1,28 +1,119 @@
 package web
 
 import (
+	"time"
+
+	"github.com/MicBun/go-100-coverage-docker-crud/core"
 	"github.com/MicBun/go-100-coverage-docker-crud/service"
 	"github.com/MicBun/go-100-coverage-docker-crud/web/handlers"
 	"github.com/MicBun/go-100-coverage-docker-crud/web/middleware"
+	"github.com/gin-gonic/gin"
 	swaggerFiles "github.com/swaggo/files"
 	ginSwagger "github.com/swaggo/gin-swagger"
 )
 
+// The verb-style /user routes replaced by /v1/users answer with Deprecation
+// and Sunset headers until they are removed.
+var (
+	legacyUserDeprecation = time.Date(2026, time.October, 18, 0, 0, 0, 0, time.UTC)
+	legacyUserSunset      = time.Date(2027, time.April, 30, 0, 0, 0, 0, time.UTC)
+)
+
 func RegisterAPIRoutes(c *service.Container) {
 	api := handlers.NewApiHandler(c)
+	can := func(permission string) gin.HandlerFunc {
+		return middleware.RequirePermission(c.RBAC, permission)
+	}
+	rateLimit := func(group string, key middleware.KeyFunc) gin.HandlerFunc {
+		return middleware.RateLimit(c.RateLimiter, group, c.RateLimits[group], key)
+	}
+	byAPIKey := middleware.ByAPIKey(c.APIKeys)
+	audited := func(action string) gin.HandlerFunc {
+		return middleware.Audit(c.Audit, action)
+	}
+	// Reads are recorded unless AUDIT_READS is false; every audited request
+	// is a write to the audit chain.
+	auditedRead := func(action string) gin.HandlerFunc {
+		if !c.AuditReads {
+			return func(ctx *gin.Context) { ctx.Next() }
+		}
+		return audited(action)
+	}
+	deprecated := func(successor string) gin.HandlerFunc {
+		return middleware.Deprecated(legacyUserDeprecation, legacyUserSunset, successor)
+	}
+
+	c.Web.Use(middleware.RequestID(), middleware.Problems(c.StrictStatus))
 
 	c.Web.GET("/hello", api.Hello)
-	c.Web.POST("/login", api.Login)
+	c.Web.GET("/.well-known/jwks.json", api.JWKS)
+
+	authRoutes := c.Web.Group("")
+	authRoutes.Use(rateLimit("auth", middleware.ByIP))
+	authRoutes.POST("/login", audited("auth.login"), api.Login)
+	authRoutes.POST("/login/mfa", audited("auth.login_mfa"), api.LoginMFA)
+	authRoutes.POST("/refresh", audited("auth.refresh"), api.RefreshToken)
+	authRoutes.POST("/password/forgot", audited("auth.password_forgot"), api.ForgotPassword)
+	authRoutes.POST("/password/reset", audited("auth.password_reset"), api.ResetPassword)
+	authRoutes.POST("/logout", audited("auth.logout"), middleware.JwtAuthMiddleware(c), api.Logout)
+	if c.Signup != nil {
+		authRoutes.POST("/signup", audited("signup.register"), api.Signup)
+		authRoutes.POST("/signup/verify", audited("signup.verify"), api.VerifySignup)
+		authRoutes.POST("/signup/resend", audited("signup.resend"), api.ResendVerification)
+	}
 
 	userRoutes := c.Web.Group("/user")
-	userRoutes.Use(middleware.JwtAuthMiddleware())
-	userRoutes.POST("/register", api.RegisterUser)
-	userRoutes.PUT("/update/:id", api.UpdateUser)
-	userRoutes.DELETE("/delete/:id", api.DeleteUser)
-	userRoutes.GET("/get/:id", api.GetUserByID)
-	userRoutes.GET("/get", api.GetUserByToken)
-	userRoutes.GET("/list", api.ListUsers)
-	userRoutes.GET("/refresh", api.RefreshToken)
+	userRoutes.Use(rateLimit("user", byAPIKey), middleware.JwtAuthMiddleware(c))
+	userRoutes.POST("/register", deprecated("/v1/users"), audited("user.register"), can(core.PermUsersWrite), api.RegisterUser)
+	userRoutes.PUT("/update/:id", deprecated("/v1/users/:id"), audited("user.update"), can(core.PermUsersWrite), api.UpdateUser)
+	userRoutes.DELETE("/delete/:id", deprecated("/v1/users/:id"), audited("user.delete"), can(core.PermUsersDelete), api.DeleteUser)
+	userRoutes.GET("/get/:id", deprecated("/v1/users/:id"), auditedRead("user.view"), can(core.PermUsersRead), api.GetUserByID)
+	userRoutes.GET("/get", deprecated("/v1/users/me"), auditedRead("profile.view"), can(core.PermProfileRead), api.GetUserByToken)
+	userRoutes.GET("/list", deprecated("/v1/users"), auditedRead("user.list"), can(core.PermUsersRead), api.ListUsers)
+	userRoutes.GET("/refresh", deprecated("/refresh"), audited("auth.refresh"), api.RefreshAccessToken)
+	userRoutes.GET("/deleted", auditedRead("user.list_deleted"), can(core.PermUsersRead), api.ListDeletedUsers)
+	userRoutes.POST("/restore/:id", audited("user.restore"), can(core.PermUsersWrite), api.RestoreUser)
+	userRoutes.DELETE("/purge/:id", audited("user.purge"), can(core.PermUsersDelete), api.PurgeUser)
+	userRoutes.PATCH("/me", audited("profile.update"), can(core.PermProfileWrite), api.UpdateMe)
+	userRoutes.POST("/me/password", audited("profile.password"), can(core.PermProfileWrite), api.ChangePassword)
+	userRoutes.GET("/sessions", auditedRead("session.list"), api.ListSessions)
+	userRoutes.DELETE("/sessions/:id", audited("session.revoke"), api.RevokeSession)
+	userRoutes.POST("/mfa/enroll", audited("mfa.enroll"), api.EnrollMFA)
+	userRoutes.POST("/mfa/confirm", audited("mfa.confirm"), api.ConfirmMFA)
+
+	v1Users := c.Web.Group("/v1/users")
+	v1Users.Use(rateLimit("user", byAPIKey), middleware.JwtAuthMiddleware(c))
+	v1Users.GET("", auditedRead("user.list"), can(core.PermUsersRead), api.ListUsers)
+	v1Users.POST("", audited("user.register"), can(core.PermUsersWrite), api.CreateUser)
+	v1Users.GET("/me", auditedRead("profile.view"), can(core.PermProfileRead), api.GetUserByToken)
+	v1Users.GET("/:id", auditedRead("user.view"), can(core.PermUsersRead), api.GetUserByID)
+	v1Users.PATCH("/:id", audited("user.update"), can(core.PermUsersWrite), api.PatchUser)
+	v1Users.PUT("/:id", audited("user.update"), can(core.PermUsersWrite), api.ReplaceUser)
+	v1Users.DELETE("/:id", audited("user.delete"), can(core.PermUsersDelete), api.DeleteUser)
+
+	roleRoutes := c.Web.Group("/role")
+	roleRoutes.Use(rateLimit("role", byAPIKey), middleware.JwtAuthMiddleware(c))
+	roleRoutes.GET("/list", auditedRead("role.list"), can(core.PermRolesRead), api.ListRoles)
+	roleRoutes.POST("/create", audited("role.create"), can(core.PermRolesWrite), api.CreateRole)
+	roleRoutes.PUT("/update/:name", audited("role.update"), can(core.PermRolesWrite), api.UpdateRole)
+
+	adminRoutes := c.Web.Group("/admin")
+	adminRoutes.Use(rateLimit("admin", byAPIKey), middleware.JwtAuthMiddleware(c))
+	adminRoutes.GET("/user/:id/roles", auditedRead("user.roles"), can(core.PermRolesRead), api.GetUserRoles)
+	adminRoutes.POST("/user/:id/roles", audited("user.role_assign"), can(core.PermRolesWrite), api.AssignRole)
+	adminRoutes.DELETE("/user/:id/roles/:role", audited("user.role_revoke"), can(core.PermRolesWrite), api.RevokeRole)
+	adminRoutes.GET("/user/:id/sessions", auditedRead("user.sessions"), can(core.PermSessionsRead), api.ListUserSessions)
+	adminRoutes.DELETE("/user/:id/sessions", audited("user.sessions_revoke"), can(core.PermSessionsWrite), api.RevokeUserSessions)
+	adminRoutes.DELETE("/user/:id/sessions/:sid", audited("user.session_revoke"), can(core.PermSessionsWrite), api.RevokeUserSession)
+	adminRoutes.DELETE("/user/:id/mfa", audited("user.mfa_reset"), can(core.PermMFAWrite), api.ResetUserMFA)
+	adminRoutes.POST("/user/:id/unlock", audited("user.unlock"), can(core.PermUsersWrite), api.UnlockUser)
+	adminRoutes.POST("/user/:id/suspend", audited("user.suspend"), can(core.PermUsersWrite), api.SuspendUser)
+	adminRoutes.POST("/user/:id/lock", audited("user.lock"), can(core.PermUsersWrite), api.LockUser)
+	adminRoutes.POST("/user/:id/reactivate", audited("user.reactivate"), can(core.PermUsersWrite), api.ReactivateUser)
+	adminRoutes.POST("/user/:id/deactivate", audited("user.deactivate"), can(core.PermUsersWrite), api.DeactivateUser)
+
+	c.Web.GET("/audit", rateLimit("admin", byAPIKey), middleware.JwtAuthMiddleware(c),
+		auditedRead("audit.list"), can(core.PermAuditRead), api.ListAuditEvents)
 
 	c.Web.GET("/swagger/*any", ginSwagger.WrapHandler(swaggerFiles.Handler))
 }
@@ -12,7 +12,7 @@ import (
 type TestFunc func(*service.Container)
 
 func RunTest(testFunc TestFunc) {
-	db, err := database.Connect()
+	db, err := database.Connect(database.InMemory())
 	if err != nil {
 		panic(err)
 	}